@@ -22,9 +22,13 @@
 package crypto11
 
 import (
+	"bytes"
 	"crypto/cipher"
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"io"
+
 	"github.com/miekg/pkcs11"
 )
 
@@ -38,32 +42,62 @@ const (
 	PaddingPKCS
 )
 
+// ErrBadGCMOutput is returned when the token's GCM output is not the expected length.
+//
+// Some tokens mishandle an empty plaintext (i.e. GMAC over the
+// additional data alone), e.g. returning no tag at all.
+var ErrBadGCMOutput = errors.New("crypto11: token returned GCM output of the wrong length")
+
+// ErrGCMNonceNotSupported is returned (or, from Seal, panicked with) when the token will not use the caller's GCM nonce.
+//
+// Some tokens generate the GCM IV themselves, rejecting a
+// caller-supplied one or overwriting it. Such tokens cannot implement
+// cipher.AEAD's Seal; use EncryptGCM, which reports the IV used.
+var ErrGCMNonceNotSupported = errors.New("crypto11: token generates its own GCM nonces; use EncryptGCM")
+
 type genericAead struct {
 	key *PKCS11SecretKey
 
 	overhead int
 
+	// If true, ciphertexts are always exactly overhead bytes longer
+	// than plaintexts, and the token's output is checked for this
+	exactOverhead bool
+
 	nonceSize int
 
-	makeMech func(nonce []byte, additionalData []byte) ([]*pkcs11.Mechanism, error)
+	// Returns the mechanism for a nonce and additional data, and
+	// for GCM its parameters, which must be freed afterwards
+	makeMech func(nonce []byte, additionalData []byte) ([]*pkcs11.Mechanism, *pkcs11.GCMParams, error)
 }
 
 // NewGCM returns a given cipher wrapped in Galois Counter Mode, with the standard
 // nonce length.
 //
+// An empty plaintext may be sealed, to authenticate the additional
+// data alone (GMAC); the ciphertext is then just the tag. If the
+// token's output is not the expected length, Seal panics and Open
+// fails with ErrBadGCMOutput, rather than returning a wrong tag.
+//
 // This depends on the HSM supporting the CKM_*_GCM mechanism. If it is not supported
 // then you must use cipher.NewGCM; it will be slow.
+//
+// Seal cannot report a token-generated IV. On tokens that generate the
+// IV themselves, Seal panics with ErrGCMNonceNotSupported rather than
+// return a ciphertext that cannot be opened with the caller's nonce;
+// use EncryptGCM instead.
 func (key *PKCS11SecretKey) NewGCM() (g cipher.AEAD, err error) {
 	if key.Cipher.GCMMech == 0 {
 		err = fmt.Errorf("GCM not implemented for key type %#x", key.Cipher.GenParams[0].KeyType)
 		return
 	}
 	g = genericAead{
-		key:       key,
-		overhead:  16,
-		nonceSize: 12,
-		makeMech: func(nonce []byte, additionalData []byte) (mech []*pkcs11.Mechanism, error error) {
-			params := pkcs11.NewGCMParams(nonce, additionalData, 16*8 /*bits*/)
+		key:           key,
+		overhead:      16,
+		exactOverhead: true,
+		nonceSize:     12,
+		makeMech: func(nonce []byte, additionalData []byte) (mech []*pkcs11.Mechanism, params *pkcs11.GCMParams, error error) {
+			params = pkcs11.NewGCMParams(nonce, additionalData, 16*8 /*bits*/)
 			mech = []*pkcs11.Mechanism{pkcs11.NewMechanism(key.Cipher.GCMMech, params)}
 			return
 		},
@@ -71,6 +105,59 @@ func (key *PKCS11SecretKey) NewGCM() (g cipher.AEAD, err error) {
 	return
 }
 
+// gcmNonceSize is the standard GCM nonce length in bytes
+const gcmNonceSize = 12
+
+// EncryptGCM encrypts and authenticates plaintext in Galois Counter
+// Mode, returning the IV that was used alongside the ciphertext.
+//
+// Some tokens (see PKCS#11 v2.40 s2.12) generate the GCM IV themselves,
+// either overwriting a caller-supplied one or rejecting it.
+// EncryptGCM first supplies a random IV; if the token rejects it,
+// the operation is retried with an empty IV buffer for the token to
+// fill in. Either way the IV actually used is returned and must be
+// stored with the ciphertext. Decrypt with the Open method of the
+// cipher.AEAD returned by NewGCM.
+func (key *PKCS11SecretKey) EncryptGCM(plaintext, additionalData []byte) (iv []byte, ciphertext []byte, err error) {
+	if key.Cipher.GCMMech == 0 {
+		err = fmt.Errorf("GCM not implemented for key type %#x", key.Cipher.GenParams[0].KeyType)
+		return
+	}
+	callerIV := make([]byte, gcmNonceSize)
+	if _, err = io.ReadFull(rand.Reader, callerIV); err != nil {
+		return
+	}
+	err = withKeySession(&key.PKCS11Object, func(session *PKCS11Session) error {
+		var err error
+		iv, ciphertext, err = key.encryptGCM(session, callerIV, plaintext, additionalData)
+		if e, ok := err.(pkcs11.Error); ok && e == pkcs11.CKR_MECHANISM_PARAM_INVALID {
+			// The token insists on generating the IV itself
+			iv, ciphertext, err = key.encryptGCM(session, make([]byte, gcmNonceSize), plaintext, additionalData)
+		}
+		return err
+	})
+	err = key.wrapError("EncryptGCM", err)
+	return
+}
+
+// encryptGCM performs a single GCM encryption, returning the IV as written back by the token.
+func (key *PKCS11SecretKey) encryptGCM(session *PKCS11Session, iv, plaintext, additionalData []byte) ([]byte, []byte, error) {
+	params := pkcs11.NewGCMParams(iv, additionalData, 16*8 /*bits*/)
+	defer params.Free()
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(key.Cipher.GCMMech, params)}
+	if err := traceCall("C_EncryptInit", mech, session.Ctx.EncryptInit(session.Handle, mech, key.Handle)); err != nil {
+		return nil, nil, err
+	}
+	ciphertext, err := session.Ctx.Encrypt(session.Handle, plaintext)
+	if err = traceCall("C_Encrypt", nil, err); err != nil {
+		return nil, nil, err
+	}
+	if len(ciphertext) != len(plaintext)+16 {
+		return nil, nil, ErrBadGCMOutput
+	}
+	return params.IV(), ciphertext, nil
+}
+
 // NewCBC returns a given cipher wrapped in CBC mode.
 //
 // Despite the cipher.AEAD return type, there is no support for additional data and no authentication.
@@ -81,7 +168,7 @@ func (key *PKCS11SecretKey) NewCBC(paddingMode int) (g cipher.AEAD, err error) {
 		key:       key,
 		overhead:  0,
 		nonceSize: key.BlockSize(),
-		makeMech: func(nonce []byte, additionalData []byte) (mech []*pkcs11.Mechanism, error error) {
+		makeMech: func(nonce []byte, additionalData []byte) (mech []*pkcs11.Mechanism, params *pkcs11.GCMParams, error error) {
 			if len(additionalData) > 0 {
 				err = errors.New("additional data not supported for CBC mode")
 			}
@@ -116,22 +203,34 @@ func (g genericAead) Overhead() int {
 
 func (g genericAead) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
 	var result []byte
-	if err := withSession(g.key.Slot, func(session *PKCS11Session) (err error) {
+	if err := withKeySession(&g.key.PKCS11Object, func(session *PKCS11Session) (err error) {
 		var mech []*pkcs11.Mechanism
-		if mech, err = g.makeMech(nonce, additionalData); err != nil {
+		var params *pkcs11.GCMParams
+		if mech, params, err = g.makeMech(nonce, additionalData); err != nil {
 			return
 		}
-		if err = session.Ctx.EncryptInit(session.Handle, mech, g.key.Handle); err != nil {
-			err = fmt.Errorf("C_EncryptInit: %v", err)
+		defer params.Free()
+		err = traceCall("C_EncryptInit", mech, session.Ctx.EncryptInit(session.Handle, mech, g.key.Handle))
+		if e, ok := err.(pkcs11.Error); ok && e == pkcs11.CKR_MECHANISM_PARAM_INVALID && params != nil {
+			return ErrGCMNonceNotSupported
+		}
+		if err != nil {
 			return
 		}
-		if result, err = session.Ctx.Encrypt(session.Handle, plaintext); err != nil {
-			err = fmt.Errorf("C_Encrypt: %v", err)
+		result, err = session.Ctx.Encrypt(session.Handle, plaintext)
+		if err = traceCall("C_Encrypt", nil, err); err != nil {
 			return
 		}
+		if g.exactOverhead && len(result) != len(plaintext)+g.overhead {
+			return ErrBadGCMOutput
+		}
+		if params != nil && !bytes.Equal(params.IV(), nonce) {
+			// The ciphertext is under the token's nonce, not the caller's
+			return ErrGCMNonceNotSupported
+		}
 		return
 	}); err != nil {
-		panic(err)
+		panic(g.key.wrapError("Seal", err))
 	} else {
 		dst = append(dst, result...)
 	}
@@ -140,22 +239,26 @@ func (g genericAead) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
 
 func (g genericAead) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
 	var result []byte
-	if err := withSession(g.key.Slot, func(session *PKCS11Session) (err error) {
+	if g.exactOverhead && len(ciphertext) < g.overhead {
+		return nil, errors.New("crypto11: ciphertext shorter than the authentication tag")
+	}
+	if err := withKeySession(&g.key.PKCS11Object, func(session *PKCS11Session) (err error) {
 		var mech []*pkcs11.Mechanism
-		if mech, err = g.makeMech(nonce, additionalData); err != nil {
+		var params *pkcs11.GCMParams
+		if mech, params, err = g.makeMech(nonce, additionalData); err != nil {
 			return
 		}
-		if err = session.Ctx.DecryptInit(session.Handle, mech, g.key.Handle); err != nil {
-			err = fmt.Errorf("C_DecryptInit: %v", err)
+		defer params.Free()
+		if err = traceCall("C_DecryptInit", mech, session.Ctx.DecryptInit(session.Handle, mech, g.key.Handle)); err != nil {
 			return
 		}
-		if result, err = session.Ctx.Decrypt(session.Handle, ciphertext); err != nil {
-			err = fmt.Errorf("C_Decrypt: %v", err)
-			return
+		result, err = session.Ctx.Decrypt(session.Handle, ciphertext)
+		if err = traceCall("C_Decrypt", nil, err); err == nil && g.exactOverhead && len(result) != len(ciphertext)-g.overhead {
+			err = ErrBadGCMOutput
 		}
 		return
 	}); err != nil {
-		return nil, err
+		return nil, g.key.wrapError("Open", err)
 	}
 	dst = append(dst, result...)
 	return dst, nil
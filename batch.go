@@ -0,0 +1,165 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto/elliptic"
+	"errors"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ErrBadKeySpec is returned by GenerateKeys when a KeySpec does not say exactly one kind of key.
+var ErrBadKeySpec = errors.New("crypto11: key spec must set exactly one of RSABits, Curve and Attributes.Cipher")
+
+// KeySpec describes one of the keys created by GenerateKeys.
+//
+// Exactly one of RSABits, Curve and Attributes.Cipher must be set,
+// making an RSA key pair, an ECDSA key pair or a secret key
+// respectively.
+type KeySpec struct {
+	// For RSA key pairs, the modulus size in bits
+	RSABits int
+
+	// For ECDSA key pairs, the curve
+	Curve elliptic.Curve
+
+	// The attributes of the new key
+	Attributes KeyAttributes
+}
+
+// GenerateKeys creates several keys, all or none.
+//
+// The keys are created in order, and returned in the same order: each
+// is a *PKCS11PrivateKeyRSA, *PKCS11PrivateKeyECDSA or
+// *PKCS11SecretKey. If any key cannot be created then the keys already
+// created are destroyed again and the error is returned.
+//
+// PKCS#11 has no transactions, so this is only an emulation: another
+// session can see the keys while the batch is in progress, and if
+// destroying them fails they are left behind. To make the rollback
+// safe, every object with a new key's CKA_ID is destroyed, so each
+// spec must have a distinct ID not already in use on the token (a
+// random one is generated if Attributes.ID is nil). Keys destroyed by
+// LabelCollisionReplace are not restored.
+func GenerateKeys(specs []KeySpec) ([]interface{}, error) {
+	return GenerateKeysOnSlot(instance.slot, specs)
+}
+
+// GenerateKeysOnSlot creates several keys on a specified slot, all or none.
+//
+// See GenerateKeys for details.
+func GenerateKeysOnSlot(slot uint, specs []KeySpec) ([]interface{}, error) {
+	var keys []interface{}
+	var err error
+	if err = ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	err = withSession(slot, func(session *PKCS11Session) error {
+		keys, err = GenerateKeysOnSession(session, slot, specs)
+		return err
+	})
+	return keys, err
+}
+
+// GenerateKeysOnSession creates several keys using a specified session, all or none.
+//
+// See GenerateKeys for details.
+func GenerateKeysOnSession(session *PKCS11Session, slot uint, specs []KeySpec) ([]interface{}, error) {
+	// Settle every ID before creating anything, so the rollback
+	// knows exactly what it may destroy
+	ids := make([][]byte, len(specs))
+	seen := map[string]bool{}
+	for i, spec := range specs {
+		kinds := 0
+		if spec.RSABits != 0 {
+			kinds++
+		}
+		if spec.Curve != nil {
+			kinds++
+		}
+		if spec.Attributes.Cipher != nil {
+			kinds++
+		}
+		if kinds != 1 {
+			return nil, ErrBadKeySpec
+		}
+		id := spec.Attributes.ID
+		if id == nil {
+			var err error
+			if id, err = generateKeyLabel(); err != nil {
+				return nil, err
+			}
+		}
+		if seen[string(id)] {
+			return nil, fmt.Errorf("crypto11: key ID %x appears twice in batch", id)
+		}
+		seen[string(id)] = true
+		existing, err := findObjects(session, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, id)})
+		if err != nil {
+			return nil, err
+		}
+		if len(existing) > 0 {
+			return nil, fmt.Errorf("crypto11: objects with ID %x already exist", id)
+		}
+		ids[i] = id
+	}
+	keys := make([]interface{}, 0, len(specs))
+	for i := range specs {
+		attrs := specs[i].Attributes
+		attrs.ID = ids[i]
+		var key interface{}
+		var err error
+		switch {
+		case specs[i].RSABits != 0:
+			key, err = GenerateRSAKeyPairWithAttributesOnSession(session, slot, specs[i].RSABits, &attrs)
+		case specs[i].Curve != nil:
+			key, err = GenerateECDSAKeyPairWithAttributesOnSession(session, slot, specs[i].Curve, &attrs)
+		default:
+			key, err = GenerateSecretKeyWithAttributesOnSession(session, slot, &attrs)
+		}
+		if err != nil {
+			// A failed generation may still leave objects behind
+			// (e.g. a public key without its private key), and
+			// ids[i] was checked to be unused above, so it is safe
+			// to clean up too.
+			destroyByIDs(session, ids[:i+1])
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// destroyByIDs destroys every object with one of the given CKA_IDs, as far as it can.
+func destroyByIDs(session *PKCS11Session, ids [][]byte) {
+	for _, id := range ids {
+		handles, err := findObjects(session, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, id)})
+		if err != nil {
+			continue
+		}
+		for _, handle := range handles {
+			destroyObject(session, handle)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto/elliptic"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+func TestGenerateKeys(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	keys, err := GenerateKeys([]KeySpec{
+		{RSABits: 2048},
+		{Curve: elliptic.P256()},
+		{Attributes: KeyAttributes{Cipher: Ciphers[pkcs11.CKK_AES], Bits: 128}},
+	})
+	if err != nil {
+		t.Fatalf("GenerateKeys: %v", err)
+	}
+	if _, ok := keys[0].(*PKCS11PrivateKeyRSA); !ok {
+		t.Errorf("GenerateKeys: key 0 is %T", keys[0])
+	}
+	if _, ok := keys[1].(*PKCS11PrivateKeyECDSA); !ok {
+		t.Errorf("GenerateKeys: key 1 is %T", keys[1])
+	}
+	if _, ok := keys[2].(*PKCS11SecretKey); !ok {
+		t.Errorf("GenerateKeys: key 2 is %T", keys[2])
+	}
+}
+
+func TestGenerateKeysRollback(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	id, err := generateKeyLabel()
+	if err != nil {
+		t.Fatalf("generateKeyLabel: %v", err)
+	}
+	bogus := *elliptic.P256().Params()
+	bogus.Name = "bogus"
+	_, err = GenerateKeys([]KeySpec{
+		{Attributes: KeyAttributes{ID: id, Cipher: Ciphers[pkcs11.CKK_AES], Bits: 128}},
+		{Curve: &bogus},
+	})
+	if err != ErrUnsupportedEllipticCurve {
+		t.Fatalf("GenerateKeys: got %v, want ErrUnsupportedEllipticCurve", err)
+	}
+	if _, err = FindKey(id, nil); err != ErrKeyNotFound {
+		t.Errorf("FindKey after rollback: got %v, want ErrKeyNotFound", err)
+	}
+	if _, err = GenerateKeys([]KeySpec{{}}); err != ErrBadKeySpec {
+		t.Errorf("GenerateKeys with empty spec: got %v, want ErrBadKeySpec", err)
+	}
+}
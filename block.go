@@ -41,12 +41,13 @@ func (key *PKCS11SecretKey) BlockSize() int {
 // For more efficient operation, see NewCBCDecrypterCloser, NewCBCDecrypter or NewCBC.
 func (key *PKCS11SecretKey) Decrypt(dst, src []byte) {
 	var result []byte
-	if err := withSession(key.Slot, func(session *PKCS11Session) (err error) {
+	if err := withKeySession(&key.PKCS11Object, func(session *PKCS11Session) (err error) {
 		mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(key.Cipher.ECBMech, nil)}
-		if err = session.Ctx.DecryptInit(session.Handle, mech, key.Handle); err != nil {
+		if err = traceCall("C_DecryptInit", mech, session.Ctx.DecryptInit(session.Handle, mech, key.Handle)); err != nil {
 			return
 		}
-		if result, err = session.Ctx.Decrypt(session.Handle, src[:key.Cipher.BlockSize]); err != nil {
+		result, err = session.Ctx.Decrypt(session.Handle, src[:key.Cipher.BlockSize])
+		if err = traceCall("C_Decrypt", nil, err); err != nil {
 			return
 		}
 		if len(result) != key.Cipher.BlockSize {
@@ -55,7 +56,7 @@ func (key *PKCS11SecretKey) Decrypt(dst, src []byte) {
 		}
 		return
 	}); err != nil {
-		panic(err)
+		panic(key.wrapError("Decrypt", err))
 	} else {
 		copy(dst[:key.Cipher.BlockSize], result)
 	}
@@ -69,12 +70,13 @@ func (key *PKCS11SecretKey) Decrypt(dst, src []byte) {
 // For more efficient operation, see NewCBCEncrypterCloser, NewCBCEncrypter or NewCBC.
 func (key *PKCS11SecretKey) Encrypt(dst, src []byte) {
 	var result []byte
-	if err := withSession(key.Slot, func(session *PKCS11Session) (err error) {
+	if err := withKeySession(&key.PKCS11Object, func(session *PKCS11Session) (err error) {
 		mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(key.Cipher.ECBMech, nil)}
-		if err = session.Ctx.EncryptInit(session.Handle, mech, key.Handle); err != nil {
+		if err = traceCall("C_EncryptInit", mech, session.Ctx.EncryptInit(session.Handle, mech, key.Handle)); err != nil {
 			return
 		}
-		if result, err = session.Ctx.Encrypt(session.Handle, src[:key.Cipher.BlockSize]); err != nil {
+		result, err = session.Ctx.Encrypt(session.Handle, src[:key.Cipher.BlockSize])
+		if err = traceCall("C_Encrypt", nil, err); err != nil {
 			return
 		}
 		if len(result) != key.Cipher.BlockSize {
@@ -83,7 +85,7 @@ func (key *PKCS11SecretKey) Encrypt(dst, src []byte) {
 		}
 		return
 	}); err != nil {
-		panic(err)
+		panic(key.wrapError("Encrypt", err))
 	} else {
 		copy(dst[:key.Cipher.BlockSize], result)
 	}
@@ -113,6 +113,10 @@ func (key *PKCS11SecretKey) newBlockModeCloser(mech uint, mode int, iv []byte, s
 		err = fmt.Errorf("crypto11: no session for slot %d", key.Slot)
 		return
 	}
+	var release func()
+	if release, err = key.acquireOp(); err != nil {
+		return
+	}
 	ctx := context.Background()
 	if instance.cfg.PoolWaitTimeout > 0 {
 		var cancel context.CancelFunc
@@ -121,6 +125,7 @@ func (key *PKCS11SecretKey) newBlockModeCloser(mech uint, mode int, iv []byte, s
 	}
 	var session pools.Resource
 	if session, err = sessionPool.Get(ctx); err != nil {
+		release()
 		return
 	}
 	bmc = &blockModeCloser{
@@ -129,14 +134,15 @@ func (key *PKCS11SecretKey) newBlockModeCloser(mech uint, mode int, iv []byte, s
 		mode:      mode,
 		cleanup: func() {
 			sessionPool.Put(session)
+			release()
 		},
 	}
 	mechDescription := []*pkcs11.Mechanism{pkcs11.NewMechanism(mech, iv)}
 	switch mode {
 	case modeDecrypt:
-		err = bmc.session.Ctx.DecryptInit(bmc.session.Handle, mechDescription, key.Handle)
+		err = traceCall("C_DecryptInit", mechDescription, bmc.session.Ctx.DecryptInit(bmc.session.Handle, mechDescription, key.Handle))
 	case modeEncrypt:
-		err = bmc.session.Ctx.EncryptInit(bmc.session.Handle, mechDescription, key.Handle)
+		err = traceCall("C_EncryptInit", mechDescription, bmc.session.Ctx.EncryptInit(bmc.session.Handle, mechDescription, key.Handle))
 	default:
 		panic("unexpected mode")
 	}
@@ -195,8 +201,10 @@ func (bmc *blockModeCloser) Close() {
 	switch bmc.mode {
 	case modeDecrypt:
 		result, err = bmc.session.Ctx.DecryptFinal(bmc.session.Handle)
+		traceCall("C_DecryptFinal", nil, err)
 	case modeEncrypt:
 		result, err = bmc.session.Ctx.EncryptFinal(bmc.session.Handle)
+		traceCall("C_EncryptFinal", nil, err)
 	}
 	bmc.session = nil
 	bmc.cleanup()
@@ -0,0 +1,513 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+// MatchCertificate reports whether a certificate's public key is the public key of a signer.
+//
+// This is intended to check that a certificate belongs to a key on
+// the token before the certificate is stored. A mismatch, including a
+// mismatch of key type, is reported as false with a nil error. An
+// error is returned only if the comparison cannot be made, e.g.
+// because the key type is not supported.
+func MatchCertificate(key crypto.Signer, cert *x509.Certificate) (bool, error) {
+	return publicKeysEqual(key.Public(), cert.PublicKey)
+}
+
+// CreateCertificate creates a certificate signed by caKey, returning it in DER form.
+//
+// The arguments are as for x509.CreateCertificate; caKey will
+// normally be a key on the token. For a self-signed certificate pass
+// the same value as template and parent, and caKey.Public() as pub.
+//
+// The signature algorithm is taken from template.SignatureAlgorithm,
+// or chosen by crypto/x509 from the type of caKey if that is not set.
+// RSA-PSS algorithms are supported for RSA keys on the token.
+//
+// The new certificate's signature is checked against caKey.Public()
+// before it is returned, so that a token that produces a malformed or
+// wrongly encoded signature is detected here rather than by relying
+// parties.
+func CreateCertificate(template, parent *x509.Certificate, pub crypto.PublicKey, caKey crypto.Signer) ([]byte, error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, caKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	issuer := &x509.Certificate{PublicKey: caKey.Public()}
+	if err = issuer.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		return nil, fmt.Errorf("crypto11: certificate signature does not verify: %v", err)
+	}
+	return der, nil
+}
+
+// CreateCertificateRequest creates a PKCS#10 certificate signing request signed by key, returning it in DER form.
+//
+// The arguments are as for x509.CreateCertificateRequest; key will
+// normally be a key on the token. As with CreateCertificate, the
+// request's signature is checked before it is returned.
+//
+// Once the certificate has been issued, StoreIssuedCertificate puts it
+// on the token next to the key.
+func CreateCertificateRequest(template *x509.CertificateRequest, key crypto.Signer) ([]byte, error) {
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("crypto11: certificate request signature does not verify: %v", err)
+	}
+	return der, nil
+}
+
+// StoreIssuedCertificate stores the certificate for a key pair on the token, under the key's CKA_ID and CKA_LABEL.
+//
+// key must be a key pair found or generated by this package, otherwise
+// ErrUnsupportedKeyType is returned, and cert must be for it, otherwise
+// ErrCertificateKeyMismatch is returned. If a certificate is already
+// stored under the key's ID then it is replaced, as by
+// ReplaceCertificate. FindCertificate and TLSCertificate will then
+// find the certificate from the key.
+func StoreIssuedCertificate(key crypto.Signer, cert *x509.Certificate) (*PKCS11Object, error) {
+	slot, ok := SlotOf(key)
+	if !ok {
+		return nil, ErrUnsupportedKeyType
+	}
+	match, err := MatchCertificate(key, cert)
+	if err != nil {
+		return nil, err
+	}
+	if !match {
+		return nil, ErrCertificateKeyMismatch
+	}
+	id, label, err := key.(interface {
+		Identify() ([]byte, []byte, error)
+	}).Identify()
+	if err != nil {
+		return nil, err
+	}
+	if err = ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	var object *PKCS11Object
+	err = withSession(slot, func(session *PKCS11Session) error {
+		object, err = ReplaceCertificateOnSession(session, slot, id, cert)
+		if err == ErrCertificateNotFound {
+			object, err = ImportCertificateOnSession(session, slot, id, label, cert)
+		}
+		return err
+	})
+	return object, err
+}
+
+// GenerateSelfSigned generates a key pair and stores a self-signed certificate for it under the same ID.
+//
+// The key pair is described by keySpec, as for EnsureKeyPair, and
+// must permit signing. If keySpec gives neither an ID nor a label
+// then random ones are used; the certificate object gets the same ID
+// and label as the key pair. There must not already be any object
+// with that ID.
+//
+// The certificate is made from template by CreateCertificate, so the
+// signature algorithm (including RSA-PSS) is taken from
+// template.SignatureAlgorithm if it is set.
+//
+// If the certificate cannot be created or stored then the new key
+// pair is destroyed again.
+func GenerateSelfSigned(template *x509.Certificate, keySpec *KeyTemplate) (crypto.Signer, *x509.Certificate, error) {
+	return GenerateSelfSignedOnSlot(instance.slot, template, keySpec)
+}
+
+// GenerateSelfSignedOnSlot generates a key pair and self-signed certificate on a specified slot.
+//
+// See GenerateSelfSigned for details. There is no OnSession variant
+// because signing the certificate needs a session of its own.
+func GenerateSelfSignedOnSlot(slot uint, template *x509.Certificate, keySpec *KeyTemplate) (crypto.Signer, *x509.Certificate, error) {
+	var id, label []byte
+	var err error
+	if keySpec.ID != "" || keySpec.Label != "" {
+		if id, label, err = keySpec.identity(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if id == nil {
+		if id, err = generateKeyLabel(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if label == nil {
+		if label, err = generateKeyLabel(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if !keySpec.Sign && keySpec.Decrypt {
+		return nil, nil, fmt.Errorf("crypto11: key template %q does not permit signing", keySpec.Label)
+	}
+	if err = ensureSessions(instance, slot); err != nil {
+		return nil, nil, err
+	}
+	var signer crypto.Signer
+	err = withSession(slot, func(session *PKCS11Session) error {
+		existing, err := findObjects(session, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, id)})
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			return fmt.Errorf("crypto11: objects with ID %x already exist", id)
+		}
+		signer, err = generateKeyPairFromTemplate(session, slot, id, label, keySpec)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var cert *x509.Certificate
+	der, err := CreateCertificate(template, template, signer.Public(), signer)
+	if err == nil {
+		cert, err = x509.ParseCertificate(der)
+	}
+	if err == nil {
+		err = withSession(slot, func(session *PKCS11Session) error {
+			_, err := ImportCertificateOnSession(session, slot, id, label, cert)
+			return err
+		})
+	}
+	if err != nil {
+		// Nothing else can have the ID, so everything with it is ours
+		withSession(slot, func(session *PKCS11Session) error {
+			destroyByIDs(session, [][]byte{id})
+			return nil
+		})
+		return nil, nil, err
+	}
+	return signer, cert, nil
+}
+
+// publicKeysEqual compares two public keys.
+func publicKeysEqual(a, b crypto.PublicKey) (bool, error) {
+	switch a := a.(type) {
+	case *rsa.PublicKey:
+		b, ok := b.(*rsa.PublicKey)
+		return ok && a.E == b.E && a.N.Cmp(b.N) == 0, nil
+	case *ecdsa.PublicKey:
+		b, ok := b.(*ecdsa.PublicKey)
+		return ok && a.Curve.Params().Name == b.Curve.Params().Name &&
+			a.X.Cmp(b.X) == 0 && a.Y.Cmp(b.Y) == 0, nil
+	case *dsa.PublicKey:
+		b, ok := b.(*dsa.PublicKey)
+		return ok && a.P.Cmp(b.P) == 0 && a.Q.Cmp(b.Q) == 0 &&
+			a.G.Cmp(b.G) == 0 && a.Y.Cmp(b.Y) == 0, nil
+	default:
+		return false, ErrUnsupportedKeyType
+	}
+}
+
+// ImportCertificate stores an X.509 certificate on the token.
+//
+// The certificate will have a random label and ID. Normally the ID
+// should match the ID of the corresponding key, so that FindCertificate
+// can find it from the key; ImportCertificateOnSlot allows that.
+func ImportCertificate(cert *x509.Certificate) (*PKCS11Object, error) {
+	return ImportCertificateOnSlot(instance.slot, nil, nil, cert)
+}
+
+// ImportCertificateOnSlot stores an X.509 certificate on a specified slot.
+//
+// Either or both label and/or id can be nil, in which case random values will be generated.
+func ImportCertificateOnSlot(slot uint, id []byte, label []byte, cert *x509.Certificate) (*PKCS11Object, error) {
+	var object *PKCS11Object
+	var err error
+	if err = ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	err = withSession(slot, func(session *PKCS11Session) error {
+		object, err = ImportCertificateOnSession(session, slot, id, label, cert)
+		return err
+	})
+	return object, err
+}
+
+// ImportCertificateOnSession stores an X.509 certificate using a specified session.
+//
+// Either or both label and/or id can be nil, in which case random values will be generated.
+func ImportCertificateOnSession(session *PKCS11Session, slot uint, id []byte, label []byte, cert *x509.Certificate) (*PKCS11Object, error) {
+	var err error
+	var content []*pkcs11.Attribute
+	if label == nil {
+		if label, err = generateKeyLabel(); err != nil {
+			return nil, err
+		}
+	}
+	if id == nil {
+		if id, err = generateKeyLabel(); err != nil {
+			return nil, err
+		}
+	}
+	if content, err = certificateContent(cert); err != nil {
+		return nil, err
+	}
+	template := append([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+		pkcs11.NewAttribute(pkcs11.CKA_CERTIFICATE_TYPE, pkcs11.CKC_X_509),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}, content...)
+	handle, err := createObject(session, template)
+	if err != nil {
+		return nil, err
+	}
+	object := newObject(handle, slot)
+	return &object, nil
+}
+
+// certificateContent returns the attributes of a certificate object that depend on the certificate itself.
+func certificateContent(cert *x509.Certificate) ([]*pkcs11.Attribute, error) {
+	// CKA_SERIAL_NUMBER is the DER encoding of the serial number
+	serial, err := asn1.Marshal(cert.SerialNumber)
+	if err != nil {
+		return nil, err
+	}
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_SUBJECT, cert.RawSubject),
+		pkcs11.NewAttribute(pkcs11.CKA_ISSUER, cert.RawIssuer),
+		pkcs11.NewAttribute(pkcs11.CKA_SERIAL_NUMBER, serial),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, cert.Raw),
+	}, nil
+}
+
+// ReplaceCertificate replaces the certificate object with a given CKA_ID.
+//
+// If there is no such object, ErrCertificateNotFound is returned.
+func ReplaceCertificate(id []byte, cert *x509.Certificate) (*PKCS11Object, error) {
+	return ReplaceCertificateOnSlot(instance.slot, id, cert)
+}
+
+// ReplaceCertificateOnSlot replaces the certificate object with a given CKA_ID, on a specified slot.
+//
+// See ReplaceCertificateOnSession for details.
+func ReplaceCertificateOnSlot(slot uint, id []byte, cert *x509.Certificate) (*PKCS11Object, error) {
+	var object *PKCS11Object
+	var err error
+	if err = ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	err = withSession(slot, func(session *PKCS11Session) error {
+		object, err = ReplaceCertificateOnSession(session, slot, id, cert)
+		return err
+	})
+	return object, err
+}
+
+// ReplaceCertificateOnSession replaces the certificate object with a given CKA_ID, using a specified session.
+//
+// Where the token allows it, the existing object is updated in place
+// with C_SetAttributeValue, so readers see either the old certificate
+// or the new one and never both or neither. The existing object is
+// returned in this case.
+//
+// Otherwise a new object is created with the same ID and label, and
+// only then is the old object destroyed, so there is always at least
+// one certificate under the ID; for a moment a concurrent reader may
+// find both. If the old object cannot be destroyed then the new one is
+// destroyed again, leaving the old certificate in place, and the error
+// is returned.
+func ReplaceCertificateOnSession(session *PKCS11Session, slot uint, id []byte, cert *x509.Certificate) (*PKCS11Object, error) {
+	oldHandle, err := findKey(session, id, nil, pkcs11.CKO_CERTIFICATE, ^uint(0))
+	if err == ErrKeyNotFound {
+		return nil, ErrCertificateNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	content, err := certificateContent(cert)
+	if err != nil {
+		return nil, err
+	}
+	if err = session.Ctx.SetAttributeValue(session.Handle, oldHandle, content); err == nil {
+		object := newObject(oldHandle, slot)
+		return &object, nil
+	}
+	attributes := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+	}
+	if attributes, err = getAttributes(session, oldHandle, attributes); err != nil {
+		return nil, err
+	}
+	object, err := ImportCertificateOnSession(session, slot, id, attributes[0].Value, cert)
+	if err != nil {
+		return nil, err
+	}
+	if err = session.Ctx.DestroyObject(session.Handle, oldHandle); err != nil {
+		session.Ctx.DestroyObject(session.Handle, object.Handle)
+		return nil, err
+	}
+	return object, nil
+}
+
+// FindCertificate retrieves a previously stored X.509 certificate.
+//
+// Either (but not both) of id and label may be nil, in which case they
+// are ignored. The certificate for a key pair is normally stored under
+// the key's CKA_ID, as returned by Identify, so FindCertificate(id, nil)
+// finds it. If there is no matching certificate object then
+// ErrCertificateNotFound is returned.
+func FindCertificate(id []byte, label []byte) (*x509.Certificate, error) {
+	return FindCertificateOnSlot(instance.slot, id, label)
+}
+
+// FindCertificateOnSlot retrieves a previously stored X.509 certificate, using a specified slot.
+func FindCertificateOnSlot(slot uint, id []byte, label []byte) (*x509.Certificate, error) {
+	if err := ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	cert, err := withFindTimeout(slot, func(session *PKCS11Session) (interface{}, error) {
+		return FindCertificateOnSession(session, id, label)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cert.(*x509.Certificate), nil
+}
+
+// FindCertificateOnSession retrieves a previously stored X.509 certificate, using a specified session.
+func FindCertificateOnSession(session *PKCS11Session, id []byte, label []byte) (*x509.Certificate, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+		pkcs11.NewAttribute(pkcs11.CKA_CERTIFICATE_TYPE, pkcs11.CKC_X_509),
+	}
+	if id != nil {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, id))
+	}
+	if label != nil {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, label))
+	}
+	handle, err := findObject(session, template)
+	if err == ErrKeyNotFound {
+		return nil, ErrCertificateNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	attributes, err := getAttributes(session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(attributes[0].Value)
+}
+
+// SkippedCertificatesError is returned by CertPool, along with the
+// pool, when some certificates could not be parsed.
+type SkippedCertificatesError struct {
+	// One error per certificate skipped
+	Errors []error
+}
+
+func (e *SkippedCertificatesError) Error() string {
+	errs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err.Error()
+	}
+	return fmt.Sprintf("crypto11: skipped %d certificates: %s", len(e.Errors), strings.Join(errs, "; "))
+}
+
+// CertPool returns a pool containing every X.509 certificate on the token.
+//
+// Certificates that cannot be parsed are skipped. If there are any
+// then the pool of the others is returned together with a
+// *SkippedCertificatesError describing them; callers that only want
+// the usable certificates may ignore that error when the pool is not
+// nil.
+func CertPool() (*x509.CertPool, error) {
+	return CertPoolOnSlot(instance.slot)
+}
+
+// CertPoolOnSlot returns a pool containing every X.509 certificate on a specified slot.
+//
+// See CertPool for details.
+func CertPoolOnSlot(slot uint) (*x509.CertPool, error) {
+	var certPool *x509.CertPool
+	var err error
+	if err = ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	err = withSession(slot, func(session *PKCS11Session) error {
+		certPool, err = CertPoolOnSession(session)
+		return err
+	})
+	return certPool, err
+}
+
+// CertPoolOnSession returns a pool containing every X.509 certificate visible to a specified session.
+//
+// See CertPool for details.
+func CertPoolOnSession(session *PKCS11Session) (*x509.CertPool, error) {
+	handles, err := findObjects(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+		pkcs11.NewAttribute(pkcs11.CKA_CERTIFICATE_TYPE, pkcs11.CKC_X_509),
+	})
+	if err != nil {
+		return nil, err
+	}
+	certPool := x509.NewCertPool()
+	var skipped []error
+	for _, handle := range handles {
+		attributes, err := getAttributes(session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		cert, err := x509.ParseCertificate(attributes[0].Value)
+		if err != nil {
+			skipped = append(skipped, fmt.Errorf("certificate %q: %v", attributes[1].Value, err))
+			continue
+		}
+		certPool.AddCert(cert)
+	}
+	if len(skipped) > 0 {
+		return certPool, &SkippedCertificatesError{skipped}
+	}
+	return certPool, nil
+}
@@ -0,0 +1,411 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+func TestMatchCertificate(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	rsaKey, err := GenerateRSAKeyPair(2048)
+	if err != nil {
+		t.Fatalf("GenerateRSAKeyPair: %v", err)
+	}
+	ecKey, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPair: %v", err)
+	}
+	otherECKey, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPair: %v", err)
+	}
+	for _, test := range []struct {
+		name  string
+		key   crypto.Signer
+		cert  crypto.Signer
+		match bool
+	}{
+		{"RSA", rsaKey, rsaKey, true},
+		{"ECDSA", ecKey, ecKey, true},
+		{"OtherECDSA", otherECKey, ecKey, false},
+		{"WrongType", rsaKey, ecKey, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cert := selfSignedCertificate(t, test.cert)
+			match, err := MatchCertificate(test.key, cert)
+			if err != nil {
+				t.Fatalf("MatchCertificate: %v", err)
+			}
+			if match != test.match {
+				t.Errorf("MatchCertificate: got %v, want %v", match, test.match)
+			}
+		})
+	}
+}
+
+func selfSignedCertificate(t *testing.T, key crypto.Signer) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "crypto11 test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	return cert
+}
+
+func TestImportCertificate(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPair: %v", err)
+	}
+	id, label, err := key.Identify()
+	if err != nil {
+		t.Fatalf("key.Identify: %v", err)
+	}
+	cert := selfSignedCertificate(t, key)
+	object, err := ImportCertificateOnSlot(key.Slot, id, label, cert)
+	if err != nil {
+		t.Fatalf("ImportCertificateOnSlot: %v", err)
+	}
+	var value []byte
+	if err = withSession(object.Slot, func(session *PKCS11Session) error {
+		attributes, err := session.Ctx.GetAttributeValue(session.Handle, object.Handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+		})
+		if err == nil {
+			value = attributes[0].Value
+		}
+		return err
+	}); err != nil {
+		t.Fatalf("GetAttributeValue: %v", err)
+	}
+	if !bytes.Equal(value, cert.Raw) {
+		t.Errorf("stored certificate does not match")
+	}
+	found, err := FindCertificate(id, nil)
+	if err != nil {
+		t.Fatalf("FindCertificate by ID: %v", err)
+	}
+	if !bytes.Equal(found.Raw, cert.Raw) {
+		t.Errorf("FindCertificate by ID: wrong certificate")
+	}
+	if found, err = FindCertificate(nil, label); err != nil {
+		t.Fatalf("FindCertificate by label: %v", err)
+	}
+	if !bytes.Equal(found.Raw, cert.Raw) {
+		t.Errorf("FindCertificate by label: wrong certificate")
+	}
+	if _, err = FindCertificate([]byte("no such certificate"), nil); err != ErrCertificateNotFound {
+		t.Errorf("FindCertificate with unknown ID: got %v, want ErrCertificateNotFound", err)
+	}
+}
+
+func TestCreateCertificate(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	caKeyECDSA, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPair: %v", err)
+	}
+	caKeyRSA, err := GenerateRSAKeyPair(2048)
+	if err != nil {
+		t.Fatalf("GenerateRSAKeyPair: %v", err)
+	}
+	t.Run("ECDSA", func(t *testing.T) { testCreateCertificate(t, caKeyECDSA, x509.ECDSAWithSHA256) })
+	t.Run("RSA", func(t *testing.T) { testCreateCertificate(t, caKeyRSA, x509.SHA256WithRSA) })
+	t.Run("RSAPSS", func(t *testing.T) {
+		needMechanism(t, caKeyRSA.Slot, pkcs11.CKM_RSA_PKCS_PSS)
+		testCreateCertificate(t, caKeyRSA, x509.SHA256WithRSAPSS)
+	})
+}
+
+func testCreateCertificate(t *testing.T, caKey crypto.Signer, algorithm x509.SignatureAlgorithm) {
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "crypto11 test CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		SignatureAlgorithm:    algorithm,
+	}
+	caDER, err := CreateCertificate(caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate (CA): %v", err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate (CA): %v", err)
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber:       big.NewInt(2),
+		Subject:            pkix.Name{CommonName: "crypto11 test leaf"},
+		NotBefore:          time.Now().Add(-time.Minute),
+		NotAfter:           time.Now().Add(time.Hour),
+		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		SignatureAlgorithm: algorithm,
+	}
+	leafDER, err := CreateCertificate(leafTemplate, caCert, leafKey.Public(), caKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate (leaf): %v", err)
+	}
+	leafCert, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate (leaf): %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	if _, err = leafCert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("leaf certificate does not verify: %v", err)
+	}
+}
+
+func TestReplaceCertificate(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPair: %v", err)
+	}
+	id, label, err := key.Identify()
+	if err != nil {
+		t.Fatalf("key.Identify: %v", err)
+	}
+	if _, err = ReplaceCertificate(id, selfSignedCertificate(t, key)); err != ErrCertificateNotFound {
+		t.Errorf("ReplaceCertificate with no certificate: got %v, want ErrCertificateNotFound", err)
+	}
+	if _, err = ImportCertificateOnSlot(key.Slot, id, label, selfSignedCertificate(t, key)); err != nil {
+		t.Fatalf("ImportCertificateOnSlot: %v", err)
+	}
+	newCert := selfSignedCertificate(t, key)
+	if _, err = ReplaceCertificate(id, newCert); err != nil {
+		t.Fatalf("ReplaceCertificate: %v", err)
+	}
+	var values [][]byte
+	err = withSession(key.Slot, func(session *PKCS11Session) error {
+		template := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		}
+		if err := session.Ctx.FindObjectsInit(session.Handle, template); err != nil {
+			return err
+		}
+		defer session.Ctx.FindObjectsFinal(session.Handle)
+		handles, _, err := session.Ctx.FindObjects(session.Handle, 10)
+		if err != nil {
+			return err
+		}
+		for _, handle := range handles {
+			attributes, err := session.Ctx.GetAttributeValue(session.Handle, handle, []*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+			})
+			if err != nil {
+				return err
+			}
+			values = append(values, attributes[0].Value)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("finding certificates: %v", err)
+	}
+	if len(values) != 1 || !bytes.Equal(values[0], newCert.Raw) {
+		t.Errorf("after ReplaceCertificate: found %d certificates, want just the new one", len(values))
+	}
+}
+
+func TestCertPool(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPair: %v", err)
+	}
+	cert := selfSignedCertificate(t, key)
+	if _, err = ImportCertificate(cert); err != nil {
+		t.Fatalf("ImportCertificate: %v", err)
+	}
+	// And one that doesn't parse
+	err = withSession(instance.slot, func(session *PKCS11Session) error {
+		_, err := createObject(session, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+			pkcs11.NewAttribute(pkcs11.CKA_CERTIFICATE_TYPE, pkcs11.CKC_X_509),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, "garbage"),
+			pkcs11.NewAttribute(pkcs11.CKA_SUBJECT, cert.RawSubject),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, []byte("not a certificate")),
+		})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("createObject: %v", err)
+	}
+	certPool, err := CertPool()
+	if _, ok := err.(*SkippedCertificatesError); !ok {
+		t.Errorf("CertPool: got %v, want a *SkippedCertificatesError", err)
+	}
+	if certPool == nil {
+		t.Fatalf("CertPool: no pool")
+	}
+	found := false
+	for _, subject := range certPool.Subjects() {
+		if bytes.Equal(subject, cert.RawSubject) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("CertPool: imported certificate missing")
+	}
+}
+
+func TestGenerateSelfSigned(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	label, err := generateKeyLabel()
+	if err != nil {
+		t.Fatalf("generateKeyLabel: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "crypto11 self-signed test"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	signer, cert, err := GenerateSelfSigned(template, &KeyTemplate{
+		Label:   string(label),
+		KeyType: KeyTypeEC,
+		Curve:   "P-256",
+		Sign:    true,
+	})
+	if err != nil {
+		t.Fatalf("GenerateSelfSigned: %v", err)
+	}
+	if ok, err := MatchCertificate(signer, cert); err != nil || !ok {
+		t.Errorf("MatchCertificate: %v/%v", ok, err)
+	}
+	if err = cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		t.Errorf("cert.CheckSignature: %v", err)
+	}
+	if _, err = FindKeyPair(nil, label); err != nil {
+		t.Errorf("FindKeyPair: %v", err)
+	}
+	pool, err := CertPool()
+	if err != nil {
+		t.Fatalf("CertPool: %v", err)
+	}
+	found := false
+	for _, subject := range pool.Subjects() {
+		if bytes.Equal(subject, cert.RawSubject) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("self-signed certificate not stored on the token")
+	}
+}
+
+func TestCertificateRequest(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPair: %v", err)
+	}
+	der, err := CreateCertificateRequest(&x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "crypto11 test request"},
+	}, key)
+	if err != nil {
+		t.Fatalf("CreateCertificateRequest: %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificateRequest: %v", err)
+	}
+	// Issue the certificate with a software CA
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, csr.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	if _, err = StoreIssuedCertificate(key, cert); err != nil {
+		t.Fatalf("StoreIssuedCertificate: %v", err)
+	}
+	id, _, err := key.Identify()
+	if err != nil {
+		t.Fatalf("key.Identify: %v", err)
+	}
+	found, err := FindCertificate(id, nil)
+	if err != nil {
+		t.Fatalf("FindCertificate: %v", err)
+	}
+	if !bytes.Equal(found.Raw, cert.Raw) {
+		t.Errorf("FindCertificate: wrong certificate")
+	}
+	other, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPair: %v", err)
+	}
+	if _, err = StoreIssuedCertificate(other, cert); err != ErrCertificateKeyMismatch {
+		t.Errorf("StoreIssuedCertificate for another key: got %v, want ErrCertificateKeyMismatch", err)
+	}
+}
@@ -24,6 +24,7 @@ package crypto11
 import (
 	"crypto"
 	"crypto/dsa"
+	"crypto/elliptic"
 	"fmt"
 	"testing"
 )
@@ -67,3 +68,44 @@ func TestClose(t *testing.T) {
 		}
 	}
 }
+
+func TestStaleObjectAfterReconfigure(t *testing.T) {
+	if _, err := ConfigureFromFile("config"); err != nil {
+		t.Fatal(err)
+	}
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("crypto11.GenerateECDSAKeyPair: %v", err)
+	}
+	if _, err = key.Info(); err != nil {
+		t.Fatalf("key.Info: %v", err)
+	}
+	id, _, err := key.Identify()
+	if err != nil {
+		t.Fatalf("key.Identify: %v", err)
+	}
+	if err = Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ConfigureFromFile("config"); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	if _, err = key.Sign(nil, make([]byte, 32), crypto.SHA256); err != ErrStaleObject {
+		t.Errorf("Sign with stale key: got %v, want ErrStaleObject", err)
+	}
+	if _, err = key.Info(); err != ErrStaleObject {
+		t.Errorf("Info of stale key: got %v, want ErrStaleObject", err)
+	}
+	if key.Valid() {
+		t.Errorf("Valid: stale key reported valid")
+	}
+	// Finding it again works
+	key2, err := FindKeyPair(id, nil)
+	if err != nil {
+		t.Fatalf("crypto11.FindKeyPair: %v", err)
+	}
+	if _, err = key2.(crypto.Signer).Sign(nil, make([]byte, 32), crypto.SHA256); err != nil {
+		t.Errorf("Sign with key found again: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"fmt"
+	"hash"
+
+	"github.com/miekg/pkcs11"
+)
+
+// cmacMechanism picks the CMAC mechanism and parameters for a key and output length.
+//
+// A length of 0, or the cipher's block size, selects the full-length
+// mechanism; anything else needs the _GENERAL variant, which takes
+// the output length as a CK_MAC_GENERAL_PARAMS.
+func (key *PKCS11SecretKey) cmacMechanism(length int) (mech uint, params []byte, err error) {
+	if key.Cipher.CMACMech == 0 {
+		err = fmt.Errorf("CMAC not implemented for key type %#x", key.Cipher.GenParams[0].KeyType)
+		return
+	}
+	if length == 0 || length == key.Cipher.BlockSize {
+		mech = key.Cipher.CMACMech
+		return
+	}
+	if length < 0 || length > key.Cipher.BlockSize {
+		err = fmt.Errorf("CMAC length %d out of range for block size %d", length, key.Cipher.BlockSize)
+		return
+	}
+	if key.Cipher.CMACGeneralMech == 0 {
+		err = fmt.Errorf("truncated CMAC not implemented for key type %#x", key.Cipher.GenParams[0].KeyType)
+		return
+	}
+	mech = key.Cipher.CMACGeneralMech
+	params = ulongToBytes(uint(length))
+	return
+}
+
+// NewCMAC returns a new CMAC hash using the key's cipher (e.g. CKM_AES_CMAC).
+//
+// length specifies the output size in bytes. If it is 0 the full
+// block size is used; otherwise the CKM_..._CMAC_GENERAL mechanism is
+// used to produce a truncated MAC.
+//
+// The key must have CKA_SIGN set, e.g. by creating it with
+// KeyAttributes.MAC. For the older CBC-MAC (CKM_AES_MAC, CKM_DES3_MAC
+// and their _GENERAL variants) use NewHMAC with the mechanism.
+//
+// As with NewHMAC, after Sum() is called no new data may be added.
+func (key *PKCS11SecretKey) NewCMAC(length int) (h hash.Hash, err error) {
+	var mech uint
+	var params []byte
+	if mech, params, err = key.cmacMechanism(length); err != nil {
+		return
+	}
+	hi := hmacImplementation{
+		key:       key,
+		size:      key.Cipher.BlockSize,
+		blockSize: key.Cipher.BlockSize,
+	}
+	if params != nil {
+		hi.size = length
+	}
+	hi.mechDescription = []*pkcs11.Mechanism{pkcs11.NewMechanism(mech, params)}
+	if err = hi.initialize(); err != nil {
+		err = key.wrapError("NewCMAC", err)
+		return
+	}
+	h = &hi
+	return
+}
+
+// CMAC returns the CMAC of message under the key, computed in a single C_Sign call.
+//
+// length is as for NewCMAC. Unlike the hash returned by NewCMAC, no
+// session is held between calls, and a failure on the token is
+// returned as an error rather than a panic, so this is preferable when
+// the whole message is at hand.
+func (key *PKCS11SecretKey) CMAC(message []byte, length int) ([]byte, error) {
+	mech, params, err := key.cmacMechanism(length)
+	if err != nil {
+		return nil, err
+	}
+	mechDescription := []*pkcs11.Mechanism{pkcs11.NewMechanism(mech, params)}
+	var mac []byte
+	err = withKeySession(&key.PKCS11Object, func(session *PKCS11Session) error {
+		if err := traceCall("C_SignInit", mechDescription, session.Ctx.SignInit(session.Handle, mechDescription, key.Handle)); err != nil {
+			return err
+		}
+		var err error
+		mac, err = session.Ctx.Sign(session.Handle, message)
+		return traceCall("C_Sign", nil, err)
+	})
+	if err != nil {
+		return nil, key.wrapError("CMAC", err)
+	}
+	return mac, nil
+}
+
+// VerifyCMAC checks that mac is a valid CMAC of message under the key.
+//
+// The check is performed on the token using C_Verify, so the key
+// need only have CKA_VERIFY set. The length of mac determines
+// whether a full-length or truncated CMAC is expected.
+//
+// If the MAC is wrong then an *ObjectError wrapping the PKCS#11 error
+// (normally CKR_SIGNATURE_INVALID) is returned.
+func (key *PKCS11SecretKey) VerifyCMAC(message []byte, mac []byte) error {
+	mech, params, err := key.cmacMechanism(len(mac))
+	if err != nil {
+		return err
+	}
+	mechDescription := []*pkcs11.Mechanism{pkcs11.NewMechanism(mech, params)}
+	err = withKeySession(&key.PKCS11Object, func(session *PKCS11Session) error {
+		if err := traceCall("C_VerifyInit", mechDescription, session.Ctx.VerifyInit(session.Handle, mechDescription, key.Handle)); err != nil {
+			return err
+		}
+		return traceCall("C_Verify", nil, session.Ctx.Verify(session.Handle, message, mac))
+	})
+	return key.wrapError("VerifyCMAC", err)
+}
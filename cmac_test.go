@@ -0,0 +1,125 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"hash"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+func TestCmac(t *testing.T) {
+	ConfigureFromFile("config")
+	t.Run("AES128", func(t *testing.T) { testCmac(t, pkcs11.CKK_AES, 128, 0, 16) })
+	t.Run("AES256", func(t *testing.T) { testCmac(t, pkcs11.CKK_AES, 256, 0, 16) })
+	t.Run("AES128General", func(t *testing.T) { testCmac(t, pkcs11.CKK_AES, 128, 8, 8) })
+	Close()
+}
+
+func testCmac(t *testing.T, keytype int, bits int, length int, xlength int) {
+	var err error
+	var key *PKCS11SecretKey
+	if key, err = GenerateSecretKeyWithAttributes(&KeyAttributes{Cipher: Ciphers[keytype], Bits: bits, MAC: true}); err != nil {
+		t.Errorf("crypto11.GenerateSecretKeyWithAttributes: %v", err)
+		return
+	}
+	mech, _, _ := key.cmacMechanism(length)
+	needMechanism(t, key.Slot, mech)
+	input := []byte("a short string")
+	var h1, h2 hash.Hash
+	if h1, err = key.NewCMAC(length); err != nil {
+		t.Errorf("key.NewCMAC: %v", err)
+		return
+	}
+	if n, err := h1.Write(input); err != nil || n != len(input) {
+		t.Errorf("h1.Write: %v/%d", err, n)
+		return
+	}
+	r1 := h1.Sum([]byte{})
+	if h2, err = key.NewCMAC(length); err != nil {
+		t.Errorf("key.NewCMAC: %v", err)
+		return
+	}
+	if n, err := h2.Write(input); err != nil || n != len(input) {
+		t.Errorf("h2.Write: %v/%d", err, n)
+		return
+	}
+	r2 := h2.Sum([]byte{})
+	if bytes.Compare(r1, r2) != 0 {
+		t.Errorf("h1/h2 inconsistent")
+		return
+	}
+	if len(r1) != xlength {
+		t.Errorf("r1 wrong length (want %v got %v)", xlength, len(r1))
+		return
+	}
+	r3, err := key.CMAC(input, length)
+	if err != nil {
+		t.Errorf("key.CMAC: %v", err)
+		return
+	}
+	if !bytes.Equal(r1, r3) {
+		t.Errorf("key.CMAC inconsistent with key.NewCMAC")
+		return
+	}
+	if err = key.VerifyCMAC(input, r1); err != nil {
+		t.Errorf("key.VerifyCMAC: %v", err)
+		return
+	}
+	r1[0] ^= 1
+	if err = key.VerifyCMAC(input, r1); err == nil {
+		t.Errorf("key.VerifyCMAC: accepted a bad MAC")
+		return
+	}
+}
+
+func TestCbcMac(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	needMechanism(t, instance.slot, pkcs11.CKM_AES_MAC_GENERAL)
+	key, err := GenerateSecretKeyWithAttributes(&KeyAttributes{Cipher: &CipherAES, Bits: 128, MAC: true})
+	if err != nil {
+		t.Fatalf("crypto11.GenerateSecretKeyWithAttributes: %v", err)
+	}
+	// Two whole blocks, so there is no padding to agree on
+	input := []byte("0123456789abcdef0123456789ABCDEF")
+	want := make([]byte, 16)
+	for i := 0; i < len(input); i += 16 {
+		for j := range want {
+			want[j] ^= input[i+j]
+		}
+		key.Encrypt(want, want)
+	}
+	h, err := key.NewHMAC(pkcs11.CKM_AES_MAC_GENERAL, 12)
+	if err != nil {
+		t.Fatalf("key.NewHMAC: %v", err)
+	}
+	if h.Size() != 12 {
+		t.Errorf("Size: got %d, want 12", h.Size())
+	}
+	h.Write(input)
+	if got := h.Sum(nil); !bytes.Equal(got, want[:12]) {
+		t.Errorf("CKM_AES_MAC_GENERAL: got %x, want %x", got, want[:12])
+	}
+}
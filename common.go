@@ -2,6 +2,7 @@ package crypto11
 
 import (
 	"C"
+	cryptorand "crypto/rand"
 	"encoding/asn1"
 	"encoding/base64"
 	"errors"
@@ -19,6 +20,9 @@ var ErrMalformedDER = errors.New("crypto11: malformed DER message")
 // string.
 var ErrMalformedSignature = errors.New("crypto11xo: malformed signature")
 
+// ckUnavailableInformation is CK_UNAVAILABLE_INFORMATION, i.e. ~0 as a CK_ULONG.
+const ckUnavailableInformation = uint(^C.ulong(0))
+
 func ulongToBytes(n uint) []byte {
 	return C.GoBytes(unsafe.Pointer(&n), C.sizeof_ulong) // ugh!
 }
@@ -27,6 +31,30 @@ func bytesToUlong(bs []byte) (n uint) {
 	return *(*uint)(unsafe.Pointer(&bs[0])) // ugh
 }
 
+// Encode a CK_MECHANISM_TYPE array
+func encodeMechanisms(mechanisms []uint) []byte {
+	var encoded [][]byte
+	for _, m := range mechanisms {
+		encoded = append(encoded, ulongToBytes(m))
+	}
+	return concat(encoded...)
+}
+
+// Decode a CK_MECHANISM_TYPE array
+func decodeMechanisms(bs []byte) []uint {
+	size := C.sizeof_ulong
+	var mechanisms []uint
+	for len(bs) >= size {
+		mechanisms = append(mechanisms, bytesToUlong(bs[:size]))
+		bs = bs[size:]
+	}
+	return mechanisms
+}
+
+func bytesToBool(bs []byte) bool {
+	return len(bs) > 0 && bs[0] != 0
+}
+
 func concat(slices ...[]byte) []byte {
 	n := 0
 	for _, slice := range slices {
@@ -40,6 +68,26 @@ func concat(slices ...[]byte) []byte {
 	return r
 }
 
+// derSignatureSize returns the largest DER encoding of a (EC)DSA
+// signature whose r and s are at most bits long.
+func derSignatureSize(bits int) int {
+	// An INTEGER may need a leading zero byte to keep it positive
+	integer := 1 + asn1LengthSize(bits/8+1) + bits/8 + 1
+	return 1 + asn1LengthSize(2*integer) + 2*integer
+}
+
+// asn1LengthSize returns the size of the DER encoding of a length.
+func asn1LengthSize(n int) int {
+	if n < 128 {
+		return 1
+	}
+	size := 1
+	for ; n > 0; n >>= 8 {
+		size++
+	}
+	return size
+}
+
 // Representation of a *DSA signature
 type dsaSignature struct {
 	R, S *big.Int
@@ -67,37 +115,57 @@ func (sig *dsaSignature) unmarshalDER(sigDER []byte) error {
 	return nil
 }
 
+// Return the raw encoding of a dsaSignature, with each of R and S padded to n bytes
+func (sig *dsaSignature) marshalBytes(n int) ([]byte, error) {
+	if sig.R.Sign() < 0 || sig.S.Sign() < 0 || len(sig.R.Bytes()) > n || len(sig.S.Bytes()) > n {
+		return nil, ErrMalformedSignature
+	}
+	sigBytes := make([]byte, 2*n)
+	r, s := sig.R.Bytes(), sig.S.Bytes()
+	copy(sigBytes[n-len(r):n], r)
+	copy(sigBytes[2*n-len(s):], s)
+	return sigBytes, nil
+}
+
 // Return the DER encoding of a dsaSignature
 func (sig *dsaSignature) marshalDER() ([]byte, error) {
 	return asn1.Marshal(*sig)
 }
 
 // Compute *DSA signature and marshal the result in DER fform
-func dsaGeneric(slot uint, key pkcs11.ObjectHandle, mechanism uint, digest []byte) ([]byte, error) {
-	var err error
-	var sigBytes []byte
+func dsaGeneric(key *PKCS11Object, mechanism uint, digest []byte) ([]byte, error) {
 	var sig dsaSignature
-	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}
-	err = withSession(slot, func(session *PKCS11Session) error {
-		if err = instance.ctx.SignInit(session.Handle, mech, key); err != nil {
-			return err
-		}
-		sigBytes, err = instance.ctx.Sign(session.Handle, digest)
-		return err
-	})
+	sigBytes, err := dsaGenericRaw(key, mechanism, digest)
 	if err != nil {
 		return nil, err
 	}
-	sig.unmarshalBytes(sigBytes)
+	if err = sig.unmarshalBytes(sigBytes); err != nil {
+		return nil, err
+	}
 	return sig.marshalDER()
 }
 
+// Compute *DSA signature, returning the token's raw r||s output
+func dsaGenericRaw(key *PKCS11Object, mechanism uint, digest []byte) ([]byte, error) {
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}
+	return withSignSession(key, func(session *PKCS11Session) ([]byte, error) {
+		if err := traceCall("C_SignInit", mech, session.Ctx.SignInit(session.Handle, mech, key.Handle)); err != nil {
+			return nil, err
+		}
+		sigBytes, err := session.Ctx.Sign(session.Handle, digest)
+		return sigBytes, traceCall("C_Sign", nil, err)
+	})
+}
+
 // Pick a random label for a key
 func generateKeyLabel() ([]byte, error) {
 	const labelSize = 32
 	rawLabel := make([]byte, labelSize)
 	var rand PKCS11RandReader
 	sz, err := rand.Read(rawLabel)
+	if err == ErrRNGNotAvailable {
+		sz, err = cryptorand.Read(rawLabel)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,224 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/elliptic"
+	"sync"
+)
+
+// Context is a token in the configured PKCS#11 library.
+//
+// Its methods are the package-level functions applied to its token,
+// so several tokens of the same library (e.g. HSM partitions) can be
+// used side by side. The package-level functions remain, and act on
+// the configured token, as if through DefaultContext.
+//
+// There is still only one configuration, and so one loaded library,
+// at a time; a Context and the session pools of its token refer to it,
+// rather than to the package state, for the library handle, the PIN
+// and the pool settings. A Context cannot be used after Close; its
+// methods return ErrStaleObject. A Context may be used, and closed,
+// from several goroutines.
+type Context struct {
+	// The configuration the context uses
+	lib *libCtx
+
+	slot uint
+
+	// Protects the fields below
+	m sync.Mutex
+
+	// True if the context holds a login on its token (see loginRegistry)
+	loggedIn bool
+
+	// The configuration the context belongs to (see libCtx.generation)
+	generation uint64
+
+	// True if the context made the configuration (see ConfigureContext)
+	owner bool
+}
+
+// ConfigureContext configures PKCS#11 as Configure does and returns a
+// Context for the configured token.
+//
+// The Context owns the configuration: closing it closes the library,
+// as Close does. If a library is already configured then the Context
+// is for its token, and closing it only releases its login.
+func ConfigureContext(config *PKCS11Config) (*Context, error) {
+	configuring.Lock()
+	defer configuring.Unlock()
+	owner := instance.ctx == nil
+	if _, err := configure(config); err != nil {
+		return nil, err
+	}
+	c, err := DefaultContext()
+	if err != nil {
+		return nil, err
+	}
+	c.owner = owner
+	return c, nil
+}
+
+// DefaultContext returns a Context for the configured token.
+func DefaultContext() (*Context, error) {
+	return ContextOnSlot(instance.slot)
+}
+
+// ContextOnSlot returns a Context for the token in a specified slot.
+//
+// If the token needs a login and the configuration has a PIN, the
+// token is logged in with it (see ForceLogin in PKCS11Config); the
+// login is shared with every other user of the token, and held until
+// the Context is closed.
+func ContextOnSlot(slot uint) (*Context, error) {
+	lib := instance
+	if lib.ctx == nil {
+		return nil, ErrNotConfigured
+	}
+	tokenInfo, err := lib.ctx.GetTokenInfo(slot)
+	if err != nil {
+		return nil, err
+	}
+	if err = ensureSessions(lib, slot); err != nil {
+		return nil, err
+	}
+	c := &Context{lib: lib, slot: slot, generation: lib.generation}
+	if loginRequired(tokenInfo.Flags, lib.cfg) {
+		if err = withSession(slot, func(s *PKCS11Session) error {
+			return logins.acquire(lib, s, slot)
+		}); err != nil {
+			return nil, err
+		}
+		c.loggedIn = true
+	}
+	return c, nil
+}
+
+// checkLive returns ErrStaleObject if the context belongs to an earlier configuration.
+func (c *Context) checkLive() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.checkLiveLocked()
+}
+
+// checkLiveLocked is checkLive for a caller that holds c.m.
+func (c *Context) checkLiveLocked() error {
+	if c.lib == nil || c.generation != c.lib.generation || c.lib.ctx == nil {
+		return ErrStaleObject
+	}
+	return nil
+}
+
+// Slot returns the slot of the context's token.
+func (c *Context) Slot() uint {
+	return c.slot
+}
+
+// Close releases the context's login on its token, if it holds one.
+//
+// If no other user of the token needs the login, the token is logged
+// out. If the context came from ConfigureContext the library is closed
+// too. The context cannot be used afterwards. Close need not be called
+// before the package-level Close.
+func (c *Context) Close() error {
+	c.m.Lock()
+	live := c.checkLiveLocked() == nil
+	loggedIn := c.loggedIn && live
+	owner := c.owner && live
+	c.loggedIn = false
+	c.generation = 0
+	c.owner = false
+	c.m.Unlock()
+	if owner {
+		// Closing the library logs out the token anyway
+		return Close()
+	}
+	if !loggedIn {
+		return nil
+	}
+	return withSession(c.slot, func(s *PKCS11Session) error {
+		return logins.release(s, c.slot)
+	})
+}
+
+// FindKeyPair retrieves a previously created asymmetric key from the context's token.
+//
+// See FindKeyPair for details.
+func (c *Context) FindKeyPair(id []byte, label []byte) (crypto.PrivateKey, error) {
+	if err := c.checkLive(); err != nil {
+		return nil, err
+	}
+	return FindKeyPairOnSlot(c.slot, id, label)
+}
+
+// FindKey retrieves a previously created symmetric key from the context's token.
+//
+// See FindKey for details.
+func (c *Context) FindKey(id []byte, label []byte) (*PKCS11SecretKey, error) {
+	if err := c.checkLive(); err != nil {
+		return nil, err
+	}
+	return FindKeyOnSlot(c.slot, id, label)
+}
+
+// GenerateRSAKeyPair creates an RSA key pair on the context's token.
+//
+// See GenerateRSAKeyPair for details.
+func (c *Context) GenerateRSAKeyPair(bits int) (*PKCS11PrivateKeyRSA, error) {
+	if err := c.checkLive(); err != nil {
+		return nil, err
+	}
+	return GenerateRSAKeyPairOnSlot(c.slot, nil, nil, bits)
+}
+
+// GenerateECDSAKeyPair creates an ECDSA key pair on the context's token.
+//
+// See GenerateECDSAKeyPair for details.
+func (c *Context) GenerateECDSAKeyPair(curve elliptic.Curve) (*PKCS11PrivateKeyECDSA, error) {
+	if err := c.checkLive(); err != nil {
+		return nil, err
+	}
+	return GenerateECDSAKeyPairOnSlot(c.slot, nil, nil, curve)
+}
+
+// GenerateDSAKeyPair creates a DSA key pair on the context's token.
+//
+// See GenerateDSAKeyPair for details.
+func (c *Context) GenerateDSAKeyPair(params *dsa.Parameters) (*PKCS11PrivateKeyDSA, error) {
+	if err := c.checkLive(); err != nil {
+		return nil, err
+	}
+	return GenerateDSAKeyPairOnSlot(c.slot, nil, nil, params)
+}
+
+// GenerateSecretKey creates a secret key on the context's token.
+//
+// See GenerateSecretKey for details.
+func (c *Context) GenerateSecretKey(bits int, cipher *SymmetricCipher) (*PKCS11SecretKey, error) {
+	if err := c.checkLive(); err != nil {
+		return nil, err
+	}
+	return GenerateSecretKeyOnSlot(c.slot, nil, nil, bits, cipher)
+}
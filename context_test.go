@@ -0,0 +1,194 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto/elliptic"
+	"testing"
+	"time"
+)
+
+func TestContext(t *testing.T) {
+	configureWithPin(t)
+	defer Close()
+	c, err := DefaultContext()
+	if err != nil {
+		t.Fatalf("DefaultContext: %v", err)
+	}
+	if c.Slot() != instance.slot {
+		t.Errorf("Context.Slot: got %d, want %d", c.Slot(), instance.slot)
+	}
+	key, err := c.GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("Context.GenerateECDSAKeyPair: %v", err)
+	}
+	id, _, err := key.Identify()
+	if err != nil {
+		t.Fatalf("key.Identify: %v", err)
+	}
+	found, err := c.FindKeyPair(id, nil)
+	if err != nil {
+		t.Fatalf("Context.FindKeyPair: %v", err)
+	}
+	if found.(*PKCS11PrivateKeyECDSA).Handle != key.Handle {
+		t.Errorf("Context.FindKeyPair found a different key")
+	}
+	if err = c.Close(); err != nil {
+		t.Fatalf("Context.Close: %v", err)
+	}
+	// The configuration's own login is still held
+	if _, err = FindKeyPair(id, nil); err != nil {
+		t.Errorf("FindKeyPair after Context.Close: %v", err)
+	}
+	if _, err = c.FindKeyPair(id, nil); err != ErrStaleObject {
+		t.Errorf("Context.FindKeyPair after Close: got %v, want ErrStaleObject", err)
+	}
+}
+
+func TestConfigureContext(t *testing.T) {
+	cfg, err := getConfig("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ConfigureContext(cfg)
+	if err != nil {
+		t.Fatalf("ConfigureContext: %v", err)
+	}
+	defer Close()
+	if c.Slot() != instance.slot {
+		t.Errorf("Context.Slot: got %d, want %d", c.Slot(), instance.slot)
+	}
+	// Concurrent closes must agree on who closes the library
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- c.Close() }()
+	}
+	for i := 0; i < 2; i++ {
+		if err = <-errs; err != nil {
+			t.Errorf("Context.Close: %v", err)
+		}
+	}
+	if instance.ctx != nil {
+		t.Errorf("Context.Close did not close the library")
+	}
+}
+
+func TestConfigureContextConcurrent(t *testing.T) {
+	cfg, err := getConfig("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	// Only one of several racing callers can have made the configuration
+	contexts := make(chan *Context, 4)
+	for i := 0; i < cap(contexts); i++ {
+		go func() {
+			c, err := ConfigureContext(cfg)
+			if err != nil {
+				t.Errorf("ConfigureContext: %v", err)
+			}
+			contexts <- c
+		}()
+	}
+	owners := 0
+	for i := 0; i < cap(contexts); i++ {
+		if c := <-contexts; c != nil && c.owner {
+			owners++
+		}
+	}
+	if owners != 1 {
+		t.Errorf("ConfigureContext: %d owners, want 1", owners)
+	}
+}
+
+func TestLoginRegistry(t *testing.T) {
+	configureWithPin(t)
+	defer Close()
+	if !loginRequired(instance.token.Flags, instance.cfg) {
+		t.Skip("token does not need a login")
+	}
+	// The configuration holds one login; take a second and give it back
+	acquire := func(s *PKCS11Session) error { return logins.acquire(instance, s, instance.slot) }
+	release := func(s *PKCS11Session) error { return logins.release(s, instance.slot) }
+	if err := withSession(instance.slot, acquire); err != nil {
+		t.Fatalf("logins.acquire: %v", err)
+	}
+	if err := withSession(instance.slot, release); err != nil {
+		t.Fatalf("logins.release: %v", err)
+	}
+	var state uint
+	err := withSession(instance.slot, func(s *PKCS11Session) error {
+		info, err := s.Ctx.GetSessionInfo(s.Handle)
+		state = info.State
+		return err
+	})
+	if err != nil {
+		t.Fatalf("GetSessionInfo: %v", err)
+	}
+	if state != 3 { // CKS_RW_USER_FUNCTIONS
+		t.Errorf("session state after one of two releases: got %d, want logged in", state)
+	}
+}
+
+func TestLoginRegistryIdleTimeout(t *testing.T) {
+	cfg, err := getConfig("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.IdleTimeout = time.Minute
+	if _, err = Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	if !loginRequired(instance.token.Flags, instance.cfg) {
+		t.Skip("token does not need a login")
+	}
+	state := func() uint {
+		var state uint
+		if err := withSession(instance.slot, func(s *PKCS11Session) error {
+			info, err := s.Ctx.GetSessionInfo(s.Handle)
+			state = info.State
+			return err
+		}); err != nil {
+			t.Fatalf("GetSessionInfo: %v", err)
+		}
+		return state
+	}
+	c, err := DefaultContext()
+	if err != nil {
+		t.Fatalf("DefaultContext: %v", err)
+	}
+	if err = c.Close(); err != nil {
+		t.Fatalf("Context.Close: %v", err)
+	}
+	// The configuration's login is still held
+	if s := state(); s != 3 { // CKS_RW_USER_FUNCTIONS
+		t.Errorf("session state after Context.Close: got %d, want logged in", s)
+	}
+	// and can be released
+	if err = Logout(); err != nil {
+		t.Fatalf("Logout: %v", err)
+	}
+	if s := state(); s == 3 {
+		t.Errorf("session state after Logout: still logged in")
+	}
+}
@@ -37,8 +37,17 @@
 //
 // 3. Retrieve existing keys with FindKeyPair. The return value is a
 // Go crypto.PrivateKey; it may be converted either to crypto.Signer
-// or to *PKCS11PrivateKeyDSA, *PKCS11PrivateKeyECDSA or
-// *PKCS11PrivateKeyRSA.
+// or to *PKCS11PrivateKeyDSA, *PKCS11PrivateKeyECDSA,
+// *PKCS11PrivateKeyEd25519 or *PKCS11PrivateKeyRSA. Ed25519 keys,
+// from GenerateEd25519KeyPair, need a token with PKCS#11 v3.0
+// Edwards curve support.
+//
+// 4. Create secret keys with GenerateSecretKey, e.g. with
+// Ciphers[pkcs11.CKK_AES], and retrieve them with FindKey. The
+// resulting *PKCS11SecretKey implements cipher.Block, encrypting one
+// block per C_Encrypt call using the cipher's ECB mechanism, so it can
+// be used with the standard Go cipher modes; NewCBC and NewGCM are
+// more efficient, running the whole mode on the token.
 //
 // Sessions and concurrency
 //
@@ -51,12 +60,22 @@
 // for an object.
 //
 // 2. For each slot we maintain a pool of read-write sessions. The
-// pool expands dynamically up to an (undocumented) limit.
+// pool expands dynamically up to an (undocumented) limit. The pools
+// for different slots are fully independent, so contention for
+// sessions on one token never delays operations on another.
 //
 // 3. Each operation transiently takes a session from the pool. They
 // have exclusive use of the session, meeting PKCS#11's concurrency
 // requirements.
 //
+// 4. There is only one configuration, and so one loaded library, at a
+// time. Other slots of the same library (e.g. further HSM partitions)
+// are reached with a Context from ContextOnSlot, or the ...OnSlot
+// functions; each slot gets its own pool and its own login record,
+// and ContextOnSlot logs in with the configured PIN when the token
+// asks for it. Close finalizes the library for all of them at once,
+// as does closing the Context that ConfigureContext returns.
+//
 // The details are, partially, exposed in the API; since the target
 // use case is PKCS#11-unaware operation it may be that the API as it
 // stands isn't good enough for PKCS#11-aware applications. Feedback
@@ -66,9 +85,10 @@
 //
 // Limitations
 //
-// The PKCS1v15DecryptOptions SessionKeyLen field is not implemented
-// and an error is returned if it is nonzero.
-// The reason for this is that it is not possible for crypto11 to guarantee the constant-time behavior in the specification.
+// A nonzero PKCS1v15DecryptOptions SessionKeyLen is supported (see
+// DecryptPKCS1v15SessionKey), but crypto11 can only hide padding
+// failures from the caller, not from a timing observer: whether the
+// token's C_Decrypt takes longer on bad padding is up to the token.
 // See https://github.com/thalesignite/crypto11/issues/5 for further discussion.
 //
 // Symmetric crypto support via cipher.Block is very slow.
@@ -79,11 +99,16 @@ package crypto11
 
 import (
 	"crypto"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/pkcs11"
@@ -101,6 +126,9 @@ var ErrTokenNotFound = errors.New("crypto11: could not find PKCS#11 token")
 // ErrKeyNotFound represents the failure to find the requested PKCS#11 key
 var ErrKeyNotFound = errors.New("crypto11: could not find PKCS#11 key")
 
+// ErrNoPublicKey is returned when a private key has no public key object and the public key cannot be recovered from it
+var ErrNoPublicKey = errors.New("crypto11: no public key object and the public key cannot be recovered from the private key")
+
 // ErrNotConfigured is returned when the PKCS#11 library is not configured
 var ErrNotConfigured = errors.New("crypto11: PKCS#11 not yet configured")
 
@@ -111,8 +139,138 @@ var ErrCannotOpenPKCS11 = errors.New("crypto11: could not open PKCS#11")
 var ErrCannotGetRandomData = errors.New("crypto11: cannot get random data from PKCS#11")
 
 // ErrUnsupportedKeyType is returned when the PKCS#11 library returns a key type that isn't supported
+//
+// FindKeyPair and FindKey return an *UnsupportedKeyTypeError instead,
+// which names the key type.
 var ErrUnsupportedKeyType = errors.New("crypto11: unrecognized key type")
 
+// ErrMechanismNotSupported is returned when the token does not support a mechanism crypto11 needs
+var ErrMechanismNotSupported = errors.New("crypto11: mechanism not supported by token")
+
+// ErrTrustedNeedsSO is returned when a key with CKA_TRUSTED is created outside an SO session
+var ErrTrustedNeedsSO = errors.New("crypto11: CKA_TRUSTED can only be set by the security officer")
+
+// ErrWrapNotTrusted is returned when a key with CKA_WRAP_WITH_TRUSTED is wrapped by an untrusted key
+var ErrWrapNotTrusted = errors.New("crypto11: key can only be wrapped by a trusted key")
+
+// ObjectError is returned when a PKCS#11 operation on an object fails.
+//
+// It records which slot and object the operation was on, so that
+// failures can be traced to a particular key. Err is the underlying
+// PKCS#11 error.
+type ObjectError struct {
+	// Operation that failed, e.g. "Sign"
+	Op string
+
+	// Slot and handle of the object
+	Slot   uint
+	Handle pkcs11.ObjectHandle
+
+	// CKA_ID and CKA_LABEL of the object, or nil if they were not
+	// known when the object was found or created
+	ID    []byte
+	Label []byte
+
+	// Underlying error (normally a pkcs11.Error)
+	Err error
+}
+
+func (e *ObjectError) Error() string {
+	s := fmt.Sprintf("crypto11: %s failed on slot %d object %d", e.Op, e.Slot, e.Handle)
+	if e.ID != nil || e.Label != nil {
+		s += fmt.Sprintf(" (id %x label %q)", e.ID, e.Label)
+	}
+	return s + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *ObjectError) Unwrap() error {
+	return e.Err
+}
+
+// ErrSignNotPermitted is returned when signing with a key that does not have CKA_SIGN set
+var ErrSignNotPermitted = errors.New("crypto11: key not permitted for signing")
+
+// ErrDecryptNotPermitted is returned when decrypting with a key that does not have CKA_DECRYPT set
+var ErrDecryptNotPermitted = errors.New("crypto11: key not permitted for decryption")
+
+// ErrUnwrapNotPermitted is returned when unwrapping with a key that does not have CKA_UNWRAP set
+var ErrUnwrapNotPermitted = errors.New("crypto11: key not permitted for unwrapping")
+
+// ErrDeriveNotPermitted is returned when deriving from a key that does not have CKA_DERIVE set
+var ErrDeriveNotPermitted = errors.New("crypto11: key not permitted for derivation")
+
+// ErrPINIncorrect is returned when the token rejects a PIN as wrong.
+var ErrPINIncorrect = errors.New("crypto11: incorrect PIN")
+
+// ErrPINLenRange is returned when a new PIN is too short or too long for the token.
+var ErrPINLenRange = errors.New("crypto11: PIN length out of range")
+
+// ErrPINInvalid is returned when a new PIN contains characters the token does not accept.
+var ErrPINInvalid = errors.New("crypto11: PIN contains invalid characters")
+
+// ErrMechanismNotAllowed is returned when a key's CKA_ALLOWED_MECHANISMS does not include the mechanism an operation needs.
+var ErrMechanismNotAllowed = errors.New("crypto11: mechanism not allowed for this key")
+
+// ErrCertificateNotFound is returned when a certificate object cannot be found.
+var ErrCertificateNotFound = errors.New("crypto11: could not find PKCS#11 certificate")
+
+// ErrCertificateKeyMismatch is returned by TLSCertificate and StoreIssuedCertificate when a certificate is not for the key pair.
+var ErrCertificateKeyMismatch = errors.New("crypto11: certificate does not match key")
+
+// ErrTokenFull is returned when a key or other object cannot be
+// created because the token's storage is exhausted (CKR_DEVICE_MEMORY).
+// Deleting unused objects may make room; see also Capacity.
+var ErrTokenFull = errors.New("crypto11: token storage exhausted")
+
+// ErrNoConfiguredKey is returned by ConfiguredKey when the configuration has no KeyID.
+var ErrNoConfiguredKey = errors.New("crypto11: no KeyID configured")
+
+// ErrPINLocked is returned when the token has locked the PIN after too many failed attempts.
+var ErrPINLocked = errors.New("crypto11: PIN locked")
+
+// ErrPINFinalTry is returned instead of logging in when the token would lock the PIN after one more failed attempt.
+//
+// This applies to every login with the configured PIN: by Configure,
+// by ContextOnSlot, and when an operation or a new pooled session
+// finds the token logged out.
+//
+// See AllowPINFinalTry in PKCS11Config.
+var ErrPINFinalTry = errors.New("crypto11: refusing to log in, PIN is on its final try")
+
+// ErrFindTimeout is returned when a search takes longer than the configured FindTimeout.
+var ErrFindTimeout = errors.New("crypto11: timed out searching for object")
+
+// ErrPoolExhausted is returned in StrictSessions mode when every session of the slot is in use.
+var ErrPoolExhausted = errors.New("crypto11: all sessions in use")
+
+// ErrOperationTimeout is returned when a signing operation takes longer than the configured SignTimeout.
+var ErrOperationTimeout = errors.New("crypto11: timed out waiting for the token")
+
+// ErrAttributeNotSupported is returned when the token does not report an attribute that was asked for.
+var ErrAttributeNotSupported = errors.New("crypto11: attribute not supported by token")
+
+// ErrStaleObject is returned when an object found or created before
+// the library was closed is used after it has been configured again.
+// Find the object again instead.
+var ErrStaleObject = errors.New("crypto11: object belongs to a closed configuration")
+
+// ErrLabelExists is returned when a key is created with LabelCollisionError and its label is already in use.
+var ErrLabelExists = errors.New("crypto11: a key with this label already exists")
+
+// ErrUniqueIDNotSupported is returned when a key is looked up by CKA_UNIQUE_ID but the library predates PKCS#11 v3.0.
+var ErrUniqueIDNotSupported = errors.New("crypto11: library does not support CKA_UNIQUE_ID")
+
+// ErrNoSignerOpts is returned when an operation that needs signer options is passed nil opts and DefaultSignerOpts is not set.
+var ErrNoSignerOpts = errors.New("crypto11: no signer options and no DefaultSignerOpts configured")
+
+// ErrKeyNotExtractable is returned by ExportSecretKey when the token will not reveal the key's value.
+var ErrKeyNotExtractable = errors.New("crypto11: key value cannot be read from the token")
+
+// ErrEmptyLabelPrefix is returned by DestroyByLabelPrefix when the prefix is empty,
+// since that would match every key on the token.
+var ErrEmptyLabelPrefix = errors.New("crypto11: empty label prefix")
+
 // PKCS11Object contains a reference to a loaded PKCS#11 object.
 type PKCS11Object struct {
 	// The PKCS#11 object handle.
@@ -121,16 +279,66 @@ type PKCS11Object struct {
 	// The PKCS#11 slot number.
 	//
 	// This is used internally to find a session handle that can
-	// access this object.
+	// access this object. It may also be read to tell which token
+	// the object is on, e.g. with SlotOf; the ...OnSlot functions
+	// take the same value.
 	Slot uint
+
+	// The configuration the handle belongs to (see libCtx.generation),
+	// or 0 if not known
+	generation uint64
+
+	// CKA_ID and CKA_LABEL, if known when the object was found or
+	// created; only used to annotate errors (see wrapError). A pointer,
+	// so that PKCS11Object stays comparable.
+	identity *objectIdentity
+}
+
+// objectIdentity is the CKA_ID and CKA_LABEL of an object.
+type objectIdentity struct {
+	id, label []byte
+}
+
+// newObject returns a reference to an object, belonging to the current configuration.
+func newObject(handle pkcs11.ObjectHandle, slot uint) PKCS11Object {
+	return PKCS11Object{Handle: handle, Slot: slot, generation: instance.generation}
+}
+
+// withIdentity records the object's CKA_ID and CKA_LABEL for error reports.
+func (object PKCS11Object) withIdentity(id, label []byte) PKCS11Object {
+	object.identity = &objectIdentity{id, label}
+	return object
+}
+
+// checkLive returns ErrStaleObject if the object belongs to an earlier configuration.
+//
+// Handles do not survive Close, so once the library has been
+// reconfigured the same handle may refer to a different object, or
+// none.
+func (object *PKCS11Object) checkLive() error {
+	if object.generation != 0 && object.generation != instance.generation {
+		return ErrStaleObject
+	}
+	return nil
 }
 
 // PKCS11PrivateKey contains a reference to a loaded PKCS#11 private key object.
+//
+// Public() and the exported fields are served from the struct and never
+// contact the token. Info() contacts the token the first time it is
+// called and caches the result. Identify(), Valid() and the
+// cryptographic operations always contact the token.
 type PKCS11PrivateKey struct {
 	PKCS11Object
 
 	// The corresponding public key
 	PubKey crypto.PublicKey
+
+	// Permitted operations, or nil if not known
+	usage *keyUsage
+
+	// Cached result of Info(), or nil if not cached
+	info *keyInfoCache
 }
 
 // In a former design we carried around the object handle for the
@@ -154,52 +362,387 @@ type libCtx struct {
 
 	token *pkcs11.TokenInfo
 	slot  uint
+
+	// True if this configuration holds a login on its token (see loginRegistry)
+	loggedIn bool
+
+	// Incremented by each Configure, so that objects from an earlier
+	// configuration can be recognized
+	generation uint64
+}
+
+const (
+	// MatchByEither identifies a token by serial number or, if no
+	// token has that serial number, by label.
+	MatchByEither = "either"
+
+	// MatchBySerial identifies a token by serial number only.
+	MatchBySerial = "serial"
+
+	// MatchByLabel identifies a token by label only.
+	MatchByLabel = "label"
+)
+
+const (
+	// AmbiguityFirst selects the matching token in the lowest-numbered slot
+	// when several tokens match.
+	AmbiguityFirst = "first"
+
+	// AmbiguityError makes Configure fail with ErrMultipleTokensMatch
+	// when several tokens match.
+	AmbiguityError = "error"
+)
+
+// TokenCandidate describes a token that matched the configured serial number or label,
+// or, as returned by ListSlots, a token that is present.
+type TokenCandidate struct {
+	Slot      uint
+	TokenInfo pkcs11.TokenInfo
+}
+
+// ErrMultipleTokensMatch is returned when several tokens match the
+// configuration and OnAmbiguity is AmbiguityError.
+type ErrMultipleTokensMatch struct {
+	// The matching tokens, in slot order
+	Candidates []TokenCandidate
+}
+
+func (e *ErrMultipleTokensMatch) Error() string {
+	slots := make([]string, len(e.Candidates))
+	for i, c := range e.Candidates {
+		slots[i] = fmt.Sprintf("%d (serial %q label %q)", c.Slot, c.TokenInfo.SerialNumber, c.TokenInfo.Label)
+	}
+	return "crypto11: multiple tokens match: slots " + strings.Join(slots, ", ")
 }
 
-// Find a token given its serial number
-func findToken(slots []uint, serial string, label string) (uint, *pkcs11.TokenInfo, error) {
-	for _, slot := range slots {
-		tokenInfo, err := instance.ctx.GetTokenInfo(slot)
+// Find a token given its serial number and/or label
+func findToken(ctx *pkcs11.Ctx, slots []uint, config *PKCS11Config) (uint, *pkcs11.TokenInfo, error) {
+	var bySerial, byLabel bool
+	switch config.MatchBy {
+	case "", MatchByEither:
+		bySerial, byLabel = true, true
+	case MatchBySerial:
+		bySerial = true
+	case MatchByLabel:
+		byLabel = true
+	default:
+		return 0, nil, fmt.Errorf("crypto11: unrecognized MatchBy value %q", config.MatchBy)
+	}
+	switch config.OnAmbiguity {
+	case "", AmbiguityFirst, AmbiguityError:
+	default:
+		return 0, nil, fmt.Errorf("crypto11: unrecognized OnAmbiguity value %q", config.OnAmbiguity)
+	}
+	if config.SlotNumber != nil {
+		return findTokenInSlot(ctx, slots, config, bySerial, byLabel)
+	}
+	// Slot order is the only stable order we have
+	sorted := append([]uint(nil), slots...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	// Serial numbers are checked first: a label is only used if no
+	// token has the serial number
+	var candidates, labelCandidates []TokenCandidate
+	for _, slot := range sorted {
+		tokenInfo, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			return 0, nil, err
+		}
+		if bySerial && tokenInfo.SerialNumber == config.TokenSerial {
+			candidates = append(candidates, TokenCandidate{slot, tokenInfo})
+		} else if byLabel && tokenInfo.Label == config.TokenLabel {
+			labelCandidates = append(labelCandidates, TokenCandidate{slot, tokenInfo})
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = labelCandidates
+	}
+	switch {
+	case len(candidates) == 0:
+		return 0, nil, ErrTokenNotFound
+	case len(candidates) == 1:
+		return candidates[0].Slot, &candidates[0].TokenInfo, nil
+	case config.SessionSelector != nil:
+		slot, err := selectWithSessions(ctx, candidates, config)
+		if err != nil {
+			return 0, nil, err
+		}
+		return pickCandidate(candidates, slot, "SessionSelector")
+	case config.SlotSelector != nil:
+		slot, err := config.SlotSelector(candidates)
 		if err != nil {
 			return 0, nil, err
 		}
-		if tokenInfo.SerialNumber == serial {
-			return slot, &tokenInfo, nil
+		return pickCandidate(candidates, slot, "SlotSelector")
+	case config.OnAmbiguity == AmbiguityError:
+		return 0, nil, &ErrMultipleTokensMatch{candidates}
+	default:
+		return candidates[0].Slot, &candidates[0].TokenInfo, nil
+	}
+}
+
+// pickCandidate returns the candidate in slot, as chosen by the named selector.
+func pickCandidate(candidates []TokenCandidate, slot uint, selector string) (uint, *pkcs11.TokenInfo, error) {
+	for _, c := range candidates {
+		if c.Slot == slot {
+			return c.Slot, &c.TokenInfo, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("crypto11: %s chose slot %d, which is not a candidate", selector, slot)
+}
+
+// selectWithSessions calls SessionSelector with a session on each candidate, logged in if the token needs it.
+//
+// The sessions are closed again afterwards.
+func selectWithSessions(ctx *pkcs11.Ctx, candidates []TokenCandidate, config *PKCS11Config) (uint, error) {
+	sessions := make([]*PKCS11Session, 0, len(candidates))
+	defer func() {
+		for _, session := range sessions {
+			ctx.CloseSession(session.Handle)
+		}
+	}()
+	for _, c := range candidates {
+		handle, err := ctx.OpenSession(c.Slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err = traceCall("C_OpenSession", nil, err); err != nil {
+			return 0, err
+		}
+		sessions = append(sessions, &PKCS11Session{ctx, handle})
+		if !loginRequired(c.TokenInfo.Flags, config) {
+			continue
+		}
+		if err = checkPINFinalTry(c.TokenInfo.Flags, config); err != nil {
+			return 0, err
 		}
-		if tokenInfo.Label == label {
-			return slot, &tokenInfo, nil
+		err = traceCall("C_Login", nil, ctx.Login(handle, pkcs11.CKU_USER, config.Pin))
+		if code, ok := err.(pkcs11.Error); ok && code == pkcs11.CKR_USER_ALREADY_LOGGED_IN {
+			err = nil
+		}
+		if err != nil {
+			return 0, pinError(err)
 		}
 	}
-	return 0, nil, ErrTokenNotFound
+	return config.SessionSelector(candidates, sessions)
+}
+
+// Find the token in the slot given by SlotNumber
+//
+// If a serial number or label is also configured then the token must
+// match it as well.
+func findTokenInSlot(ctx *pkcs11.Ctx, slots []uint, config *PKCS11Config, bySerial bool, byLabel bool) (uint, *pkcs11.TokenInfo, error) {
+	slot := *config.SlotNumber
+	present := false
+	for _, s := range slots {
+		if s == slot {
+			present = true
+			break
+		}
+	}
+	if !present {
+		return 0, nil, tokenNotPresentError(slot)
+	}
+	tokenInfo, err := ctx.GetTokenInfo(slot)
+	if err != nil {
+		return 0, nil, err
+	}
+	if config.TokenSerial != "" || config.TokenLabel != "" {
+		if !(bySerial && tokenInfo.SerialNumber == config.TokenSerial) && !(byLabel && tokenInfo.Label == config.TokenLabel) {
+			return 0, nil, ErrTokenNotFound
+		}
+	}
+	return slot, &tokenInfo, nil
+}
+
+// tokenNotPresentError is returned when the slot given by SlotNumber has no token.
+type tokenNotPresentError uint
+
+func (e tokenNotPresentError) Error() string {
+	return fmt.Sprintf("crypto11: no token present in slot %d", uint(e))
+}
+
+// Find the configured token, retrying while it is not ready
+//
+// The token not being found, or the library reporting that it is not
+// initialized, may just mean the token has not appeared yet. These are
+// retried StartupRetries times, waiting StartupRetryDelay (by default
+// one second) before the first retry and twice as long before each
+// one after. Other errors are returned at once.
+func findTokenWithRetry(ctx *pkcs11.Ctx, config *PKCS11Config) (uint, *pkcs11.TokenInfo, error) {
+	delay := config.StartupRetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		slot, token, err := findTokenOnce(ctx, config)
+		if err == nil || attempt >= config.StartupRetries || !startupRetryable(err) {
+			return slot, token, err
+		}
+		log.Printf("PKCS#11 token not ready, retrying in %v: %s", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// List the slots and find the configured token among them
+func findTokenOnce(ctx *pkcs11.Ctx, config *PKCS11Config) (uint, *pkcs11.TokenInfo, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		log.Printf("Failed to list PKCS#11 Slots: %s", err.Error())
+		if code, ok := err.(pkcs11.Error); ok && code == pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED {
+			// Give the library another chance before the retry
+			traceCall("C_Initialize", nil, ctx.Initialize())
+		}
+		return 0, nil, err
+	}
+	return findToken(ctx, slots, config)
+}
+
+// startupRetryable reports whether an error finding the token may go away if Configure waits.
+func startupRetryable(err error) bool {
+	switch e := err.(type) {
+	case tokenNotPresentError:
+		return true
+	case pkcs11.Error:
+		return e == pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED || e == pkcs11.CKR_TOKEN_NOT_PRESENT || e == pkcs11.CKR_DEVICE_REMOVED
+	}
+	return err == ErrTokenNotFound
 }
 
 // PKCS11Config holds PKCS#11 configuration information.
 //
 // A token may be identified either by serial number or label.  If
-// both are specified then the first match wins.
+// both are specified then the serial number is tried first, and the
+// label only if no token has that serial number, unless MatchBy
+// restricts matching to one or the other. If several tokens
+// match, SessionSelector or SlotSelector (if set) picks one;
+// otherwise OnAmbiguity decides.
+//
+// Alternatively the token may be identified by its slot ID, given as
+// SlotNumber.
 //
 // Supply this to Configure(), or alternatively use ConfigureFromFile().
 type PKCS11Config struct {
 	// Full path to PKCS#11 library
 	Path string
 
+	// If true, Path is replaced by a short hash of it in log messages
+	// and errors, e.g. if it contains a license token.
+	RedactPath bool
+
 	// Token serial number
 	TokenSerial string
 
 	// Token label
 	TokenLabel string
 
+	// Slot ID of the token, for instance as returned by ListSlots. If
+	// set, the token must be present in this slot, and must also match
+	// TokenSerial or TokenLabel if either is set.
+	SlotNumber *uint
+
+	// Number of times Configure retries finding the token if it is
+	// not present yet, or the library reports that it is not ready
+	// (0 for no retries). Failing to load the library is not retried.
+	StartupRetries int
+
+	// Delay before Configure's first retry; each later retry waits
+	// twice as long as the one before. The default is one second.
+	StartupRetryDelay time.Duration
+
+	// How to match the token: MatchByEither (the default, if empty),
+	// MatchBySerial or MatchByLabel
+	MatchBy string
+
 	// User PIN (password)
 	Pin string
 
+	// If true, log in with Pin even if the token does not set
+	// CKF_LOGIN_REQUIRED, for tokens that misreport the flag or that
+	// only need a login for some objects. Otherwise such a token is
+	// not logged in, and operations that need it fail.
+	ForceLogin bool
+
+	// If true, Configure logs in even if the token sets
+	// CKF_USER_PIN_FINAL_TRY. Otherwise it fails with ErrPINFinalTry,
+	// so that a wrong PIN cannot lock the token.
+	AllowPINFinalTry bool
+
+	// CKA_ID of the key returned by ConfiguredKey, as a hex or base64
+	// string
+	KeyID string
+
 	// Maximum number of concurrent sessions to open
 	MaxSessions int
 
 	// Session idle timeout to be evicted from the pool
 	IdleTimeout time.Duration
 
+	// Minimum number of sessions to keep open when IdleTimeout is set.
+	// These are checked with the token every IdleTimeout/2, so that
+	// the token does not time them out either.
+	MinSessions int
+
 	// Maximum time allowed to wait a sessions pool for a session
 	PoolWaitTimeout time.Duration
+
+	// If true, an operation that finds all MaxSessions sessions of a
+	// slot in use fails at once with ErrPoolExhausted, rather than
+	// waiting (for up to PoolWaitTimeout) for one to be returned.
+	// Sessions briefly borrowed to keep MinSessions alive, and
+	// sessions abandoned after SignTimeout until their call returns,
+	// count as in use.
+	StrictSessions bool
+
+	// Maximum time allowed for FindKeyPair and FindKey to search
+	// the token (0 for no limit). A search that takes longer returns
+	// ErrFindTimeout but keeps its session busy until the token
+	// finishes it.
+	FindTimeout time.Duration
+
+	// Maximum time allowed for a signing operation on the token (0 for
+	// no limit). A signature that takes longer returns
+	// ErrOperationTimeout, and its session is discarded.
+	SignTimeout time.Duration
+
+	// Per-key concurrency limits, keyed by hex-encoded CKA_ID. See
+	// PKCS11Object.SetMaxConcurrentOps.
+	MaxConcurrentOps map[string]int
+
+	// Key pairs to create, if missing, with ProvisionFromConfig
+	Keys []KeyTemplate
+
+	// Number of recent PKCS#11 calls to record for Dump (0 to disable)
+	TraceSize int
+
+	// Number of RSA PKCS#1 v1.5 signatures to remember (0 to disable),
+	// so that signing the same digest again with the same key does not
+	// use the token. Randomized signatures (PSS, ECDSA, DSA) are never
+	// cached. Signatures are remembered by the key's handle and CKA_ID,
+	// and are discarded when this package destroys the key; do not
+	// enable the cache if another application may replace keys with
+	// new ones under the same CKA_ID.
+	SignatureCacheSize int
+
+	// What to do when several tokens match: AmbiguityFirst (the
+	// default, if empty) or AmbiguityError
+	OnAmbiguity string
+
+	// If not nil, called to choose between several matching tokens.
+	// It must return the slot of one of the candidates.
+	SlotSelector func(candidates []TokenCandidate) (uint, error) `json:"-"`
+
+	// If not nil, called instead of SlotSelector to choose between
+	// several matching tokens, with a session on each candidate (in
+	// the same order), logged in with Pin if the token needs it. This
+	// allows tokens that share every identifier in CK_TOKEN_INFO, such
+	// as cloned tokens, to be told apart by objects or attributes that
+	// can only be read after login. It must return the slot of one of
+	// the candidates. The sessions are closed when it returns.
+	SessionSelector func(candidates []TokenCandidate, sessions []*PKCS11Session) (uint, error) `json:"-"`
+
+	// Signer options to use when Sign and the other signing and
+	// verification methods are passed nil opts, e.g. a
+	// *rsa.PSSOptions to make PSS with SHA-256 the default. It can
+	// only be set from Go.
+	DefaultSignerOpts crypto.SignerOpts `json:"-"`
 }
 
 // Configure configures PKCS#11 from a PKCS11Config.
@@ -217,9 +760,21 @@ type PKCS11Config struct {
 // If config is nil, and the library has already been configured, the
 // context from the first configuration is returned (and
 // the error will be nil in this case).
+//
+// Configure keeps its own copy of config, so the caller's value is not
+// modified (e.g. by SetPIN) and later changes to it have no effect.
 func Configure(config *PKCS11Config) (*pkcs11.Ctx, error) {
+	configuring.Lock()
+	defer configuring.Unlock()
+	return configure(config)
+}
+
+// Serializes Configure, ConfigureContext and Close
+var configuring sync.Mutex
+
+// configure is Configure for a caller that holds configuring.
+func configure(config *PKCS11Config) (*pkcs11.Ctx, error) {
 	var err error
-	var slots []uint
 
 	if config == nil {
 		if instance.ctx != nil {
@@ -231,31 +786,45 @@ func Configure(config *PKCS11Config) (*pkcs11.Ctx, error) {
 		log.Printf("PKCS#11 library already configured")
 		return instance.ctx, nil
 	}
+	copied := *config
+	config = &copied
 
 	if config.MaxSessions == 0 {
 		config.MaxSessions = DefaultMaxSessions
 	}
+	if config.KeyID != "" {
+		if _, err = decodeKeyID(config.KeyID); err != nil {
+			return nil, err
+		}
+	}
 	instance.cfg = config
+	if config.TraceSize > 0 {
+		EnableTrace(config.TraceSize)
+	}
+	instance.generation++
 	instance.ctx = pkcs11.New(config.Path)
 	if instance.ctx == nil {
-		log.Printf("Could not open PKCS#11 library: %s", config.Path)
+		log.Printf("Could not open PKCS#11 library: %s", displayPath(config))
 		return nil, ErrCannotOpenPKCS11
 	}
-	if err = instance.ctx.Initialize(); err != nil {
+	// pkcs11.Ctx.Initialize passes CK_C_INITIALIZE_ARGS with
+	// CKF_OS_LOCKING_OK set (and no mutex callbacks), which is what
+	// this package needs since sessions are used from many goroutines.
+	// Keep it that way if the pkcs11 dependency is ever updated.
+	if err = traceCall("C_Initialize", nil, instance.ctx.Initialize()); err != nil {
 		log.Printf("Failed to initialize PKCS#11 library: %s", err.Error())
 		return nil, err
 	}
-	if slots, err = instance.ctx.GetSlotList(true); err != nil {
-		log.Printf("Failed to list PKCS#11 Slots: %s", err.Error())
-		return nil, err
-	}
-
-	instance.slot, instance.token, err = findToken(slots, config.TokenSerial, config.TokenLabel)
+	instance.slot, instance.token, err = findTokenWithRetry(instance.ctx, config)
 	if err != nil {
 		log.Printf("Failed to find Token in any Slot: %s", err.Error())
 		return nil, err
 	}
 
+	if instance.cfg.MinSessions > instance.cfg.MaxSessions {
+		return nil, fmt.Errorf("crypto11: min sessions value (%d) exceeds max sessions value (%d)", instance.cfg.MinSessions, instance.cfg.MaxSessions)
+	}
+
 	if instance.token.MaxRwSessionCount > 0 && uint(instance.cfg.MaxSessions) > instance.token.MaxRwSessionCount {
 		return nil, fmt.Errorf("crypto11: provided max sessions value (%d) exceeds max value the token supports (%d)", instance.cfg.MaxSessions, instance.token.MaxRwSessionCount)
 	}
@@ -264,19 +833,61 @@ func Configure(config *PKCS11Config) (*pkcs11.Ctx, error) {
 		return nil, err
 	}
 
-	// login required if a pool evict idle sessions (handled by the pool) or
-	// for the first connection in the pool (handled here)
-	if instance.cfg.IdleTimeout == 0 {
-		if instance.token.Flags&pkcs11.CKF_LOGIN_REQUIRED != 0 && instance.cfg.Pin != "" {
-			if err = withSession(instance.slot, loginToken); err != nil {
-				return nil, err
-			}
-		}
+	if err = login(); err != nil {
+		return nil, err
 	}
 
 	return instance.ctx, nil
 }
 
+// login logs in to the configured token, if it needs it and there is a PIN.
+func login() error {
+	// The configuration holds a login, shared with any other users of
+	// the token; if the pool evicts idle sessions, new ones restore it
+	if loginRequired(instance.token.Flags, instance.cfg) {
+		if err := withSession(instance.slot, func(s *PKCS11Session) error {
+			return logins.acquire(instance, s, instance.slot)
+		}); err != nil {
+			return err
+		}
+		instance.loggedIn = true
+	}
+	return nil
+}
+
+// defaultSignerOpts returns opts, or DefaultSignerOpts if opts is nil.
+func defaultSignerOpts(opts crypto.SignerOpts) (crypto.SignerOpts, error) {
+	if opts != nil {
+		return opts, nil
+	}
+	if instance.cfg != nil && instance.cfg.DefaultSignerOpts != nil {
+		return instance.cfg.DefaultSignerOpts, nil
+	}
+	return nil, ErrNoSignerOpts
+}
+
+// displayPath returns the library path to use in diagnostics, redacted if config asks for it.
+func displayPath(config *PKCS11Config) string {
+	if !config.RedactPath {
+		return config.Path
+	}
+	sum := sha256.Sum256([]byte(config.Path))
+	return fmt.Sprintf("<redacted %x>", sum[:4])
+}
+
+// checkPINFinalTry returns ErrPINFinalTry if a wrong PIN would lock the token and config does not allow the risk.
+func checkPINFinalTry(flags uint, config *PKCS11Config) error {
+	if flags&pkcs11.CKF_USER_PIN_FINAL_TRY != 0 && !config.AllowPINFinalTry {
+		return ErrPINFinalTry
+	}
+	return nil
+}
+
+// loginRequired reports whether to log in to a token with the given CK_TOKEN_INFO flags.
+func loginRequired(flags uint, config *PKCS11Config) bool {
+	return config.Pin != "" && (flags&pkcs11.CKF_LOGIN_REQUIRED != 0 || config.ForceLogin)
+}
+
 // ConfigureFromFile configures PKCS#11 from a name configuration file.
 //
 // Configuration files are a JSON representation of the PKCSConfig object.
@@ -292,19 +903,130 @@ func ConfigureFromFile(configLocation string) (*pkcs11.Ctx, error) {
 		return nil, err
 	}
 	defer file.Close()
-	configDecoder := json.NewDecoder(file)
+	return ConfigureFromReader(file)
+}
+
+// ConfigureFromReader configures PKCS#11 from a JSON representation
+// of the PKCS11Config object, read from r.
+//
+// This allows a configuration (which may contain the PIN) to be
+// supplied from memory rather than from the filesystem.
+// The return value is as for Configure().
+func ConfigureFromReader(r io.Reader) (*pkcs11.Ctx, error) {
+	configDecoder := json.NewDecoder(r)
 	config := &PKCS11Config{}
-	err = configDecoder.Decode(config)
+	err := configDecoder.Decode(config)
 	if err != nil {
-		log.Printf("Could decode config file: %s", err.Error())
+		log.Printf("Could not decode config: %s", err.Error())
 		return nil, err
 	}
 	return Configure(config)
 }
 
+// Logout releases the login held by the configured token.
+//
+// Login state is shared by everything using the same token via the
+// same library, so the token is only actually logged out (C_Logout)
+// when the last user of it releases its login.
+func Logout() error {
+	if instance.ctx == nil {
+		return ErrNotConfigured
+	}
+	if !instance.loggedIn {
+		return nil
+	}
+	if err := withSession(instance.slot, func(s *PKCS11Session) error {
+		return logins.release(s, instance.slot)
+	}); err != nil {
+		return err
+	}
+	instance.loggedIn = false
+	return nil
+}
+
+// RefreshSessions closes the configured token's sessions and opens fresh ones.
+//
+// This is for recovery after the token has been through maintenance or
+// an HSM failover, or its PIN has been changed behind this package's
+// back (set the new one in the configuration first), leaving the
+// pooled sessions stale or logged out. The token information is read
+// again and the token is logged in again with the configured PIN. The
+// library itself stays initialized, so object handles remain valid.
+//
+// Closing the sessions logs the token out for every user of it within
+// this process, and any operation in progress fails.
+func RefreshSessions() error {
+	if instance.ctx == nil {
+		return ErrNotConfigured
+	}
+	slot := instance.slot
+	if err := pool.closeSessions(slot); err != nil && err != errPoolNotFound {
+		return err
+	}
+	if err := traceCall("C_CloseAllSessions", nil, instance.ctx.CloseAllSessions(slot)); err != nil {
+		return err
+	}
+	logins.forgetSlot(instance.ctx, slot)
+	instance.loggedIn = false
+	tokenInfo, err := instance.ctx.GetTokenInfo(slot)
+	if err != nil {
+		return err
+	}
+	instance.token = &tokenInfo
+	if err = setupSessions(instance, slot); err != nil {
+		return err
+	}
+	return login()
+}
+
+// SetPIN changes the user PIN of the configured token.
+//
+// On success the new PIN is also used for any subsequent automatic
+// login. The PKCS11Config passed to Configure is not changed.
+// PIN-related failures are reported as ErrPINIncorrect,
+// ErrPINLenRange, ErrPINInvalid or ErrPINLocked; other errors are
+// returned as the PKCS#11 library reported them.
+func SetPIN(oldPIN string, newPIN string) error {
+	if instance.ctx == nil {
+		return ErrNotConfigured
+	}
+	if err := withSession(instance.slot, func(session *PKCS11Session) error {
+		return traceCall("C_SetPIN", nil, session.Ctx.SetPIN(session.Handle, oldPIN, newPIN))
+	}); err != nil {
+		return pinError(err)
+	}
+	instance.cfg.Pin = newPIN
+	return nil
+}
+
+// pinError translates PIN-related PKCS#11 errors into crypto11 errors.
+func pinError(err error) error {
+	if code, ok := err.(pkcs11.Error); ok {
+		switch code {
+		case pkcs11.CKR_PIN_INCORRECT:
+			return ErrPINIncorrect
+		case pkcs11.CKR_PIN_LEN_RANGE:
+			return ErrPINLenRange
+		case pkcs11.CKR_PIN_INVALID:
+			return ErrPINInvalid
+		case pkcs11.CKR_PIN_LOCKED:
+			return ErrPINLocked
+		}
+	}
+	return err
+}
+
 // Close releases all sessions and uninitializes library default handle.
 // Once library handle is released, library may be configured once again.
+//
+// Cached state that depends on the library, such as per-key
+// concurrency limits, mechanism lists, cached signatures and the keys
+// found by FindAndSign, is discarded. Objects found or created before
+// Close cannot be used after a later Configure; their operations
+// return ErrStaleObject.
 func Close() error {
+	configuring.Lock()
+	defer configuring.Unlock()
 	ctx := instance.ctx
 	if ctx != nil {
 		slots, err := ctx.GetSlotList(true)
@@ -326,6 +1048,13 @@ func Close() error {
 			return err
 		}
 
+		// Closing the sessions logged out the token, whoever else was using it
+		logins.forget(ctx)
+		instance.loggedIn = false
+		limits.reset()
+		mechanisms.reset()
+		signers.reset()
+		signatures.reset()
 		ctx.Destroy()
 		instance.ctx = nil
 	}
@@ -22,13 +22,21 @@
 package crypto11
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/miekg/pkcs11"
+	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -44,6 +52,107 @@ func TestInitializeFromConfig(t *testing.T) {
 	Close()
 }
 
+func TestConfigureFromReader(t *testing.T) {
+	data, err := ioutil.ReadFile("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ConfigureFromReader(bytes.NewReader(data)); err != nil {
+		t.Fatal("failed to configure service:", err)
+	}
+	if err = Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatchBy(t *testing.T) {
+	cfg, err := getConfig("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TokenLabel == "" {
+		t.Skip("configuration does not identify the token by label")
+	}
+	cfg.TokenSerial = "NoSuchSerial"
+	cfg.MatchBy = MatchBySerial
+	if _, err = Configure(cfg); err != ErrTokenNotFound {
+		t.Errorf("Configure with MatchBySerial: got %v, want ErrTokenNotFound", err)
+	}
+	Close()
+	cfg.MatchBy = MatchByLabel
+	if _, err = Configure(cfg); err != nil {
+		t.Errorf("Configure with MatchByLabel: %v", err)
+	}
+	Close()
+	// No token has the serial number, so the label is used
+	cfg.MatchBy = MatchByEither
+	if _, err = Configure(cfg); err != nil {
+		t.Errorf("Configure with MatchByEither: %v", err)
+	}
+	Close()
+}
+
+func TestOnAmbiguity(t *testing.T) {
+	cfg, err := getConfig("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A single matching token is not ambiguous
+	cfg.OnAmbiguity = AmbiguityError
+	cfg.SlotSelector = func(candidates []TokenCandidate) (uint, error) {
+		t.Errorf("SlotSelector called with %d candidates", len(candidates))
+		return candidates[0].Slot, nil
+	}
+	if _, err = Configure(cfg); err != nil {
+		t.Errorf("Configure with AmbiguityError: %v", err)
+	}
+	Close()
+	cfg.OnAmbiguity = "random"
+	if _, err = Configure(cfg); err == nil {
+		t.Errorf("Configure with unrecognized OnAmbiguity: no error")
+	}
+	Close()
+	e := &ErrMultipleTokensMatch{[]TokenCandidate{{Slot: 1}, {Slot: 2}}}
+	if !strings.Contains(e.Error(), "slots 1 ") || !strings.Contains(e.Error(), ", 2 ") {
+		t.Errorf("ErrMultipleTokensMatch.Error: %q", e.Error())
+	}
+}
+
+func TestSessionSelector(t *testing.T) {
+	cfg, err := getConfig("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	candidates := []TokenCandidate{{instance.slot, *instance.token}}
+	cfg.SessionSelector = func(candidates []TokenCandidate, sessions []*PKCS11Session) (uint, error) {
+		if len(sessions) != len(candidates) {
+			t.Fatalf("SessionSelector: %d sessions for %d candidates", len(sessions), len(candidates))
+		}
+		info, err := sessions[0].Ctx.GetSessionInfo(sessions[0].Handle)
+		if err != nil {
+			t.Fatalf("GetSessionInfo: %v", err)
+		}
+		if loginRequired(candidates[0].TokenInfo.Flags, cfg) && info.State != 3 { // CKS_RW_USER_FUNCTIONS
+			t.Errorf("SessionSelector: session state %d, want logged in", info.State)
+		}
+		return candidates[0].Slot, nil
+	}
+	slot, err := selectWithSessions(instance.ctx, candidates, cfg)
+	if err != nil {
+		t.Fatalf("selectWithSessions: %v", err)
+	}
+	if slot != instance.slot {
+		t.Errorf("selectWithSessions: got slot %d, want %d", slot, instance.slot)
+	}
+	if _, _, err = pickCandidate(candidates, instance.slot+1, "SessionSelector"); err == nil {
+		t.Errorf("pickCandidate: accepted a slot that is not a candidate")
+	}
+}
+
 func TestLoginContext(t *testing.T) {
 	t.Run("key identity with login", func(t *testing.T) {
 		configureWithPin(t)
@@ -190,6 +299,589 @@ func TestIdentityExpiration(t *testing.T) {
 		if perr, ok := err.(pkcs11.Error); !ok || perr != pkcs11.CKR_OBJECT_HANDLE_INVALID {
 			t.Fatal("failed to generate a key, unexpected error:", err)
 		}
+		if key.Valid() {
+			t.Fatal("key reported valid despite invalid handle")
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	configureWithPin(t)
+	defer Close()
+
+	key, err := GenerateDSAKeyPair(dsaSizes[dsa.L1024N160])
+	if err != nil {
+		t.Fatalf("crypto11.GenerateDSAKeyPair: %v", err)
+	}
+	if !key.Valid() {
+		t.Fatal("freshly generated key reported invalid")
+	}
+	stale := *key
+	stale.Handle = ^pkcs11.ObjectHandle(0)
+	if stale.Valid() {
+		t.Fatal("bogus handle reported valid")
+	}
+}
+
+func TestObjectError(t *testing.T) {
+	configureWithPin(t)
+	defer Close()
+
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("crypto11.GenerateECDSAKeyPair: %v", err)
+	}
+	id, label, err := key.Identify()
+	if err != nil {
+		t.Fatalf("key.Identify: %v", err)
+	}
+	// An RSA mechanism cannot be used with an EC key
+	_, err = key.SignWithMechanism(pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil), []byte("data"))
+	oerr, ok := err.(*ObjectError)
+	if !ok {
+		t.Fatalf("SignWithMechanism: got %v, want an *ObjectError", err)
+	}
+	if oerr.Slot != key.Slot || oerr.Handle != key.Handle {
+		t.Errorf("ObjectError: slot %d handle %d, want slot %d handle %d", oerr.Slot, oerr.Handle, key.Slot, key.Handle)
+	}
+	if !bytes.Equal(oerr.ID, id) || !bytes.Equal(oerr.Label, label) {
+		t.Errorf("ObjectError: id %x label %q, want id %x label %q", oerr.ID, oerr.Label, id, label)
+	}
+	if _, ok := oerr.Err.(pkcs11.Error); !ok {
+		t.Errorf("ObjectError: underlying error %v is not a pkcs11.Error", oerr.Err)
+	}
+}
+
+func TestFindKeyPairWithTemplate(t *testing.T) {
+	configureWithPin(t)
+	defer Close()
+
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("crypto11.GenerateECDSAKeyPair: %v", err)
+	}
+	_, label, err := key.Identify()
+	if err != nil {
+		t.Fatalf("key.Identify: %v", err)
+	}
+	found, err := FindKeyPairWithTemplate([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	})
+	if err != nil {
+		t.Fatalf("crypto11.FindKeyPairWithTemplate: %v", err)
+	}
+	if ok, err := publicKeysEqual(found.(crypto.Signer).Public(), key.Public()); err != nil || !ok {
+		t.Errorf("crypto11.FindKeyPairWithTemplate: found the wrong key (%v)", err)
+	}
+	// The template's class replaces the default
+	_, err = FindKeyPairWithTemplate([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_VENDOR_DEFINED),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	})
+	if err != ErrKeyNotFound {
+		t.Errorf("crypto11.FindKeyPairWithTemplate with vendor class: got %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestDestroyByLabelPrefix(t *testing.T) {
+	configureWithPin(t)
+	defer Close()
+
+	prefix, err := generateKeyLabel()
+	if err != nil {
+		t.Fatalf("generateKeyLabel: %v", err)
+	}
+	for _, suffix := range []string{"-a", "-b"} {
+		if _, err = GenerateECDSAKeyPairOnSlot(instance.slot, nil, append(prefix, suffix...), elliptic.P256()); err != nil {
+			t.Fatalf("crypto11.GenerateECDSAKeyPairOnSlot: %v", err)
+		}
+	}
+	// Same bytes but not a prefix
+	other := append([]byte("x"), prefix...)
+	if _, err = GenerateECDSAKeyPairOnSlot(instance.slot, nil, other, elliptic.P256()); err != nil {
+		t.Fatalf("crypto11.GenerateECDSAKeyPairOnSlot: %v", err)
+	}
+	n, err := DestroyByLabelPrefix(prefix)
+	if err != nil {
+		t.Fatalf("crypto11.DestroyByLabelPrefix: %v", err)
+	}
+	if n != 4 {
+		t.Errorf("crypto11.DestroyByLabelPrefix: destroyed %d objects, want 4", n)
+	}
+	if _, err = FindKeyPair(nil, append(prefix, "-a"...)); err != ErrKeyNotFound {
+		t.Errorf("crypto11.FindKeyPair after destroy: got %v, want ErrKeyNotFound", err)
+	}
+	if _, err = FindKeyPair(nil, other); err != nil {
+		t.Errorf("crypto11.FindKeyPair on non-matching label: %v", err)
+	}
+	if _, err = DestroyByLabelPrefix(nil); err != ErrEmptyLabelPrefix {
+		t.Errorf("crypto11.DestroyByLabelPrefix(nil): got %v, want ErrEmptyLabelPrefix", err)
+	}
+}
+
+func TestDeleteKeyPair(t *testing.T) {
+	configureWithPin(t)
+	defer Close()
+
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("crypto11.GenerateECDSAKeyPair: %v", err)
+	}
+	id, _, err := key.Identify()
+	if err != nil {
+		t.Fatalf("key.Identify: %v", err)
+	}
+	if err = key.Delete(); err != nil {
+		t.Fatalf("key.Delete: %v", err)
+	}
+	if key.Valid() {
+		t.Errorf("key.Valid: deleted key is still valid")
+	}
+	if _, err = FindKeyPair(id, nil); err != ErrKeyNotFound {
+		t.Errorf("crypto11.FindKeyPair after Delete: got %v, want ErrKeyNotFound", err)
+	}
+	err = withSession(instance.slot, func(session *PKCS11Session) error {
+		_, err := findKey(session, id, nil, pkcs11.CKO_PUBLIC_KEY, ^uint(0))
+		return err
+	})
+	if err != ErrKeyNotFound {
+		t.Errorf("public key after Delete: got %v, want ErrKeyNotFound", err)
+	}
+
+	label, err := generateKeyLabel()
+	if err != nil {
+		t.Fatalf("generateKeyLabel: %v", err)
+	}
+	if _, err = GenerateRSAKeyPairOnSlot(instance.slot, nil, label, 2048); err != nil {
+		t.Fatalf("crypto11.GenerateRSAKeyPairOnSlot: %v", err)
+	}
+	if err = DeleteKeyPair(nil, label); err != nil {
+		t.Fatalf("crypto11.DeleteKeyPair: %v", err)
+	}
+	if _, err = FindKeyPair(nil, label); err != ErrKeyNotFound {
+		t.Errorf("crypto11.FindKeyPair after DeleteKeyPair: got %v, want ErrKeyNotFound", err)
+	}
+	if err = DeleteKeyPair(nil, label); err != ErrKeyNotFound {
+		t.Errorf("crypto11.DeleteKeyPair again: got %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestUnsupportedKeyTypeError(t *testing.T) {
+	for keyType, want := range map[uint]string{
+		pkcs11.CKK_GOSTR3410:            "crypto11: unsupported key type CKK_GOSTR3410",
+		0x7f:                            "crypto11: unsupported key type 0x7f",
+		pkcs11.CKK_VENDOR_DEFINED + 0x2: "crypto11: unsupported key type CKK_VENDOR_DEFINED+0x2",
+	} {
+		if got := (&UnsupportedKeyTypeError{keyType}).Error(); got != want {
+			t.Errorf("UnsupportedKeyTypeError(%#x): got %q, want %q", keyType, got, want)
+		}
+	}
+}
+
+func TestFindAndValidateKeyPair(t *testing.T) {
+	configureWithPin(t)
+	defer Close()
+
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("crypto11.GenerateECDSAKeyPair: %v", err)
+	}
+	id, label, err := key.Identify()
+	if err != nil {
+		t.Fatalf("key.Identify: %v", err)
+	}
+	if _, err = FindAndValidateKeyPair(id, label, pkcs11.CKK_ECDSA); err != nil {
+		t.Errorf("crypto11.FindAndValidateKeyPair: %v", err)
+	}
+	if _, err = FindAndValidateKeyPair(id, nil, pkcs11.CKK_RSA); err != ErrKeyNotFound {
+		t.Errorf("crypto11.FindAndValidateKeyPair with wrong type: got %v, want ErrKeyNotFound", err)
+	}
+	// Destroyed between find and use
+	if err = withSession(key.Slot, func(session *PKCS11Session) error {
+		return session.Ctx.DestroyObject(session.Handle, key.Handle)
+	}); err != nil {
+		t.Fatalf("DestroyObject: %v", err)
+	}
+	if err = validateKeyPair(key, id, label, ^uint(0)); err != ErrKeyNotFound {
+		t.Errorf("validateKeyPair on destroyed key: got %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestIDString(t *testing.T) {
+	configureWithPin(t)
+	defer Close()
+
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("crypto11.GenerateECDSAKeyPair: %v", err)
+	}
+	id, _, err := key.Identify()
+	if err != nil {
+		t.Fatalf("key.Identify: %v", err)
+	}
+	s, err := key.IDString()
+	if err != nil {
+		t.Fatalf("key.IDString: %v", err)
+	}
+	if s != hex.EncodeToString(id) {
+		t.Errorf("key.IDString: got %q, want hex of %x", s, id)
+	}
+	for _, encoded := range []string{s, base64.RawURLEncoding.EncodeToString(id)} {
+		k, err := FindKeyPairByIDString(encoded)
+		if err != nil {
+			t.Errorf("crypto11.FindKeyPairByIDString(%q): %v", encoded, err)
+			continue
+		}
+		if k.(*PKCS11PrivateKeyECDSA).Handle != key.Handle {
+			t.Errorf("crypto11.FindKeyPairByIDString(%q) found a different key", encoded)
+		}
+	}
+}
+
+func TestFindKeyPairMatch(t *testing.T) {
+	configureWithPin(t)
+	defer Close()
+
+	k1, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("crypto11.GenerateECDSAKeyPair: %v", err)
+	}
+	k2, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("crypto11.GenerateECDSAKeyPair: %v", err)
+	}
+	id1, label1, err := k1.Identify()
+	if err != nil {
+		t.Fatalf("k1.Identify: %v", err)
+	}
+	_, label2, err := k2.Identify()
+	if err != nil {
+		t.Fatalf("k2.Identify: %v", err)
+	}
+	count := func(id, label []byte, mode MatchMode) int {
+		keys, err := FindKeyPairMatch(id, label, mode)
+		if err == ErrKeyNotFound {
+			return 0
+		}
+		if err != nil {
+			t.Fatalf("crypto11.FindKeyPairMatch: %v", err)
+		}
+		return len(keys)
+	}
+	if n := count(id1, label1, MatchAnd); n != 1 {
+		t.Errorf("MatchAnd with k1's ID and label: found %d keys, want 1", n)
+	}
+	if n := count(id1, label2, MatchAnd); n != 0 {
+		t.Errorf("MatchAnd with k1's ID and k2's label: found %d keys, want 0", n)
+	}
+	if n := count(id1, label2, MatchOr); n != 2 {
+		t.Errorf("MatchOr with k1's ID and k2's label: found %d keys, want 2", n)
+	}
+	// Both searches find k1, but it is returned once
+	if n := count(id1, label1, MatchOr); n != 1 {
+		t.Errorf("MatchOr with k1's ID and label: found %d keys, want 1", n)
+	}
+}
+
+func TestFindKeyPairByPrivateLabel(t *testing.T) {
+	configureWithPin(t)
+	defer Close()
+
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("crypto11.GenerateECDSAKeyPair: %v", err)
+	}
+	id, label, err := key.Identify()
+	if err != nil {
+		t.Fatalf("key.Identify: %v", err)
+	}
+	// The public key object no longer shares the private key's label
+	err = withSession(key.Slot, func(session *PKCS11Session) error {
+		pubHandle, err := findKey(session, id, nil, pkcs11.CKO_PUBLIC_KEY, pkcs11.CKK_ECDSA)
+		if err != nil {
+			return err
+		}
+		return session.Ctx.SetAttributeValue(session.Handle, pubHandle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, []byte("relabelled")),
+		})
+	})
+	if err != nil {
+		t.Fatalf("SetAttributeValue: %v", err)
+	}
+	k, err := FindKeyPair(nil, label)
+	if err != nil {
+		t.Fatalf("crypto11.FindKeyPair by label: %v", err)
+	}
+	got, want := k.(*PKCS11PrivateKeyECDSA).Public().(*ecdsa.PublicKey), key.Public().(*ecdsa.PublicKey)
+	if got.X.Cmp(want.X) != 0 || got.Y.Cmp(want.Y) != 0 {
+		t.Errorf("crypto11.FindKeyPair by label: wrong public key")
+	}
+}
+
+func TestConfiguredKey(t *testing.T) {
+	cfg, err := getConfig("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Configure(cfg); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	if _, err = ConfiguredKey(); err != ErrNoConfiguredKey {
+		t.Errorf("ConfiguredKey without KeyID: got %v, want ErrNoConfiguredKey", err)
+	}
+	id := []byte{0xc0, 0xf1, 0x93, 0x70}
+	key, err := GenerateECDSAKeyPairOnSlot(instance.slot, id, nil, elliptic.P256())
+	if err != nil {
+		t.Fatalf("crypto11.GenerateECDSAKeyPairOnSlot: %v", err)
+	}
+	Close()
+
+	for _, keyID := range []string{"c0f19370", "wPGTcA==", "wPGTcA"} {
+		cfg.KeyID = keyID
+		if _, err = Configure(cfg); err != nil {
+			t.Fatalf("Configure with KeyID %q: %v", keyID, err)
+		}
+		configured, err := ConfiguredKey()
+		if err != nil {
+			t.Errorf("ConfiguredKey with KeyID %q: %v", keyID, err)
+		} else if ok, _ := publicKeysEqual(configured.Public(), key.Public()); !ok {
+			t.Errorf("ConfiguredKey with KeyID %q: found the wrong key", keyID)
+		}
+		Close()
+	}
+
+	cfg.KeyID = "not an ID!"
+	if _, err = Configure(cfg); err == nil {
+		t.Errorf("Configure accepted an undecodable KeyID")
+	}
+	Close()
+}
+
+func TestStorageError(t *testing.T) {
+	if err := storageError(pkcs11.Error(pkcs11.CKR_DEVICE_MEMORY)); err != ErrTokenFull {
+		t.Errorf("storageError(CKR_DEVICE_MEMORY): got %v, want ErrTokenFull", err)
+	}
+	if err := storageError(pkcs11.Error(pkcs11.CKR_DEVICE_ERROR)); err != pkcs11.Error(pkcs11.CKR_DEVICE_ERROR) {
+		t.Errorf("storageError(CKR_DEVICE_ERROR): got %v", err)
+	}
+	if err := storageError(nil); err != nil {
+		t.Errorf("storageError(nil): got %v", err)
+	}
+}
+
+func TestKeyInfo(t *testing.T) {
+	configureWithPin(t)
+	defer Close()
+
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("crypto11.GenerateECDSAKeyPair: %v", err)
+	}
+	id, label, err := key.Identify()
+	if err != nil {
+		t.Fatalf("key.Identify: %v", err)
+	}
+	info, err := key.Info()
+	if err != nil {
+		t.Fatalf("key.Info: %v", err)
+	}
+	if !bytes.Equal(info.ID, id) || !bytes.Equal(info.Label, label) {
+		t.Errorf("Info: id %x label %q, want id %x label %q", info.ID, info.Label, id, label)
+	}
+	// Once cached, Info doesn't see changes on the token
+	err = withSession(key.Slot, func(session *PKCS11Session) error {
+		return session.Ctx.SetAttributeValue(session.Handle, key.Handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, []byte("relabelled")),
+		})
+	})
+	if err != nil {
+		t.Fatalf("SetAttributeValue: %v", err)
+	}
+	if info, err = key.Info(); err != nil {
+		t.Fatalf("key.Info: %v", err)
+	}
+	if !bytes.Equal(info.Label, label) {
+		t.Errorf("Info: label %q, want cached label %q", info.Label, label)
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	configureWithPin(t)
+	defer Close()
+
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("crypto11.GenerateECDSAKeyPair: %v", err)
+	}
+	id, label, err := key.Identify()
+	if err != nil {
+		t.Fatalf("key.Identify: %v", err)
+	}
+	keys, err := ListKeys()
+	if err != nil {
+		t.Fatalf("crypto11.ListKeys: %v", err)
+	}
+	found := 0
+	for _, k := range keys {
+		if bytes.Equal(k.ID, id) {
+			found++
+			if !bytes.Equal(k.Label, label) || k.KeyType != pkcs11.CKK_ECDSA {
+				t.Errorf("ListKeys: label %q type %#x, want label %q type CKK_ECDSA", k.Label, k.KeyType, label)
+			}
+		}
+	}
+	if found != 1 {
+		t.Errorf("ListKeys: found the key %d times, want once", found)
+	}
+}
+
+func TestFindKeyPairByUniqueID(t *testing.T) {
+	configureWithPin(t)
+	defer Close()
+
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("crypto11.GenerateECDSAKeyPair: %v", err)
+	}
+	supported, err := supportsUniqueID(instance.ctx)
+	if err != nil {
+		t.Fatalf("supportsUniqueID: %v", err)
+	}
+	if !supported {
+		if _, err = FindKeyPairByUniqueID([]byte("any")); err != ErrUniqueIDNotSupported {
+			t.Errorf("FindKeyPairByUniqueID: got %v, want ErrUniqueIDNotSupported", err)
+		}
+		t.Skip("library predates PKCS#11 v3.0")
+	}
+	info, err := key.Info()
+	if err != nil {
+		t.Fatalf("key.Info: %v", err)
+	}
+	if info.UniqueID == nil {
+		t.Skip("token does not report CKA_UNIQUE_ID")
+	}
+	k, err := FindKeyPairByUniqueID(info.UniqueID)
+	if err != nil {
+		t.Fatalf("FindKeyPairByUniqueID: %v", err)
+	}
+	if k.(*PKCS11PrivateKeyECDSA).Handle != key.Handle {
+		t.Errorf("FindKeyPairByUniqueID found a different key")
+	}
+}
+
+func TestLoginRequired(t *testing.T) {
+	cases := []struct {
+		flags      uint
+		pin        string
+		forceLogin bool
+		want       bool
+	}{
+		{pkcs11.CKF_LOGIN_REQUIRED, "1234", false, true},
+		{0, "1234", false, false},
+		{0, "1234", true, true},
+		{pkcs11.CKF_LOGIN_REQUIRED, "", true, false},
+	}
+	for _, c := range cases {
+		if got := loginRequired(c.flags, &PKCS11Config{Pin: c.pin, ForceLogin: c.forceLogin}); got != c.want {
+			t.Errorf("loginRequired(%#x, Pin %q, ForceLogin %v): got %v, want %v", c.flags, c.pin, c.forceLogin, got, c.want)
+		}
+	}
+}
+
+func TestDisplayPath(t *testing.T) {
+	path := "/opt/vendor/libpkcs11-LICENSE123.so"
+	if got := displayPath(&PKCS11Config{Path: path}); got != path {
+		t.Errorf("displayPath: got %q, want %q", got, path)
+	}
+	got := displayPath(&PKCS11Config{Path: path, RedactPath: true})
+	if strings.Contains(got, "LICENSE123") {
+		t.Errorf("displayPath: %q not redacted", got)
+	}
+	if other := displayPath(&PKCS11Config{Path: path + "x", RedactPath: true}); other == got {
+		t.Errorf("displayPath: different paths both redacted to %q", got)
+	}
+}
+
+func TestSlotOf(t *testing.T) {
+	if _, ok := SlotOf(&PKCS11PrivateKeyECDSA{PKCS11PrivateKey{PKCS11Object: PKCS11Object{Slot: 7}}}); !ok {
+		t.Errorf("SlotOf: not recognized")
+	}
+	if slot, _ := SlotOf(&PKCS11PrivateKeyRSA{PKCS11PrivateKey{PKCS11Object: PKCS11Object{Slot: 7}}}); slot != 7 {
+		t.Errorf("SlotOf: got %d, want 7", slot)
+	}
+	native, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	if _, ok := SlotOf(native); ok {
+		t.Errorf("SlotOf: recognized a key not on a token")
+	}
+}
+
+func TestStartupRetryable(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{ErrTokenNotFound, true},
+		{tokenNotPresentError(3), true},
+		{pkcs11.Error(pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED), true},
+		{pkcs11.Error(pkcs11.CKR_ARGUMENTS_BAD), false},
+		{ErrCannotOpenPKCS11, false},
+	}
+	for _, c := range cases {
+		if got := startupRetryable(c.err); got != c.want {
+			t.Errorf("startupRetryable(%v): got %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestStartupRetries(t *testing.T) {
+	cfg, err := getConfig("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.TokenLabel = "NoSuchToken"
+	cfg.TokenSerial = ""
+	cfg.StartupRetries = 2
+	cfg.StartupRetryDelay = 10 * time.Millisecond
+	started := time.Now()
+	_, err = Configure(cfg)
+	defer Close()
+	if err != ErrTokenNotFound {
+		t.Errorf("Configure: got %v, want ErrTokenNotFound", err)
+	}
+	// Waits of 10ms and 20ms
+	if elapsed := time.Since(started); elapsed < 30*time.Millisecond {
+		t.Errorf("Configure returned after %v, before retrying", elapsed)
+	}
+}
+
+func TestSetPIN(t *testing.T) {
+	cfg, err := getConfig("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Configure(cfg); err != nil {
+		t.Fatal("failed to configure service:", err)
+	}
+	defer Close()
+
+	pin := instance.cfg.Pin
+	if err := SetPIN(pin+"wrong", pin+"new"); err != ErrPINIncorrect {
+		t.Fatalf("SetPIN with wrong old PIN: got %v, want ErrPINIncorrect", err)
+	}
+	if err := SetPIN(pin, pin+"new"); err != nil {
+		t.Fatalf("SetPIN: %v", err)
+	}
+	if instance.cfg.Pin != pin+"new" {
+		t.Errorf("SetPIN did not update the configured PIN")
+	}
+	if cfg.Pin != pin {
+		t.Errorf("SetPIN changed the caller's PKCS11Config")
+	}
+	if err := SetPIN(pin+"new", pin); err != nil {
+		t.Fatalf("SetPIN (restore): %v", err)
 	}
 }
 
@@ -228,3 +920,24 @@ func getConfig(configLocation string) (*PKCS11Config, error) {
 	return config, nil
 }
 
+func BenchmarkParallelFindKeyPair(b *testing.B) {
+	ConfigureFromFile("config")
+	defer Close()
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		b.Fatalf("crypto11.GenerateECDSAKeyPair: %v", err)
+	}
+	id, _, err := key.Identify()
+	if err != nil {
+		b.Fatalf("key.Identify: %v", err)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := FindKeyPair(id, nil); err != nil {
+				b.Errorf("crypto11.FindKeyPair: %v", err)
+				return
+			}
+		}
+	})
+}
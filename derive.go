@@ -0,0 +1,225 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"runtime"
+	"unsafe"
+
+	"github.com/miekg/pkcs11"
+)
+
+const (
+	// CKZ_SALT_SPECIFIED: the salt is supplied in the parameters
+	ckzSaltSpecified = 0x00000001
+
+	// CKP_PKCS5_PBKD2_HMAC_SHA1: PBKDF2 with HMAC-SHA1 as its PRF
+	ckpPKCS5PBKD2HMACSHA1 = 0x00000001
+
+	// PKCS#11 v3.0 HKDF mechanisms, which the pkcs11 package predates
+	ckmHKDFDerive = 0x0000402a
+	ckmHKDFData   = 0x0000402b
+
+	// CK_HKDF_PARAMS ulSaltType values
+	ckfHKDFSaltNull = 0x00000001
+	ckfHKDFSaltData = 0x00000002
+)
+
+// DeriveKeyFromPassword derives a secret key from a password, on the
+// token, using PBKDF2 (CKM_PKCS5_PBKD2) with HMAC-SHA1 as the PRF.
+//
+// template describes the key to create; its Cipher field must be set,
+// and its Bits field should be set unless the key type has a fixed
+// length. The password and salt are passed to the token and not
+// retained.
+//
+// If the token does not support CKM_PKCS5_PBKD2 then
+// ErrMechanismNotSupported is returned, so that the caller can fall
+// back to a software implementation.
+func DeriveKeyFromPassword(password []byte, salt []byte, iterations int, template *KeyAttributes) (*PKCS11SecretKey, error) {
+	return DeriveKeyFromPasswordOnSlot(instance.slot, password, salt, iterations, template)
+}
+
+// DeriveKeyFromPasswordOnSlot derives a secret key from a password, on a specified slot.
+//
+// See DeriveKeyFromPassword for details.
+func DeriveKeyFromPasswordOnSlot(slot uint, password []byte, salt []byte, iterations int, template *KeyAttributes) (*PKCS11SecretKey, error) {
+	var k *PKCS11SecretKey
+	var err error
+	if err = ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	err = withSession(slot, func(session *PKCS11Session) error {
+		k, err = DeriveKeyFromPasswordOnSession(session, slot, password, salt, iterations, template)
+		return err
+	})
+	return k, err
+}
+
+// DeriveKeyFromPasswordOnSession derives a secret key from a password, using a specified session.
+//
+// See DeriveKeyFromPassword for details.
+func DeriveKeyFromPasswordOnSession(session *PKCS11Session, slot uint, password []byte, salt []byte, iterations int, template *KeyAttributes) (*PKCS11SecretKey, error) {
+	var err error
+	var saltData, passwordData uint
+	var attributes []*pkcs11.Attribute
+	if template == nil || template.Cipher == nil {
+		return nil, errNoCipher
+	}
+	if attributes, err = template.secretKeyTemplate(template.Cipher.GenParams[0].KeyType); err != nil {
+		return nil, err
+	}
+	if len(salt) > 0 {
+		saltData = uint(uintptr(unsafe.Pointer(&salt[0])))
+	}
+	if len(password) > 0 {
+		passwordData = uint(uintptr(unsafe.Pointer(&password[0])))
+	}
+	// CK_PKCS5_PBKD2_PARAMS2
+	parameters := concat(ulongToBytes(ckzSaltSpecified),
+		ulongToBytes(saltData),
+		ulongToBytes(uint(len(salt))),
+		ulongToBytes(uint(iterations)),
+		ulongToBytes(ckpPKCS5PBKD2HMACSHA1),
+		ulongToBytes(0), // pPrfData
+		ulongToBytes(0), // ulPrfDataLen
+		ulongToBytes(passwordData),
+		ulongToBytes(uint(len(password))))
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_PKCS5_PBKD2, parameters)}
+	handle, err := session.Ctx.GenerateKey(session.Handle, mech, attributes)
+	traceCall("C_GenerateKey", mech, err, attributes)
+	runtime.KeepAlive(salt)
+	runtime.KeepAlive(password)
+	if err != nil {
+		if e, ok := err.(pkcs11.Error); ok && e == pkcs11.CKR_MECHANISM_INVALID {
+			return nil, ErrMechanismNotSupported
+		}
+		return nil, storageError(template.trustError(err))
+	}
+	return &PKCS11SecretKey{PKCS11Object: newObject(handle, slot), Cipher: template.Cipher}, nil
+}
+
+// HKDFDerive derives a secret key, or raw bytes, from a base key using
+// HKDF (RFC 5869) on the token.
+//
+// hash is the PRF hash mechanism (e.g. pkcs11.CKM_SHA256). salt may
+// be nil, in which case the HKDF default salt is used. Both the
+// extract and expand steps are performed, producing outLen bytes.
+//
+// If template is not nil then CKM_HKDF_DERIVE is used to create a
+// secret key described by template, whose Cipher field must be set;
+// if its Bits field is 0 then outLen*8 is used. If template is nil
+// then CKM_HKDF_DATA is used and the output is returned as raw bytes;
+// the temporary data object that holds it is destroyed. So exactly one
+// of the key and the bytes is returned.
+//
+// The base key must permit derivation (CKA_DERIVE); if it is known not
+// to, ErrDeriveNotPermitted is returned. HKDF was added in
+// PKCS#11 v3.0; if the token does not support it then
+// ErrMechanismNotSupported is returned.
+func HKDFDerive(baseKey *PKCS11SecretKey, hash uint, salt []byte, info []byte, outLen int, template *KeyAttributes) (*PKCS11SecretKey, []byte, error) {
+	if err := baseKey.usage.checkDerive(); err != nil {
+		return nil, nil, err
+	}
+	var key *PKCS11SecretKey
+	var data []byte
+	err := withKeySession(&baseKey.PKCS11Object, func(session *PKCS11Session) error {
+		var err error
+		key, data, err = hkdfDerive(session, baseKey, hash, salt, info, outLen, template)
+		return err
+	})
+	if err == ErrMechanismNotSupported || err == errNoCipher {
+		return nil, nil, err
+	}
+	return key, data, baseKey.wrapError("HKDFDerive", err)
+}
+
+func hkdfDerive(session *PKCS11Session, baseKey *PKCS11SecretKey, hash uint, salt []byte, info []byte, outLen int, template *KeyAttributes) (*PKCS11SecretKey, []byte, error) {
+	var err error
+	var attributes []*pkcs11.Attribute
+	var mechanism uint
+	if template != nil {
+		if template.Cipher == nil {
+			return nil, nil, errNoCipher
+		}
+		t := *template
+		if t.Bits == 0 {
+			t.Bits = outLen * 8
+		}
+		if attributes, err = t.secretKeyTemplate(t.Cipher.GenParams[0].KeyType); err != nil {
+			return nil, nil, err
+		}
+		mechanism = ckmHKDFDerive
+	} else {
+		attributes = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, outLen),
+		}
+		mechanism = ckmHKDFData
+	}
+	var saltType, saltData, infoData uint
+	saltType = ckfHKDFSaltNull
+	if len(salt) > 0 {
+		saltType = ckfHKDFSaltData
+		saltData = uint(uintptr(unsafe.Pointer(&salt[0])))
+	}
+	if len(info) > 0 {
+		infoData = uint(uintptr(unsafe.Pointer(&info[0])))
+	}
+	// CK_HKDF_PARAMS. The two CK_BBOOLs share the first word, padded
+	// to the alignment of the CK_ULONG that follows.
+	flags := make([]byte, len(ulongToBytes(0)))
+	flags[0] = 1 // bExtract
+	flags[1] = 1 // bExpand
+	parameters := concat(flags,
+		ulongToBytes(hash),
+		ulongToBytes(saltType),
+		ulongToBytes(saltData),
+		ulongToBytes(uint(len(salt))),
+		ulongToBytes(0), // hSaltKey
+		ulongToBytes(infoData),
+		ulongToBytes(uint(len(info))))
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, parameters)}
+	handle, err := session.Ctx.DeriveKey(session.Handle, mech, baseKey.Handle, attributes)
+	traceCall("C_DeriveKey", mech, err, attributes)
+	runtime.KeepAlive(salt)
+	runtime.KeepAlive(info)
+	if err != nil {
+		if e, ok := err.(pkcs11.Error); ok && e == pkcs11.CKR_MECHANISM_INVALID {
+			return nil, nil, ErrMechanismNotSupported
+		}
+		if template != nil {
+			err = template.trustError(err)
+		}
+		return nil, nil, storageError(err)
+	}
+	if template != nil {
+		return &PKCS11SecretKey{PKCS11Object: newObject(handle, baseKey.Slot), Cipher: template.Cipher}, nil, nil
+	}
+	defer session.Ctx.DestroyObject(session.Handle, handle)
+	value := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil)}
+	if value, err = getAttributes(session, handle, value); err != nil {
+		return nil, nil, err
+	}
+	return nil, value[0].Value, nil
+}
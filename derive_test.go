@@ -0,0 +1,109 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+func TestDeriveKeyFromPassword(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	needMechanism(t, instance.slot, pkcs11.CKM_PKCS5_PBKD2)
+	password := []byte("correct horse battery staple")
+	salt := []byte("NaCl")
+	derive := func(password []byte) *PKCS11SecretKey {
+		key, err := DeriveKeyFromPassword(password, salt, 1000, &KeyAttributes{Cipher: &CipherAES, Bits: 128})
+		if err != nil {
+			t.Fatalf("DeriveKeyFromPassword: %v", err)
+		}
+		return key
+	}
+	k1, k2, k3 := derive(password), derive(password), derive([]byte("Tr0ub4dor&3"))
+	plaintext := make([]byte, k1.BlockSize())
+	c1, c2, c3 := make([]byte, len(plaintext)), make([]byte, len(plaintext)), make([]byte, len(plaintext))
+	k1.Encrypt(c1, plaintext)
+	k2.Encrypt(c2, plaintext)
+	k3.Encrypt(c3, plaintext)
+	if !bytes.Equal(c1, c2) {
+		t.Errorf("same password derived different keys")
+	}
+	if bytes.Equal(c1, c3) {
+		t.Errorf("different passwords derived the same key")
+	}
+	if _, err := DeriveKeyFromPassword(password, salt, 1000, nil); err != errNoCipher {
+		t.Errorf("DeriveKeyFromPassword with no template: got %v, want errNoCipher", err)
+	}
+}
+
+func TestHKDFDerive(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	needMechanism(t, instance.slot, ckmHKDFData)
+	needMechanism(t, instance.slot, ckmHKDFDerive)
+	prk, err := GenerateSecretKeyWithAttributes(&KeyAttributes{Cipher: &CipherGeneric, Bits: 256, Derive: true})
+	if err != nil {
+		t.Fatalf("GenerateSecretKeyWithAttributes: %v", err)
+	}
+	salt, info := []byte("salt"), []byte("handshake data")
+	key, d1, err := HKDFDerive(prk, pkcs11.CKM_SHA256, salt, info, 32, nil)
+	if err != nil {
+		t.Fatalf("HKDFDerive (data): %v", err)
+	}
+	if key != nil || len(d1) != 32 {
+		t.Fatalf("HKDFDerive (data): got key %v and %d bytes", key, len(d1))
+	}
+	_, d2, err := HKDFDerive(prk, pkcs11.CKM_SHA256, salt, info, 32, nil)
+	if err != nil {
+		t.Fatalf("HKDFDerive (data): %v", err)
+	}
+	if !bytes.Equal(d1, d2) {
+		t.Errorf("HKDFDerive: same inputs derived different bytes")
+	}
+	_, d3, err := HKDFDerive(prk, pkcs11.CKM_SHA256, salt, []byte("other"), 32, nil)
+	if err != nil {
+		t.Fatalf("HKDFDerive (data): %v", err)
+	}
+	if bytes.Equal(d1, d3) {
+		t.Errorf("HKDFDerive: different info derived the same bytes")
+	}
+	key, data, err := HKDFDerive(prk, pkcs11.CKM_SHA256, nil, info, 16, &KeyAttributes{Cipher: &CipherAES})
+	if err != nil {
+		t.Fatalf("HKDFDerive (key): %v", err)
+	}
+	if key == nil || data != nil {
+		t.Fatalf("HKDFDerive (key): got key %v and %d bytes", key, len(data))
+	}
+	plaintext := make([]byte, key.BlockSize())
+	key.Encrypt(plaintext, plaintext)
+}
+
+func TestHKDFDeriveUsageCheck(t *testing.T) {
+	// As for private keys, the check happens before any PKCS#11 call.
+	key := &PKCS11SecretKey{Cipher: &CipherGeneric, usage: &keyUsage{sign: true}}
+	if _, _, err := HKDFDerive(key, pkcs11.CKM_SHA256, nil, nil, 32, nil); err != ErrDeriveNotPermitted {
+		t.Errorf("HKDFDerive with non-deriving key: got %v, want ErrDeriveNotPermitted", err)
+	}
+}
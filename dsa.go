@@ -43,24 +43,27 @@ func exportDSAPublicKey(session *PKCS11Session, pubHandle pkcs11.ObjectHandle) (
 		pkcs11.NewAttribute(pkcs11.CKA_BASE, nil),
 		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
 	}
-	exported, err := session.Ctx.GetAttributeValue(session.Handle, pubHandle, template)
+	exported, err := getAttributes(session, pubHandle, template)
 	if err != nil {
 		return nil, err
 	}
-	var p, q, g, y big.Int
-	p.SetBytes(exported[0].Value)
-	q.SetBytes(exported[1].Value)
-	g.SetBytes(exported[2].Value)
-	y.SetBytes(exported[3].Value)
-	result := dsa.PublicKey{
+	return dsaPublicKeyFromValues(exported[0].Value, exported[1].Value, exported[2].Value, exported[3].Value), nil
+}
+
+// Build a DSA public key from its CKA_PRIME, CKA_SUBPRIME, CKA_BASE and CKA_VALUE.
+//
+// PKCS#11 big integers are unsigned big-endian byte strings, so they
+// are converted with SetBytes: a set top bit does not make a value
+// negative, and a leading zero byte is neither needed nor harmful.
+func dsaPublicKeyFromValues(p []byte, q []byte, g []byte, y []byte) *dsa.PublicKey {
+	return &dsa.PublicKey{
 		Parameters: dsa.Parameters{
-			P: &p,
-			Q: &q,
-			G: &g,
+			P: new(big.Int).SetBytes(p),
+			Q: new(big.Int).SetBytes(q),
+			G: new(big.Int).SetBytes(g),
 		},
-		Y: &y,
+		Y: new(big.Int).SetBytes(y),
 	}
-	return &result, nil
 }
 
 // GenerateDSAKeyPair creates a DSA private key on the default slot
@@ -130,13 +133,14 @@ func GenerateDSAKeyPairOnSession(session *PKCS11Session, slot uint, id []byte, l
 		mech,
 		publicKeyTemplate,
 		privateKeyTemplate)
+	traceCall("C_GenerateKeyPair", mech, err, publicKeyTemplate, privateKeyTemplate)
 	if err != nil {
-		return nil, err
+		return nil, storageError(err)
 	}
 	if pub, err = exportDSAPublicKey(session, pubHandle); err != nil {
 		return nil, err
 	}
-	priv := PKCS11PrivateKeyDSA{PKCS11PrivateKey{PKCS11Object{privHandle, slot}, pub}}
+	priv := PKCS11PrivateKeyDSA{newPrivateKey(session, slot, privHandle, pub)}
 	return &priv, nil
 }
 
@@ -148,5 +152,17 @@ func GenerateDSAKeyPairOnSession(session *PKCS11Session, slot uint, id []byte, l
 //
 // The return value is a DER-encoded byteblock.
 func (signer *PKCS11PrivateKeyDSA) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) (signature []byte, err error) {
-	return dsaGeneric(signer.Slot, signer.Handle, pkcs11.CKM_DSA, digest)
+	if err = signer.checkSign(pkcs11.CKM_DSA); err != nil {
+		return nil, err
+	}
+	signature, err = dsaGeneric(&signer.PKCS11Object, pkcs11.CKM_DSA, digest)
+	return signature, signer.wrapError("Sign", err)
+}
+
+// SignatureSize returns the largest size of a signature made by Sign.
+//
+// Sign returns a DER encoding, which is shorter when r or s happens to
+// be small, so actual signatures may be a few bytes shorter.
+func (signer *PKCS11PrivateKeyDSA) SignatureSize() int {
+	return derSignatureSize(signer.PubKey.(*dsa.PublicKey).Q.BitLen())
 }
@@ -166,3 +166,23 @@ func testDsaSigningWithHash(t *testing.T, key crypto.Signer, hashFunction crypto
 		t.Errorf("DSA %s Verify failed (psize %d hash %v)", what, psize, hashFunction)
 	}
 }
+
+func TestDSAPublicKeyFromValues(t *testing.T) {
+	// Every value has its top bit set, and y has a leading zero as well
+	p, q, g := []byte{0xff, 0x01}, []byte{0x80}, []byte{0x9a, 0xbc}
+	y := []byte{0x00, 0xc0, 0x01}
+	pub := dsaPublicKeyFromValues(p, q, g, y)
+	for name, c := range map[string]struct {
+		got  *big.Int
+		want int64
+	}{
+		"P": {pub.P, 0xff01},
+		"Q": {pub.Q, 0x80},
+		"G": {pub.G, 0x9abc},
+		"Y": {pub.Y, 0xc001},
+	} {
+		if c.got.Sign() < 0 || c.got.Cmp(big.NewInt(c.want)) != 0 {
+			t.Errorf("%s: got %v, want %#x", name, c.got, c.want)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"errors"
+	"runtime"
+	"unsafe"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS#11 v3.0 Montgomery curve constants, which the pkcs11 package does not define
+const (
+	ckkECMontgomery           = 0x41
+	ckmECMontgomeryKeyPairGen = 0x1056
+	x25519PrintableCurveID    = "curve25519"
+
+	// CKD_NULL: use the shared secret as it is
+	ckdNull = 0x00000001
+
+	// x25519KeySize is the size of X25519 keys and shared secrets, in bytes
+	x25519KeySize = 32
+)
+
+// x25519Params is CKA_EC_PARAMS for X25519: the DER-encoded OID id-X25519 (RFC 8410)
+var x25519Params = mustMarshal(asn1.ObjectIdentifier{1, 3, 101, 110})
+
+// ErrPeerCurveMismatch is returned by ECDH and DeriveKey when the peer's public key is on a different curve.
+var ErrPeerCurveMismatch = errors.New("crypto11: peer public key is on a different curve")
+
+// ErrPeerNotOnCurve is returned by ECDH and DeriveKey when the peer's public key is not a point on its curve.
+var ErrPeerNotOnCurve = errors.New("crypto11: peer public key is not on its curve")
+
+// PKCS11PrivateKeyX25519 contains a reference to a loaded PKCS#11 X25519 private key object.
+//
+// Its public key is the 32-byte X25519 public value, as a []byte. It
+// is used for key agreement only, and so is not a crypto.Signer.
+type PKCS11PrivateKeyX25519 struct {
+	PKCS11PrivateKey
+}
+
+// ecdh1Derive performs CKM_ECDH1_DERIVE with the peer's public value, creating a secret key object described by attributes.
+func ecdh1Derive(session *PKCS11Session, privHandle pkcs11.ObjectHandle, publicData []byte, attributes []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	// CK_ECDH1_DERIVE_PARAMS, with no KDF and no shared data
+	parameters := concat(ulongToBytes(ckdNull),
+		ulongToBytes(0), // ulSharedDataLen
+		ulongToBytes(0), // pSharedData
+		ulongToBytes(uint(len(publicData))),
+		ulongToBytes(uint(uintptr(unsafe.Pointer(&publicData[0])))))
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDH1_DERIVE, parameters)}
+	handle, err := session.Ctx.DeriveKey(session.Handle, mech, privHandle, attributes)
+	traceCall("C_DeriveKey", mech, err, attributes)
+	runtime.KeepAlive(publicData)
+	if e, ok := err.(pkcs11.Error); ok && e == pkcs11.CKR_MECHANISM_INVALID {
+		return 0, ErrMechanismNotSupported
+	}
+	return handle, err
+}
+
+// ecdhSecret performs ECDH and returns the raw shared secret, of size bytes.
+//
+// The secret is derived into a temporary, extractable session object,
+// which is read and destroyed again.
+func ecdhSecret(priv *PKCS11PrivateKey, publicData []byte, size int) ([]byte, error) {
+	var secret []byte
+	err := withKeySession(&priv.PKCS11Object, func(session *PKCS11Session) error {
+		attributes := []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, size),
+		}
+		handle, err := ecdh1Derive(session, priv.Handle, publicData, attributes)
+		if err != nil {
+			return err
+		}
+		defer session.Ctx.DestroyObject(session.Handle, handle)
+		value := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil)}
+		if value, err = getAttributes(session, handle, value); err != nil {
+			return err
+		}
+		secret = value[0].Value
+		return nil
+	})
+	return secret, err
+}
+
+// ecdhKey performs ECDH and stores the result as a secret key described by template.
+func ecdhKey(priv *PKCS11PrivateKey, publicData []byte, template *KeyAttributes) (*PKCS11SecretKey, error) {
+	if template.Cipher == nil {
+		return nil, errNoCipher
+	}
+	attributes, err := template.secretKeyTemplate(template.Cipher.GenParams[0].KeyType)
+	if err != nil {
+		return nil, err
+	}
+	var key *PKCS11SecretKey
+	err = withKeySession(&priv.PKCS11Object, func(session *PKCS11Session) error {
+		handle, err := ecdh1Derive(session, priv.Handle, publicData, attributes)
+		if err != nil {
+			if err != ErrMechanismNotSupported {
+				err = storageError(template.trustError(err))
+			}
+			return err
+		}
+		key = &PKCS11SecretKey{PKCS11Object: newObject(handle, priv.Slot), Cipher: template.Cipher}
+		return nil
+	})
+	return key, err
+}
+
+// ecdsaPublicData returns the peer's public value for CKM_ECDH1_DERIVE, checking that it is on the key's curve.
+func (priv *PKCS11PrivateKeyECDSA) ecdsaPublicData(peer *ecdsa.PublicKey) ([]byte, int, error) {
+	pub, ok := priv.PubKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, 0, ErrUnsupportedKeyType
+	}
+	if peer.Curve.Params().Name != pub.Curve.Params().Name {
+		return nil, 0, ErrPeerCurveMismatch
+	}
+	// Not all tokens validate the point, and an invalid one can leak
+	// information about the private key
+	if peer.X == nil || peer.Y == nil || !pub.Curve.IsOnCurve(peer.X, peer.Y) {
+		return nil, 0, ErrPeerNotOnCurve
+	}
+	return elliptic.Marshal(peer.Curve, peer.X, peer.Y), (pub.Curve.Params().BitSize + 7) / 8, nil
+}
+
+// ECDH performs elliptic curve Diffie-Hellman with a peer's public key, on the token, returning the shared secret.
+//
+// The shared secret is the x coordinate of the shared point, as by
+// CKM_ECDH1_DERIVE with CKD_NULL; it should be passed through a KDF
+// before use. The private key must permit derivation (see Derive in
+// KeyAttributes), or ErrDeriveNotPermitted is returned. Use DeriveKey instead to keep the result on the
+// token.
+func (priv *PKCS11PrivateKeyECDSA) ECDH(peer *ecdsa.PublicKey) ([]byte, error) {
+	if err := priv.usage.checkDerive(); err != nil {
+		return nil, err
+	}
+	publicData, size, err := priv.ecdsaPublicData(peer)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ecdhSecret(&priv.PKCS11PrivateKey, publicData, size)
+	if err == ErrMechanismNotSupported {
+		return nil, err
+	}
+	return secret, priv.wrapError("ECDH", err)
+}
+
+// DeriveKey performs elliptic curve Diffie-Hellman with a peer's public key, storing the result as a secret key on the token.
+//
+// template describes the key to create, and its Cipher field must be
+// set. The key's value is the shared secret (see ECDH), truncated to
+// template.Bits if that is set.
+func (priv *PKCS11PrivateKeyECDSA) DeriveKey(peer *ecdsa.PublicKey, template *KeyAttributes) (*PKCS11SecretKey, error) {
+	if err := priv.usage.checkDerive(); err != nil {
+		return nil, err
+	}
+	publicData, _, err := priv.ecdsaPublicData(peer)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdhKey(&priv.PKCS11PrivateKey, publicData, template)
+	if err == ErrMechanismNotSupported || err == errNoCipher {
+		return nil, err
+	}
+	return key, priv.wrapError("DeriveKey", err)
+}
+
+// Export the public value corresponding to a private X25519 key.
+func exportX25519PublicKey(session *PKCS11Session, pubHandle pkcs11.ObjectHandle) ([]byte, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	}
+	attributes, err := getAttributes(session, pubHandle, template)
+	if err != nil {
+		return nil, err
+	}
+	if !isCurveParams(attributes[0].Value, x25519Params, x25519PrintableCurveID) {
+		return nil, ErrUnsupportedEllipticCurve
+	}
+	return unmarshalRawPoint(attributes[1].Value, x25519KeySize)
+}
+
+// GenerateX25519KeyPair creates an X25519 key pair (CKK_EC_MONTGOMERY), for key agreement.
+//
+// The key will have a random label and ID. The token must support
+// CKM_EC_MONTGOMERY_KEY_PAIR_GEN, which is part of PKCS#11 v3.0.
+func GenerateX25519KeyPair() (*PKCS11PrivateKeyX25519, error) {
+	return GenerateX25519KeyPairOnSlot(instance.slot, nil, nil)
+}
+
+// GenerateX25519KeyPairOnSlot creates an X25519 key pair on a specified slot.
+//
+// label and/or id can be nil, in which case random values will be generated.
+func GenerateX25519KeyPairOnSlot(slot uint, id []byte, label []byte) (*PKCS11PrivateKeyX25519, error) {
+	var k *PKCS11PrivateKeyX25519
+	var err error
+	if err = ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	err = withSession(slot, func(session *PKCS11Session) error {
+		k, err = GenerateX25519KeyPairOnSession(session, slot, id, label)
+		return err
+	})
+	return k, err
+}
+
+// GenerateX25519KeyPairOnSession creates an X25519 key pair using a specified session.
+//
+// label and/or id can be nil, in which case random values will be generated.
+func GenerateX25519KeyPairOnSession(session *PKCS11Session, slot uint, id []byte, label []byte) (*PKCS11PrivateKeyX25519, error) {
+	attrs := &KeyAttributes{ID: id, Label: label}
+	id, label, err := attrs.identity()
+	if err != nil {
+		return nil, err
+	}
+	publicKeyTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, ckkECMontgomery),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_DERIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, x25519Params),
+	}
+	privateKeyTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_DERIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(ckmECMontgomeryKeyPairGen, nil)}
+	pubHandle, privHandle, err := session.Ctx.GenerateKeyPair(session.Handle,
+		mech,
+		publicKeyTemplate,
+		privateKeyTemplate)
+	traceCall("C_GenerateKeyPair", mech, err, publicKeyTemplate, privateKeyTemplate)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	pub, err := exportX25519PublicKey(session, pubHandle)
+	if err != nil {
+		return nil, err
+	}
+	return &PKCS11PrivateKeyX25519{newPrivateKey(session, slot, privHandle, pub)}, nil
+}
+
+// checkX25519Peer checks that a peer's X25519 public value is the right size.
+func checkX25519Peer(peer []byte) error {
+	if len(peer) != x25519KeySize {
+		return ErrMalformedPoint
+	}
+	return nil
+}
+
+// ECDH performs X25519 with a peer's 32-byte public value, on the token, returning the shared secret.
+//
+// As with the ECDSA version, the result should be passed through a KDF
+// before use; use DeriveKey instead to keep it on the token.
+func (priv *PKCS11PrivateKeyX25519) ECDH(peer []byte) ([]byte, error) {
+	if err := priv.usage.checkDerive(); err != nil {
+		return nil, err
+	}
+	if err := checkX25519Peer(peer); err != nil {
+		return nil, err
+	}
+	secret, err := ecdhSecret(&priv.PKCS11PrivateKey, peer, x25519KeySize)
+	if err == ErrMechanismNotSupported {
+		return nil, err
+	}
+	return secret, priv.wrapError("ECDH", err)
+}
+
+// DeriveKey performs X25519 with a peer's 32-byte public value, storing the result as a secret key on the token.
+//
+// See DeriveKey on PKCS11PrivateKeyECDSA.
+func (priv *PKCS11PrivateKeyX25519) DeriveKey(peer []byte, template *KeyAttributes) (*PKCS11SecretKey, error) {
+	if err := priv.usage.checkDerive(); err != nil {
+		return nil, err
+	}
+	if err := checkX25519Peer(peer); err != nil {
+		return nil, err
+	}
+	key, err := ecdhKey(&priv.PKCS11PrivateKey, peer, template)
+	if err == ErrMechanismNotSupported || err == errNoCipher {
+		return nil, err
+	}
+	return key, priv.wrapError("DeriveKey", err)
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"math/big"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+func TestECDH(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	needMechanism(t, instance.slot, pkcs11.CKM_ECDH1_DERIVE)
+	curve := elliptic.P256()
+	key, err := GenerateECDSAKeyPairWithAttributes(curve, &KeyAttributes{Derive: true})
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPairWithAttributes: %v", err)
+	}
+	peer, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	secret, err := key.ECDH(&peer.PublicKey)
+	if err != nil {
+		t.Fatalf("ECDH: %v", err)
+	}
+	pub := key.Public().(*ecdsa.PublicKey)
+	x, _ := curve.ScalarMult(pub.X, pub.Y, peer.D.Bytes())
+	want := make([]byte, (curve.Params().BitSize+7)/8)
+	xb := x.Bytes()
+	copy(want[len(want)-len(xb):], xb)
+	if !bytes.Equal(secret, want) {
+		t.Errorf("ECDH: shared secret differs from software")
+	}
+	derived, err := key.DeriveKey(&peer.PublicKey, &KeyAttributes{Cipher: Ciphers[pkcs11.CKK_AES], Bits: 128})
+	if err != nil {
+		t.Fatalf("DeriveKey: %v", err)
+	}
+	if derived.Cipher != Ciphers[pkcs11.CKK_AES] {
+		t.Errorf("DeriveKey: wrong cipher")
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	if _, err = key.ECDH(&other.PublicKey); err != ErrPeerCurveMismatch {
+		t.Errorf("ECDH with a P-384 peer: got %v, want ErrPeerCurveMismatch", err)
+	}
+	invalid := peer.PublicKey
+	invalid.Y = new(big.Int).Add(invalid.Y, big.NewInt(1))
+	if _, err = key.ECDH(&invalid); err != ErrPeerNotOnCurve {
+		t.Errorf("ECDH with a point not on the curve: got %v, want ErrPeerNotOnCurve", err)
+	}
+}
+
+func TestX25519(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	needMechanism(t, instance.slot, ckmECMontgomeryKeyPairGen)
+	needMechanism(t, instance.slot, pkcs11.CKM_ECDH1_DERIVE)
+	a, err := GenerateX25519KeyPair()
+	if err != nil {
+		t.Fatalf("GenerateX25519KeyPair: %v", err)
+	}
+	b, err := GenerateX25519KeyPair()
+	if err != nil {
+		t.Fatalf("GenerateX25519KeyPair: %v", err)
+	}
+	ab, err := a.ECDH(b.Public().([]byte))
+	if err != nil {
+		t.Fatalf("ECDH: %v", err)
+	}
+	ba, err := b.ECDH(a.Public().([]byte))
+	if err != nil {
+		t.Fatalf("ECDH: %v", err)
+	}
+	if !bytes.Equal(ab, ba) || len(ab) != x25519KeySize {
+		t.Errorf("ECDH: shared secrets differ")
+	}
+	if _, err = a.ECDH([]byte("short")); err != ErrMalformedPoint {
+		t.Errorf("ECDH with a short peer value: got %v, want ErrMalformedPoint", err)
+	}
+}
+
+func TestECDHUsageCheck(t *testing.T) {
+	// No token access is needed: the check happens before any PKCS#11 call.
+	usage := &keyUsage{sign: true}
+	key := &PKCS11PrivateKeyECDSA{PKCS11PrivateKey{usage: usage}}
+	if _, err := key.ECDH(&ecdsa.PublicKey{}); err != ErrDeriveNotPermitted {
+		t.Errorf("ECDH with sign-only key: got %v, want ErrDeriveNotPermitted", err)
+	}
+	if _, err := key.DeriveKey(&ecdsa.PublicKey{}, &KeyAttributes{Cipher: &CipherAES}); err != ErrDeriveNotPermitted {
+		t.Errorf("DeriveKey with sign-only key: got %v, want ErrDeriveNotPermitted", err)
+	}
+	xkey := &PKCS11PrivateKeyX25519{PKCS11PrivateKey{usage: usage}}
+	if _, err := xkey.ECDH(make([]byte, 32)); err != ErrDeriveNotPermitted {
+		t.Errorf("X25519 ECDH with sign-only key: got %v, want ErrDeriveNotPermitted", err)
+	}
+	if _, err := xkey.DeriveKey(make([]byte, 32), &KeyAttributes{Cipher: &CipherAES}); err != ErrDeriveNotPermitted {
+		t.Errorf("X25519 DeriveKey with sign-only key: got %v, want ErrDeriveNotPermitted", err)
+	}
+}
@@ -44,6 +44,10 @@ var ErrUnsupportedEllipticCurve = errors.New("crypto11/ecdsa: unsupported ellipt
 // decode a point.
 var ErrMalformedPoint = errors.New("crypto11/ecdsa: malformed elliptic curve point")
 
+// ErrUnsupportedHash is returned by SignMessage when the hash function
+// is neither supported by the token nor available in software.
+var ErrUnsupportedHash = errors.New("crypto11/ecdsa: unsupported hash function")
+
 // PKCS11PrivateKeyECDSA contains a reference to a loaded PKCS#11 ECDSA private key object.
 type PKCS11PrivateKeyECDSA struct {
 	PKCS11PrivateKey
@@ -203,7 +207,7 @@ func exportECDSAPublicKey(session *PKCS11Session, pubHandle pkcs11.ObjectHandle)
 		pkcs11.NewAttribute(pkcs11.CKA_ECDSA_PARAMS, nil),
 		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
 	}
-	if attributes, err = session.Ctx.GetAttributeValue(session.Handle, pubHandle, template); err != nil {
+	if attributes, err = getAttributes(session, pubHandle, template); err != nil {
 		return nil, err
 	}
 	if pub.Curve, err = unmarshalEcParams(attributes[0].Value); err != nil {
@@ -251,19 +255,48 @@ func GenerateECDSAKeyPairOnSlot(slot uint, id []byte, label []byte, c elliptic.C
 // Only a limited set of named elliptic curves are supported. The
 // underlying PKCS#11 implementation may impose further restrictions.
 func GenerateECDSAKeyPairOnSession(session *PKCS11Session, slot uint, id []byte, label []byte, c elliptic.Curve) (*PKCS11PrivateKeyECDSA, error) {
+	return GenerateECDSAKeyPairWithAttributesOnSession(session, slot, c, &KeyAttributes{ID: id, Label: label})
+}
+
+// GenerateECDSAKeyPairWithAttributes creates an ECDSA private key using curve c, with the ID, label and extra attributes given by attrs.
+//
+// attrs.ID and attrs.Label are used as for other keys; attrs.Extra,
+// attrs.PublicExtra and attrs.PrivateExtra are added to the public and
+// private key templates, replacing the defaults they overlap, and
+// attrs.LabelCollision applies to existing public and private keys.
+// attrs.Derive sets CKA_DERIVE on the private key, so that it can be
+// used for ECDH, and attrs.Trusted and attrs.WrapWithTrusted set
+// CKA_TRUSTED on the public key and CKA_WRAP_WITH_TRUSTED on the
+// private key. The other fields of attrs are ignored.
+func GenerateECDSAKeyPairWithAttributes(c elliptic.Curve, attrs *KeyAttributes) (*PKCS11PrivateKeyECDSA, error) {
+	return GenerateECDSAKeyPairWithAttributesOnSlot(instance.slot, c, attrs)
+}
+
+// GenerateECDSAKeyPairWithAttributesOnSlot creates an ECDSA private key described by attrs, on a specified slot.
+func GenerateECDSAKeyPairWithAttributesOnSlot(slot uint, c elliptic.Curve, attrs *KeyAttributes) (*PKCS11PrivateKeyECDSA, error) {
+	var k *PKCS11PrivateKeyECDSA
 	var err error
+	if err = ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	err = withSession(slot, func(session *PKCS11Session) error {
+		k, err = GenerateECDSAKeyPairWithAttributesOnSession(session, slot, c, attrs)
+		return err
+	})
+	return k, err
+}
+
+// GenerateECDSAKeyPairWithAttributesOnSession creates an ECDSA private key described by attrs, using a specified session.
+func GenerateECDSAKeyPairWithAttributesOnSession(session *PKCS11Session, slot uint, c elliptic.Curve, attrs *KeyAttributes) (*PKCS11PrivateKeyECDSA, error) {
 	var parameters []byte
 	var pub crypto.PublicKey
 
-	if label == nil {
-		if label, err = generateKeyLabel(); err != nil {
-			return nil, err
-		}
+	if err := attrs.checkLabelCollision(session, pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY); err != nil {
+		return nil, err
 	}
-	if id == nil {
-		if id, err = generateKeyLabel(); err != nil {
-			return nil, err
-		}
+	id, label, err := attrs.identity()
+	if err != nil {
+		return nil, err
 	}
 	if parameters, err = marshalEcParams(c); err != nil {
 		return nil, err
@@ -285,21 +318,147 @@ func GenerateECDSAKeyPairOnSession(session *PKCS11Session, slot uint, id []byte,
 		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
 		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
 	}
+	if attrs.Derive {
+		privateKeyTemplate = append(privateKeyTemplate, pkcs11.NewAttribute(pkcs11.CKA_DERIVE, true))
+	}
+	publicKeyTemplate, privateKeyTemplate = attrs.keyPairTemplates(publicKeyTemplate, privateKeyTemplate)
 	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA_KEY_PAIR_GEN, nil)}
 	pubHandle, privHandle, err := session.Ctx.GenerateKeyPair(session.Handle,
 		mech,
 		publicKeyTemplate,
 		privateKeyTemplate)
+	traceCall("C_GenerateKeyPair", mech, err, publicKeyTemplate, privateKeyTemplate)
 	if err != nil {
-		return nil, err
+		return nil, storageError(attrs.trustError(err))
 	}
 	if pub, err = exportECDSAPublicKey(session, pubHandle); err != nil {
 		return nil, err
 	}
-	priv := PKCS11PrivateKeyECDSA{PKCS11PrivateKey{PKCS11Object{privHandle, slot}, pub}}
+	priv := PKCS11PrivateKeyECDSA{newPrivateKey(session, slot, privHandle, pub)}
 	return &priv, nil
 }
 
+// ImportECDSAKeyPair stores an existing ECDSA private key, and its public key, on the token.
+//
+// The key will have a random label and ID.
+func ImportECDSAKeyPair(key *ecdsa.PrivateKey) (*PKCS11PrivateKeyECDSA, error) {
+	return ImportECDSAKeyPairOnSlot(instance.slot, nil, nil, key)
+}
+
+// ImportECDSAKeyPairOnSlot stores an existing ECDSA private key, and its public key, on a specified slot.
+//
+// Either or both label and/or id can be nil, in which case random values will be generated.
+func ImportECDSAKeyPairOnSlot(slot uint, id []byte, label []byte, key *ecdsa.PrivateKey) (*PKCS11PrivateKeyECDSA, error) {
+	var k *PKCS11PrivateKeyECDSA
+	var err error
+	if err = ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	err = withSession(slot, func(session *PKCS11Session) error {
+		k, err = ImportECDSAKeyPairOnSession(session, slot, id, label, key)
+		return err
+	})
+	return k, err
+}
+
+// ImportECDSAKeyPairOnSession stores an existing ECDSA private key, and its public key, using a specified session.
+//
+// Either or both label and/or id can be nil, in which case random values will be generated.
+//
+// Only a limited set of named elliptic curves are supported. The
+// underlying PKCS#11 implementation may impose further restrictions.
+func ImportECDSAKeyPairOnSession(session *PKCS11Session, slot uint, id []byte, label []byte, key *ecdsa.PrivateKey) (*PKCS11PrivateKeyECDSA, error) {
+	return ImportECDSAKeyPairWithAttributesOnSession(session, slot, key, &KeyAttributes{ID: id, Label: label})
+}
+
+// ImportECDSAKeyPairWithAttributes stores an existing ECDSA private key, and its public key, with the attributes given by attrs.
+//
+// attrs.ID, attrs.Label, attrs.LabelCollision, attrs.Derive and the
+// extra attribute fields are used as for
+// GenerateECDSAKeyPairWithAttributes. attrs.Extractable sets
+// CKA_EXTRACTABLE on the private key, and attrs.Trusted and
+// attrs.WrapWithTrusted are applied as for key generation; other
+// flags, such as CKA_SENSITIVE, can be changed with
+// attrs.PrivateExtra. The other fields of attrs are ignored.
+func ImportECDSAKeyPairWithAttributes(key *ecdsa.PrivateKey, attrs *KeyAttributes) (*PKCS11PrivateKeyECDSA, error) {
+	return ImportECDSAKeyPairWithAttributesOnSlot(instance.slot, key, attrs)
+}
+
+// ImportECDSAKeyPairWithAttributesOnSlot stores an existing ECDSA private key described by attrs, on a specified slot.
+func ImportECDSAKeyPairWithAttributesOnSlot(slot uint, key *ecdsa.PrivateKey, attrs *KeyAttributes) (*PKCS11PrivateKeyECDSA, error) {
+	var k *PKCS11PrivateKeyECDSA
+	var err error
+	if err = ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	err = withSession(slot, func(session *PKCS11Session) error {
+		k, err = ImportECDSAKeyPairWithAttributesOnSession(session, slot, key, attrs)
+		return err
+	})
+	return k, err
+}
+
+// ImportECDSAKeyPairWithAttributesOnSession stores an existing ECDSA private key described by attrs, using a specified session.
+func ImportECDSAKeyPairWithAttributesOnSession(session *PKCS11Session, slot uint, key *ecdsa.PrivateKey, attrs *KeyAttributes) (*PKCS11PrivateKeyECDSA, error) {
+	priv, _, err := importECDSAKeyPair(session, slot, key, attrs)
+	return priv, err
+}
+
+// importECDSAKeyPair implements ImportECDSAKeyPairWithAttributesOnSession, also returning the public key handle.
+func importECDSAKeyPair(session *PKCS11Session, slot uint, key *ecdsa.PrivateKey, attrs *KeyAttributes) (*PKCS11PrivateKeyECDSA, pkcs11.ObjectHandle, error) {
+	var parameters []byte
+	if err := attrs.checkLabelCollision(session, pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY); err != nil {
+		return nil, 0, err
+	}
+	id, label, err := attrs.identity()
+	if err != nil {
+		return nil, 0, err
+	}
+	if parameters, err = marshalEcParams(key.Curve); err != nil {
+		return nil, 0, err
+	}
+	// CKA_EC_POINT is a DER-encoded OCTET STRING
+	point := mustMarshal(elliptic.Marshal(key.Curve, key.X, key.Y))
+	// CKA_VALUE is the private scalar, which PKCS#11 expects at full length
+	value := make([]byte, (key.Curve.Params().BitSize+7)/8)
+	d := key.D.Bytes()
+	copy(value[len(value)-len(d):], d)
+	publicKeyTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_ECDSA_PARAMS, parameters),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, point),
+	}
+	privateKeyTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, attrs.Extractable),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_ECDSA_PARAMS, parameters),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, value),
+	}
+	if attrs.Derive {
+		privateKeyTemplate = append(privateKeyTemplate, pkcs11.NewAttribute(pkcs11.CKA_DERIVE, true))
+	}
+	publicKeyTemplate, privateKeyTemplate = attrs.keyPairTemplates(publicKeyTemplate, privateKeyTemplate)
+	pubHandle, privHandle, err := importKeyPair(session, publicKeyTemplate, privateKeyTemplate)
+	if err != nil {
+		return nil, 0, attrs.trustError(err)
+	}
+	pub := key.PublicKey
+	priv := PKCS11PrivateKeyECDSA{newPrivateKey(session, slot, privHandle, &pub)}
+	return &priv, pubHandle, nil
+}
+
 // Sign signs a message using an ECDSA key.
 //
 // This completes the implemention of crypto.Signer for PKCS11PrivateKeyECDSA.
@@ -308,5 +467,128 @@ func GenerateECDSAKeyPairOnSession(session *PKCS11Session, slot uint, id []byte,
 //
 // The return value is a DER-encoded byteblock.
 func (signer *PKCS11PrivateKeyECDSA) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
-	return dsaGeneric(signer.Slot, signer.Handle, pkcs11.CKM_ECDSA, digest)
+	if err := signer.checkSign(pkcs11.CKM_ECDSA); err != nil {
+		return nil, err
+	}
+	signature, err := dsaGeneric(&signer.PKCS11Object, pkcs11.CKM_ECDSA, digest)
+	return signature, signer.wrapError("Sign", err)
+}
+
+// ecdsaHashMechanisms maps hash functions to the combined ECDSA mechanisms.
+var ecdsaHashMechanisms = map[crypto.Hash]uint{
+	crypto.SHA1:   pkcs11.CKM_ECDSA_SHA1,
+	crypto.SHA224: pkcs11.CKM_ECDSA_SHA224,
+	crypto.SHA256: pkcs11.CKM_ECDSA_SHA256,
+	crypto.SHA384: pkcs11.CKM_ECDSA_SHA384,
+	crypto.SHA512: pkcs11.CKM_ECDSA_SHA512,
+}
+
+// SignMessage hashes and signs a message using an ECDSA key.
+//
+// If the token supports the combined mechanism for opts.HashFunc()
+// (e.g. CKM_ECDSA_SHA256) then the message is passed to the token to
+// hash and sign. Otherwise, or if the token rejects the combined
+// mechanism despite listing it, it is hashed here and the digest is
+// signed with CKM_ECDSA, as by Sign. Use this if the token supports only the
+// combined mechanisms, since Sign is only given a digest.
+//
+// The return value is a DER-encoded byteblock.
+func (signer *PKCS11PrivateKeyECDSA) SignMessage(message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	opts, err := defaultSignerOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	hash := opts.HashFunc()
+	if mechanism, ok := ecdsaHashMechanisms[hash]; ok {
+		supported, err := hasMechanism(signer.Slot, mechanism)
+		if err != nil {
+			return nil, err
+		}
+		if supported {
+			if err = signer.checkSign(mechanism); err != nil {
+				return nil, err
+			}
+			signature, err := dsaGeneric(&signer.PKCS11Object, mechanism, message)
+			if !isMechanismInvalid(err) {
+				return signature, signer.wrapError("SignMessage", err)
+			}
+			// Listed but not actually supported
+			rejectMechanism(signer.Slot, mechanism)
+		}
+	}
+	if !hash.Available() {
+		return nil, ErrUnsupportedHash
+	}
+	h := hash.New()
+	h.Write(message)
+	return signer.Sign(nil, h.Sum(nil), opts)
+}
+
+// SignP1363 signs a message using an ECDSA key, returning the signature in IEEE P1363 form.
+//
+// The result is the raw concatenation r||s, with each of r and s
+// left-padded to the size of the curve, as used by JWS (RFC 7518) and
+// WebCrypto. It is produced directly from the token's output, with no
+// DER encoding. As with Sign, opts is ignored.
+func (signer *PKCS11PrivateKeyECDSA) SignP1363(digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	pub, ok := signer.PubKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, ErrUnsupportedKeyType
+	}
+	if err := signer.checkSign(pkcs11.CKM_ECDSA); err != nil {
+		return nil, err
+	}
+	sigBytes, err := dsaGenericRaw(&signer.PKCS11Object, pkcs11.CKM_ECDSA, digest)
+	if err != nil {
+		return nil, signer.wrapError("SignP1363", err)
+	}
+	n := (pub.Curve.Params().BitSize + 7) / 8
+	if len(sigBytes) == 2*n {
+		return sigBytes, nil
+	}
+	// Some tokens strip leading zeros
+	var sig dsaSignature
+	if err = sig.unmarshalBytes(sigBytes); err != nil {
+		return nil, err
+	}
+	return sig.marshalBytes(n)
+}
+
+// SignatureSize returns the largest size of a signature made by Sign.
+//
+// Sign returns a DER encoding, which is shorter when r or s happens to
+// be small, so actual signatures may be a few bytes shorter.
+func (signer *PKCS11PrivateKeyECDSA) SignatureSize() int {
+	return derSignatureSize(signer.PubKey.(*ecdsa.PublicKey).Curve.Params().N.BitLen())
+}
+
+// P1363SignatureSize returns the size of a signature made by SignP1363, which is always the same.
+func (signer *PKCS11PrivateKeyECDSA) P1363SignatureSize() int {
+	return 2 * ((signer.PubKey.(*ecdsa.PublicKey).Curve.Params().BitSize + 7) / 8)
+}
+
+// VerifyWithPublicKey checks a DER-encoded signature using the token's public key object.
+//
+// The signature is checked by the token with C_Verify, rather than by
+// crypto/ecdsa. As with Sign, opts is ignored. The public key object is
+// found by the private key's CKA_ID; if there is none, ErrNoPublicKey
+// is returned.
+//
+// If the signature is wrong then an *ObjectError wrapping the PKCS#11
+// error (normally CKR_SIGNATURE_INVALID) is returned.
+func (signer *PKCS11PrivateKeyECDSA) VerifyWithPublicKey(digest []byte, signature []byte, opts crypto.SignerOpts) error {
+	pub, ok := signer.PubKey.(*ecdsa.PublicKey)
+	if !ok {
+		return ErrUnsupportedKeyType
+	}
+	var sig dsaSignature
+	if err := sig.unmarshalDER(signature); err != nil {
+		return err
+	}
+	sigBytes, err := sig.marshalBytes((pub.Curve.Params().BitSize + 7) / 8)
+	if err != nil {
+		return err
+	}
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}
+	return signer.verifyWithPublicKey(pkcs11.CKK_ECDSA, mech, digest, sigBytes)
 }
@@ -27,9 +27,11 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	_ "crypto/sha1"
-	_ "crypto/sha256"
+	"crypto/sha256"
 	_ "crypto/sha512"
 	"testing"
+
+	"github.com/miekg/pkcs11"
 )
 
 var curves = []elliptic.Curve{
@@ -118,3 +120,219 @@ func testEcdsaSigning(t *testing.T, key crypto.Signer, hashFunction crypto.Hash)
 	}
 
 }
+
+func TestImportECDSAKeyPair(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	softKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	key, err := ImportECDSAKeyPair(softKey)
+	if err != nil {
+		t.Fatalf("ImportECDSAKeyPair: %v", err)
+	}
+	testEcdsaSigning(t, key, crypto.SHA256)
+}
+
+func TestImportECDSAKeyPairWithAttributes(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	softKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	label, err := generateKeyLabel()
+	if err != nil {
+		t.Fatalf("generateKeyLabel: %v", err)
+	}
+	key, err := ImportECDSAKeyPairWithAttributes(softKey, &KeyAttributes{Label: label, Extractable: true})
+	if err != nil {
+		t.Fatalf("ImportECDSAKeyPairWithAttributes: %v", err)
+	}
+	testEcdsaSigning(t, key, crypto.SHA256)
+	err = withSession(key.Slot, func(session *PKCS11Session) error {
+		attributes, err := session.Ctx.GetAttributeValue(session.Handle, key.Handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+		})
+		if err != nil {
+			return err
+		}
+		if !bytesToBool(attributes[0].Value) {
+			t.Errorf("CKA_EXTRACTABLE: got false, want true")
+		}
+		if string(attributes[1].Value) != string(label) {
+			t.Errorf("CKA_LABEL: got %q, want %q", attributes[1].Value, label)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("GetAttributeValue: %v", err)
+	}
+	_, err = ImportECDSAKeyPairWithAttributes(softKey, &KeyAttributes{Label: label, LabelCollision: LabelCollisionError})
+	if err != ErrLabelExists {
+		t.Errorf("ImportECDSAKeyPairWithAttributes with a used label: got %v, want ErrLabelExists", err)
+	}
+}
+
+func TestEcdsaVerifyWithPublicKey(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	softKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	key, err := ImportECDSAKeyPair(softKey)
+	if err != nil {
+		t.Fatalf("ImportECDSAKeyPair: %v", err)
+	}
+	digest := make([]byte, 32)
+	sigDER, err := softKey.Sign(rand.Reader, digest, crypto.SHA256)
+	if err != nil {
+		t.Fatalf("ecdsa.Sign: %v", err)
+	}
+	if err = key.VerifyWithPublicKey(digest, sigDER, crypto.SHA256); err != nil {
+		t.Errorf("VerifyWithPublicKey: %v", err)
+	}
+	digest[0] ^= 1
+	if err = key.VerifyWithPublicKey(digest, sigDER, crypto.SHA256); err == nil {
+		t.Errorf("VerifyWithPublicKey: accepted a bad signature")
+	}
+}
+
+func TestEcdsaSignP1363(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	key, err := GenerateECDSAKeyPair(elliptic.P384())
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPair: %v", err)
+	}
+	digest := make([]byte, 48)
+	sigBytes, err := key.SignP1363(digest, crypto.SHA384)
+	if err != nil {
+		t.Fatalf("SignP1363: %v", err)
+	}
+	if len(sigBytes) != 96 {
+		t.Fatalf("SignP1363: got %d bytes, want 96", len(sigBytes))
+	}
+	var sig dsaSignature
+	if err = sig.unmarshalBytes(sigBytes); err != nil {
+		t.Fatalf("unmarshalBytes: %v", err)
+	}
+	if !ecdsa.Verify(key.Public().(*ecdsa.PublicKey), digest, sig.R, sig.S) {
+		t.Errorf("SignP1363: signature does not verify")
+	}
+}
+
+func TestEcdsaSignMessage(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPair: %v", err)
+	}
+	message := []byte("sign me with the token's own hash")
+	sigDER, err := key.SignMessage(message, crypto.SHA256)
+	if err != nil {
+		t.Fatalf("SignMessage: %v", err)
+	}
+	var sig dsaSignature
+	if err = sig.unmarshalDER(sigDER); err != nil {
+		t.Fatalf("unmarshalDER: %v", err)
+	}
+	digest := sha256.Sum256(message)
+	if !ecdsa.Verify(key.Public().(*ecdsa.PublicKey), digest[:], sig.R, sig.S) {
+		t.Errorf("SignMessage: signature does not verify")
+	}
+}
+
+func TestEcdsaExtraAttributes(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	subject := []byte("application domain")
+	key, err := GenerateECDSAKeyPairWithAttributes(elliptic.P256(), &KeyAttributes{
+		Extra: []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_SUBJECT, subject)},
+	})
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPairWithAttributes: %v", err)
+	}
+	err = withSession(key.Slot, func(session *PKCS11Session) error {
+		attributes, err := session.Ctx.GetAttributeValue(session.Handle, key.Handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_SUBJECT, nil),
+		})
+		if err != nil {
+			return err
+		}
+		if string(attributes[0].Value) != string(subject) {
+			t.Errorf("CKA_SUBJECT: got %q, want %q", attributes[0].Value, subject)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("GetAttributeValue: %v", err)
+	}
+}
+
+func TestEcdsaLabelCollision(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	label, err := generateKeyLabel()
+	if err != nil {
+		t.Fatalf("generateKeyLabel: %v", err)
+	}
+	first, err := GenerateECDSAKeyPairWithAttributes(elliptic.P256(), &KeyAttributes{Label: label})
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPairWithAttributes: %v", err)
+	}
+	firstID, _, err := first.Identify()
+	if err != nil {
+		t.Fatalf("first.Identify: %v", err)
+	}
+	_, err = GenerateECDSAKeyPairWithAttributes(elliptic.P256(), &KeyAttributes{
+		Label:          label,
+		LabelCollision: LabelCollisionError,
+	})
+	if err != ErrLabelExists {
+		t.Errorf("LabelCollisionError: got %v, want ErrLabelExists", err)
+	}
+	second, err := GenerateECDSAKeyPairWithAttributes(elliptic.P256(), &KeyAttributes{
+		Label:          label,
+		LabelCollision: LabelCollisionReplace,
+	})
+	if err != nil {
+		t.Fatalf("LabelCollisionReplace: %v", err)
+	}
+	if _, err = FindKeyPair(firstID, nil); err != ErrKeyNotFound {
+		t.Errorf("FindKeyPair of replaced key: got %v, want ErrKeyNotFound", err)
+	}
+	k, err := FindKeyPair(nil, label)
+	if err != nil {
+		t.Fatalf("FindKeyPair: %v", err)
+	}
+	if k.(*PKCS11PrivateKeyECDSA).Handle != second.Handle {
+		t.Errorf("FindKeyPair found a key other than the replacement")
+	}
+}
+
+func TestEcdsaSignatureSize(t *testing.T) {
+	cases := []struct {
+		curve      elliptic.Curve
+		der, p1363 int
+	}{
+		{elliptic.P224(), 64, 56},
+		{elliptic.P256(), 72, 64},
+		{elliptic.P384(), 104, 96},
+		{elliptic.P521(), 139, 132},
+	}
+	for _, c := range cases {
+		signer := &PKCS11PrivateKeyECDSA{PKCS11PrivateKey{PubKey: &ecdsa.PublicKey{Curve: c.curve}}}
+		name := c.curve.Params().Name
+		if got := signer.SignatureSize(); got != c.der {
+			t.Errorf("%s: SignatureSize: got %d, want %d", name, got, c.der)
+		}
+		if got := signer.P1363SignatureSize(); got != c.p1363 {
+			t.Errorf("%s: P1363SignatureSize: got %d, want %d", name, got, c.p1363)
+		}
+	}
+}
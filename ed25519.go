@@ -0,0 +1,190 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/asn1"
+	"errors"
+	"io"
+
+	"github.com/miekg/pkcs11"
+	"golang.org/x/crypto/ed25519"
+)
+
+// PKCS#11 v3.0 Edwards curve constants, which the pkcs11 package does not define
+const (
+	ckkECEdwards            = 0x40
+	ckmECEdwardsKeyPairGen  = 0x1055
+	ckmEdDSA                = 0x1057
+	ed25519PrintableCurveID = "edwards25519"
+)
+
+// ErrUnsupportedEd25519Options is returned by Ed25519 Sign when opts asks for a prehash.
+//
+// Only pure Ed25519 is supported, so opts.HashFunc() must be 0; the
+// message itself is passed to Sign.
+var ErrUnsupportedEd25519Options = errors.New("crypto11/ed25519: only pure Ed25519 (opts.HashFunc() == 0) is supported")
+
+// ed25519Params is CKA_EC_PARAMS for Ed25519: the DER-encoded OID id-Ed25519 (RFC 8410)
+var ed25519Params = mustMarshal(asn1.ObjectIdentifier{1, 3, 101, 112})
+
+// PKCS11PrivateKeyEd25519 contains a reference to a loaded PKCS#11 Ed25519 private key object.
+//
+// Its public key is an ed25519.PublicKey.
+type PKCS11PrivateKeyEd25519 struct {
+	PKCS11PrivateKey
+}
+
+// Export the public key corresponding to a private Ed25519 key.
+func exportEd25519PublicKey(session *PKCS11Session, pubHandle pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	}
+	attributes, err := getAttributes(session, pubHandle, template)
+	if err != nil {
+		return nil, err
+	}
+	if !isCurveParams(attributes[0].Value, ed25519Params, ed25519PrintableCurveID) {
+		return nil, ErrUnsupportedEllipticCurve
+	}
+	point, err := unmarshalRawPoint(attributes[1].Value, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.PublicKey(point), nil
+}
+
+// isCurveParams reports whether CKA_EC_PARAMS names a curve, either by its DER-encoded OID or by its printable name.
+func isCurveParams(params []byte, oid []byte, name string) bool {
+	if bytes.Equal(params, oid) {
+		return true
+	}
+	var s string
+	rest, err := asn1.Unmarshal(params, &s)
+	return err == nil && len(rest) == 0 && s == name
+}
+
+// unmarshalRawPoint decodes the CKA_EC_POINT of an Edwards or Montgomery key, which is size bytes long.
+//
+// It should be a DER-encoded OCTET STRING, but some tokens return the
+// raw key.
+func unmarshalRawPoint(point []byte, size int) ([]byte, error) {
+	if len(point) != size {
+		var raw []byte
+		if rest, err := asn1.Unmarshal(point, &raw); err != nil || len(rest) != 0 {
+			return nil, ErrMalformedDER
+		}
+		point = raw
+	}
+	if len(point) != size {
+		return nil, ErrMalformedPoint
+	}
+	return append([]byte(nil), point...), nil
+}
+
+// GenerateEd25519KeyPair creates an Ed25519 key pair (CKK_EC_EDWARDS).
+//
+// The key will have a random label and ID. The token must support
+// CKM_EC_EDWARDS_KEY_PAIR_GEN, which is part of PKCS#11 v3.0.
+func GenerateEd25519KeyPair() (*PKCS11PrivateKeyEd25519, error) {
+	return GenerateEd25519KeyPairOnSlot(instance.slot, nil, nil)
+}
+
+// GenerateEd25519KeyPairOnSlot creates an Ed25519 key pair on a specified slot.
+//
+// label and/or id can be nil, in which case random values will be generated.
+func GenerateEd25519KeyPairOnSlot(slot uint, id []byte, label []byte) (*PKCS11PrivateKeyEd25519, error) {
+	var k *PKCS11PrivateKeyEd25519
+	var err error
+	if err = ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	err = withSession(slot, func(session *PKCS11Session) error {
+		k, err = GenerateEd25519KeyPairOnSession(session, slot, id, label)
+		return err
+	})
+	return k, err
+}
+
+// GenerateEd25519KeyPairOnSession creates an Ed25519 key pair using a specified session.
+//
+// label and/or id can be nil, in which case random values will be generated.
+func GenerateEd25519KeyPairOnSession(session *PKCS11Session, slot uint, id []byte, label []byte) (*PKCS11PrivateKeyEd25519, error) {
+	attrs := &KeyAttributes{ID: id, Label: label}
+	id, label, err := attrs.identity()
+	if err != nil {
+		return nil, err
+	}
+	publicKeyTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, ckkECEdwards),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, ed25519Params),
+	}
+	privateKeyTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(ckmECEdwardsKeyPairGen, nil)}
+	pubHandle, privHandle, err := session.Ctx.GenerateKeyPair(session.Handle,
+		mech,
+		publicKeyTemplate,
+		privateKeyTemplate)
+	traceCall("C_GenerateKeyPair", mech, err, publicKeyTemplate, privateKeyTemplate)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	pub, err := exportEd25519PublicKey(session, pubHandle)
+	if err != nil {
+		return nil, err
+	}
+	return &PKCS11PrivateKeyEd25519{newPrivateKey(session, slot, privHandle, pub)}, nil
+}
+
+// Sign signs a message using an Ed25519 key.
+//
+// This completes the implemention of crypto.Signer for PKCS11PrivateKeyEd25519.
+//
+// As with ed25519.PrivateKey, the whole message is passed rather than
+// a digest, and opts.HashFunc() must be 0 (e.g. crypto.Hash(0)). The
+// signature is made by the token with CKM_EDDSA, and the rand
+// argument is ignored.
+func (signer *PKCS11PrivateKeyEd25519) Sign(rand io.Reader, message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts != nil && opts.HashFunc() != 0 {
+		return nil, ErrUnsupportedEd25519Options
+	}
+	if err := signer.checkSign(ckmEdDSA); err != nil {
+		return nil, err
+	}
+	signature, err := dsaGenericRaw(&signer.PKCS11Object, ckmEdDSA, message)
+	return signature, signer.wrapError("Sign", err)
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestEd25519(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	needMechanism(t, instance.slot, ckmECEdwardsKeyPairGen)
+	needMechanism(t, instance.slot, ckmEdDSA)
+	key, err := GenerateEd25519KeyPair()
+	if err != nil {
+		t.Fatalf("GenerateEd25519KeyPair: %v", err)
+	}
+	pub, ok := key.Public().(ed25519.PublicKey)
+	if !ok {
+		t.Fatalf("Public: got %T", key.Public())
+	}
+	message := []byte("sign me with Ed25519")
+	signature, err := key.Sign(nil, message, crypto.Hash(0))
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if !ed25519.Verify(pub, message, signature) {
+		t.Errorf("Sign: signature does not verify")
+	}
+	if _, err = key.Sign(nil, message, crypto.SHA512); err != ErrUnsupportedEd25519Options {
+		t.Errorf("Sign with a hash: got %v, want ErrUnsupportedEd25519Options", err)
+	}
+	id, _, err := key.Identify()
+	if err != nil {
+		t.Fatalf("Identify: %v", err)
+	}
+	found, err := FindKeyPair(id, nil)
+	if err != nil {
+		t.Fatalf("FindKeyPair: %v", err)
+	}
+	if found, ok := found.(*PKCS11PrivateKeyEd25519); !ok || found.Handle != key.Handle {
+		t.Errorf("FindKeyPair: found %T, want the generated key", found)
+	}
+}
+
+func TestEd25519Params(t *testing.T) {
+	if !isCurveParams(ed25519Params, ed25519Params, ed25519PrintableCurveID) {
+		t.Errorf("isCurveParams: OID not recognized")
+	}
+	if !isCurveParams(mustMarshal("edwards25519"), ed25519Params, ed25519PrintableCurveID) {
+		t.Errorf("isCurveParams: printable curve name not recognized")
+	}
+	if isCurveParams(wellKnownCurves["P-256"].oid, ed25519Params, ed25519PrintableCurveID) {
+		t.Errorf("isCurveParams: accepted P-256")
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// signerCache holds the keys found by FindAndSign, by slot and hex-encoded CKA_ID.
+type signerCache struct {
+	m       sync.Mutex
+	signers map[uint]map[string]crypto.Signer
+}
+
+var signers = signerCache{signers: map[uint]map[string]crypto.Signer{}}
+
+func (c *signerCache) get(slot uint, id string) crypto.Signer {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.signers[slot][id]
+}
+
+func (c *signerCache) put(slot uint, id string, signer crypto.Signer) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.signers[slot] == nil {
+		c.signers[slot] = map[string]crypto.Signer{}
+	}
+	c.signers[slot][id] = signer
+}
+
+func (c *signerCache) forget(slot uint, id string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.signers[slot], id)
+}
+
+// forgetHandle discards the cached keys whose private key object has the handle, on any slot.
+func (c *signerCache) forgetHandle(handle pkcs11.ObjectHandle) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for _, byID := range c.signers {
+		for id, signer := range byID {
+			if object := signerObject(signer); object != nil && object.Handle == handle {
+				delete(byID, id)
+			}
+		}
+	}
+}
+
+// signerObject returns the private key object of a key returned by this package, or nil.
+func signerObject(signer crypto.Signer) *PKCS11Object {
+	switch k := signer.(type) {
+	case *PKCS11PrivateKeyRSA:
+		return &k.PKCS11Object
+	case *PKCS11PrivateKeyECDSA:
+		return &k.PKCS11Object
+	case *PKCS11PrivateKeyDSA:
+		return &k.PKCS11Object
+	case *PKCS11PrivateKeyEd25519:
+		return &k.PKCS11Object
+	default:
+		return nil
+	}
+}
+
+// reset discards all cached keys, e.g. because the library is being closed.
+func (c *signerCache) reset() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.signers = map[uint]map[string]crypto.Signer{}
+}
+
+// FindAndSign signs digest with the key pair whose CKA_ID is id.
+//
+// The key is found with FindKeyPair the first time and cached until
+// Close, so later calls go straight to C_SignInit. If signing with a
+// cached key fails, it is dropped from the cache and found again once,
+// in case the object was deleted and re-created on the token; the
+// error from that second attempt is returned.
+func FindAndSign(id []byte, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return FindAndSignOnSlot(instance.slot, id, digest, opts)
+}
+
+// FindAndSignOnSlot signs digest with the key pair whose CKA_ID is id, using a specified slot.
+//
+// See FindAndSign for details.
+func FindAndSignOnSlot(slot uint, id []byte, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	key := hex.EncodeToString(id)
+	if signer := signers.get(slot, key); signer != nil {
+		signature, err := signer.Sign(rand.Reader, digest, opts)
+		if err == nil {
+			return signature, nil
+		}
+		signers.forget(slot, key)
+	}
+	k, err := FindKeyPairOnSlot(slot, id, nil)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedKeyType
+	}
+	signature, err := signer.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		return nil, err
+	}
+	signers.put(slot, key, signer)
+	return signature, nil
+}
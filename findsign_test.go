@@ -0,0 +1,59 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestFindAndSign(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	key, err := GenerateRSAKeyPair(2048)
+	if err != nil {
+		t.Fatalf("GenerateRSAKeyPair: %v", err)
+	}
+	id, _, err := key.Identify()
+	if err != nil {
+		t.Fatalf("key.Identify: %v", err)
+	}
+	digest := sha256.Sum256([]byte("find and sign"))
+	for i := 0; i < 2; i++ {
+		signature, err := FindAndSign(id, digest[:], crypto.SHA256)
+		if err != nil {
+			t.Fatalf("FindAndSign: %v", err)
+		}
+		if err = rsa.VerifyPKCS1v15(key.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], signature); err != nil {
+			t.Errorf("FindAndSign: bad signature: %v", err)
+		}
+		if signers.get(key.Slot, hex.EncodeToString(id)) == nil {
+			t.Errorf("FindAndSign: key not cached")
+		}
+	}
+	if _, err = FindAndSign([]byte("no such key"), digest[:], crypto.SHA256); err != ErrKeyNotFound {
+		t.Errorf("FindAndSign with unknown ID: got %v, want ErrKeyNotFound", err)
+	}
+}
@@ -22,11 +22,10 @@
 package crypto11
 
 import (
-	"context"
+	"crypto"
 	"errors"
 	"fmt"
 	"github.com/miekg/pkcs11"
-	"github.com/youtube/vitess/go/pools"
 	"hash"
 )
 
@@ -107,6 +106,14 @@ var hmacInfos = map[int]*hmacInfo{
 	pkcs11.CKM_SHA512_256_HMAC_GENERAL: {32, 128, true},
 	pkcs11.CKM_RIPEMD160_HMAC:          {20, 64, false},
 	pkcs11.CKM_RIPEMD160_HMAC_GENERAL:  {20, 64, true},
+	pkcs11.CKM_AES_MAC:                 {8, 16, false},
+	pkcs11.CKM_AES_MAC_GENERAL:         {8, 16, true},
+	pkcs11.CKM_AES_CMAC:                {16, 16, false},
+	pkcs11.CKM_AES_CMAC_GENERAL:        {16, 16, true},
+	pkcs11.CKM_DES3_MAC:                {4, 8, false},
+	pkcs11.CKM_DES3_MAC_GENERAL:        {4, 8, true},
+	pkcs11.CKM_DES3_CMAC:               {8, 8, false},
+	pkcs11.CKM_DES3_CMAC_GENERAL:       {8, 8, true},
 }
 
 // ErrHmacClosed is called if an HMAC is updated after it has finished.
@@ -116,12 +123,20 @@ var ErrHmacClosed = errors.New("already called Sum()")
 // and key.
 // length specifies the output size, for _GENERAL mechanisms.
 //
+// Besides the HMAC mechanisms, the built-in list includes the AES and
+// DES3 CBC-MAC and CMAC mechanisms, for keys created with
+// KeyAttributes.MAC.
+//
 // If the mechanism is not in the built-in list of known mechanisms then the
 // Size() function will return whatever length was, even if it is wrong.
 // BlockSize() will always return 0 in this case.
 //
-// The Reset() method is not implemented.
-// After Sum() is called no new data may be added.
+// After Sum() is called no new data may be added, though Sum() may be
+// called again and returns the same result. Reset() starts a new
+// computation on the token.
+//
+// The hash holds a session from the pool until Sum() is called, so
+// it should always be called, even if the result is not wanted.
 func (key *PKCS11SecretKey) NewHMAC(mech int, length int) (h hash.Hash, err error) {
 	var hi hmacImplementation
 	hi = hmacImplementation{
@@ -141,35 +156,59 @@ func (key *PKCS11SecretKey) NewHMAC(mech int, length int) (h hash.Hash, err erro
 	}
 	hi.mechDescription = []*pkcs11.Mechanism{pkcs11.NewMechanism(uint(mech), params)}
 	if err = hi.initialize(); err != nil {
+		err = key.wrapError("NewHMAC", err)
 		return
 	}
 	h = &hi
 	return
 }
 
+// hmacMechanisms maps hash functions to the corresponding full-length HMAC mechanisms.
+var hmacMechanisms = map[crypto.Hash]int{
+	crypto.MD5:        pkcs11.CKM_MD5_HMAC,
+	crypto.SHA1:       pkcs11.CKM_SHA_1_HMAC,
+	crypto.SHA224:     pkcs11.CKM_SHA224_HMAC,
+	crypto.SHA256:     pkcs11.CKM_SHA256_HMAC,
+	crypto.SHA384:     pkcs11.CKM_SHA384_HMAC,
+	crypto.SHA512:     pkcs11.CKM_SHA512_HMAC,
+	crypto.SHA512_224: pkcs11.CKM_SHA512_224_HMAC,
+	crypto.SHA512_256: pkcs11.CKM_SHA512_256_HMAC,
+	crypto.RIPEMD160:  pkcs11.CKM_RIPEMD160_HMAC,
+}
+
+// NewHMACWithHash returns a new HMAC hash using the key and the HMAC mechanism for a hash function.
+//
+// For example crypto.SHA256 selects CKM_SHA256_HMAC, so the result
+// matches hmac.New(sha256.New, k) where k is the key's value. The key
+// may be a CKK_GENERIC_SECRET key or one of the CKK_..._HMAC types; the
+// token decides which key types it accepts for which mechanisms. See
+// NewHMAC for the behaviour of the returned hash.
+func (key *PKCS11SecretKey) NewHMACWithHash(hashFunction crypto.Hash) (hash.Hash, error) {
+	mech, ok := hmacMechanisms[hashFunction]
+	if !ok {
+		return nil, fmt.Errorf("crypto11: no HMAC mechanism for hash function %v", hashFunction)
+	}
+	return key.NewHMAC(mech, 0)
+}
+
 func (hi *hmacImplementation) initialize() (err error) {
 	// TODO refactor with newBlockModeCloser
-	sessionPool := pool.Get(hi.key.Slot)
-	if sessionPool == nil {
-		err = fmt.Errorf("crypto11: no session for slot %d", hi.key.Slot)
+	var release func()
+	if release, err = hi.key.acquireOp(); err != nil {
 		return
 	}
-	ctx := context.Background()
-	if instance.cfg.PoolWaitTimeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(context.Background(), instance.cfg.PoolWaitTimeout)
-		defer cancel()
-	}
-	var session pools.Resource
-	if session, err = sessionPool.Get(ctx); err != nil {
+	sessionPool, session, err := getSession(hi.key.Slot)
+	if err != nil {
+		release()
 		return
 	}
-	hi.session = session.(*PKCS11Session)
+	hi.session = session
 	hi.cleanup = func() {
 		sessionPool.Put(session)
 		hi.session = nil
+		release()
 	}
-	if err = hi.session.Ctx.SignInit(hi.session.Handle, hi.mechDescription, hi.key.Handle); err != nil {
+	if err = traceCall("C_SignInit", hi.mechDescription, hi.session.Ctx.SignInit(hi.session.Handle, hi.mechDescription, hi.key.Handle)); err != nil {
 		hi.cleanup()
 		return
 	}
@@ -204,6 +243,7 @@ func (hi *hmacImplementation) Sum(b []byte) []byte {
 			}
 		}
 		hi.result, err = hi.session.Ctx.SignFinal(hi.session.Handle)
+		traceCall("C_SignFinal", nil, err)
 		hi.cleanup()
 		if err != nil {
 			panic(err)
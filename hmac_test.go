@@ -23,6 +23,9 @@ package crypto11
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
 	"github.com/miekg/pkcs11"
 	"hash"
 	"testing"
@@ -183,3 +186,42 @@ func testHmac(t *testing.T, keytype int, mech int, length int, xlength int, full
 		})
 	}
 }
+
+func TestHmacWithHash(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	info, err := instance.ctx.GetInfo()
+	if err != nil {
+		t.Fatalf("GetInfo: %v", err)
+	}
+	if info.ManufacturerID == "SoftHSM" {
+		t.Skipf("HMAC not implemented on SoftHSM")
+	}
+	// Readable, so the result can be checked with crypto/hmac
+	key, err := GenerateSecretKeyWithAttributes(&KeyAttributes{
+		Cipher:      &CipherHMACSHA256,
+		Bits:        256,
+		Extractable: true,
+	})
+	if err != nil {
+		t.Fatalf("GenerateSecretKeyWithAttributes: %v", err)
+	}
+	value, err := ExportSecretKey(key)
+	if err != nil {
+		t.Skipf("ExportSecretKey: %v", err)
+	}
+	h, err := key.NewHMACWithHash(crypto.SHA256)
+	if err != nil {
+		t.Fatalf("key.NewHMACWithHash: %v", err)
+	}
+	input := []byte("a short string")
+	h.Write(input)
+	want := hmac.New(sha256.New, value)
+	want.Write(input)
+	if !bytes.Equal(h.Sum(nil), want.Sum(nil)) {
+		t.Errorf("NewHMACWithHash: result differs from crypto/hmac")
+	}
+	if _, err = key.NewHMACWithHash(crypto.SHA3_256); err == nil {
+		t.Errorf("NewHMACWithHash(SHA3_256): no error")
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+)
+
+// ErrTokenIdentityMismatch is returned by VerifyTokenIdentity when the token's key does not match the expected public key.
+var ErrTokenIdentityMismatch = errors.New("crypto11: token key does not match the expected public key")
+
+// VerifyTokenIdentity checks that the token holds the private key for a known public key.
+//
+// The key pair with CKA_ID keyID is found, made to sign the SHA-256
+// hash of a fresh random nonce, and the signature is checked in
+// software against expectedPub. The public key the token reports is
+// not used, so a token that holds a different key, or that is not the
+// intended token at all, is detected even if it claims the expected
+// public key.
+//
+// If the signature does not verify, including when the key on the
+// token is of a different type, ErrTokenIdentityMismatch is returned.
+// RSA, ECDSA and DSA public keys are supported.
+func VerifyTokenIdentity(expectedPub crypto.PublicKey, keyID []byte) error {
+	k, err := FindKeyPair(keyID, nil)
+	if err != nil {
+		return err
+	}
+	signer, ok := k.(crypto.Signer)
+	if !ok {
+		return ErrUnsupportedKeyType
+	}
+	nonce := make([]byte, 32)
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	hash := sha256.Sum256(nonce)
+	digest := hash[:]
+	switch pub := expectedPub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	case *dsa.PublicKey:
+		// DSA signs the leftmost bits of the hash, as many as Q has
+		if n := (pub.Q.BitLen() + 7) / 8; n < len(digest) {
+			digest = digest[:n]
+		}
+	default:
+		return ErrUnsupportedKeyType
+	}
+	signature, err := signer.Sign(rand.Reader, digest, crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	var verified bool
+	switch pub := expectedPub.(type) {
+	case *rsa.PublicKey:
+		verified = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		var sig dsaSignature
+		if rest, err := asn1.Unmarshal(signature, &sig); err == nil && len(rest) == 0 {
+			verified = ecdsa.Verify(pub, digest, sig.R, sig.S)
+		}
+	case *dsa.PublicKey:
+		var sig dsaSignature
+		if rest, err := asn1.Unmarshal(signature, &sig); err == nil && len(rest) == 0 {
+			verified = dsa.Verify(pub, digest, sig.R, sig.S)
+		}
+	}
+	if !verified {
+		return ErrTokenIdentityMismatch
+	}
+	return nil
+}
@@ -22,21 +22,270 @@
 package crypto11
 
 import (
+	"bytes"
 	"crypto"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
 
 	pkcs11 "github.com/miekg/pkcs11"
 )
 
+// KeyAttributes describes the attributes of a key to be created on the token.
+//
+// The zero value describes a token-resident, sensitive,
+// non-extractable key with a random ID and label.
+type KeyAttributes struct {
+	// CKA_ID of the new key. If nil then a random value is generated.
+	ID []byte
+
+	// CKA_LABEL of the new key. If nil then a random value is generated.
+	Label []byte
+
+	// For secret keys, the cipher the key is for.
+	Cipher *SymmetricCipher
+
+	// For secret keys, the key length in bits. If 0 then the key
+	// length is left to the token (or the mechanism).
+	Bits int
+
+	// If true, the key is created with CKA_EXTRACTABLE set, so that
+	// it may be wrapped out of the token. A secret key is also created
+	// with CKA_SENSITIVE clear, so that its value may be read (see
+	// ExportSecretKey), unless Sensitive is set as well. Private keys
+	// keep CKA_SENSITIVE set.
+	Extractable bool
+
+	// If true, a secret key created with Extractable keeps
+	// CKA_SENSITIVE set, so that it can be wrapped out of the token but
+	// its value cannot be read in the clear. Keys that are not
+	// extractable are always sensitive.
+	Sensitive bool
+
+	// If true, the key is created with CKA_WRAP and CKA_UNWRAP set,
+	// so that it can be used to wrap and unwrap other keys.
+	Wrap bool
+
+	// If true, a secret key is created with CKA_SIGN and CKA_VERIFY
+	// set, so that it can compute MACs (e.g. with NewCMAC), even if
+	// its cipher is not a MAC cipher. AES and DES3 keys need this for
+	// CMAC; without it they are encryption-only.
+	MAC bool
+
+	// If true, the key is created with CKA_DERIVE set, so that other
+	// keys can be derived from it (e.g. by HKDFDerive, or for an
+	// ECDSA key pair by ECDH).
+	Derive bool
+
+	// If true, the key is created with CKA_TRUSTED set (for a key
+	// pair, on the public key, which is the half that wraps). Only the
+	// security officer may set this, so the key must be created on a
+	// session logged in as SO; otherwise ErrTrustedNeedsSO is returned.
+	// This applies to imported keys too.
+	Trusted bool
+
+	// If true, the key is created with CKA_WRAP_WITH_TRUSTED set (for
+	// a key pair, on the private key), so that it can only be wrapped
+	// by a key with CKA_TRUSTED set.
+	WrapWithTrusted bool
+
+	// If not empty, the key is created with CKA_ALLOWED_MECHANISMS
+	// set, so that the token will only use it with these mechanisms
+	// (CKM_... constants).
+	AllowedMechanisms []uint
+
+	// Further attributes, e.g. vendor-defined ones, to include in the
+	// template verbatim. For key pairs they are included in both the
+	// public and private key templates. An attribute that the default
+	// template already sets, such as CKA_SIGN, CKA_EXTRACTABLE or
+	// CKA_MODIFIABLE, is replaced rather than repeated, since the
+	// token may reject a template that mentions an attribute twice.
+	// Use ID and Label rather than setting CKA_ID or CKA_LABEL here.
+	Extra []*pkcs11.Attribute
+
+	// For key pairs, further attributes for the public key template
+	// only, e.g. CKA_ENCRYPT. They are applied after Extra, in the
+	// same way.
+	PublicExtra []*pkcs11.Attribute
+
+	// For key pairs, further attributes for the private key template
+	// only, e.g. CKA_DECRYPT or CKA_EXTRACTABLE. They are applied
+	// after Extra, in the same way.
+	PrivateExtra []*pkcs11.Attribute
+
+	// What to do if Label is set and a key with that label already
+	// exists. The default is LabelCollisionAllow.
+	LabelCollision LabelCollisionPolicy
+}
+
+// LabelCollisionPolicy says what to do when a new key's label is already in use.
+//
+// Tokens differ: some refuse to create a second object with the same
+// label and some allow it. The policy makes the outcome the same on
+// every token.
+type LabelCollisionPolicy int
+
+const (
+	// LabelCollisionAllow creates the new key anyway, leaving it to
+	// the token whether that succeeds.
+	LabelCollisionAllow LabelCollisionPolicy = iota
+
+	// LabelCollisionError fails with ErrLabelExists.
+	LabelCollisionError
+
+	// LabelCollisionReplace destroys the existing keys with the label
+	// before creating the new one.
+	LabelCollisionReplace
+)
+
+var errNoCipher = errors.New("crypto11: no cipher specified for secret key")
+
+// Fill in random values for the ID and label, if they are absent.
+func (attrs *KeyAttributes) identity() (id []byte, label []byte, err error) {
+	if id = attrs.ID; id == nil {
+		if id, err = generateKeyLabel(); err != nil {
+			return
+		}
+	}
+	if label = attrs.Label; label == nil {
+		if label, err = generateKeyLabel(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// checkLabelCollision applies attrs.LabelCollision before a key with attrs.Label is created.
+//
+// classes are the object classes the new key will have, e.g. the
+// private and public key classes for a key pair. Only existing keys of
+// those classes count as collisions.
+func (attrs *KeyAttributes) checkLabelCollision(session *PKCS11Session, classes ...uint) error {
+	if attrs.Label == nil || attrs.LabelCollision == LabelCollisionAllow {
+		return nil
+	}
+	var existing []pkcs11.ObjectHandle
+	for _, class := range classes {
+		handles, err := findObjects(session, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, attrs.Label),
+		})
+		if err != nil {
+			return err
+		}
+		existing = append(existing, handles...)
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+	switch attrs.LabelCollision {
+	case LabelCollisionError:
+		return ErrLabelExists
+	case LabelCollisionReplace:
+		for _, handle := range existing {
+			if err := destroyObject(session, handle); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("crypto11: unrecognized LabelCollisionPolicy %d", attrs.LabelCollision)
+	}
+}
+
+// secretKeyTemplate returns the attribute template for a secret key of the given key type.
+func (attrs *KeyAttributes) secretKeyTemplate(keyType uint) ([]*pkcs11.Attribute, error) {
+	if attrs.Cipher == nil {
+		return nil, errNoCipher
+	}
+	id, label, err := attrs.identity()
+	if err != nil {
+		return nil, err
+	}
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, attrs.Cipher.MAC || attrs.MAC),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, attrs.Cipher.MAC || attrs.MAC),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, attrs.Cipher.Encrypt),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, attrs.Cipher.Encrypt),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, attrs.Wrap),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, attrs.Wrap),
+		pkcs11.NewAttribute(pkcs11.CKA_DERIVE, attrs.Derive),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, !attrs.Extractable || attrs.Sensitive),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, attrs.Extractable),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	template = append(template, attrs.trustTemplate()...)
+	if len(attrs.AllowedMechanisms) > 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ALLOWED_MECHANISMS, encodeMechanisms(attrs.AllowedMechanisms)))
+	}
+	if attrs.Bits > 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, attrs.Bits/8))
+	}
+	return mergeTemplate(template, attrs.Extra), nil
+}
+
+// keyPairTemplates completes both default key pair templates from attrs.
+//
+// The trust attributes are added (CKA_TRUSTED to the public key and
+// CKA_WRAP_WITH_TRUSTED to the private key), then attrs.Extra is
+// applied to both, then PublicExtra and PrivateExtra to one each.
+func (attrs *KeyAttributes) keyPairTemplates(public []*pkcs11.Attribute, private []*pkcs11.Attribute) ([]*pkcs11.Attribute, []*pkcs11.Attribute) {
+	if attrs.Trusted {
+		public = append(public, pkcs11.NewAttribute(pkcs11.CKA_TRUSTED, true))
+	}
+	if attrs.WrapWithTrusted {
+		private = append(private, pkcs11.NewAttribute(pkcs11.CKA_WRAP_WITH_TRUSTED, true))
+	}
+	public = mergeTemplate(mergeTemplate(public, attrs.Extra), attrs.PublicExtra)
+	private = mergeTemplate(mergeTemplate(private, attrs.Extra), attrs.PrivateExtra)
+	return public, private
+}
+
+// trustTemplate returns the CKA_TRUSTED and CKA_WRAP_WITH_TRUSTED attributes, if requested.
+//
+// They are omitted when false, since some tokens refuse any mention of
+// CKA_TRUSTED outside an SO session.
+func (attrs *KeyAttributes) trustTemplate() (template []*pkcs11.Attribute) {
+	if attrs.Trusted {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_TRUSTED, true))
+	}
+	if attrs.WrapWithTrusted {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_WRAP_WITH_TRUSTED, true))
+	}
+	return
+}
+
+// trustError maps the token's refusal to set CKA_TRUSTED to ErrTrustedNeedsSO.
+func (attrs *KeyAttributes) trustError(err error) error {
+	if e, ok := err.(pkcs11.Error); ok && attrs.Trusted {
+		if e == pkcs11.CKR_ATTRIBUTE_READ_ONLY || e == pkcs11.CKR_USER_NOT_LOGGED_IN {
+			return ErrTrustedNeedsSO
+		}
+	}
+	return err
+}
+
 // Identify returns the ID and label for a PKCS#11 object.
 //
 // Either of these values may be used to retrieve the key for later use.
+// The token is contacted on every call; for private keys, see also
+// PKCS11PrivateKey.Info.
 func (object *PKCS11Object) Identify() (id []byte, label []byte, err error) {
+	if err = object.checkLive(); err != nil {
+		return nil, nil, err
+	}
 	a := []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
 		pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
 	}
 	if err = withSession(object.Slot, func(session *PKCS11Session) error {
-		a, err = instance.ctx.GetAttributeValue(session.Handle, object.Handle, a)
+		a, err = getAttributes(session, object.Handle, a)
 		return err
 	}); err != nil {
 		return nil, nil, err
@@ -44,11 +293,114 @@ func (object *PKCS11Object) Identify() (id []byte, label []byte, err error) {
 	return a[0].Value, a[1].Value, nil
 }
 
+// IDString returns the object's CKA_ID as a hex string.
+//
+// This is the form accepted by FindKeyPairByIDString, FindKeyByIDString
+// and the KeyID configuration field, so it can be stored as a
+// reference to the key and used to find it again.
+func (object *PKCS11Object) IDString() (string, error) {
+	id, _, err := object.Identify()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Valid reports whether the object handle still refers to a live object.
+//
+// It performs a cheap attribute read (CKA_CLASS) on the token. A false
+// return means the handle is dead (for instance because the token was
+// removed and reinserted, the HSM failed over, or the library has been
+// closed and configured again since the object was found) or that the token
+// cannot currently be reached; in either case the caller should find
+// the object again before using it.
+func (object *PKCS11Object) Valid() bool {
+	if object.checkLive() != nil {
+		return false
+	}
+	a := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, nil),
+	}
+	err := withSession(object.Slot, func(session *PKCS11Session) error {
+		_, err := getAttributes(session, object.Handle, a)
+		return err
+	})
+	return err == nil
+}
+
+// SignWithMechanism signs data with the object using a caller-supplied mechanism.
+//
+// The mechanism is passed to C_SignInit unmodified, including its
+// parameter bytes, bypassing the mapping from crypto.SignerOpts that
+// the Sign methods perform. This allows vendor-specific mechanisms,
+// or mechanisms crypto11 does not otherwise support, to be used.
+// The caller is responsible for encoding the parameters in the form
+// the PKCS#11 library expects, and for interpreting the result.
+func (object *PKCS11Object) SignWithMechanism(mech *pkcs11.Mechanism, data []byte) (signature []byte, err error) {
+	signature, err = withSignSession(object, func(session *PKCS11Session) ([]byte, error) {
+		if err := traceCall("C_SignInit", []*pkcs11.Mechanism{mech}, session.Ctx.SignInit(session.Handle, []*pkcs11.Mechanism{mech}, object.Handle)); err != nil {
+			return nil, err
+		}
+		signature, err := session.Ctx.Sign(session.Handle, data)
+		return signature, traceCall("C_Sign", nil, err)
+	})
+	return signature, object.wrapError("Sign", err)
+}
+
+// wrapError adds the object's slot, handle, ID and label to a PKCS#11 error.
+//
+// Other errors, such as crypto11's own, are returned unchanged. The
+// token is not contacted: the ID and label are those recorded when the
+// object was found or created, so that a failure costs no more than a
+// success (which matters for e.g. RSA decryption).
+func (object *PKCS11Object) wrapError(op string, err error) error {
+	if _, ok := err.(pkcs11.Error); !ok {
+		return err
+	}
+	e := &ObjectError{Op: op, Slot: object.Slot, Handle: object.Handle, Err: err}
+	if object.identity != nil {
+		e.ID, e.Label = object.identity.id, object.identity.label
+	}
+	return e
+}
+
+// Create an object from a template.
+func createObject(session *PKCS11Session, template []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	handle, err := session.Ctx.CreateObject(session.Handle, template)
+	return handle, storageError(traceCall("C_CreateObject", nil, err, template))
+}
+
+// getAttributes reads attributes of an object, as by C_GetAttributeValue.
+func getAttributes(session *PKCS11Session, handle pkcs11.ObjectHandle, template []*pkcs11.Attribute) ([]*pkcs11.Attribute, error) {
+	attributes, err := session.Ctx.GetAttributeValue(session.Handle, handle, template)
+	return attributes, traceCall("C_GetAttributeValue", nil, err, attributes)
+}
+
+// storageError maps the token's report that it has no room for a new object to ErrTokenFull.
+func storageError(err error) error {
+	if e, ok := err.(pkcs11.Error); ok && e == pkcs11.CKR_DEVICE_MEMORY {
+		return ErrTokenFull
+	}
+	return err
+}
+
+// Create a public and private key object from templates.
+//
+// If the private key object cannot be created then the public key
+// object is destroyed again.
+func importKeyPair(session *PKCS11Session, publicKeyTemplate []*pkcs11.Attribute, privateKeyTemplate []*pkcs11.Attribute) (pubHandle pkcs11.ObjectHandle, privHandle pkcs11.ObjectHandle, err error) {
+	if pubHandle, err = createObject(session, publicKeyTemplate); err != nil {
+		return
+	}
+	if privHandle, err = createObject(session, privateKeyTemplate); err != nil {
+		destroyObject(session, pubHandle)
+	}
+	return
+}
+
 // Find a key object.  For asymmetric keys this only finds one half so
 // callers will call it twice.
 func findKey(session *PKCS11Session, id []byte, label []byte, keyclass uint, keytype uint) (pkcs11.ObjectHandle, error) {
-	var err error
-	var handles []pkcs11.ObjectHandle
 	var template []*pkcs11.Attribute
 	if keyclass != ^uint(0) {
 		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_CLASS, keyclass))
@@ -62,7 +414,18 @@ func findKey(session *PKCS11Session, id []byte, label []byte, keyclass uint, key
 	if label != nil {
 		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, label))
 	}
-	if err = session.Ctx.FindObjectsInit(session.Handle, template); err != nil {
+	return findObject(session, template)
+}
+
+// Find the first object matching a template.
+//
+// C_FindObjectsInit, C_FindObjects and C_FindObjectsFinal all run on
+// the given session, which the caller holds throughout; concurrent
+// finds use different pooled sessions and so do not block each other.
+func findObject(session *PKCS11Session, template []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	var err error
+	var handles []pkcs11.ObjectHandle
+	if err = traceCall("C_FindObjectsInit", nil, session.Ctx.FindObjectsInit(session.Handle, template), template); err != nil {
 		return 0, err
 	}
 	defer session.Ctx.FindObjectsFinal(session.Handle)
@@ -75,48 +438,641 @@ func findKey(session *PKCS11Session, id []byte, label []byte, keyclass uint, key
 	return handles[0], nil
 }
 
+// Find all objects matching a template.
+func findObjects(session *PKCS11Session, template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+	var err error
+	var handles []pkcs11.ObjectHandle
+	if err = traceCall("C_FindObjectsInit", nil, session.Ctx.FindObjectsInit(session.Handle, template), template); err != nil {
+		return nil, err
+	}
+	defer session.Ctx.FindObjectsFinal(session.Handle)
+	for {
+		var batch []pkcs11.ObjectHandle
+		if batch, _, err = session.Ctx.FindObjects(session.Handle, 64); err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			return handles, nil
+		}
+		handles = append(handles, batch...)
+	}
+}
+
+// DestroyByLabelPrefix destroys every private and public key object whose CKA_LABEL starts with prefix.
+//
+// The comparison is on the exact label bytes; objects with no label
+// never match. The return value is the number of objects destroyed,
+// so a complete key pair counts twice. An empty prefix is rejected
+// with ErrEmptyLabelPrefix.
+func DestroyByLabelPrefix(prefix []byte) (int, error) {
+	return DestroyByLabelPrefixOnSlot(instance.slot, prefix)
+}
+
+// DestroyByLabelPrefixOnSlot destroys key objects by label prefix, using a specified slot.
+func DestroyByLabelPrefixOnSlot(slot uint, prefix []byte) (int, error) {
+	var err error
+	var n int
+	if err = ensureSessions(instance, slot); err != nil {
+		return 0, err
+	}
+	err = withSession(slot, func(session *PKCS11Session) error {
+		n, err = DestroyByLabelPrefixOnSession(session, prefix)
+		return err
+	})
+	return n, err
+}
+
+// DestroyByLabelPrefixOnSession destroys key objects by label prefix, using a specified session.
+//
+// If destroying an object fails then the count of objects destroyed
+// so far is returned along with the error.
+func DestroyByLabelPrefixOnSession(session *PKCS11Session, prefix []byte) (int, error) {
+	if len(prefix) == 0 {
+		return 0, ErrEmptyLabelPrefix
+	}
+	var matched []pkcs11.ObjectHandle
+	for _, class := range []uint{pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY} {
+		handles, err := findObjects(session, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)})
+		if err != nil {
+			return 0, err
+		}
+		for _, handle := range handles {
+			attributes, err := getAttributes(session, handle, []*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+			})
+			if err != nil {
+				// No readable label, so it cannot match
+				continue
+			}
+			if bytes.HasPrefix(attributes[0].Value, prefix) {
+				matched = append(matched, handle)
+			}
+		}
+	}
+	// Destroy only after the searches have finished, since modifying
+	// objects during a search has undefined results.
+	for n, handle := range matched {
+		if err := destroyObject(session, handle); err != nil {
+			return n, err
+		}
+	}
+	return len(matched), nil
+}
+
+// Delete destroys the private key object and the public key object with the same CKA_ID.
+//
+// If there is no public key object only the private key is destroyed.
+// The private key is destroyed first, so if destroying the public key
+// fails the key can no longer be used but the public half remains on
+// the token. Afterwards the key, and any other reference to the same
+// object, must not be used.
+func (priv *PKCS11PrivateKey) Delete() error {
+	err := withKeySession(&priv.PKCS11Object, func(session *PKCS11Session) error {
+		return destroyKeyPair(session, priv.Slot, priv.Handle)
+	})
+	return priv.wrapError("Delete", err)
+}
+
+// DeleteKeyPair destroys a key pair on the token.
+//
+// Either (but not both) of id and label may be nil, in which case they
+// are ignored. The first matching private key is destroyed, along with
+// the public key object with the same CKA_ID; see Delete. If there is
+// no matching private key, ErrKeyNotFound is returned.
+func DeleteKeyPair(id []byte, label []byte) error {
+	return DeleteKeyPairOnSlot(instance.slot, id, label)
+}
+
+// DeleteKeyPairOnSlot destroys a key pair, using a specified slot.
+func DeleteKeyPairOnSlot(slot uint, id []byte, label []byte) error {
+	if err := ensureSessions(instance, slot); err != nil {
+		return err
+	}
+	return withSession(slot, func(session *PKCS11Session) error {
+		return DeleteKeyPairOnSession(session, slot, id, label)
+	})
+}
+
+// DeleteKeyPairOnSession destroys a key pair, using a specified session.
+func DeleteKeyPairOnSession(session *PKCS11Session, slot uint, id []byte, label []byte) error {
+	privHandle, err := findKey(session, id, label, pkcs11.CKO_PRIVATE_KEY, ^uint(0))
+	if err != nil {
+		return err
+	}
+	return destroyKeyPair(session, slot, privHandle)
+}
+
+// destroyKeyPair destroys a private key object and the public key object with the same CKA_ID and type.
+//
+// FindAndSign keys cached under the CKA_ID are discarded too.
+func destroyKeyPair(session *PKCS11Session, slot uint, privHandle pkcs11.ObjectHandle) error {
+	attributes, err := getAttributes(session, privHandle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+	if err != nil {
+		return err
+	}
+	id := attributes[0].Value
+	var pubHandle pkcs11.ObjectHandle
+	if len(id) > 0 {
+		// Find before destroying, since modifying objects during a
+		// search has undefined results.
+		pubHandle, err = findKey(session, id, nil, pkcs11.CKO_PUBLIC_KEY, bytesToUlong(attributes[1].Value))
+		if err != nil && err != ErrKeyNotFound {
+			return err
+		}
+	}
+	if err = destroyObject(session, privHandle); err != nil {
+		return err
+	}
+	signers.forget(slot, hex.EncodeToString(id))
+	if pubHandle == 0 {
+		return nil
+	}
+	return destroyObject(session, pubHandle)
+}
+
+// destroyObject destroys an object, discarding anything cached for its handle.
+//
+// The token may give the handle to a new object, so cached signatures,
+// FindAndSign keys and concurrency limits must not outlive the object. The session's slot
+// is not known, so entries for the handle on every slot are discarded;
+// at worst this costs a cache miss.
+func destroyObject(session *PKCS11Session, handle pkcs11.ObjectHandle) error {
+	err := traceCall("C_DestroyObject", nil, session.Ctx.DestroyObject(session.Handle, handle))
+	signatures.forgetHandle(handle)
+	signers.forgetHandle(handle)
+	limits.forgetHandle(handle)
+	return err
+}
+
+// SlotOf returns the slot of the token holding a key.
+//
+// The second result is false if key was not returned by this package.
+func SlotOf(key crypto.Signer) (uint, bool) {
+	switch k := key.(type) {
+	case *PKCS11PrivateKeyRSA:
+		return k.Slot, true
+	case *PKCS11PrivateKeyECDSA:
+		return k.Slot, true
+	case *PKCS11PrivateKeyDSA:
+		return k.Slot, true
+	case *PKCS11PrivateKeyEd25519:
+		return k.Slot, true
+	default:
+		return 0, false
+	}
+}
+
 // FindKeyPair retrieves a previously created asymmetric key.
 //
-// Either (but not both) of id and label may be nil, in which case they are ignored.
+// Either (but not both) of id and label may be nil, in which case they
+// are ignored. If several private keys match, the first the token
+// returns is used; FindKeyPairMatch returns them all.
+//
+// Only the private key object need match both id and label. The public
+// key object is found by the private key object's own CKA_ID, or by its
+// CKA_LABEL if it has no CKA_ID, so a key found by label alone is
+// completed even if its public key object has a different label.
+//
+// If there is no public key object then the public key is recovered
+// from the private key object where possible. For RSA keys it is read
+// from CKA_MODULUS and CKA_PUBLIC_EXPONENT, which PKCS#11 requires on
+// the private key. For EC keys it only works if the token exposes
+// CKA_EC_POINT on the private key, which is not required by PKCS#11.
+// If the public key cannot be recovered, ErrNoPublicKey is returned.
 func FindKeyPair(id []byte, label []byte) (crypto.PrivateKey, error) {
 	return FindKeyPairOnSlot(instance.slot, id, label)
 }
 
+// ConfiguredKey retrieves the key pair whose CKA_ID is given by KeyID in the configuration.
+//
+// ErrNoConfiguredKey is returned if KeyID is not set.
+func ConfiguredKey() (crypto.Signer, error) {
+	if instance.ctx == nil {
+		return nil, ErrNotConfigured
+	}
+	if instance.cfg.KeyID == "" {
+		return nil, ErrNoConfiguredKey
+	}
+	id, err := decodeKeyID(instance.cfg.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	k, err := FindKeyPair(id, nil)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedKeyType
+	}
+	return signer, nil
+}
+
+// FindKeyPairByIDString retrieves a previously created asymmetric key by a textual CKA_ID.
+//
+// The ID may be hex, as returned by IDString, or base64; see KeyID in
+// PKCS11Config.
+func FindKeyPairByIDString(id string) (crypto.PrivateKey, error) {
+	bid, err := decodeKeyID(id)
+	if err != nil {
+		return nil, err
+	}
+	return FindKeyPair(bid, nil)
+}
+
+// decodeKeyID decodes a CKA_ID given as text.
+//
+// Hex is tried first, then standard and URL-safe base64 (with or
+// without padding). A string that is valid hex is always treated as
+// hex.
+func decodeKeyID(s string) ([]byte, error) {
+	if id, err := hex.DecodeString(s); err == nil {
+		return id, nil
+	}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if id, err := encoding.DecodeString(s); err == nil {
+			return id, nil
+		}
+	}
+	return nil, fmt.Errorf("crypto11: key ID %q is neither hex nor base64", s)
+}
+
 // FindKeyPairOnSlot retrieves a previously created asymmetric key, using a specified slot.
 //
 // Either (but not both) of id and label may be nil, in which case they are ignored.
 func FindKeyPairOnSlot(slot uint, id []byte, label []byte) (crypto.PrivateKey, error) {
-	var err error
-	var k crypto.PrivateKey
-	if err = ensureSessions(instance, slot); err != nil {
+	if err := ensureSessions(instance, slot); err != nil {
 		return nil, err
 	}
-	err = withSession(slot, func(session *PKCS11Session) error {
-		k, err = FindKeyPairOnSession(session, slot, id, label)
-		return err
+	k, err := withFindTimeout(slot, func(session *PKCS11Session) (interface{}, error) {
+		return FindKeyPairOnSession(session, slot, id, label)
 	})
-	return k, err
+	if err != nil {
+		return nil, err
+	}
+	return k.(crypto.PrivateKey), nil
 }
 
 // FindKeyPairOnSession retrieves a previously created asymmetric key, using a specified session.
 //
 // Either (but not both) of id and label may be nil, in which case they are ignored.
 func FindKeyPairOnSession(session *PKCS11Session, slot uint, id []byte, label []byte) (crypto.PrivateKey, error) {
-	var err error
-	var privHandle, pubHandle pkcs11.ObjectHandle
-	var pub crypto.PublicKey
+	privHandle, err := findKey(session, id, label, pkcs11.CKO_PRIVATE_KEY, ^uint(0))
+	if err != nil {
+		return nil, err
+	}
+	return findKeyPairFromPrivateHandle(session, slot, privHandle)
+}
+
+// MatchMode says how FindKeyPairMatch combines an ID and a label.
+type MatchMode int
+
+const (
+	// MatchAnd finds keys with both the ID and the label.
+	MatchAnd MatchMode = iota
 
-	if privHandle, err = findKey(session, id, label, pkcs11.CKO_PRIVATE_KEY, ^uint(0)); err != nil {
+	// MatchOr finds keys with either the ID or the label.
+	MatchOr
+)
+
+// FindKeyPairMatch retrieves all the asymmetric keys matching an ID and/or a label.
+//
+// With MatchAnd a key must have both the given ID and the given label;
+// with MatchOr either is enough, which needs two searches. A key that
+// matches both searches is returned only once. A nil id or label is
+// ignored, so MatchAnd with both nil matches every key pair, and
+// MatchOr with both nil matches none. If nothing matches then
+// ErrKeyNotFound is returned.
+//
+// The public key of each match is found by the private key object's
+// own CKA_ID, or recovered from the private key object as described
+// for FindKeyPair.
+func FindKeyPairMatch(id []byte, label []byte, mode MatchMode) ([]crypto.PrivateKey, error) {
+	return FindKeyPairMatchOnSlot(instance.slot, id, label, mode)
+}
+
+// FindKeyPairMatchOnSlot retrieves all the asymmetric keys matching an ID and/or a label, using a specified slot.
+//
+// See FindKeyPairMatch for details.
+func FindKeyPairMatchOnSlot(slot uint, id []byte, label []byte, mode MatchMode) ([]crypto.PrivateKey, error) {
+	if err := ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	keys, err := withFindTimeout(slot, func(session *PKCS11Session) (interface{}, error) {
+		return FindKeyPairMatchOnSession(session, slot, id, label, mode)
+	})
+	if err != nil {
 		return nil, err
 	}
+	return keys.([]crypto.PrivateKey), nil
+}
+
+// FindKeyPairMatchOnSession retrieves all the asymmetric keys matching an ID and/or a label, using a specified session.
+//
+// See FindKeyPairMatch for details.
+func FindKeyPairMatchOnSession(session *PKCS11Session, slot uint, id []byte, label []byte, mode MatchMode) ([]crypto.PrivateKey, error) {
+	class := pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY)
+	var templates [][]*pkcs11.Attribute
+	switch mode {
+	case MatchAnd:
+		template := []*pkcs11.Attribute{class}
+		if id != nil {
+			template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, id))
+		}
+		if label != nil {
+			template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, label))
+		}
+		templates = append(templates, template)
+	case MatchOr:
+		if id != nil {
+			templates = append(templates, []*pkcs11.Attribute{class, pkcs11.NewAttribute(pkcs11.CKA_ID, id)})
+		}
+		if label != nil {
+			templates = append(templates, []*pkcs11.Attribute{class, pkcs11.NewAttribute(pkcs11.CKA_LABEL, label)})
+		}
+	default:
+		return nil, fmt.Errorf("crypto11: unrecognized MatchMode %d", mode)
+	}
+	var privHandles []pkcs11.ObjectHandle
+	seen := map[pkcs11.ObjectHandle]bool{}
+	for _, template := range templates {
+		handles, err := findObjects(session, template)
+		if err != nil {
+			return nil, err
+		}
+		for _, handle := range handles {
+			if !seen[handle] {
+				seen[handle] = true
+				privHandles = append(privHandles, handle)
+			}
+		}
+	}
+	var keys []crypto.PrivateKey
+	for _, privHandle := range privHandles {
+		// Under MatchOr the key need not have both the ID and the
+		// label searched for, so use its own
+		k, err := findKeyPairFromPrivateHandle(session, slot, privHandle)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	return keys, nil
+}
+
+// findKeyPairFromPrivateHandle completes a key pair from a private key found by other means than its ID and label.
+//
+// The public key object is looked for by the private key object's own
+// CKA_ID, or its CKA_LABEL if it has no ID.
+func findKeyPairFromPrivateHandle(session *PKCS11Session, slot uint, privHandle pkcs11.ObjectHandle) (crypto.PrivateKey, error) {
+	attributes, err := getAttributes(session, privHandle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var id, label []byte
+	if len(attributes[0].Value) > 0 {
+		id = attributes[0].Value
+	} else {
+		label = attributes[1].Value
+	}
+	return findKeyPairFromPrivate(session, slot, privHandle, id, label)
+}
+
+// FindKeyPairByUniqueID retrieves a previously created asymmetric key by its CKA_UNIQUE_ID.
+//
+// CKA_UNIQUE_ID is assigned by the token, and is available from the
+// UniqueID field of KeyInfo. It was introduced in PKCS#11 v3.0; if the
+// library implements an earlier version then ErrUniqueIDNotSupported
+// is returned.
+func FindKeyPairByUniqueID(uid []byte) (crypto.PrivateKey, error) {
+	return FindKeyPairByUniqueIDOnSlot(instance.slot, uid)
+}
+
+// FindKeyPairByUniqueIDOnSlot retrieves a previously created asymmetric key by its CKA_UNIQUE_ID, using a specified slot.
+//
+// See FindKeyPairByUniqueID for details.
+func FindKeyPairByUniqueIDOnSlot(slot uint, uid []byte) (crypto.PrivateKey, error) {
+	if err := ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	k, err := withFindTimeout(slot, func(session *PKCS11Session) (interface{}, error) {
+		return FindKeyPairByUniqueIDOnSession(session, slot, uid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return k.(crypto.PrivateKey), nil
+}
+
+// FindKeyPairByUniqueIDOnSession retrieves a previously created asymmetric key by its CKA_UNIQUE_ID, using a specified session.
+//
+// See FindKeyPairByUniqueID for details.
+func FindKeyPairByUniqueIDOnSession(session *PKCS11Session, slot uint, uid []byte) (crypto.PrivateKey, error) {
+	supported, err := supportsUniqueID(session.Ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !supported {
+		return nil, ErrUniqueIDNotSupported
+	}
+	handles, err := findObjects(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(ckaUniqueID, uid),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(handles) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	return findKeyPairFromPrivateHandle(session, slot, handles[0])
+}
+
+// FindAndValidateKeyPair retrieves a previously created asymmetric key and checks that it is still live.
+//
+// After the key is found its private key object is read again to
+// confirm that it still exists, is a private key of type keyType (a
+// CKK_ constant, or ^uint(0) for any type) and still has the CKA_ID
+// and CKA_LABEL searched for. If not, ErrKeyNotFound is returned.
+// This narrows, but cannot close, the window in which another process
+// may destroy or replace the key before it is used.
+func FindAndValidateKeyPair(id []byte, label []byte, keyType uint) (crypto.PrivateKey, error) {
+	return FindAndValidateKeyPairOnSlot(instance.slot, id, label, keyType)
+}
+
+// FindAndValidateKeyPairOnSlot retrieves and checks a previously created asymmetric key, using a specified slot.
+//
+// See FindAndValidateKeyPair for details.
+func FindAndValidateKeyPairOnSlot(slot uint, id []byte, label []byte, keyType uint) (crypto.PrivateKey, error) {
+	k, err := FindKeyPairOnSlot(slot, id, label)
+	if err != nil {
+		return nil, err
+	}
+	if err = validateKeyPair(k, id, label, keyType); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// validateKeyPair checks that a key pair's private key object is live and as expected
+func validateKeyPair(k crypto.PrivateKey, id []byte, label []byte, keyType uint) error {
+	var priv *PKCS11PrivateKey
+	switch k := k.(type) {
+	case *PKCS11PrivateKeyDSA:
+		priv = &k.PKCS11PrivateKey
+	case *PKCS11PrivateKeyRSA:
+		priv = &k.PKCS11PrivateKey
+	case *PKCS11PrivateKeyECDSA:
+		priv = &k.PKCS11PrivateKey
+	case *PKCS11PrivateKeyEd25519:
+		priv = &k.PKCS11PrivateKey
+	case *PKCS11PrivateKeyX25519:
+		priv = &k.PKCS11PrivateKey
+	default:
+		return ErrUnsupportedKeyType
+	}
+	return withSession(priv.Slot, func(session *PKCS11Session) error {
+		attributes, err := getAttributes(session, priv.Handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+		})
+		if err != nil {
+			if code, ok := err.(pkcs11.Error); ok && code == pkcs11.CKR_OBJECT_HANDLE_INVALID {
+				return ErrKeyNotFound
+			}
+			return err
+		}
+		switch {
+		case bytesToUlong(attributes[0].Value) != pkcs11.CKO_PRIVATE_KEY,
+			keyType != ^uint(0) && bytesToUlong(attributes[1].Value) != keyType,
+			id != nil && !bytes.Equal(attributes[2].Value, id),
+			label != nil && !bytes.Equal(attributes[3].Value, label):
+			return ErrKeyNotFound
+		}
+		return nil
+	})
+}
+
+// FindKeyPairWithTemplate retrieves a previously created asymmetric key, matching the private key object against a template.
+//
+// The template is matched in addition to CKA_CLASS=CKO_PRIVATE_KEY;
+// an attribute in the template replaces the default attribute of the
+// same type, so a vendor-defined object class may be given. The
+// public key object is then found by the private key object's CKA_ID,
+// or recovered from the private key object as described for
+// FindKeyPair.
+func FindKeyPairWithTemplate(template []*pkcs11.Attribute) (crypto.PrivateKey, error) {
+	return FindKeyPairWithTemplateOnSlot(instance.slot, template)
+}
+
+// FindKeyPairWithTemplateOnSlot retrieves a previously created asymmetric key, matching a template, using a specified slot.
+//
+// See FindKeyPairWithTemplate for details.
+func FindKeyPairWithTemplateOnSlot(slot uint, template []*pkcs11.Attribute) (crypto.PrivateKey, error) {
+	if err := ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	k, err := withFindTimeout(slot, func(session *PKCS11Session) (interface{}, error) {
+		return FindKeyPairWithTemplateOnSession(session, slot, template)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return k.(crypto.PrivateKey), nil
+}
+
+// FindKeyPairWithTemplateOnSession retrieves a previously created asymmetric key, matching a template, using a specified session.
+//
+// See FindKeyPairWithTemplate for details.
+func FindKeyPairWithTemplateOnSession(session *PKCS11Session, slot uint, template []*pkcs11.Attribute) (crypto.PrivateKey, error) {
+	template = mergeTemplate([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+	}, template)
+	privHandle, err := findObject(session, template)
+	if err != nil {
+		return nil, err
+	}
+	attributes := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+	}
+	if attributes, err = getAttributes(session, privHandle, attributes); err != nil {
+		return nil, err
+	}
+	var id []byte
+	if len(attributes[0].Value) > 0 {
+		id = attributes[0].Value
+	}
+	return findKeyPairFromPrivate(session, slot, privHandle, id, nil)
+}
+
+// mergeTemplate returns base with the attributes of overrides added,
+// replacing any attribute of base with the same type.
+func mergeTemplate(base []*pkcs11.Attribute, overrides []*pkcs11.Attribute) []*pkcs11.Attribute {
+	var merged []*pkcs11.Attribute
+	for _, a := range base {
+		replaced := false
+		for _, o := range overrides {
+			if o.Type == a.Type {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, a)
+		}
+	}
+	return append(merged, overrides...)
+}
+
+// findKeyPairFromPrivate completes a key pair given its private key object.
+//
+// The public key object is found using id and label, which must not
+// both be nil; if there is no public key object then the public key is
+// recovered from the private key object where possible.
+func findKeyPairFromPrivate(session *PKCS11Session, slot uint, privHandle pkcs11.ObjectHandle, id []byte, label []byte) (crypto.PrivateKey, error) {
+	var err error
+	var pubHandle pkcs11.ObjectHandle
+	var pub crypto.PublicKey
+
 	attributes := []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, 0),
 	}
-	if attributes, err = session.Ctx.GetAttributeValue(session.Handle, privHandle, attributes); err != nil {
+	if attributes, err = getAttributes(session, privHandle, attributes); err != nil {
 		return nil, err
 	}
 	keyType := bytesToUlong(attributes[0].Value)
-	if pubHandle, err = findKey(session, id, label, pkcs11.CKO_PUBLIC_KEY, keyType); err != nil {
+	switch keyType {
+	case pkcs11.CKK_DSA, pkcs11.CKK_RSA, pkcs11.CKK_ECDSA, ckkECEdwards, ckkECMontgomery:
+	default:
+		return nil, &UnsupportedKeyTypeError{keyType}
+	}
+	if id == nil && label == nil {
+		// Nothing to find the public key object by
+		err = ErrKeyNotFound
+	} else {
+		pubHandle, err = findKey(session, id, label, pkcs11.CKO_PUBLIC_KEY, keyType)
+	}
+	// Some tokens hold only the private key object. An RSA private key
+	// object should always carry the public key (CKA_MODULUS and
+	// CKA_PUBLIC_EXPONENT), though a token may still refuse to reveal
+	// it. An EC private key object normally does not, since the EC point
+	// cannot be derived from the attributes PKCS#11 requires, but some
+	// tokens expose CKA_EC_POINT anyway. There is no equivalent for DSA.
+	fromPrivate := err == ErrKeyNotFound && keyType != pkcs11.CKK_DSA
+	if fromPrivate {
+		pubHandle = privHandle
+	} else if err != nil {
 		return nil, err
 	}
 	switch keyType {
@@ -124,24 +1080,503 @@ func FindKeyPairOnSession(session *PKCS11Session, slot uint, id []byte, label []
 		if pub, err = exportDSAPublicKey(session, pubHandle); err != nil {
 			return nil, err
 		}
-		return &PKCS11PrivateKeyDSA{PKCS11PrivateKey{PKCS11Object{privHandle, slot}, pub}}, nil
+		return &PKCS11PrivateKeyDSA{newPrivateKey(session, slot, privHandle, pub)}, nil
 	case pkcs11.CKK_RSA:
 		if pub, err = exportRSAPublicKey(session, pubHandle); err != nil {
+			if fromPrivate && publicKeyWithheld(err) {
+				// e.g. a token that withholds CKA_MODULUS
+				return nil, ErrNoPublicKey
+			}
 			return nil, err
 		}
-		return &PKCS11PrivateKeyRSA{PKCS11PrivateKey{PKCS11Object{privHandle, slot}, pub}}, nil
+		return &PKCS11PrivateKeyRSA{newPrivateKey(session, slot, privHandle, pub)}, nil
 	case pkcs11.CKK_ECDSA:
 		if pub, err = exportECDSAPublicKey(session, pubHandle); err != nil {
+			if fromPrivate && publicKeyWithheld(err) {
+				return nil, ErrNoPublicKey
+			}
+			return nil, err
+		}
+		return &PKCS11PrivateKeyECDSA{newPrivateKey(session, slot, privHandle, pub)}, nil
+	case ckkECEdwards:
+		if pub, err = exportEd25519PublicKey(session, pubHandle); err != nil {
+			if fromPrivate && publicKeyWithheld(err) {
+				return nil, ErrNoPublicKey
+			}
 			return nil, err
 		}
-		return &PKCS11PrivateKeyECDSA{PKCS11PrivateKey{PKCS11Object{privHandle, slot}, pub}}, nil
+		return &PKCS11PrivateKeyEd25519{newPrivateKey(session, slot, privHandle, pub)}, nil
+	case ckkECMontgomery:
+		if pub, err = exportX25519PublicKey(session, pubHandle); err != nil {
+			if fromPrivate && publicKeyWithheld(err) {
+				return nil, ErrNoPublicKey
+			}
+			return nil, err
+		}
+		return &PKCS11PrivateKeyX25519{newPrivateKey(session, slot, privHandle, pub)}, nil
 	default:
-		return nil, ErrUnsupportedKeyType
+		return nil, &UnsupportedKeyTypeError{keyType}
+	}
+}
+
+// publicKeyWithheld reports whether err is the token declining to reveal
+// the public key attributes of a private key object.
+//
+// Other errors, such as a failed session, are not a sign that the
+// public key is unavailable and are returned as they are.
+func publicKeyWithheld(err error) bool {
+	e, ok := err.(pkcs11.Error)
+	return ok && (e == pkcs11.CKR_ATTRIBUTE_SENSITIVE || e == pkcs11.CKR_ATTRIBUTE_TYPE_INVALID)
+}
+
+// UnsupportedKeyTypeError is returned by FindKeyPair and FindKey when
+// the key object found has a CKA_KEY_TYPE that crypto11 does not
+// implement.
+type UnsupportedKeyTypeError struct {
+	KeyType uint // CKA_KEY_TYPE of the object
+}
+
+func (e *UnsupportedKeyTypeError) Error() string {
+	return fmt.Sprintf("crypto11: unsupported key type %s", keyTypeName(e.KeyType))
+}
+
+// keyTypeNames maps CKK_ values to their names, for error messages.
+var keyTypeNames = map[uint]string{
+	pkcs11.CKK_RSA:            "CKK_RSA",
+	pkcs11.CKK_DSA:            "CKK_DSA",
+	pkcs11.CKK_DH:             "CKK_DH",
+	pkcs11.CKK_EC:             "CKK_EC",
+	ckkECEdwards:              "CKK_EC_EDWARDS",
+	ckkECMontgomery:           "CKK_EC_MONTGOMERY",
+	pkcs11.CKK_X9_42_DH:       "CKK_X9_42_DH",
+	pkcs11.CKK_KEA:            "CKK_KEA",
+	pkcs11.CKK_GENERIC_SECRET: "CKK_GENERIC_SECRET",
+	pkcs11.CKK_RC2:            "CKK_RC2",
+	pkcs11.CKK_RC4:            "CKK_RC4",
+	pkcs11.CKK_DES:            "CKK_DES",
+	pkcs11.CKK_DES2:           "CKK_DES2",
+	pkcs11.CKK_DES3:           "CKK_DES3",
+	pkcs11.CKK_CAST:           "CKK_CAST",
+	pkcs11.CKK_CAST3:          "CKK_CAST3",
+	pkcs11.CKK_CAST128:        "CKK_CAST128",
+	pkcs11.CKK_RC5:            "CKK_RC5",
+	pkcs11.CKK_IDEA:           "CKK_IDEA",
+	pkcs11.CKK_SKIPJACK:       "CKK_SKIPJACK",
+	pkcs11.CKK_BATON:          "CKK_BATON",
+	pkcs11.CKK_JUNIPER:        "CKK_JUNIPER",
+	pkcs11.CKK_CDMF:           "CKK_CDMF",
+	pkcs11.CKK_AES:            "CKK_AES",
+	pkcs11.CKK_BLOWFISH:       "CKK_BLOWFISH",
+	pkcs11.CKK_TWOFISH:        "CKK_TWOFISH",
+	pkcs11.CKK_SECURID:        "CKK_SECURID",
+	pkcs11.CKK_HOTP:           "CKK_HOTP",
+	pkcs11.CKK_ACTI:           "CKK_ACTI",
+	pkcs11.CKK_CAMELLIA:       "CKK_CAMELLIA",
+	pkcs11.CKK_ARIA:           "CKK_ARIA",
+	pkcs11.CKK_SHA256_HMAC:    "CKK_SHA256_HMAC",
+	pkcs11.CKK_SHA384_HMAC:    "CKK_SHA384_HMAC",
+	pkcs11.CKK_SHA512_HMAC:    "CKK_SHA512_HMAC",
+	pkcs11.CKK_SHA224_HMAC:    "CKK_SHA224_HMAC",
+	pkcs11.CKK_SEED:           "CKK_SEED",
+	pkcs11.CKK_GOSTR3410:      "CKK_GOSTR3410",
+	pkcs11.CKK_GOSTR3411:      "CKK_GOSTR3411",
+	pkcs11.CKK_GOST28147:      "CKK_GOST28147",
+}
+
+// keyTypeName returns the name of a CKK_ value, or its hex value if it has no name.
+func keyTypeName(keyType uint) string {
+	if name, ok := keyTypeNames[keyType]; ok {
+		return name
+	}
+	if keyType >= pkcs11.CKK_VENDOR_DEFINED {
+		return fmt.Sprintf("CKK_VENDOR_DEFINED+%#x", keyType-pkcs11.CKK_VENDOR_DEFINED)
+	}
+	return fmt.Sprintf("%#x", keyType)
+}
+
+// keyUsage records the operations a key object permits.
+type keyUsage struct {
+	sign    bool // CKA_SIGN
+	decrypt bool // CKA_DECRYPT
+	unwrap  bool // CKA_UNWRAP
+	derive  bool // CKA_DERIVE
+
+	id    []byte // CKA_ID
+	label []byte // CKA_LABEL
+
+	// CKA_ALLOWED_MECHANISMS, or nil if unrestricted or not known
+	mechanisms []uint
+}
+
+// Read the usage attributes of a private or secret key object.
+//
+// If the token will not report them then nil is returned, and no
+// checks are made before operations with the key.
+func readKeyUsage(session *PKCS11Session, privHandle pkcs11.ObjectHandle) *keyUsage {
+	attributes := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_DERIVE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+	}
+	attributes, err := getAttributes(session, privHandle, attributes)
+	if err != nil {
+		return nil
+	}
+	usage := &keyUsage{
+		sign:    bytesToBool(attributes[0].Value),
+		decrypt: bytesToBool(attributes[1].Value),
+		unwrap:  bytesToBool(attributes[2].Value),
+		derive:  bytesToBool(attributes[3].Value),
+		id:      attributes[4].Value,
+		label:   attributes[5].Value,
+	}
+	// Read separately, since older tokens reject the attribute
+	usage.mechanisms, _ = readAllowedMechanisms(session, privHandle)
+	return usage
+}
+
+// readAllowedMechanisms reads an object's CKA_ALLOWED_MECHANISMS.
+//
+// nil is returned if the object has no restriction.
+func readAllowedMechanisms(session *PKCS11Session, handle pkcs11.ObjectHandle) ([]uint, error) {
+	attributes := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ALLOWED_MECHANISMS, nil),
+	}
+	attributes, err := getAttributes(session, handle, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMechanisms(attributes[0].Value), nil
+}
+
+// Provenance records how a key came to be on the token.
+type Provenance struct {
+	// CKA_LOCAL: the key was generated on the token (or is a copy of
+	// such a key), rather than imported or unwrapped
+	Local bool
+
+	// CKA_NEVER_EXTRACTABLE: the key has never had CKA_EXTRACTABLE set
+	NeverExtractable bool
+}
+
+// Provenance reads CKA_LOCAL and CKA_NEVER_EXTRACTABLE from the token.
+//
+// If the token does not report either attribute then
+// ErrAttributeNotSupported is returned, rather than assuming false.
+func (object *PKCS11Object) Provenance() (*Provenance, error) {
+	var attributes []*pkcs11.Attribute
+	err := withSession(object.Slot, func(session *PKCS11Session) error {
+		var err error
+		attributes, err = getAttributes(session, object.Handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_LOCAL, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_NEVER_EXTRACTABLE, nil),
+		})
+		return err
+	})
+	if code, ok := err.(pkcs11.Error); ok && code == pkcs11.CKR_ATTRIBUTE_TYPE_INVALID {
+		return nil, ErrAttributeNotSupported
+	}
+	if err != nil {
+		return nil, object.wrapError("Provenance", err)
+	}
+	if len(attributes[0].Value) == 0 || len(attributes[1].Value) == 0 {
+		return nil, ErrAttributeNotSupported
+	}
+	return &Provenance{
+		Local:            bytesToBool(attributes[0].Value),
+		NeverExtractable: bytesToBool(attributes[1].Value),
+	}, nil
+}
+
+// IsTokenGenerated reports whether the key was generated on the token (CKA_LOCAL).
+//
+// Imported and unwrapped keys are not. Errors are as for Provenance.
+func (object *PKCS11Object) IsTokenGenerated() (bool, error) {
+	p, err := object.Provenance()
+	if err != nil {
+		return false, err
+	}
+	return p.Local, nil
+}
+
+// AllowedMechanisms returns the mechanisms the object may be used with (CKA_ALLOWED_MECHANISMS).
+//
+// nil is returned if the object is not restricted. The token is
+// contacted on every call.
+func (object *PKCS11Object) AllowedMechanisms() ([]uint, error) {
+	var mechanisms []uint
+	err := withSession(object.Slot, func(session *PKCS11Session) error {
+		var err error
+		mechanisms, err = readAllowedMechanisms(session, object.Handle)
+		return err
+	})
+	return mechanisms, err
+}
+
+// Construct a PKCS11PrivateKey, caching the usage attributes of the private key object.
+func newPrivateKey(session *PKCS11Session, slot uint, privHandle pkcs11.ObjectHandle, pub crypto.PublicKey) PKCS11PrivateKey {
+	usage := readKeyUsage(session, privHandle)
+	object := newObject(privHandle, slot)
+	if usage != nil {
+		object = object.withIdentity(usage.id, usage.label)
+	}
+	return PKCS11PrivateKey{
+		PKCS11Object: object,
+		PubKey:       pub,
+		usage:        usage,
+		info:         &keyInfoCache{},
+	}
+}
+
+// ckaUniqueID is CKA_UNIQUE_ID, from PKCS#11 v3.0, which the pkcs11 package does not define.
+const ckaUniqueID = 0x4
+
+// KeyInfo describes a private key object.
+type KeyInfo struct {
+	// The key's CKA_ID
+	ID []byte
+
+	// The key's CKA_LABEL
+	Label []byte
+
+	// The key's CKA_UNIQUE_ID, or nil if the library predates
+	// PKCS#11 v3.0 or the token does not report one
+	UniqueID []byte
+}
+
+// keyInfoCache holds the result of Info() once it has been read successfully.
+type keyInfoCache struct {
+	m    sync.Mutex
+	info *KeyInfo
+}
+
+// Info returns the ID and label of the key.
+//
+// The token is only contacted the first time Info is called for a key
+// returned by this package; the result is then cached. Errors are not
+// cached. Unlike Identify, later changes to the object's label on the
+// token are not seen.
+func (priv *PKCS11PrivateKey) Info() (*KeyInfo, error) {
+	// The cache belongs to the handle, so goes stale with it
+	if err := priv.checkLive(); err != nil {
+		return nil, err
+	}
+	if priv.info == nil {
+		return priv.readInfo()
+	}
+	priv.info.m.Lock()
+	defer priv.info.m.Unlock()
+	if priv.info.info == nil {
+		info, err := priv.readInfo()
+		if err != nil {
+			return nil, err
+		}
+		priv.info.info = info
+	}
+	// Copy, so callers can't modify the cached value
+	return &KeyInfo{
+		ID:       append([]byte(nil), priv.info.info.ID...),
+		Label:    append([]byte(nil), priv.info.info.Label...),
+		UniqueID: append([]byte(nil), priv.info.info.UniqueID...),
+	}, nil
+}
+
+// readInfo reads a KeyInfo from the token.
+func (priv *PKCS11PrivateKey) readInfo() (*KeyInfo, error) {
+	id, label, err := priv.Identify()
+	if err != nil {
+		return nil, err
+	}
+	info := &KeyInfo{ID: id, Label: label}
+	supported, err := supportsUniqueID(instance.ctx)
+	if err != nil || !supported {
+		return info, err
+	}
+	err = withSession(priv.Slot, func(session *PKCS11Session) error {
+		info.UniqueID, err = readUniqueID(session, priv.Handle)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// readUniqueID reads an object's CKA_UNIQUE_ID, or nil if the token does not report one.
+func readUniqueID(session *PKCS11Session, handle pkcs11.ObjectHandle) ([]byte, error) {
+	attributes, err := getAttributes(session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(ckaUniqueID, nil),
+	})
+	if code, ok := err.(pkcs11.Error); ok && code == pkcs11.CKR_ATTRIBUTE_TYPE_INVALID {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(attributes[0].Value) == 0 {
+		return nil, nil
+	}
+	return attributes[0].Value, nil
+}
+
+// KeyPairInfo describes a private key object found by ListKeys.
+type KeyPairInfo struct {
+	KeyInfo
+
+	// The key's CKA_KEY_TYPE, e.g. pkcs11.CKK_RSA
+	KeyType uint
+}
+
+// ListKeys describes every private key object on the token.
+//
+// Only the private key objects' attributes are read, so keys of types
+// this package cannot use are listed too, and no public key is needed.
+// To use a key, find it by its ID with FindKeyPair; to load every key
+// pair at once, use FindKeyPairMatch with MatchAnd and a nil ID and
+// label. If there are no private keys an empty list is returned.
+func ListKeys() ([]KeyPairInfo, error) {
+	return ListKeysOnSlot(instance.slot)
+}
+
+// ListKeysOnSlot describes every private key object, using a specified slot.
+func ListKeysOnSlot(slot uint) ([]KeyPairInfo, error) {
+	if err := ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	keys, err := withFindTimeout(slot, func(session *PKCS11Session) (interface{}, error) {
+		return ListKeysOnSession(session)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys.([]KeyPairInfo), nil
+}
+
+// ListKeysOnSession describes every private key object, using a specified session.
+func ListKeysOnSession(session *PKCS11Session) ([]KeyPairInfo, error) {
+	handles, err := findObjects(session, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY)})
+	if err != nil {
+		return nil, err
+	}
+	supported, err := supportsUniqueID(session.Ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys := []KeyPairInfo{}
+	for _, handle := range handles {
+		attributes, err := getAttributes(session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		info := KeyPairInfo{
+			KeyInfo: KeyInfo{ID: attributes[0].Value, Label: attributes[1].Value},
+			KeyType: bytesToUlong(attributes[2].Value),
+		}
+		if supported {
+			if info.UniqueID, err = readUniqueID(session, handle); err != nil {
+				return nil, err
+			}
+		}
+		keys = append(keys, info)
+	}
+	return keys, nil
+}
+
+// verifyWithPublicKey verifies a signature on the token, using the public key object with the same CKA_ID.
+func (priv *PKCS11PrivateKey) verifyWithPublicKey(keyType uint, mech []*pkcs11.Mechanism, data []byte, signature []byte) error {
+	err := withKeySession(&priv.PKCS11Object, func(session *PKCS11Session) error {
+		pubHandle, err := priv.findPublicKeyObject(session, keyType)
+		if err != nil {
+			return err
+		}
+		if err = traceCall("C_VerifyInit", mech, session.Ctx.VerifyInit(session.Handle, mech, pubHandle)); err != nil {
+			return err
+		}
+		return traceCall("C_Verify", nil, session.Ctx.Verify(session.Handle, data, signature))
+	})
+	return priv.wrapError("VerifyWithPublicKey", err)
+}
+
+// findPublicKeyObject finds the public key object with the same CKA_ID as the private key.
+//
+// ErrNoPublicKey is returned if there is none.
+func (priv *PKCS11PrivateKey) findPublicKeyObject(session *PKCS11Session, keyType uint) (pkcs11.ObjectHandle, error) {
+	attributes := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+	}
+	attributes, err := getAttributes(session, priv.Handle, attributes)
+	if err != nil {
+		return 0, err
+	}
+	if len(attributes[0].Value) == 0 {
+		return 0, ErrNoPublicKey
+	}
+	pubHandle, err := findKey(session, attributes[0].Value, nil, pkcs11.CKO_PUBLIC_KEY, keyType)
+	if err == ErrKeyNotFound {
+		return 0, ErrNoPublicKey
+	}
+	return pubHandle, err
+}
+
+// Check that a key may be used for signing with a mechanism, before asking the token to do so.
+func (priv *PKCS11PrivateKey) checkSign(mechanism uint) error {
+	if priv.usage == nil {
+		return nil
+	}
+	if !priv.usage.sign {
+		return ErrSignNotPermitted
+	}
+	if priv.usage.mechanisms != nil {
+		for _, m := range priv.usage.mechanisms {
+			if m == mechanism {
+				return nil
+			}
+		}
+		return ErrMechanismNotAllowed
+	}
+	return nil
+}
+
+// Check that a key may be used for decryption, before asking the token to do so.
+func (priv *PKCS11PrivateKey) checkDecrypt() error {
+	if priv.usage != nil && !priv.usage.decrypt {
+		return ErrDecryptNotPermitted
+	}
+	return nil
+}
+
+// Check that a key may be used for unwrapping, before asking the token to do so.
+//
+// The check is skipped if the key's usage is not known (u is nil).
+func (u *keyUsage) checkUnwrap() error {
+	if u != nil && !u.unwrap {
+		return ErrUnwrapNotPermitted
+	}
+	return nil
+}
+
+// Check that a key may be used for derivation, before asking the token to do so.
+//
+// The check is skipped if the key's usage is not known (u is nil).
+func (u *keyUsage) checkDerive() error {
+	if u != nil && !u.derive {
+		return ErrDeriveNotPermitted
 	}
+	return nil
 }
 
 // Public returns the public half of a private key.
 //
+// The key is served from the PubKey field, which is read when the key
+// is generated or found; the token is not contacted.
+//
 // This partially implements the go.crypto.Signer and go.crypto.Decrypter interfaces for
 // PKCS11PrivateKey. (The remains of the implementation is in the
 // key-specific types.)
@@ -149,6 +1584,17 @@ func (signer PKCS11PrivateKey) Public() crypto.PublicKey {
 	return signer.PubKey
 }
 
+// FindKeyByIDString retrieves a previously created symmetric key by a textual CKA_ID.
+//
+// The ID is decoded as for FindKeyPairByIDString.
+func FindKeyByIDString(id string) (*PKCS11SecretKey, error) {
+	bid, err := decodeKeyID(id)
+	if err != nil {
+		return nil, err
+	}
+	return FindKey(bid, nil)
+}
+
 // FindKey retrieves a previously created symmetric key.
 //
 // Either (but not both) of id and label may be nil, in which case they are ignored.
@@ -160,16 +1606,16 @@ func FindKey(id []byte, label []byte) (*PKCS11SecretKey, error) {
 //
 // Either (but not both) of id and label may be nil, in which case they are ignored.
 func FindKeyOnSlot(slot uint, id []byte, label []byte) (*PKCS11SecretKey, error) {
-	var err error
-	var k *PKCS11SecretKey
-	if err = ensureSessions(instance, slot); err != nil {
+	if err := ensureSessions(instance, slot); err != nil {
 		return nil, err
 	}
-	err = withSession(slot, func(session *PKCS11Session) error {
-		k, err = FindKeyOnSession(session, slot, id, label)
-		return err
+	k, err := withFindTimeout(slot, func(session *PKCS11Session) (interface{}, error) {
+		return FindKeyOnSession(session, slot, id, label)
 	})
-	return k, err
+	if err != nil {
+		return nil, err
+	}
+	return k.(*PKCS11SecretKey), nil
 }
 
 // FindKeyOnSession retrieves a previously created symmetric key, using a specified session.
@@ -182,14 +1628,18 @@ func FindKeyOnSession(session *PKCS11Session, slot uint, id []byte, label []byte
 	}
 	attributes := []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, 0),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
 	}
-	if attributes, err = session.Ctx.GetAttributeValue(session.Handle, privHandle, attributes); err != nil {
+	if attributes, err = getAttributes(session, privHandle, attributes); err != nil {
 		return
 	}
-	if cipher, ok := Ciphers[int(bytesToUlong(attributes[0].Value))]; ok {
-		key = &PKCS11SecretKey{PKCS11Object{privHandle, slot}, cipher}
+	keyType := bytesToUlong(attributes[0].Value)
+	if cipher, ok := Ciphers[int(keyType)]; ok {
+		object := newObject(privHandle, slot).withIdentity(attributes[1].Value, attributes[2].Value)
+		key = &PKCS11SecretKey{PKCS11Object: object, Cipher: cipher, usage: readKeyUsage(session, privHandle)}
 	} else {
-		err = ErrUnsupportedKeyType
+		err = &UnsupportedKeyTypeError{keyType}
 		return
 	}
 	return
@@ -0,0 +1,168 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ErrKeyBusy is returned when an operation waits longer than
+// PoolWaitTimeout for its key's concurrency limit.
+var ErrKeyBusy = errors.New("crypto11: timed out waiting for a key with a concurrency limit")
+
+// opLimitKey identifies an object for concurrency limiting.
+type opLimitKey struct {
+	slot   uint
+	handle pkcs11.ObjectHandle
+}
+
+// opLimits holds the per-key concurrency limits.
+//
+// An object with no entry has not been looked up yet; an entry with a
+// nil semaphore means the object is unlimited.
+type opLimits struct {
+	m    sync.Mutex
+	sems map[opLimitKey]chan struct{}
+}
+
+var limits = opLimits{sems: map[opLimitKey]chan struct{}{}}
+
+// SetMaxConcurrentOps limits the number of operations that may use the key at once.
+//
+// Operations over the limit wait for one of the others to finish (or
+// for PoolWaitTimeout, if set) rather than failing, so that a single
+// slow key cannot take every session in the pool. A limit of 0 removes
+// any limit, including one set by the MaxConcurrentOps configuration.
+//
+// The limit belongs to the key's handle, so it also applies to any
+// other PKCS11Object found for the same key object. It is discarded
+// when this package destroys the object.
+func (object *PKCS11Object) SetMaxConcurrentOps(n int) {
+	var sem chan struct{}
+	if n > 0 {
+		sem = make(chan struct{}, n)
+	}
+	limits.m.Lock()
+	defer limits.m.Unlock()
+	limits.sems[opLimitKey{object.Slot, object.Handle}] = sem
+}
+
+// semaphore returns the object's semaphore, or nil if it is unlimited.
+//
+// The first time an object is seen, its CKA_ID is looked up in the
+// MaxConcurrentOps configuration. No lookup is done if that is empty,
+// and the token is only asked for the CKA_ID if it was not read when
+// the object was found.
+func (object *PKCS11Object) semaphore() chan struct{} {
+	k := opLimitKey{object.Slot, object.Handle}
+	limits.m.Lock()
+	sem, ok := limits.sems[k]
+	limits.m.Unlock()
+	cfg := slotLib(object.Slot).cfg
+	if ok || cfg == nil || len(cfg.MaxConcurrentOps) == 0 {
+		return sem
+	}
+	id, err := object.limitID()
+	if err == nil {
+		if n := cfg.MaxConcurrentOps[hex.EncodeToString(id)]; n > 0 {
+			sem = make(chan struct{}, n)
+		}
+	}
+	limits.m.Lock()
+	defer limits.m.Unlock()
+	// Another goroutine may have got here first
+	if existing, ok := limits.sems[k]; ok {
+		return existing
+	}
+	limits.sems[k] = sem
+	return sem
+}
+
+// limitID returns the object's CKA_ID, preferring the one recorded when it was found.
+func (object *PKCS11Object) limitID() ([]byte, error) {
+	if object.identity != nil {
+		return object.identity.id, nil
+	}
+	id, _, err := object.Identify()
+	return id, err
+}
+
+// forgetHandle discards the limit of an object, on any slot, e.g. because it has been destroyed.
+func (l *opLimits) forgetHandle(handle pkcs11.ObjectHandle) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for k := range l.sems {
+		if k.handle == handle {
+			delete(l.sems, k)
+		}
+	}
+}
+
+// acquireOp waits until the object is below its concurrency limit.
+//
+// The returned function must be called when the operation is finished.
+// ErrStaleObject is returned if the object is from an earlier
+// configuration.
+func (object *PKCS11Object) acquireOp() (release func(), err error) {
+	if err = object.checkLive(); err != nil {
+		return nil, err
+	}
+	sem := object.semaphore()
+	if sem == nil {
+		return func() {}, nil
+	}
+	var timeout <-chan time.Time
+	if cfg := slotLib(object.Slot).cfg; cfg != nil && cfg.PoolWaitTimeout > 0 {
+		timer := time.NewTimer(cfg.PoolWaitTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-timeout:
+		return nil, ErrKeyBusy
+	}
+}
+
+// Run a function with a session, within the object's concurrency limit.
+func withKeySession(object *PKCS11Object, f func(session *PKCS11Session) error) error {
+	release, err := object.acquireOp()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return withSession(object.Slot, f)
+}
+
+// reset discards all limits, e.g. because the handles they apply to
+// are no longer valid.
+func (l *opLimits) reset() {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.sems = map[opLimitKey]chan struct{}{}
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOpLimit(t *testing.T) {
+	object := &PKCS11Object{Handle: 1, Slot: 0}
+	object.SetMaxConcurrentOps(1)
+	defer limits.reset()
+	release, err := object.acquireOp()
+	if err != nil {
+		t.Fatalf("acquireOp: %v", err)
+	}
+	acquired := make(chan struct{})
+	go func() {
+		release2, err := object.acquireOp()
+		if err != nil {
+			t.Errorf("acquireOp: %v", err)
+		} else {
+			release2()
+		}
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("second operation did not wait for the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second operation not released")
+	}
+	object.SetMaxConcurrentOps(0)
+	if sem := object.semaphore(); sem != nil {
+		t.Errorf("limit not removed")
+	}
+}
+
+func TestOpLimitForgetHandle(t *testing.T) {
+	object := &PKCS11Object{Handle: 1, Slot: 0}
+	object.SetMaxConcurrentOps(1)
+	defer limits.reset()
+	other := &PKCS11Object{Handle: 2, Slot: 0}
+	other.SetMaxConcurrentOps(1)
+	limits.forgetHandle(object.Handle)
+	limits.m.Lock()
+	_, forgotten := limits.sems[opLimitKey{object.Slot, object.Handle}]
+	_, kept := limits.sems[opLimitKey{other.Slot, other.Handle}]
+	limits.m.Unlock()
+	if forgotten || !kept {
+		t.Errorf("forgetHandle: limit for handle 1 present %v, for handle 2 present %v", forgotten, kept)
+	}
+}
+
+func TestOpLimitSign(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPair: %v", err)
+	}
+	key.SetMaxConcurrentOps(1)
+	digest := make([]byte, 32)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := key.Sign(rand.Reader, digest, crypto.SHA256); err != nil {
+				t.Errorf("Sign: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
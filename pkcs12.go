@@ -0,0 +1,167 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+
+	"github.com/miekg/pkcs11"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// ImportPKCS12 stores the private key and certificates from a PKCS#12 (PFX) bundle on the token.
+//
+// The bundle is decrypted in software. The private key (with its
+// public key) and the certificate for it are stored under the given
+// ID; if id is nil then a random ID is generated. Any other
+// certificates in the bundle, such as CA certificates, are stored each
+// with a random ID of its own, so that FindCertificate and
+// TLSCertificate find the key's own certificate by the key's ID.
+// Labels are taken from the bundle's friendly names, where present;
+// the key's certificate otherwise gets the key's label, and other
+// certificates a random label.
+//
+// RSA and ECDSA keys are supported; other key types result in
+// ErrUnsupportedKeyType. If any object cannot be stored then those
+// already stored are destroyed again.
+func ImportPKCS12(data []byte, password string, id []byte) (crypto.PrivateKey, error) {
+	return ImportPKCS12OnSlot(instance.slot, data, password, id)
+}
+
+// ImportPKCS12OnSlot stores the private key and certificates from a PKCS#12 bundle on a specified slot.
+//
+// See ImportPKCS12 for details.
+func ImportPKCS12OnSlot(slot uint, data []byte, password string, id []byte) (crypto.PrivateKey, error) {
+	var k crypto.PrivateKey
+	var err error
+	if err = ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	err = withSession(slot, func(session *PKCS11Session) error {
+		k, err = ImportPKCS12OnSession(session, slot, data, password, id)
+		return err
+	})
+	return k, err
+}
+
+// ImportPKCS12OnSession stores the private key and certificates from a PKCS#12 bundle using a specified session.
+//
+// See ImportPKCS12 for details.
+func ImportPKCS12OnSession(session *PKCS11Session, slot uint, data []byte, password string, id []byte) (crypto.PrivateKey, error) {
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return nil, err
+	}
+	var key interface{}
+	var keyLabel []byte
+	var certs []*x509.Certificate
+	var certLabels [][]byte
+	for _, block := range blocks {
+		var label []byte
+		if name, ok := block.Headers["friendlyName"]; ok {
+			label = []byte(name)
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			if key != nil {
+				return nil, errors.New("crypto11: PKCS#12 bundle contains more than one private key")
+			}
+			// pkcs12.ToPEM re-encodes keys in their algorithm-specific form
+			if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+					return nil, ErrUnsupportedKeyType
+				}
+			}
+			keyLabel = label
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+			certLabels = append(certLabels, label)
+		}
+	}
+	if key == nil {
+		return nil, errors.New("crypto11: PKCS#12 bundle contains no private key")
+	}
+	if id == nil {
+		if id, err = generateKeyLabel(); err != nil {
+			return nil, err
+		}
+	}
+	if keyLabel == nil {
+		if keyLabel, err = generateKeyLabel(); err != nil {
+			return nil, err
+		}
+	}
+	var priv crypto.PrivateKey
+	var privHandle, pubHandle pkcs11.ObjectHandle
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var k *PKCS11PrivateKeyRSA
+		if k, pubHandle, err = importRSAKeyPair(session, slot, key, &KeyAttributes{ID: id, Label: keyLabel}); err == nil {
+			priv, privHandle = k, k.Handle
+		}
+	case *ecdsa.PrivateKey:
+		var k *PKCS11PrivateKeyECDSA
+		if k, pubHandle, err = importECDSAKeyPair(session, slot, key, &KeyAttributes{ID: id, Label: keyLabel}); err == nil {
+			priv, privHandle = k, k.Handle
+		}
+	default:
+		err = ErrUnsupportedKeyType
+	}
+	if err != nil {
+		return nil, err
+	}
+	created := []pkcs11.ObjectHandle{privHandle, pubHandle}
+	leafStored := false
+	for i, cert := range certs {
+		// Only the key's own certificate shares its ID; nil asks for
+		// a random one
+		var certID []byte
+		label := certLabels[i]
+		matched, err := MatchCertificate(priv.(crypto.Signer), cert)
+		if err == nil && matched && !leafStored {
+			certID, leafStored = id, true
+			if label == nil {
+				label = keyLabel
+			}
+		}
+		var object *PKCS11Object
+		if err == nil {
+			object, err = ImportCertificateOnSession(session, slot, certID, label, cert)
+		}
+		if err != nil {
+			for _, handle := range created {
+				destroyObject(session, handle)
+			}
+			return nil, err
+		}
+		created = append(created, object.Handle)
+	}
+	return priv, nil
+}
@@ -27,6 +27,8 @@ import (
 	"crypto/rand"
 	"fmt"
 	"github.com/miekg/pkcs11"
+	"github.com/youtube/vitess/go/pools"
+	"sync"
 	"testing"
 	"time"
 )
@@ -71,6 +73,9 @@ func TestPoolTimeout(t *testing.T) {
 			digest := crypto.SHA256.New()
 			digest.Write([]byte("sha256"))
 			_, err = key.Sign(rand.Reader, digest.Sum(nil), crypto.SHA256)
+			if oerr, ok := err.(*ObjectError); ok {
+				err = oerr.Err
+			}
 			if err != nil {
 				if perr, ok := err.(pkcs11.Error); !ok || perr != pkcs11.CKR_OBJECT_HANDLE_INVALID {
 					t.Fatal("failed to reuse existing key handle, unexpected error:", err)
@@ -79,3 +84,222 @@ func TestPoolTimeout(t *testing.T) {
 		})
 	}
 }
+
+// addTestSlotPools registers a pool of size sessions on the configured
+// token under each of the given otherwise-unused slot IDs.
+func addTestSlotPools(t *testing.T, size int, slots ...uint) {
+	for _, slot := range slots {
+		if err := pool.PutIfAbsent(slot, &slotPool{ResourcePool: pools.NewResourcePool(func() (pools.Resource, error) {
+			return newSession(instance.ctx, instance.slot)
+		}, size, size, 0), lib: instance}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIndependentSlotPools(t *testing.T) {
+	configureWithPin(t)
+	defer Close()
+
+	slow, fast := ^uint(0)-1, ^uint(0)-2
+	addTestSlotPools(t, 1, slow, fast)
+	defer pool.closeSessions(slow)
+	defer pool.closeSessions(fast)
+	if pool.Get(slow) == pool.Get(fast) {
+		t.Fatalf("slots share a session pool")
+	}
+
+	// Borrow the slow slot's only session and keep it
+	held := make(chan struct{})
+	release := make(chan struct{})
+	go withSession(slow, func(s *PKCS11Session) error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+	defer close(release)
+	if available := pool.Get(slow).Available(); available != 0 {
+		t.Fatalf("slow slot has %d sessions available, want none", available)
+	}
+
+	// The fast slot's session must still be obtainable
+	done := make(chan error, 1)
+	go func() {
+		done <- withSession(fast, func(s *PKCS11Session) error {
+			_, err := s.Ctx.GenerateRandom(s.Handle, 16)
+			return err
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("withSession on the fast slot: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("withSession on the fast slot blocked while the slow slot was fully borrowed")
+	}
+}
+
+func TestSlotContention(t *testing.T) {
+	configureWithPin(t)
+	defer Close()
+
+	const size = 2
+	slow, fast := ^uint(0)-1, ^uint(0)-2
+	addTestSlotPools(t, size, slow, fast)
+	defer pool.closeSessions(slow)
+	defer pool.closeSessions(fast)
+
+	// Hold every session of the slow slot, with many more operations
+	// queued behind them
+	release := make(chan struct{})
+	holding := make(chan struct{}, size+threadCount)
+	var queued sync.WaitGroup
+	for i := 0; i < size+threadCount; i++ {
+		queued.Add(1)
+		go func() {
+			defer queued.Done()
+			withSession(slow, func(s *PKCS11Session) error {
+				holding <- struct{}{}
+				<-release
+				return nil
+			})
+		}()
+	}
+	for i := 0; i < size; i++ {
+		<-holding
+	}
+	defer queued.Wait()
+	defer close(release)
+
+	// Operations on the fast slot must all complete, and promptly
+	const ops = 64
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < ops; i++ {
+			if err := withSession(fast, func(s *PKCS11Session) error {
+				_, err := s.Ctx.GenerateRandom(s.Handle, 16)
+				return err
+			}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("withSession on the fast slot: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("%d operations on the fast slot did not finish while the slow slot was saturated", ops)
+	}
+}
+
+func TestMinSessions(t *testing.T) {
+	cfg, err := getConfig("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.IdleTimeout = time.Second
+	cfg.MinSessions = 2
+	if _, err = Configure(cfg); err != nil {
+		t.Fatal("failed to configure service:", err)
+	}
+
+	// Long enough for the pool to close idle sessions
+	time.Sleep(3 * cfg.IdleTimeout)
+
+	// The keeper returns what it borrows
+	if inUse := pool.Get(instance.slot).InUse(); inUse != 0 {
+		t.Errorf("pool has %d sessions in use after a quiet period, want none", inUse)
+	}
+	if _, err = GenerateECDSAKeyPair(elliptic.P256()); err != nil {
+		t.Errorf("failed to generate a key after a quiet period: %v", err)
+	}
+	if err = Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(pool.stopKeepers); n != 0 {
+		t.Errorf("%d session keepers still running after Close", n)
+	}
+}
+
+func TestFindTimeout(t *testing.T) {
+	configureWithPin(t)
+	defer Close()
+	prevFindTimeout := instance.cfg.FindTimeout
+	defer func() { instance.cfg.FindTimeout = prevFindTimeout }()
+	instance.cfg.FindTimeout = 100 * time.Millisecond
+
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("crypto11.GenerateECDSAKeyPair: %v", err)
+	}
+	id, _, err := key.Identify()
+	if err != nil {
+		t.Fatalf("key.Identify: %v", err)
+	}
+	if _, err = FindKeyPair(id, nil); err != nil {
+		t.Errorf("crypto11.FindKeyPair within FindTimeout: %v", err)
+	}
+	// A search that outlasts the timeout
+	release := make(chan struct{})
+	_, err = withFindTimeout(instance.slot, func(session *PKCS11Session) (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+	close(release)
+	if err != ErrFindTimeout {
+		t.Errorf("withFindTimeout: got %v, want ErrFindTimeout", err)
+	}
+}
+
+func TestStrictSessions(t *testing.T) {
+	cfg, err := getConfig("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.MaxSessions = 1
+	cfg.StrictSessions = true
+	if _, err = Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	random := func(s *PKCS11Session) error {
+		_, err := s.Ctx.GenerateRandom(s.Handle, 16)
+		return err
+	}
+	err = withSession(instance.slot, func(s *PKCS11Session) error {
+		// The only session is in use, so this must fail at once
+		return withSession(instance.slot, random)
+	})
+	if err != ErrPoolExhausted {
+		t.Errorf("nested withSession: got %v, want ErrPoolExhausted", err)
+	}
+	// Failing must not have used up the session
+	if err = withSession(instance.slot, random); err != nil {
+		t.Errorf("withSession: %v", err)
+	}
+}
+
+func TestRefreshSessions(t *testing.T) {
+	configureWithPin(t)
+	defer Close()
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("crypto11.GenerateECDSAKeyPair: %v", err)
+	}
+	if err = RefreshSessions(); err != nil {
+		t.Fatalf("crypto11.RefreshSessions: %v", err)
+	}
+	if !instance.loggedIn {
+		t.Errorf("crypto11.RefreshSessions: not logged in again")
+	}
+	if _, err = key.Sign(rand.Reader, make([]byte, 32), crypto.SHA256); err != nil {
+		t.Errorf("Sign after RefreshSessions: %v", err)
+	}
+}
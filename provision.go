@@ -0,0 +1,238 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Key types for KeyTemplate.KeyType
+const (
+	KeyTypeRSA = "RSA"
+	KeyTypeEC  = "EC"
+)
+
+// ErrNoKeyIdentity is returned by EnsureKeyPair when a KeyTemplate has neither ID nor Label.
+var ErrNoKeyIdentity = errors.New("crypto11: key template needs an ID or label")
+
+// KeyTemplate describes a key pair declaratively, e.g. in the Keys field of PKCS11Config.
+//
+// Private keys are always token-resident and sensitive.
+type KeyTemplate struct {
+	// CKA_ID, as a hex or base64 string (see KeyID in PKCS11Config)
+	ID string
+
+	// CKA_LABEL
+	Label string
+
+	// KeyTypeRSA or KeyTypeEC
+	KeyType string
+
+	// For RSA keys, the modulus size in bits
+	Bits int
+
+	// For EC keys, the curve name, e.g. "P-256"
+	Curve string
+
+	// Permitted operations. If neither is set, Sign is assumed.
+	// Decrypt is only meaningful for RSA keys.
+	Sign    bool
+	Decrypt bool
+
+	// If true, the private key is created with CKA_EXTRACTABLE set
+	Extractable bool
+}
+
+// identity decodes the template's ID and label.
+func (t *KeyTemplate) identity() (id []byte, label []byte, err error) {
+	if t.ID == "" && t.Label == "" {
+		return nil, nil, ErrNoKeyIdentity
+	}
+	if t.ID != "" {
+		if id, err = decodeKeyID(t.ID); err != nil {
+			return nil, nil, err
+		}
+	}
+	if t.Label != "" {
+		label = []byte(t.Label)
+	}
+	return id, label, nil
+}
+
+// ProvisionFromConfig ensures that every key pair in the Keys field of the configuration exists.
+//
+// See EnsureKeyPair. The keys are returned in the same order as the
+// configuration. If a key cannot be found or created, the error is
+// returned immediately; keys created before then are left in place,
+// so the call can simply be repeated.
+func ProvisionFromConfig() ([]crypto.Signer, error) {
+	if instance.ctx == nil {
+		return nil, ErrNotConfigured
+	}
+	signers := make([]crypto.Signer, 0, len(instance.cfg.Keys))
+	for i := range instance.cfg.Keys {
+		signer, err := EnsureKeyPair(&instance.cfg.Keys[i])
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// EnsureKeyPair returns the key pair described by a template, creating it if it does not exist.
+//
+// The key pair is looked up by the template's ID and label. If it
+// exists it is returned as it is, provided it has the template's key
+// type; its other attributes are not checked. Otherwise it is
+// generated according to the template.
+func EnsureKeyPair(t *KeyTemplate) (crypto.Signer, error) {
+	return EnsureKeyPairOnSlot(instance.slot, t)
+}
+
+// EnsureKeyPairOnSlot returns the key pair described by a template, creating it on a specified slot if it does not exist.
+//
+// See EnsureKeyPair for details.
+func EnsureKeyPairOnSlot(slot uint, t *KeyTemplate) (crypto.Signer, error) {
+	var signer crypto.Signer
+	var err error
+	if err = ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	err = withSession(slot, func(session *PKCS11Session) error {
+		signer, err = EnsureKeyPairOnSession(session, slot, t)
+		return err
+	})
+	return signer, err
+}
+
+// EnsureKeyPairOnSession returns the key pair described by a template, creating it using a specified session if it does not exist.
+//
+// See EnsureKeyPair for details.
+func EnsureKeyPairOnSession(session *PKCS11Session, slot uint, t *KeyTemplate) (crypto.Signer, error) {
+	id, label, err := t.identity()
+	if err != nil {
+		return nil, err
+	}
+	k, err := FindKeyPairOnSession(session, slot, id, label)
+	if err == nil {
+		var ok bool
+		switch k.(type) {
+		case *PKCS11PrivateKeyRSA:
+			ok = t.KeyType == KeyTypeRSA
+		case *PKCS11PrivateKeyECDSA:
+			ok = t.KeyType == KeyTypeEC
+		}
+		if !ok {
+			return nil, fmt.Errorf("crypto11: existing key %q is not of type %s", t.Label, t.KeyType)
+		}
+		return k.(crypto.Signer), nil
+	}
+	if err != ErrKeyNotFound {
+		return nil, err
+	}
+	return generateKeyPairFromTemplate(session, slot, id, label, t)
+}
+
+// generateKeyPairFromTemplate creates a key pair described by a KeyTemplate.
+func generateKeyPairFromTemplate(session *PKCS11Session, slot uint, id []byte, label []byte, t *KeyTemplate) (crypto.Signer, error) {
+	var err error
+	if id == nil {
+		if id, err = generateKeyLabel(); err != nil {
+			return nil, err
+		}
+	}
+	if label == nil {
+		if label, err = generateKeyLabel(); err != nil {
+			return nil, err
+		}
+	}
+	sign, decrypt := t.Sign, t.Decrypt
+	if !sign && !decrypt {
+		sign = true
+	}
+	publicKeyTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, sign),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	privateKeyTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, sign),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, t.Extractable),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	var genMech uint
+	switch t.KeyType {
+	case KeyTypeRSA:
+		if t.Bits <= 0 {
+			return nil, fmt.Errorf("crypto11: RSA key template %q has no size", t.Label)
+		}
+		genMech = pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN
+		publicKeyTemplate = append(publicKeyTemplate,
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+			pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, decrypt),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, t.Bits))
+		privateKeyTemplate = append(privateKeyTemplate,
+			pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, decrypt))
+	case KeyTypeEC:
+		ci, ok := wellKnownCurves[t.Curve]
+		if !ok {
+			return nil, ErrUnsupportedEllipticCurve
+		}
+		genMech = pkcs11.CKM_ECDSA_KEY_PAIR_GEN
+		publicKeyTemplate = append(publicKeyTemplate,
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_ECDSA),
+			pkcs11.NewAttribute(pkcs11.CKA_ECDSA_PARAMS, ci.oid))
+	default:
+		return nil, fmt.Errorf("crypto11: unrecognized key type %q", t.KeyType)
+	}
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(genMech, nil)}
+	pubHandle, privHandle, err := session.Ctx.GenerateKeyPair(session.Handle,
+		mech,
+		publicKeyTemplate,
+		privateKeyTemplate)
+	traceCall("C_GenerateKeyPair", mech, err, publicKeyTemplate, privateKeyTemplate)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	var pub crypto.PublicKey
+	if t.KeyType == KeyTypeRSA {
+		if pub, err = exportRSAPublicKey(session, pubHandle); err != nil {
+			return nil, err
+		}
+		return &PKCS11PrivateKeyRSA{newPrivateKey(session, slot, privHandle, pub)}, nil
+	}
+	if pub, err = exportECDSAPublicKey(session, pubHandle); err != nil {
+		return nil, err
+	}
+	return &PKCS11PrivateKeyECDSA{newPrivateKey(session, slot, privHandle, pub)}, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestProvisionFromConfig(t *testing.T) {
+	cfg, err := getConfig("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	label, err := generateKeyLabel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := `[
+		{"Label": "` + string(label) + `-rsa", "KeyType": "RSA", "Bits": 2048, "Sign": true, "Decrypt": true},
+		{"Label": "` + string(label) + `-ec", "KeyType": "EC", "Curve": "P-256"}
+	]`
+	if err = json.Unmarshal([]byte(spec), &cfg.Keys); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if _, err = Configure(cfg); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer Close()
+	first, err := ProvisionFromConfig()
+	if err != nil {
+		t.Fatalf("ProvisionFromConfig: %v", err)
+	}
+	if _, ok := first[0].(*PKCS11PrivateKeyRSA); !ok {
+		t.Errorf("ProvisionFromConfig: first key is %T, want RSA", first[0])
+	}
+	if _, ok := first[1].(*PKCS11PrivateKeyECDSA); !ok {
+		t.Errorf("ProvisionFromConfig: second key is %T, want ECDSA", first[1])
+	}
+	// A second run finds the same keys rather than creating new ones
+	second, err := ProvisionFromConfig()
+	if err != nil {
+		t.Fatalf("ProvisionFromConfig (again): %v", err)
+	}
+	for i := range first {
+		if ok, err := publicKeysEqual(first[i].Public(), second[i].Public()); err != nil || !ok {
+			t.Errorf("ProvisionFromConfig (again): key %d changed", i)
+		}
+	}
+	if _, err = EnsureKeyPair(&KeyTemplate{KeyType: KeyTypeEC, Curve: "P-256"}); err != ErrNoKeyIdentity {
+		t.Errorf("EnsureKeyPair without ID or label: got %v, want ErrNoKeyIdentity", err)
+	}
+}
@@ -21,24 +21,101 @@
 
 package crypto11
 
+import (
+	"errors"
+	"io"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ErrRNGNotAvailable is returned when the token has no random number
+// generator (CKF_RNG is not set). Callers may fall back to crypto/rand.
+var ErrRNGNotAvailable = errors.New("crypto11: token has no random number generator")
+
+// maxRandomRequest is the most bytes asked of C_GenerateRandom in one call.
+//
+// Some tokens reject larger requests; longer reads are split.
+const maxRandomRequest = 1024
+
 // PKCS11RandReader is a random number reader that uses PKCS#11.
+//
+// The zero value reads from the configured token. Use
+// NewRandomReaderOnSlot for another token. Reads of any length are
+// split into requests of at most 1KB, since some tokens cap the size
+// of a C_GenerateRandom request. A PKCS11RandReader can be used
+// wherever crypto/rand.Reader is.
 type PKCS11RandReader struct {
+	// The slot to use, if onSlot is set
+	slot   uint
+	onSlot bool
 }
 
-// Read fills data with random bytes generated via PKCS#11 using the default slot.
+// NewRandomReader returns a reader for the configured token's random number generator.
 //
-// This implements the Reader interface for PKCS11RandReader.
-func (reader PKCS11RandReader) Read(data []byte) (n int, err error) {
-	var result []byte
+// ErrRNGNotAvailable is returned if the token does not have one. The
+// check uses the token information read by Configure, so it does not
+// contact the token.
+func NewRandomReader() (io.Reader, error) {
+	if instance.ctx == nil || instance.token == nil {
+		return nil, ErrNotConfigured
+	}
+	if instance.token.Flags&pkcs11.CKF_RNG == 0 {
+		return nil, ErrRNGNotAvailable
+	}
+	return PKCS11RandReader{}, nil
+}
+
+// NewRandomReaderOnSlot returns a reader for the random number generator of the token in a specified slot.
+//
+// ErrRNGNotAvailable is returned if the token does not have one.
+func NewRandomReaderOnSlot(slot uint) (io.Reader, error) {
 	if instance.ctx == nil {
+		return nil, ErrNotConfigured
+	}
+	if err := ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	info, err := instance.ctx.GetTokenInfo(slot)
+	if err != nil {
+		return nil, err
+	}
+	if info.Flags&pkcs11.CKF_RNG == 0 {
+		return nil, ErrRNGNotAvailable
+	}
+	return PKCS11RandReader{slot: slot, onSlot: true}, nil
+}
+
+// Read fills data with random bytes generated via PKCS#11.
+//
+// This implements the Reader interface for PKCS11RandReader. If the
+// token fails part way through a long read, the number of bytes
+// filled so far is returned with the error.
+func (reader PKCS11RandReader) Read(data []byte) (n int, err error) {
+	if instance.ctx == nil || instance.token == nil {
 		return 0, ErrNotConfigured
 	}
-	if err = withSession(instance.slot, func(session *PKCS11Session) error {
-		result, err = instance.ctx.GenerateRandom(session.Handle, len(data))
-		return err
-	}); err != nil {
-		return 0, err
+	slot := instance.slot
+	if reader.onSlot {
+		slot = reader.slot
+	} else if instance.token.Flags&pkcs11.CKF_RNG == 0 {
+		return 0, ErrRNGNotAvailable
 	}
-	copy(data, result)
-	return len(result), err
+	err = withSession(slot, func(session *PKCS11Session) error {
+		for n < len(data) {
+			size := len(data) - n
+			if size > maxRandomRequest {
+				size = maxRandomRequest
+			}
+			result, err := session.Ctx.GenerateRandom(session.Handle, size)
+			if err = traceCall("C_GenerateRandom", nil, err); err != nil {
+				return err
+			}
+			if len(result) == 0 {
+				return io.ErrNoProgress
+			}
+			n += copy(data[n:], result)
+		}
+		return nil
+	})
+	return n, err
 }
@@ -43,3 +43,50 @@ func TestRandomReader(t *testing.T) {
 	}
 	Close()
 }
+
+func TestNewRandomReader(t *testing.T) {
+	if _, err := NewRandomReader(); err != ErrNotConfigured {
+		t.Errorf("crypto11.NewRandomReader before Configure: got %v, want ErrNotConfigured", err)
+	}
+	ConfigureFromFile("config")
+	defer Close()
+	r, err := NewRandomReader()
+	if err == ErrRNGNotAvailable {
+		t.Skip("token has no RNG")
+	}
+	if err != nil {
+		t.Fatalf("crypto11.NewRandomReader: %v", err)
+	}
+	var a [16]byte
+	if n, err := r.Read(a[:]); err != nil || n != len(a) {
+		t.Errorf("Read: %v/%d", err, n)
+	}
+}
+
+func TestNewRandomReaderOnSlot(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	r, err := NewRandomReaderOnSlot(instance.slot)
+	if err == ErrRNGNotAvailable {
+		t.Skip("token has no RNG")
+	}
+	if err != nil {
+		t.Fatalf("crypto11.NewRandomReaderOnSlot: %v", err)
+	}
+	// Longer than a single request
+	a := make([]byte, 3*maxRandomRequest+5)
+	if n, err := r.Read(a); err != nil || n != len(a) {
+		t.Errorf("Read: %v/%d", err, n)
+	}
+	// The last chunk is filled too
+	tail := a[len(a)-maxRandomRequest:]
+	zero := true
+	for _, b := range tail {
+		if b != 0 {
+			zero = false
+		}
+	}
+	if zero {
+		t.Errorf("Read: last chunk not filled")
+	}
+}
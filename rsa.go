@@ -23,10 +23,12 @@ package crypto11
 
 import (
 	"crypto"
+	"crypto/rand"
 	"crypto/rsa"
 	"errors"
 	"io"
 	"math/big"
+	"runtime"
 	"unsafe"
 
 	pkcs11 "github.com/miekg/pkcs11"
@@ -44,11 +46,29 @@ var ErrUnrecognizedRSAOptions = errors.New("crypto11/rsa: unrecognized RSA optio
 
 // ErrUnsupportedRSAOptions is returned when an unsupported RSA option is requested.
 //
-// Currently this means a nontrivial SessionKeyLen when decrypting; or
-// an unsupported hash function; or crypto.rsa.PSSSaltLengthAuto was
-// requested.
+// Currently this means an unsupported hash function, a PSS salt
+// length that does not fit the key, or rsa.PSSSaltLengthAuto when
+// verifying.
 var ErrUnsupportedRSAOptions = errors.New("crypto11/rsa: unsupported RSA option value")
 
+// ErrBadDigestLength is returned when the digest passed to Sign does
+// not match the size of the hash function in the signer options.
+var ErrBadDigestLength = errors.New("crypto11/rsa: digest length does not match hash function")
+
+// PSSOptions extends rsa.PSSOptions to allow the MGF1 hash to be
+// chosen independently of the message digest hash.
+//
+// Pass a *PSSOptions to Sign in place of a *rsa.PSSOptions when a
+// profile requires the two hashes to differ.
+type PSSOptions struct {
+	rsa.PSSOptions
+
+	// MGFHash is the hash function used by MGF1. If it is zero then
+	// the message digest hash (PSSOptions.Hash) is used, matching
+	// crypto/rsa.
+	MGFHash crypto.Hash
+}
+
 // PKCS11PrivateKeyRSA contains a reference to a loaded PKCS#11 RSA private key object.
 type PKCS11PrivateKeyRSA struct {
 	PKCS11PrivateKey
@@ -60,14 +80,24 @@ func exportRSAPublicKey(session *PKCS11Session, pubHandle pkcs11.ObjectHandle) (
 		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
 		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
 	}
-	exported, err := session.Ctx.GetAttributeValue(session.Handle, pubHandle, template)
+	exported, err := getAttributes(session, pubHandle, template)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := rsaPublicKeyFromValues(exported[0].Value, exported[1].Value)
 	if err != nil {
 		return nil, err
 	}
-	var modulus = new(big.Int)
-	modulus.SetBytes(exported[0].Value)
-	var bigExponent = new(big.Int)
-	bigExponent.SetBytes(exported[1].Value)
+	return pub, nil
+}
+
+// Build an RSA public key from its CKA_MODULUS and CKA_PUBLIC_EXPONENT.
+//
+// As unsigned big-endian byte strings these are converted with
+// SetBytes; see dsaPublicKeyFromValues.
+func rsaPublicKeyFromValues(n []byte, e []byte) (*rsa.PublicKey, error) {
+	modulus := new(big.Int).SetBytes(n)
+	bigExponent := new(big.Int).SetBytes(e)
 	if bigExponent.BitLen() > 32 {
 		return nil, ErrMalformedRSAKey
 	}
@@ -118,18 +148,48 @@ func GenerateRSAKeyPairOnSlot(slot uint, id []byte, label []byte, bits int) (*PK
 // RSA private keys are generated with both sign and decrypt
 // permissions, and a public exponent of 65537.
 func GenerateRSAKeyPairOnSession(session *PKCS11Session, slot uint, id []byte, label []byte, bits int) (*PKCS11PrivateKeyRSA, error) {
+	return GenerateRSAKeyPairWithAttributesOnSession(session, slot, bits, &KeyAttributes{ID: id, Label: label})
+}
+
+// GenerateRSAKeyPairWithAttributes creates an RSA private key of given length, with the ID, label and extra attributes given by attrs.
+//
+// attrs.ID and attrs.Label are used as for other keys; attrs.Extra,
+// attrs.PublicExtra and attrs.PrivateExtra are added to the public and
+// private key templates, replacing the defaults they overlap, and
+// attrs.LabelCollision applies to existing public and private keys.
+// attrs.Wrap sets CKA_WRAP on the public key and CKA_UNWRAP on the
+// private key, which UnwrapKey needs. attrs.Trusted and
+// attrs.WrapWithTrusted set CKA_TRUSTED on the public key and
+// CKA_WRAP_WITH_TRUSTED on the private key. The other fields of attrs
+// are ignored.
+func GenerateRSAKeyPairWithAttributes(bits int, attrs *KeyAttributes) (*PKCS11PrivateKeyRSA, error) {
+	return GenerateRSAKeyPairWithAttributesOnSlot(instance.slot, bits, attrs)
+}
+
+// GenerateRSAKeyPairWithAttributesOnSlot creates an RSA private key described by attrs, on a specified slot.
+func GenerateRSAKeyPairWithAttributesOnSlot(slot uint, bits int, attrs *KeyAttributes) (*PKCS11PrivateKeyRSA, error) {
+	var k *PKCS11PrivateKeyRSA
 	var err error
+	if err = ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	err = withSession(slot, func(session *PKCS11Session) error {
+		k, err = GenerateRSAKeyPairWithAttributesOnSession(session, slot, bits, attrs)
+		return err
+	})
+	return k, err
+}
+
+// GenerateRSAKeyPairWithAttributesOnSession creates an RSA private key described by attrs, using a specified session.
+func GenerateRSAKeyPairWithAttributesOnSession(session *PKCS11Session, slot uint, bits int, attrs *KeyAttributes) (*PKCS11PrivateKeyRSA, error) {
 	var pub crypto.PublicKey
 
-	if label == nil {
-		if label, err = generateKeyLabel(); err != nil {
-			return nil, err
-		}
+	if err := attrs.checkLabelCollision(session, pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY); err != nil {
+		return nil, err
 	}
-	if id == nil {
-		if id, err = generateKeyLabel(); err != nil {
-			return nil, err
-		}
+	id, label, err := attrs.identity()
+	if err != nil {
+		return nil, err
 	}
 	publicKeyTemplate := []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
@@ -137,6 +197,7 @@ func GenerateRSAKeyPairOnSession(session *PKCS11Session, slot uint, id []byte, l
 		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
 		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
 		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, attrs.Wrap),
 		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
 		pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, bits),
 		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
@@ -146,41 +207,184 @@ func GenerateRSAKeyPairOnSession(session *PKCS11Session, slot uint, id []byte, l
 		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
 		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
 		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, attrs.Wrap),
 		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
 		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
 		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
 		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
 	}
+	publicKeyTemplate, privateKeyTemplate = attrs.keyPairTemplates(publicKeyTemplate, privateKeyTemplate)
 	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)}
 	pubHandle, privHandle, err := session.Ctx.GenerateKeyPair(session.Handle,
 		mech,
 		publicKeyTemplate,
 		privateKeyTemplate)
+	traceCall("C_GenerateKeyPair", mech, err, publicKeyTemplate, privateKeyTemplate)
 	if err != nil {
-		return nil, err
+		return nil, storageError(attrs.trustError(err))
 	}
 	if pub, err = exportRSAPublicKey(session, pubHandle); err != nil {
 		return nil, err
 	}
-	priv := PKCS11PrivateKeyRSA{PKCS11PrivateKey{PKCS11Object{privHandle, slot}, pub}}
+	priv := PKCS11PrivateKeyRSA{newPrivateKey(session, slot, privHandle, pub)}
 	return &priv, nil
 }
 
+// ImportRSAKeyPair stores an existing RSA private key, and its public key, on the token.
+//
+// The key will have a random label and ID.
+func ImportRSAKeyPair(key *rsa.PrivateKey) (*PKCS11PrivateKeyRSA, error) {
+	return ImportRSAKeyPairOnSlot(instance.slot, nil, nil, key)
+}
+
+// ImportRSAKeyPairOnSlot stores an existing RSA private key, and its public key, on a specified slot.
+//
+// Either or both label and/or id can be nil, in which case random values will be generated.
+func ImportRSAKeyPairOnSlot(slot uint, id []byte, label []byte, key *rsa.PrivateKey) (*PKCS11PrivateKeyRSA, error) {
+	var k *PKCS11PrivateKeyRSA
+	var err error
+	if err = ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	err = withSession(slot, func(session *PKCS11Session) error {
+		k, err = ImportRSAKeyPairOnSession(session, slot, id, label, key)
+		return err
+	})
+	return k, err
+}
+
+// ImportRSAKeyPairOnSession stores an existing RSA private key, and its public key, using a specified session.
+//
+// Either or both label and/or id can be nil, in which case random values will be generated.
+//
+// As with generated keys, the private key is given both sign and
+// decrypt permissions, and is sensitive and not extractable. Only
+// two-prime keys are supported.
+func ImportRSAKeyPairOnSession(session *PKCS11Session, slot uint, id []byte, label []byte, key *rsa.PrivateKey) (*PKCS11PrivateKeyRSA, error) {
+	return ImportRSAKeyPairWithAttributesOnSession(session, slot, key, &KeyAttributes{ID: id, Label: label})
+}
+
+// ImportRSAKeyPairWithAttributes stores an existing RSA private key, and its public key, with the attributes given by attrs.
+//
+// attrs.ID, attrs.Label, attrs.LabelCollision and the extra attribute
+// fields are used as for GenerateRSAKeyPairWithAttributes.
+// attrs.Extractable sets CKA_EXTRACTABLE on the private key, and
+// attrs.Wrap, attrs.Trusted and attrs.WrapWithTrusted are applied as
+// for key generation; other flags, such as CKA_SENSITIVE, can be
+// changed with attrs.PrivateExtra. The other fields of attrs are
+// ignored.
+func ImportRSAKeyPairWithAttributes(key *rsa.PrivateKey, attrs *KeyAttributes) (*PKCS11PrivateKeyRSA, error) {
+	return ImportRSAKeyPairWithAttributesOnSlot(instance.slot, key, attrs)
+}
+
+// ImportRSAKeyPairWithAttributesOnSlot stores an existing RSA private key described by attrs, on a specified slot.
+func ImportRSAKeyPairWithAttributesOnSlot(slot uint, key *rsa.PrivateKey, attrs *KeyAttributes) (*PKCS11PrivateKeyRSA, error) {
+	var k *PKCS11PrivateKeyRSA
+	var err error
+	if err = ensureSessions(instance, slot); err != nil {
+		return nil, err
+	}
+	err = withSession(slot, func(session *PKCS11Session) error {
+		k, err = ImportRSAKeyPairWithAttributesOnSession(session, slot, key, attrs)
+		return err
+	})
+	return k, err
+}
+
+// ImportRSAKeyPairWithAttributesOnSession stores an existing RSA private key described by attrs, using a specified session.
+func ImportRSAKeyPairWithAttributesOnSession(session *PKCS11Session, slot uint, key *rsa.PrivateKey, attrs *KeyAttributes) (*PKCS11PrivateKeyRSA, error) {
+	priv, _, err := importRSAKeyPair(session, slot, key, attrs)
+	return priv, err
+}
+
+// importRSAKeyPair implements ImportRSAKeyPairWithAttributesOnSession, also returning the public key handle.
+func importRSAKeyPair(session *PKCS11Session, slot uint, key *rsa.PrivateKey, attrs *KeyAttributes) (*PKCS11PrivateKeyRSA, pkcs11.ObjectHandle, error) {
+	if len(key.Primes) != 2 {
+		return nil, 0, ErrUnsupportedKeyType
+	}
+	if err := attrs.checkLabelCollision(session, pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY); err != nil {
+		return nil, 0, err
+	}
+	id, label, err := attrs.identity()
+	if err != nil {
+		return nil, 0, err
+	}
+	key.Precompute()
+	exponent := big.NewInt(int64(key.E)).Bytes()
+	publicKeyTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, attrs.Wrap),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, key.N.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, exponent),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	privateKeyTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, attrs.Wrap),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, attrs.Extractable),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, key.N.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, exponent),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE_EXPONENT, key.D.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIME_1, key.Primes[0].Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIME_2, key.Primes[1].Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_1, key.Precomputed.Dp.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_2, key.Precomputed.Dq.Bytes()),
+		pkcs11.NewAttribute(pkcs11.CKA_COEFFICIENT, key.Precomputed.Qinv.Bytes()),
+	}
+	publicKeyTemplate, privateKeyTemplate = attrs.keyPairTemplates(publicKeyTemplate, privateKeyTemplate)
+	pubHandle, privHandle, err := importKeyPair(session, publicKeyTemplate, privateKeyTemplate)
+	if err != nil {
+		return nil, 0, attrs.trustError(err)
+	}
+	pub := key.PublicKey
+	priv := PKCS11PrivateKeyRSA{newPrivateKey(session, slot, privHandle, &pub)}
+	return &priv, pubHandle, nil
+}
+
 // Decrypt decrypts a message using a RSA key.
 //
 // This completes the implemention of crypto.Decrypter for PKCS11PrivateKeyRSA.
 //
-// Note that the SessionKeyLen option (for PKCS#1v1.5 decryption) is not supported.
+// If a *rsa.PKCS1v15DecryptOptions with a nonzero SessionKeyLen is
+// passed then, as with crypto/rsa, a padding failure is not reported:
+// a random value of SessionKeyLen bytes is returned instead. See
+// DecryptPKCS1v15SessionKey.
+//
+// A *rsa.OAEPOptions selects CKM_RSA_PKCS_OAEP, with its Hash used for
+// both the digest and MGF1 and its Label passed as the encoding
+// parameter. SHA-1, SHA-224, SHA-256, SHA-384 and SHA-512 are
+// supported.
 //
 // The underlying PKCS#11 implementation may impose further restrictions.
 func (priv *PKCS11PrivateKeyRSA) Decrypt(rand io.Reader, ciphertext []byte, options crypto.DecrypterOpts) (plaintext []byte, err error) {
-	err = withSession(priv.Slot, func(session *PKCS11Session) error {
+	if err = priv.checkDecrypt(); err != nil {
+		return nil, err
+	}
+	err = withKeySession(&priv.PKCS11Object, func(session *PKCS11Session) error {
 		if options == nil {
-			plaintext, err = decryptPKCS1v15(session, priv, ciphertext, 0)
+			plaintext, err = decryptPKCS1v15(session, priv, ciphertext)
 		} else {
 			switch o := options.(type) {
 			case *rsa.PKCS1v15DecryptOptions:
-				plaintext, err = decryptPKCS1v15(session, priv, ciphertext, o.SessionKeyLen)
+				if o.SessionKeyLen != 0 {
+					plaintext = make([]byte, o.SessionKeyLen)
+					err = decryptPKCS1v15SessionKey(session, priv, rand, ciphertext, plaintext)
+				} else {
+					plaintext, err = decryptPKCS1v15(session, priv, ciphertext)
+				}
 			case *rsa.OAEPOptions:
 				plaintext, err = decryptOAEP(session, priv, ciphertext, o.Hash, o.Label)
 			default:
@@ -189,40 +393,100 @@ func (priv *PKCS11PrivateKeyRSA) Decrypt(rand io.Reader, ciphertext []byte, opti
 		}
 		return err
 	})
-	return plaintext, err
+	return plaintext, priv.wrapError("Decrypt", err)
 }
 
-func decryptPKCS1v15(session *PKCS11Session, key *PKCS11PrivateKeyRSA, ciphertext []byte, sessionKeyLen int) ([]byte, error) {
-	if sessionKeyLen != 0 {
-		return nil, ErrUnsupportedRSAOptions
+// DecryptPKCS1v15SessionKey decrypts a session key using RSA PKCS#1 v1.5, without revealing padding failures.
+//
+// This mirrors rsa.DecryptPKCS1v15SessionKey. key is filled with
+// random bytes from rand (or crypto/rand, if rand is nil) before
+// decryption. If the ciphertext decrypts to a value of exactly
+// len(key) bytes then key is overwritten with it; if the token reports
+// bad padding, or the plaintext has the wrong length, key keeps its
+// random contents and no error is returned. The caller should then
+// find that the session key does not work, e.g. because an AEAD open
+// fails, without learning anything about the padding.
+//
+// Errors unrelated to the ciphertext, such as a failed session, are
+// still returned.
+//
+// This only hides the padding outcome from the caller's error
+// handling. The token itself may still take different amounts of time
+// for good and bad padding.
+func (priv *PKCS11PrivateKeyRSA) DecryptPKCS1v15SessionKey(rand io.Reader, ciphertext []byte, key []byte) error {
+	if err := priv.checkDecrypt(); err != nil {
+		return err
+	}
+	err := withKeySession(&priv.PKCS11Object, func(session *PKCS11Session) error {
+		return decryptPKCS1v15SessionKey(session, priv, rand, ciphertext, key)
+	})
+	return priv.wrapError("DecryptPKCS1v15SessionKey", err)
+}
+
+func decryptPKCS1v15SessionKey(session *PKCS11Session, key *PKCS11PrivateKeyRSA, random io.Reader, ciphertext []byte, sessionKey []byte) error {
+	if random == nil {
+		random = rand.Reader
+	}
+	if _, err := io.ReadFull(random, sessionKey); err != nil {
+		return err
+	}
+	plaintext, err := decryptPKCS1v15(session, key, ciphertext)
+	if e, ok := err.(pkcs11.Error); ok && (e == pkcs11.CKR_ENCRYPTED_DATA_INVALID || e == pkcs11.CKR_ENCRYPTED_DATA_LEN_RANGE) {
+		// Padding failure; keep the random key
+		return nil
+	}
+	if err != nil {
+		return err
 	}
+	if len(plaintext) == len(sessionKey) {
+		copy(sessionKey, plaintext)
+	}
+	return nil
+}
+
+func decryptPKCS1v15(session *PKCS11Session, key *PKCS11PrivateKeyRSA, ciphertext []byte) ([]byte, error) {
 	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)}
-	if err := session.Ctx.DecryptInit(session.Handle, mech, key.Handle); err != nil {
+	if err := traceCall("C_DecryptInit", mech, session.Ctx.DecryptInit(session.Handle, mech, key.Handle)); err != nil {
 		return nil, err
 	}
-	return session.Ctx.Decrypt(session.Handle, ciphertext)
+	plaintext, err := session.Ctx.Decrypt(session.Handle, ciphertext)
+	return plaintext, traceCall("C_Decrypt", nil, err)
 }
 
 func decryptOAEP(session *PKCS11Session, key *PKCS11PrivateKeyRSA, ciphertext []byte, hashFunction crypto.Hash, label []byte) ([]byte, error) {
-	var err error
-	var hMech, mgf, sourceData, sourceDataLen uint
-	if hMech, mgf, _, err = hashToPKCS11(hashFunction); err != nil {
+	parameters, err := oaepParameters(hashFunction, label)
+	if err != nil {
 		return nil, err
 	}
-	if label != nil && len(label) > 0 {
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, parameters)}
+	if err = traceCall("C_DecryptInit", mech, session.Ctx.DecryptInit(session.Handle, mech, key.Handle)); err != nil {
+		return nil, err
+	}
+	plaintext, err := session.Ctx.Decrypt(session.Handle, ciphertext)
+	runtime.KeepAlive(label)
+	return plaintext, traceCall("C_Decrypt", nil, err)
+}
+
+// oaepParameters builds a CK_RSA_PKCS_OAEP_PARAMS for hashFunction and label.
+//
+// MGF1 uses the same hash, as crypto/rsa does. The parameters point
+// into label, which must be kept alive until the mechanism has been
+// used.
+func oaepParameters(hashFunction crypto.Hash, label []byte) ([]byte, error) {
+	hMech, mgf, _, err := hashToPKCS11(hashFunction)
+	if err != nil {
+		return nil, err
+	}
+	var sourceData, sourceDataLen uint
+	if len(label) > 0 {
 		sourceData = uint(uintptr(unsafe.Pointer(&label[0])))
 		sourceDataLen = uint(len(label))
 	}
-	parameters := concat(ulongToBytes(hMech),
+	return concat(ulongToBytes(hMech),
 		ulongToBytes(mgf),
 		ulongToBytes(pkcs11.CKZ_DATA_SPECIFIED),
 		ulongToBytes(sourceData),
-		ulongToBytes(sourceDataLen))
-	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, parameters)}
-	if err = session.Ctx.DecryptInit(session.Handle, mech, key.Handle); err != nil {
-		return nil, err
-	}
-	return session.Ctx.Decrypt(session.Handle, ciphertext)
+		ulongToBytes(sourceDataLen)), nil
 }
 
 func hashToPKCS11(hashFunction crypto.Hash) (uint, uint, uint, error) {
@@ -242,18 +506,42 @@ func hashToPKCS11(hashFunction crypto.Hash) (uint, uint, uint, error) {
 	}
 }
 
-func signPSS(session *PKCS11Session, key *PKCS11PrivateKeyRSA, digest []byte, opts *rsa.PSSOptions) ([]byte, error) {
+func signPSS(session *PKCS11Session, key *PKCS11PrivateKeyRSA, digest []byte, opts *rsa.PSSOptions, mgfHash crypto.Hash) ([]byte, error) {
+	mech, err := pssMechanism(opts, mgfHash, key.keyBits())
+	if err != nil {
+		return nil, err
+	}
+	if err = traceCall("C_SignInit", mech, session.Ctx.SignInit(session.Handle, mech, key.Handle)); err != nil {
+		return nil, err
+	}
+	signature, err := session.Ctx.Sign(session.Handle, digest)
+	return signature, traceCall("C_Sign", nil, err)
+}
+
+// pssMechanism builds the CKM_RSA_PKCS_PSS mechanism for the given options.
+//
+// If mgfHash is 0 the MGF1 hash is the same as the digest hash.
+// keyBits is the modulus size, used to resolve rsa.PSSSaltLengthAuto
+// to the largest salt that fits, as crypto/rsa does.
+func pssMechanism(opts *rsa.PSSOptions, mgfHash crypto.Hash, keyBits int) ([]*pkcs11.Mechanism, error) {
 	var hMech, mgf, hLen, sLen uint
 	var err error
 	if hMech, mgf, hLen, err = hashToPKCS11(opts.Hash); err != nil {
 		return nil, err
 	}
+	if mgfHash != 0 {
+		if _, mgf, _, err = hashToPKCS11(mgfHash); err != nil {
+			return nil, err
+		}
+	}
 	switch opts.SaltLength {
 	case rsa.PSSSaltLengthAuto: // parseltongue constant
-		// TODO we could (in principle) work out the biggest
-		// possible size from the key, but until someone has
-		// the effort to do that...
-		return nil, ErrUnsupportedRSAOptions
+		// RFC 8017 s9.1.1: emLen = ceil((modBits-1)/8) >= hLen + sLen + 2
+		maxLen := (keyBits-1+7)/8 - int(hLen) - 2
+		if maxLen < 0 {
+			return nil, ErrUnsupportedRSAOptions
+		}
+		sLen = uint(maxLen)
 	case rsa.PSSSaltLengthEqualsHash:
 		sLen = hLen
 	default:
@@ -264,13 +552,12 @@ func signPSS(session *PKCS11Session, key *PKCS11PrivateKeyRSA, digest []byte, op
 	parameters := concat(ulongToBytes(hMech),
 		ulongToBytes(mgf),
 		ulongToBytes(sLen))
-	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, parameters)}
-	if err = session.Ctx.SignInit(session.Handle, mech, key.Handle); err != nil {
-		return nil, err
-	}
-	return session.Ctx.Sign(session.Handle, digest)
+	return []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, parameters)}, nil
 }
 
+// pkcs1Prefix maps hash functions to the DER encoding of the
+// DigestInfo that precedes the digest in EMSA-PKCS1-v1_5 (RFC 8017
+// s9.2 note 1).
 var pkcs1Prefix = map[crypto.Hash][]byte{
 	crypto.SHA1:   []byte{0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
 	crypto.SHA224: []byte{0x30, 0x2d, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x04, 0x05, 0x00, 0x04, 0x1c},
@@ -279,45 +566,260 @@ var pkcs1Prefix = map[crypto.Hash][]byte{
 	crypto.SHA512: []byte{0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
 }
 
+// signPKCS1v15 signs a precomputed digest with bare CKM_RSA_PKCS.
+//
+// The token only performs the padding and the RSA operation, so the
+// DigestInfo for the hash is prepended here. A hash of 0 means that
+// digest is already a complete DigestInfo (or some other value the
+// caller wants signed directly), as with crypto/rsa.SignPKCS1v15.
 func signPKCS1v15(session *PKCS11Session, key *PKCS11PrivateKeyRSA, digest []byte, hash crypto.Hash) (signature []byte, err error) {
-	/* Calculate T for EMSA-PKCS1-v1_5. */
-	oid := pkcs1Prefix[hash]
-	T := make([]byte, len(oid)+len(digest))
-	copy(T[0:len(oid)], oid)
-	copy(T[len(oid):], digest)
+	var T []byte
+	if T, err = pkcs1v15DigestInfo(digest, hash); err != nil {
+		return
+	}
 	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)}
-	err = session.Ctx.SignInit(session.Handle, mech, key.Handle)
+	err = traceCall("C_SignInit", mech, session.Ctx.SignInit(session.Handle, mech, key.Handle))
 	if err == nil {
 		signature, err = session.Ctx.Sign(session.Handle, T)
+		traceCall("C_Sign", nil, err)
 	}
 	return
 }
 
+// pkcs1v15DigestInfo calculates T for EMSA-PKCS1-v1_5.
+func pkcs1v15DigestInfo(digest []byte, hash crypto.Hash) ([]byte, error) {
+	var oid []byte
+	if hash != 0 {
+		var ok bool
+		if oid, ok = pkcs1Prefix[hash]; !ok {
+			return nil, ErrUnsupportedRSAOptions
+		}
+		if len(digest) != hash.Size() {
+			return nil, ErrBadDigestLength
+		}
+	}
+	T := make([]byte, len(oid)+len(digest))
+	copy(T[0:len(oid)], oid)
+	copy(T[len(oid):], digest)
+	return T, nil
+}
+
 // Sign signs a message using a RSA key.
 //
 // This completes the implemention of crypto.Signer for PKCS11PrivateKeyRSA.
 //
 // PKCS#11 expects to pick its own random data where necessary for signatures, so the rand argument is ignored.
 //
-// Note that (at present) the crypto.rsa.PSSSaltLengthAuto option is
-// not supported. The caller must either use
-// crypto.rsa.PSSSaltLengthEqualsHash (recommended) or pass an
-// explicit salt length. Moreover the underlying PKCS#11
-// implementation may impose further restrictions.
+// For PKCS#1 v1.5 signatures digest must be the output of
+// opts.HashFunc(); the corresponding DigestInfo is added before
+// signing with CKM_RSA_PKCS, so only that mechanism is required of
+// the token. SHA-1, SHA-224, SHA-256, SHA-384 and SHA-512 are
+// supported.
+//
+// For PSS signatures opts may be either a *rsa.PSSOptions or, if the
+// MGF1 hash must differ from the digest hash, a *PSSOptions.
+//
+// If opts is nil then DefaultSignerOpts from the configuration is
+// used; if that is not set either, ErrNoSignerOpts is returned.
+//
+// The salt length may be crypto.rsa.PSSSaltLengthEqualsHash
+// (recommended), an explicit length, or crypto.rsa.PSSSaltLengthAuto,
+// which asks for the largest salt the key allows. The underlying
+// PKCS#11 implementation may impose further restrictions.
 func (priv *PKCS11PrivateKeyRSA) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) (signature []byte, err error) {
-	if err != nil {
+	if opts, err = defaultSignerOpts(opts); err != nil {
 		return nil, err
 	}
-	err = withSession(priv.Slot, func(session *PKCS11Session) error {
-		switch opts.(type) {
+	mechanism := uint(pkcs11.CKM_RSA_PKCS)
+	switch opts.(type) {
+	case *rsa.PSSOptions, *PSSOptions:
+		mechanism = pkcs11.CKM_RSA_PKCS_PSS
+	}
+	if err = priv.checkSign(mechanism); err != nil {
+		return nil, err
+	}
+	// PKCS#1 v1.5 signatures are deterministic, so may be cached, as
+	// long as the key's CKA_ID is known
+	cacheable := mechanism == pkcs11.CKM_RSA_PKCS && priv.identity != nil
+	var cacheKey signatureKey
+	if cacheable {
+		cacheKey = signatureKey{priv.Slot, priv.Handle, string(priv.identity.id), priv.generation, mechanism, opts.HashFunc(), string(digest)}
+		if signature = signatures.get(cacheKey); signature != nil {
+			return signature, nil
+		}
+	}
+	signature, err = withSignSession(&priv.PKCS11Object, func(session *PKCS11Session) ([]byte, error) {
+		switch o := opts.(type) {
 		case *rsa.PSSOptions:
-			signature, err = signPSS(session, priv, digest, opts.(*rsa.PSSOptions))
+			return signPSS(session, priv, digest, o, 0)
+		case *PSSOptions:
+			return signPSS(session, priv, digest, &o.PSSOptions, o.MGFHash)
 		default: /* PKCS1-v1_5 */
-			signature, err = signPKCS1v15(session, priv, digest, opts.HashFunc())
+			return signPKCS1v15(session, priv, digest, opts.HashFunc())
 		}
-		return err
 	})
-	return signature, err
+	if err == nil && cacheable {
+		signatures.put(cacheKey, signature)
+	}
+	return signature, priv.wrapError("Sign", err)
+}
+
+// rsaHashMechanisms maps hash functions to the combined PKCS#1 v1.5 mechanisms.
+var rsaHashMechanisms = map[crypto.Hash]uint{
+	crypto.SHA1:   pkcs11.CKM_SHA1_RSA_PKCS,
+	crypto.SHA224: pkcs11.CKM_SHA224_RSA_PKCS,
+	crypto.SHA256: pkcs11.CKM_SHA256_RSA_PKCS,
+	crypto.SHA384: pkcs11.CKM_SHA384_RSA_PKCS,
+	crypto.SHA512: pkcs11.CKM_SHA512_RSA_PKCS,
+}
+
+// rsaPSSHashMechanisms maps hash functions to the combined PSS mechanisms.
+var rsaPSSHashMechanisms = map[crypto.Hash]uint{
+	crypto.SHA1:   pkcs11.CKM_SHA1_RSA_PKCS_PSS,
+	crypto.SHA224: pkcs11.CKM_SHA224_RSA_PKCS_PSS,
+	crypto.SHA256: pkcs11.CKM_SHA256_RSA_PKCS_PSS,
+	crypto.SHA384: pkcs11.CKM_SHA384_RSA_PKCS_PSS,
+	crypto.SHA512: pkcs11.CKM_SHA512_RSA_PKCS_PSS,
+}
+
+// combinedMechanism returns the mechanism that hashes and signs in one step for opts, or nil if there is none.
+//
+// keyBits is the modulus size; see pssMechanism.
+func combinedMechanism(opts crypto.SignerOpts, keyBits int) ([]*pkcs11.Mechanism, error) {
+	var mech []*pkcs11.Mechanism
+	var err error
+	switch o := opts.(type) {
+	case *rsa.PSSOptions:
+		mech, err = pssMechanism(o, 0, keyBits)
+	case *PSSOptions:
+		mech, err = pssMechanism(&o.PSSOptions, o.MGFHash, keyBits)
+	default: /* PKCS1-v1_5 */
+		if m, ok := rsaHashMechanisms[opts.HashFunc()]; ok {
+			return []*pkcs11.Mechanism{pkcs11.NewMechanism(m, nil)}, nil
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m, ok := rsaPSSHashMechanisms[opts.HashFunc()]
+	if !ok {
+		return nil, nil
+	}
+	// Same CK_RSA_PKCS_PSS_PARAMS, different mechanism
+	mech[0].Mechanism = m
+	return mech, nil
+}
+
+// SignMessage hashes and signs a message using an RSA key.
+//
+// opts is as for Sign. First the combined mechanism for opts (e.g.
+// CKM_SHA256_RSA_PKCS or CKM_SHA256_RSA_PKCS_PSS) is tried, passing
+// the message to the token to hash. If the token rejects it with
+// CKR_MECHANISM_INVALID then the message is hashed here and signed as
+// by Sign, and the combined mechanism is not tried again on that slot
+// until Close. The token's mechanism list is not consulted, since some
+// libraries misreport it.
+func (priv *PKCS11PrivateKeyRSA) SignMessage(message []byte, opts crypto.SignerOpts) ([]byte, error) {
+	opts, err := defaultSignerOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	mech, err := combinedMechanism(opts, priv.keyBits())
+	if err != nil {
+		return nil, err
+	}
+	if mech != nil && !mechanismRejected(priv.Slot, mech[0].Mechanism) && priv.checkSign(mech[0].Mechanism) == nil {
+		signature, err := withSignSession(&priv.PKCS11Object, func(session *PKCS11Session) ([]byte, error) {
+			if err := traceCall("C_SignInit", mech, session.Ctx.SignInit(session.Handle, mech, priv.Handle)); err != nil {
+				return nil, err
+			}
+			signature, err := session.Ctx.Sign(session.Handle, message)
+			return signature, traceCall("C_Sign", nil, err)
+		})
+		if !isMechanismInvalid(err) {
+			return signature, priv.wrapError("SignMessage", err)
+		}
+		rejectMechanism(priv.Slot, mech[0].Mechanism)
+	}
+	hash := opts.HashFunc()
+	if !hash.Available() {
+		return nil, ErrUnsupportedRSAOptions
+	}
+	h := hash.New()
+	h.Write(message)
+	return priv.Sign(nil, h.Sum(nil), opts)
+}
+
+// VerifyWithPublicKey checks a signature using the token's public key object.
+//
+// The signature is checked by the token with C_Verify, rather than by
+// crypto/rsa, so this can be used to confirm that the token agrees
+// with a signature produced elsewhere. opts selects the mechanism as
+// for Sign. The public key object is found by the private key's
+// CKA_ID; if there is none, ErrNoPublicKey is returned.
+//
+// For PSS the salt length must be given exactly:
+// rsa.PSSSaltLengthAuto, which crypto/rsa takes to mean that any salt
+// length is accepted, is rejected with ErrUnsupportedRSAOptions, since
+// C_Verify can only check one length.
+//
+// If the signature is wrong then an *ObjectError wrapping the PKCS#11
+// error (normally CKR_SIGNATURE_INVALID) is returned.
+func (priv *PKCS11PrivateKeyRSA) VerifyWithPublicKey(digest []byte, signature []byte, opts crypto.SignerOpts) error {
+	var mech []*pkcs11.Mechanism
+	opts, err := defaultSignerOpts(opts)
+	if err != nil {
+		return err
+	}
+	if err = checkVerifySaltLength(opts); err != nil {
+		return err
+	}
+	data := digest
+	switch o := opts.(type) {
+	case *rsa.PSSOptions:
+		mech, err = pssMechanism(o, 0, priv.keyBits())
+	case *PSSOptions:
+		mech, err = pssMechanism(&o.PSSOptions, o.MGFHash, priv.keyBits())
+	default: /* PKCS1-v1_5 */
+		mech = []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)}
+		data, err = pkcs1v15DigestInfo(digest, opts.HashFunc())
+	}
+	if err != nil {
+		return err
+	}
+	return priv.verifyWithPublicKey(pkcs11.CKK_RSA, mech, data, signature)
+}
+
+// checkVerifySaltLength rejects rsa.PSSSaltLengthAuto for verification.
+//
+// pssMechanism turns it into the maximum salt length, which is right
+// for signing, but crypto/rsa verifies an Auto signature of any salt
+// length, and the token cannot do that.
+func checkVerifySaltLength(opts crypto.SignerOpts) error {
+	switch o := opts.(type) {
+	case *rsa.PSSOptions:
+		if o.SaltLength == rsa.PSSSaltLengthAuto {
+			return ErrUnsupportedRSAOptions
+		}
+	case *PSSOptions:
+		if o.SaltLength == rsa.PSSSaltLengthAuto {
+			return ErrUnsupportedRSAOptions
+		}
+	}
+	return nil
+}
+
+// SignatureSize returns the size of a signature made by Sign, which is the size of the modulus.
+//
+// This is also the size of a ciphertext that Decrypt accepts.
+func (priv *PKCS11PrivateKeyRSA) SignatureSize() int {
+	return priv.PubKey.(*rsa.PublicKey).Size()
+}
+
+// keyBits returns the size of the modulus in bits.
+func (priv *PKCS11PrivateKeyRSA) keyBits() int {
+	return priv.PubKey.(*rsa.PublicKey).N.BitLen()
 }
 
 // Validate checks an RSA key.
@@ -27,7 +27,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	_ "crypto/sha1"
-	_ "crypto/sha256"
+	"crypto/sha256"
 	_ "crypto/sha512"
 	"fmt"
 	"github.com/miekg/pkcs11"
@@ -82,6 +82,9 @@ func TestHardRSA(t *testing.T) {
 				}
 			})
 			t.Run("Sign", func(t *testing.T) { testRsaSigning(t, key, nbits, key.Slot) })
+			t.Run("SignWithMechanism", func(t *testing.T) { testRsaSigningWithMechanism(t, key) })
+			t.Run("PSSMGFHash", func(t *testing.T) { testRsaSigningPSSMGFHash(t, key) })
+			t.Run("PSSSaltAuto", func(t *testing.T) { testRsaSigningPSSSaltAuto(t, key) })
 			t.Run("Encrypt", func(t *testing.T) { testRsaEncryption(t, key, nbits, key.Slot) })
 			t.Run("FindId", func(t *testing.T) {
 				// Get a fresh handle to  the key
@@ -123,6 +126,11 @@ func testRsaSigning(t *testing.T, key crypto.Signer, nbits int, slot uint) {
 	t.Run("SHA256", func(t *testing.T) { testRsaSigningPKCS1v15(t, key, crypto.SHA256) })
 	t.Run("SHA384", func(t *testing.T) { testRsaSigningPKCS1v15(t, key, crypto.SHA384) })
 	t.Run("SHA512", func(t *testing.T) { testRsaSigningPKCS1v15(t, key, crypto.SHA512) })
+	t.Run("BadDigest", func(t *testing.T) {
+		if _, err := key.Sign(rand.Reader, make([]byte, 31), crypto.SHA256); err == nil {
+			t.Errorf("PKCS#1 v1.5 Sign accepted a digest of the wrong length")
+		}
+	})
 	t.Run("PSSSHA1", func(t *testing.T) { testRsaSigningPSS(t, key, crypto.SHA1, slot) })
 	t.Run("PSSSHA224", func(t *testing.T) { testRsaSigningPSS(t, key, crypto.SHA224, slot) })
 	t.Run("PSSSHA256", func(t *testing.T) { testRsaSigningPSS(t, key, crypto.SHA256, slot) })
@@ -154,6 +162,25 @@ func testRsaSigningPKCS1v15(t *testing.T, key crypto.Signer, hashFunction crypto
 	}
 }
 
+func testRsaSigningWithMechanism(t *testing.T, key *PKCS11PrivateKeyRSA) {
+	var err error
+	var sig []byte
+
+	needMechanism(t, key.Slot, pkcs11.CKM_SHA256_RSA_PKCS)
+	plaintext := []byte("sign me with an explicit mechanism")
+	mech := pkcs11.NewMechanism(pkcs11.CKM_SHA256_RSA_PKCS, nil)
+	if sig, err = key.SignWithMechanism(mech, plaintext); err != nil {
+		t.Errorf("SignWithMechanism: %v", err)
+		return
+	}
+	h := crypto.SHA256.New()
+	h.Write(plaintext)
+	rsaPubkey := key.Public().(crypto.PublicKey).(*rsa.PublicKey)
+	if err = rsa.VerifyPKCS1v15(rsaPubkey, crypto.SHA256, h.Sum(nil), sig); err != nil {
+		t.Errorf("SignWithMechanism Verify: %v", err)
+	}
+}
+
 func testRsaSigningPSS(t *testing.T, key crypto.Signer, hashFunction crypto.Hash, slot uint) {
 	var err error
 	var sig []byte
@@ -177,8 +204,68 @@ func testRsaSigningPSS(t *testing.T, key crypto.Signer, hashFunction crypto.Hash
 	}
 }
 
+func testRsaSigningPSSMGFHash(t *testing.T, key *PKCS11PrivateKeyRSA) {
+	var err error
+	var sig []byte
+
+	needMechanism(t, key.Slot, pkcs11.CKM_RSA_PKCS_PSS)
+	plaintext := []byte("sign me with PSS and an explicit MGF")
+	h := crypto.SHA256.New()
+	h.Write(plaintext)
+	plaintextHash := h.Sum(nil)
+	opts := &PSSOptions{
+		PSSOptions: rsa.PSSOptions{
+			SaltLength: rsa.PSSSaltLengthEqualsHash,
+			Hash:       crypto.SHA256,
+		},
+		MGFHash: crypto.SHA256,
+	}
+	if sig, err = key.Sign(rand.Reader, plaintextHash, opts); err != nil {
+		t.Errorf("PSS Sign (MGF hash %v): %v", opts.MGFHash, err)
+		return
+	}
+	rsaPubkey := key.Public().(crypto.PublicKey).(*rsa.PublicKey)
+	if err = rsa.VerifyPSS(rsaPubkey, crypto.SHA256, plaintextHash, sig, &opts.PSSOptions); err != nil {
+		t.Errorf("PSS Verify (MGF hash %v): %v", opts.MGFHash, err)
+	}
+	// A different MGF1 hash must produce a signature crypto/rsa rejects
+	opts.MGFHash = crypto.SHA1
+	if sig, err = key.Sign(rand.Reader, plaintextHash, opts); err != nil {
+		t.Skipf("PSS Sign (MGF hash %v): %v", opts.MGFHash, err)
+	}
+	if err = rsa.VerifyPSS(rsaPubkey, crypto.SHA256, plaintextHash, sig, &opts.PSSOptions); err == nil {
+		t.Errorf("PSS Verify (MGF hash %v): MGF hash was ignored", opts.MGFHash)
+	}
+}
+
+func testRsaSigningPSSSaltAuto(t *testing.T, key *PKCS11PrivateKeyRSA) {
+	var err error
+	var sig []byte
+
+	needMechanism(t, key.Slot, pkcs11.CKM_RSA_PKCS_PSS)
+	plaintext := []byte("sign me with the largest salt")
+	h := crypto.SHA256.New()
+	h.Write(plaintext)
+	plaintextHash := h.Sum(nil)
+	opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: crypto.SHA256}
+	if sig, err = key.Sign(rand.Reader, plaintextHash, opts); err != nil {
+		t.Errorf("PSS Sign (auto salt): %v", err)
+		return
+	}
+	rsaPubkey := key.Public().(*rsa.PublicKey)
+	if err = rsa.VerifyPSS(rsaPubkey, crypto.SHA256, plaintextHash, sig, opts); err != nil {
+		t.Errorf("PSS Verify (auto salt): %v", err)
+	}
+	// The salt must be the maximum, so a verifier expecting exactly that length accepts it
+	exact := &rsa.PSSOptions{SaltLength: (rsaPubkey.N.BitLen()-1+7)/8 - crypto.SHA256.Size() - 2, Hash: crypto.SHA256}
+	if err = rsa.VerifyPSS(rsaPubkey, crypto.SHA256, plaintextHash, sig, exact); err != nil {
+		t.Errorf("PSS Verify (salt length %d): %v", exact.SaltLength, err)
+	}
+}
+
 func testRsaEncryption(t *testing.T, key crypto.Decrypter, nbits int, slot uint) {
 	t.Run("PKCS1v15", func(t *testing.T) { testRsaEncryptionPKCS1v15(t, key) })
+	t.Run("PKCS1v15SessionKey", func(t *testing.T) { testRsaEncryptionSessionKey(t, key) })
 	t.Run("OAEPSHA1", func(t *testing.T) { testRsaEncryptionOAEP(t, key, crypto.SHA1, []byte{}, slot) })
 	t.Run("OAEPSHA224", func(t *testing.T) { testRsaEncryptionOAEP(t, key, crypto.SHA224, []byte{}, slot) })
 	t.Run("OAEPSHA256", func(t *testing.T) { testRsaEncryptionOAEP(t, key, crypto.SHA256, []byte{}, slot) })
@@ -234,6 +321,36 @@ func testRsaEncryptionPKCS1v15(t *testing.T, key crypto.Decrypter) {
 	}
 }
 
+func testRsaEncryptionSessionKey(t *testing.T, key crypto.Decrypter) {
+	sessionKey := []byte("0123456789abcdef")
+	rsaPubkey := key.Public().(crypto.PublicKey).(*rsa.PublicKey)
+	ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, rsaPubkey, sessionKey)
+	if err != nil {
+		t.Fatalf("PKCS#1v1.5 Encrypt: %v", err)
+	}
+	options := &rsa.PKCS1v15DecryptOptions{SessionKeyLen: len(sessionKey)}
+	decrypted, err := key.Decrypt(rand.Reader, ciphertext, options)
+	if err != nil {
+		t.Fatalf("PKCS#1v1.5 Decrypt (session key): %v", err)
+	}
+	if !bytes.Equal(decrypted, sessionKey) {
+		t.Errorf("PKCS#1v1.5 Decrypt (session key): wrong answer")
+	}
+	// Neither bad padding nor the wrong length may be reported
+	options.SessionKeyLen = len(sessionKey) + 8
+	if decrypted, err = key.Decrypt(rand.Reader, ciphertext, options); err != nil || len(decrypted) != options.SessionKeyLen {
+		t.Errorf("PKCS#1v1.5 Decrypt (wrong length): %v/%d", err, len(decrypted))
+	}
+	options.SessionKeyLen = len(sessionKey)
+	ciphertext[len(ciphertext)-1] ^= 1
+	if decrypted, err = key.Decrypt(rand.Reader, ciphertext, options); err != nil || len(decrypted) != len(sessionKey) {
+		t.Errorf("PKCS#1v1.5 Decrypt (bad padding): %v/%d", err, len(decrypted))
+	}
+	if bytes.Equal(decrypted, sessionKey) {
+		t.Errorf("PKCS#1v1.5 Decrypt (bad padding): corrupt ciphertext decrypted")
+	}
+}
+
 func testRsaEncryptionOAEP(t *testing.T, key crypto.Decrypter, hashFunction crypto.Hash, label []byte, slot uint) {
 	var err error
 	var ciphertext, decrypted []byte
@@ -286,3 +403,241 @@ func needMechanism(t *testing.T, slot uint, wantMech uint) {
 	}
 	t.Skipf("mechanism %v not supported", wantMech)
 }
+
+func TestRsaUsageCheck(t *testing.T) {
+	// No token access is needed: the check happens before any PKCS#11 call.
+	key := &PKCS11PrivateKeyRSA{PKCS11PrivateKey{usage: &keyUsage{sign: true}}}
+	if _, err := key.Decrypt(rand.Reader, []byte{0}, nil); err != ErrDecryptNotPermitted {
+		t.Errorf("Decrypt with sign-only key: got %v, want ErrDecryptNotPermitted", err)
+	}
+	key = &PKCS11PrivateKeyRSA{PKCS11PrivateKey{usage: &keyUsage{decrypt: true}}}
+	if _, err := key.Sign(rand.Reader, make([]byte, 32), crypto.SHA256); err != ErrSignNotPermitted {
+		t.Errorf("Sign with decrypt-only key: got %v, want ErrSignNotPermitted", err)
+	}
+	if _, err := key.UnwrapKey(make([]byte, 256), nil, &KeyAttributes{Cipher: &CipherAES}); err != ErrUnwrapNotPermitted {
+		t.Errorf("UnwrapKey with decrypt-only key: got %v, want ErrUnwrapNotPermitted", err)
+	}
+}
+
+func TestRsaAllowedMechanismCheck(t *testing.T) {
+	// As above, the check happens before any PKCS#11 call.
+	key := &PKCS11PrivateKeyRSA{PKCS11PrivateKey{usage: &keyUsage{sign: true, mechanisms: []uint{pkcs11.CKM_RSA_PKCS_PSS}}}}
+	if _, err := key.Sign(rand.Reader, make([]byte, 32), crypto.SHA256); err != ErrMechanismNotAllowed {
+		t.Errorf("PKCS#1 v1.5 Sign with PSS-only key: got %v, want ErrMechanismNotAllowed", err)
+	}
+}
+
+func TestRsaPublicFromPrivate(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	key, err := GenerateRSAKeyPair(2048)
+	if err != nil {
+		t.Fatalf("GenerateRSAKeyPair: %v", err)
+	}
+	id, label, err := key.Identify()
+	if err != nil {
+		t.Fatalf("key.Identify: %v", err)
+	}
+	// Leave only the private key object behind
+	if err = withSession(key.Slot, func(session *PKCS11Session) error {
+		pubHandle, err := findKey(session, id, label, pkcs11.CKO_PUBLIC_KEY, pkcs11.CKK_RSA)
+		if err != nil {
+			return err
+		}
+		return session.Ctx.DestroyObject(session.Handle, pubHandle)
+	}); err != nil {
+		t.Fatalf("destroying public key: %v", err)
+	}
+	found, err := FindKeyPair(id, nil)
+	if err != nil {
+		t.Fatalf("FindKeyPair: %v", err)
+	}
+	match, err := publicKeysEqual(found.(crypto.Signer).Public(), key.Public())
+	if err != nil || !match {
+		t.Errorf("FindKeyPair: recovered public key does not match (%v)", err)
+	}
+}
+
+func TestImportRSAKeyPair(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	softKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	key, err := ImportRSAKeyPair(softKey)
+	if err != nil {
+		t.Fatalf("ImportRSAKeyPair: %v", err)
+	}
+	testRsaSigning(t, key, 2048, key.Slot)
+	testRsaEncryption(t, key, 2048, key.Slot)
+}
+
+func TestRsaVerifyWithPublicKey(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	softKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	key, err := ImportRSAKeyPair(softKey)
+	if err != nil {
+		t.Fatalf("ImportRSAKeyPair: %v", err)
+	}
+	digest := sha256.Sum256([]byte("verify me on the token"))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, softKey, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("rsa.SignPKCS1v15: %v", err)
+	}
+	if err = key.VerifyWithPublicKey(digest[:], sig, crypto.SHA256); err != nil {
+		t.Errorf("VerifyWithPublicKey (PKCS#1 v1.5): %v", err)
+	}
+	needMechanism(t, key.Slot, pkcs11.CKM_RSA_PKCS_PSS)
+	pssOptions := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	if sig, err = rsa.SignPSS(rand.Reader, softKey, crypto.SHA256, digest[:], pssOptions); err != nil {
+		t.Fatalf("rsa.SignPSS: %v", err)
+	}
+	if err = key.VerifyWithPublicKey(digest[:], sig, pssOptions); err != nil {
+		t.Errorf("VerifyWithPublicKey (PSS): %v", err)
+	}
+	// crypto/rsa would detect the salt length; the token cannot
+	auto := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto, Hash: crypto.SHA256}
+	if err = key.VerifyWithPublicKey(digest[:], sig, auto); err != ErrUnsupportedRSAOptions {
+		t.Errorf("VerifyWithPublicKey (PSS, auto salt): got %v, want ErrUnsupportedRSAOptions", err)
+	}
+	if _, err = key.NewVerifier(auto); err != ErrUnsupportedRSAOptions {
+		t.Errorf("NewVerifier (PSS, auto salt): got %v, want ErrUnsupportedRSAOptions", err)
+	}
+	sig[0] ^= 1
+	if err = key.VerifyWithPublicKey(digest[:], sig, pssOptions); err == nil {
+		t.Errorf("VerifyWithPublicKey: accepted a bad signature")
+	}
+}
+
+func TestRSAPublicKeyFromValues(t *testing.T) {
+	n := make([]byte, 256)
+	n[0], n[255] = 0x80, 0x01
+	pub, err := rsaPublicKeyFromValues(n, []byte{1, 0, 1})
+	if err != nil {
+		t.Fatalf("rsaPublicKeyFromValues: %v", err)
+	}
+	if pub.N.Sign() <= 0 || pub.N.BitLen() != 2048 || pub.E != 65537 {
+		t.Errorf("rsaPublicKeyFromValues: got N of %d bits (sign %d), E %d", pub.N.BitLen(), pub.N.Sign(), pub.E)
+	}
+	if _, err = rsaPublicKeyFromValues(n, []byte{1}); err != ErrMalformedRSAKey {
+		t.Errorf("rsaPublicKeyFromValues with E=1: got %v, want ErrMalformedRSAKey", err)
+	}
+}
+
+func TestRsaProvenance(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	generated, err := GenerateRSAKeyPair(1024)
+	if err != nil {
+		t.Fatalf("GenerateRSAKeyPair: %v", err)
+	}
+	p, err := generated.Provenance()
+	if err != nil {
+		t.Fatalf("Provenance: %v", err)
+	}
+	if !p.Local || !p.NeverExtractable {
+		t.Errorf("Provenance of generated key: got %+v, want both true", p)
+	}
+	softKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	imported, err := ImportRSAKeyPair(softKey)
+	if err != nil {
+		t.Fatalf("ImportRSAKeyPair: %v", err)
+	}
+	if local, err := imported.IsTokenGenerated(); err != nil || local {
+		t.Errorf("IsTokenGenerated of imported key: got %v, %v; want false", local, err)
+	}
+}
+
+func TestRsaSignMessage(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	key, err := GenerateRSAKeyPair(2048)
+	if err != nil {
+		t.Fatalf("GenerateRSAKeyPair: %v", err)
+	}
+	pub := key.Public().(*rsa.PublicKey)
+	message := []byte("sign me with whichever mechanism works")
+	digest := sha256.Sum256(message)
+	pssOpts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	check := func(name string) {
+		sig, err := key.SignMessage(message, crypto.SHA256)
+		if err != nil {
+			t.Fatalf("%s: SignMessage: %v", name, err)
+		}
+		if err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			t.Errorf("%s: PKCS#1 v1.5 signature does not verify: %v", name, err)
+		}
+		if sig, err = key.SignMessage(message, pssOpts); err != nil {
+			t.Fatalf("%s: SignMessage (PSS): %v", name, err)
+		}
+		if err = rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig, pssOpts); err != nil {
+			t.Errorf("%s: PSS signature does not verify: %v", name, err)
+		}
+	}
+	check("combined")
+	// As if the token had rejected the combined mechanisms
+	rejectMechanism(key.Slot, pkcs11.CKM_SHA256_RSA_PKCS)
+	rejectMechanism(key.Slot, pkcs11.CKM_SHA256_RSA_PKCS_PSS)
+	check("fallback")
+}
+
+func TestRsaDefaultSignerOpts(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	key, err := GenerateRSAKeyPair(2048)
+	if err != nil {
+		t.Fatalf("GenerateRSAKeyPair: %v", err)
+	}
+	digest := sha256.Sum256([]byte("default options"))
+	if _, err = key.Sign(rand.Reader, digest[:], nil); err != ErrNoSignerOpts {
+		t.Errorf("Sign with nil opts and no default: got %v, want ErrNoSignerOpts", err)
+	}
+	needMechanism(t, key.Slot, pkcs11.CKM_RSA_PKCS_PSS)
+	pss := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	instance.cfg.DefaultSignerOpts = pss
+	signature, err := key.Sign(rand.Reader, digest[:], nil)
+	if err != nil {
+		t.Fatalf("Sign with nil opts: %v", err)
+	}
+	if err = rsa.VerifyPSS(key.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], signature, pss); err != nil {
+		t.Errorf("Sign with nil opts did not use DefaultSignerOpts: %v", err)
+	}
+}
+
+func TestRsaPrivateExtraAttributes(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	key, err := GenerateRSAKeyPairWithAttributes(2048, &KeyAttributes{
+		PrivateExtra: []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, false)},
+	})
+	if err != nil {
+		t.Fatalf("GenerateRSAKeyPairWithAttributes: %v", err)
+	}
+	err = withSession(key.Slot, func(session *PKCS11Session) error {
+		attributes, err := session.Ctx.GetAttributeValue(session.Handle, key.Handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, nil),
+		})
+		if err != nil {
+			return err
+		}
+		if bytesToBool(attributes[0].Value) || !bytesToBool(attributes[1].Value) {
+			t.Errorf("CKA_DECRYPT %v CKA_SIGN %v, want false and true", bytesToBool(attributes[0].Value), bytesToBool(attributes[1].Value))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("GetAttributeValue: %v", err)
+	}
+	if _, err = key.Decrypt(rand.Reader, make([]byte, key.SignatureSize()), nil); err != ErrDecryptNotPermitted {
+		t.Errorf("Decrypt: got %v, want ErrDecryptNotPermitted", err)
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"github.com/youtube/vitess/go/pools"
 	"log"
 	"sync"
+	"time"
 )
 
 // PKCS11Session is a pair of PKCS#11 context and a reference to a loaded session handle.
@@ -38,9 +39,65 @@ type PKCS11Session struct {
 }
 
 // sessionPool is a thread safe pool of PKCS#11 sessions
+//
+// Each slot has its own independent resource pool. The lock here only
+// guards the map itself and is never held while waiting for a
+// session, so a busy slot cannot starve any other slot.
 type sessionPool struct {
 	m    sync.RWMutex
-	pool map[uint]*pools.ResourcePool
+	pool map[uint]*slotPool
+
+	// Functions to stop the keepers of slots with MinSessions set
+	stopKeepers map[uint]func()
+}
+
+// slotPool is the resource pool of one slot's sessions.
+//
+// In StrictSessions mode borrowed holds a value for each session that
+// has been borrowed and not yet returned, and a Get that finds it
+// full fails with ErrPoolExhausted instead of waiting.
+type slotPool struct {
+	*pools.ResourcePool
+	borrowed chan struct{}
+
+	// The configuration the pool belongs to
+	lib *libCtx
+}
+
+// Get borrows a session from the pool.
+func (sp *slotPool) Get(ctx context.Context) (pools.Resource, error) {
+	if sp.borrowed != nil {
+		select {
+		case sp.borrowed <- struct{}{}:
+		default:
+			return nil, ErrPoolExhausted
+		}
+	}
+	r, err := sp.ResourcePool.Get(ctx)
+	if err != nil && sp.borrowed != nil {
+		<-sp.borrowed
+	}
+	return r, err
+}
+
+// Put returns a session to the pool, or discards it if r is nil.
+func (sp *slotPool) Put(r pools.Resource) {
+	sp.ResourcePool.Put(r)
+	if sp.borrowed != nil {
+		<-sp.borrowed
+	}
+}
+
+// abandon discards a borrowed session that is still in use elsewhere,
+// so that the pool may open a replacement. In StrictSessions mode the
+// session stays counted as borrowed until done is called.
+func (sp *slotPool) abandon() (done func()) {
+	sp.ResourcePool.Put(nil)
+	return func() {
+		if sp.borrowed != nil {
+			<-sp.borrowed
+		}
+	}
 }
 
 // Map of slot IDs to session pools
@@ -55,6 +112,7 @@ var errPoolNotFound = errors.New("pool not found")
 // Create a new session for a given slot
 func newSession(ctx *pkcs11.Ctx, slot uint) (*PKCS11Session, error) {
 	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	traceCall("C_OpenSession", nil, err)
 	if err != nil {
 		return nil, err
 	}
@@ -64,7 +122,8 @@ func newSession(ctx *pkcs11.Ctx, slot uint) (*PKCS11Session, error) {
 // Create a new session pool with default configuration
 func newSessionPool() *sessionPool {
 	return &sessionPool{
-		pool: map[uint]*pools.ResourcePool{},
+		pool:        map[uint]*slotPool{},
+		stopKeepers: map[uint]func(){},
 	}
 }
 
@@ -74,14 +133,14 @@ func (session *PKCS11Session) Close() {
 }
 
 // Get returns requested resource pool by slot id
-func (p *sessionPool) Get(slot uint) *pools.ResourcePool {
+func (p *sessionPool) Get(slot uint) *slotPool {
 	p.m.RLock()
 	defer p.m.RUnlock()
 	return p.pool[slot]
 }
 
 // Put stores new resource pool into the pool if the requested slot is free
-func (p *sessionPool) PutIfAbsent(slot uint, pool *pools.ResourcePool) error {
+func (p *sessionPool) PutIfAbsent(slot uint, pool *slotPool) error {
 	p.m.Lock()
 	defer p.m.Unlock()
 	if _, ok := p.pool[slot]; ok {
@@ -91,35 +150,66 @@ func (p *sessionPool) PutIfAbsent(slot uint, pool *pools.ResourcePool) error {
 	return nil
 }
 
+// slotLib returns the configuration that a slot's sessions belong to.
+//
+// If the slot has no pool yet then it is the package configuration.
+func slotLib(slot uint) *libCtx {
+	if sp := pool.Get(slot); sp != nil {
+		return sp.lib
+	}
+	return instance
+}
+
 // Run a function with a session
 //
 // setupSessions must have been called for the slot already, otherwise
 // an error will be returned.
 func withSession(slot uint, f func(session *PKCS11Session) error) error {
+	sessionPool, s, err := getSession(slot)
+	if err != nil {
+		return err
+	}
+	defer sessionPool.Put(s)
+	return withLogin(sessionPool.lib, s, slot, f)
+}
+
+// Borrow a session from a slot's pool
+//
+// The caller must return it with Put, or Put(nil) if it must be discarded.
+func getSession(slot uint) (*slotPool, *PKCS11Session, error) {
 	sessionPool := pool.Get(slot)
 	if sessionPool == nil {
-		return fmt.Errorf("crypto11: no session for slot %d", slot)
+		return nil, nil, fmt.Errorf("crypto11: no session for slot %d", slot)
 	}
 
 	ctx := context.Background()
-	if instance.cfg.PoolWaitTimeout > 0 {
+	if timeout := sessionPool.lib.cfg.PoolWaitTimeout; timeout > 0 {
 		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(context.Background(), instance.cfg.PoolWaitTimeout)
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
 		defer cancel()
 	}
 
 	session, err := sessionPool.Get(ctx)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer sessionPool.Put(session)
+	return sessionPool, session.(*PKCS11Session), nil
+}
 
-	s := session.(*PKCS11Session)
-	err = f(s)
+// Run a function with a session, logging in and retrying if it needs a login
+//
+// The token is only logged in again if something holds a login on it
+// (see loginRegistry); otherwise the error is returned as it is.
+func withLogin(c *libCtx, s *PKCS11Session, slot uint, f func(session *PKCS11Session) error) error {
+	err := f(s)
 	if err != nil {
 		// if a request required login, then try to login
-		if perr, ok := err.(pkcs11.Error); ok && perr == pkcs11.CKR_USER_NOT_LOGGED_IN && instance.cfg.Pin != "" {
-			if err = s.Ctx.Login(s.Handle, pkcs11.CKU_USER, instance.cfg.Pin); err != nil {
+		if perr, ok := err.(pkcs11.Error); ok && perr == pkcs11.CKR_USER_NOT_LOGGED_IN {
+			held, lerr := logins.restore(c, s, slot)
+			if lerr != nil {
+				return lerr
+			}
+			if !held {
 				return err
 			}
 			// retry after login
@@ -132,8 +222,53 @@ func withSession(slot uint, f func(session *PKCS11Session) error) error {
 	return nil
 }
 
+// Run a search with a session, abandoning it after FindTimeout
+//
+// If FindTimeout is set then f runs on its own goroutine. A PKCS#11
+// call cannot be interrupted, so on timeout that goroutine, and the
+// session it holds, stay busy until the token returns; the result is
+// then discarded and the session goes back to the pool. Repeated
+// timeouts can therefore exhaust the pool. f must not modify anything
+// the caller can see, since it may still be running after the caller
+// has returned.
+func withFindTimeout(slot uint, f func(session *PKCS11Session) (interface{}, error)) (interface{}, error) {
+	type result struct {
+		v   interface{}
+		err error
+	}
+	run := func() (r result) {
+		r.err = withSession(slot, func(session *PKCS11Session) error {
+			var err error
+			r.v, err = f(session)
+			return err
+		})
+		return
+	}
+	timeout := slotLib(slot).cfg.FindTimeout
+	if timeout <= 0 {
+		r := run()
+		return r.v, r.err
+	}
+	done := make(chan result, 1)
+	go func() { done <- run() }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-timer.C:
+		return nil, ErrFindTimeout
+	}
+}
+
 // Ensures that sessions are setup.
+//
+// This is called on every top-level operation, so the common case of
+// an existing pool only takes the pool map's read lock.
 func ensureSessions(ctx *libCtx, slot uint) error {
+	if pool.Get(slot) != nil {
+		return nil
+	}
 	if err := setupSessions(ctx, slot); err != nil && err != errSlotBusy {
 		return err
 	}
@@ -143,20 +278,21 @@ func ensureSessions(ctx *libCtx, slot uint) error {
 // Create the session pool for a given slot if it does not exist
 // already.
 func setupSessions(c *libCtx, slot uint) error {
-	return pool.PutIfAbsent(slot, pools.NewResourcePool(
+	rp := pools.NewResourcePool(
 		func() (pools.Resource, error) {
 			s, err := newSession(c.ctx, slot)
 			if err != nil {
 				return nil, err
 			}
 
-			if instance.token.Flags&pkcs11.CKF_LOGIN_REQUIRED != 0 && instance.cfg.Pin != "" {
-				// login required if a pool evict idle sessions or
-				// for the first connection in the pool (handled in lib conf)
-				if instance.cfg.IdleTimeout > 0 {
-					if err = loginToken(s); err != nil {
-						return nil, err
-					}
+			// If the pool evicts idle sessions then the token may have
+			// logged out when the last one closed; log in again for
+			// whoever holds the login
+			if c.cfg.IdleTimeout > 0 {
+				if _, err = logins.restore(c, s, slot); err != nil {
+					log.Printf("Failed to open PKCS#11 Session: %s", err.Error())
+					s.Close()
+					return nil, err
 				}
 			}
 
@@ -165,24 +301,214 @@ func setupSessions(c *libCtx, slot uint) error {
 		c.cfg.MaxSessions,
 		c.cfg.MaxSessions,
 		c.cfg.IdleTimeout,
-	))
+	)
+	sp := &slotPool{ResourcePool: rp, lib: c}
+	if c.cfg.StrictSessions {
+		sp.borrowed = make(chan struct{}, c.cfg.MaxSessions)
+	}
+	if err := pool.PutIfAbsent(slot, sp); err != nil {
+		rp.Close()
+		return err
+	}
+	if c.cfg.IdleTimeout > 0 && c.cfg.MinSessions > 0 {
+		pool.startKeeper(slot, sp, c.cfg.MinSessions, c.cfg.IdleTimeout/2)
+	}
+	return nil
 }
 
-func loginToken(s *PKCS11Session) error {
+// startKeeper starts a goroutine that keeps at least min sessions open in a slot's pool.
+//
+// The resource pool itself closes sessions that have been idle longer
+// than IdleTimeout. Every interval in which no session is in use the
+// keeper borrows min sessions, creating them if necessary, and checks
+// each with C_GetSessionInfo.
+// This resets both the pool's and the token's idle timers for those
+// sessions, and replaces any the token has closed, so that the first
+// request after a quiet period finds a working session.
+func (p *sessionPool) startKeeper(slot uint, rp *slotPool, min int, interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	p.m.Lock()
+	p.stopKeepers[slot] = func() {
+		cancel()
+		<-done
+	}
+	p.m.Unlock()
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				keepSessions(ctx, rp, min, interval)
+			}
+		}
+	}()
+}
+
+// keepSessions borrows, checks and returns min sessions, unless the pool is busy.
+func keepSessions(ctx context.Context, rp *slotPool, min int, timeout time.Duration) {
+	// Skip a turn rather than take sessions that other operations
+	// (or, in StrictSessions mode, their quota) may be waiting for
+	if rp.InUse() > 0 {
+		return
+	}
+	// Don't wait indefinitely if the pool is busy. Busy sessions
+	// don't need keeping anyway.
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var borrowed []pools.Resource
+	for len(borrowed) < min {
+		r, err := rp.Get(ctx)
+		if err != nil {
+			break
+		}
+		borrowed = append(borrowed, r)
+	}
+	for _, r := range borrowed {
+		s := r.(*PKCS11Session)
+		if _, err := s.Ctx.GetSessionInfo(s.Handle); err != nil {
+			// The pool will open a replacement when one is needed
+			s.Close()
+			rp.Put(nil)
+			continue
+		}
+		rp.Put(r)
+	}
+}
+
+// loginToken logs in to the token in slot with c's PIN.
+//
+// Every login with the configured PIN goes through here. The token
+// information is read first, so that a PIN on its final try is not
+// risked (see checkPINFinalTry) however long ago the token was last
+// looked at.
+//
+// CKR_USER_ALREADY_LOGGED_IN counts as success: the application is
+// authenticated either way, e.g. after a quick restart the token may
+// still hold the previous process's login. There is no debug log
+// level, so this case is not logged; the C_Login call and its result
+// appear in the call trace if TraceSize is set.
+func loginToken(c *libCtx, s *PKCS11Session, slot uint) error {
+	tokenInfo, err := s.Ctx.GetTokenInfo(slot)
+	if err != nil {
+		return err
+	}
+	if err = checkPINFinalTry(tokenInfo.Flags, c.cfg); err != nil {
+		return err
+	}
 	// login is pkcs11 context wide, not just handle/session scoped
-	err := s.Ctx.Login(s.Handle, pkcs11.CKU_USER, instance.cfg.Pin)
+	err = traceCall("C_Login", nil, s.Ctx.Login(s.Handle, pkcs11.CKU_USER, c.cfg.Pin))
 	if err != nil {
 		if code, ok := err.(pkcs11.Error); ok && code == pkcs11.CKR_USER_ALREADY_LOGGED_IN {
 			return nil
 		}
-		log.Printf("Failed to open PKCS#11 Session: %s", err.Error())
-		s.Close()
 		return err
+	}
+	return nil
+}
+
+// loginKey identifies a token within a loaded PKCS#11 library.
+type loginKey struct {
+	ctx  *pkcs11.Ctx
+	slot uint
+}
+
+// loginRegistry reference-counts logins per (library, slot).
+//
+// PKCS#11 login state is per-application-per-token, not per-session:
+// a C_Logout on behalf of one user of a token logs out every other
+// user of the same token too. Users therefore acquire and release the
+// login through the registry, and C_Logout is only called when the
+// last of them releases it. Every other login with the configured PIN
+// (a new pooled session, or an operation that found the token logged
+// out) also goes through the registry, and only restores a login that
+// someone holds.
+type loginRegistry struct {
+	m     sync.Mutex
+	count map[loginKey]int
+}
+
+// Map of (library, slot) pairs to login reference counts
+var logins = &loginRegistry{
+	count: map[loginKey]int{},
+}
+
+// acquire logs in to the token on the session's slot with c's PIN,
+// unless another user of the token has already done so, and records a
+// new user.
+func (r *loginRegistry) acquire(c *libCtx, s *PKCS11Session, slot uint) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	k := loginKey{s.Ctx, slot}
+	if r.count[k] == 0 {
+		if err := loginToken(c, s, slot); err != nil {
+			return err
+		}
+	}
+	r.count[k]++
+	return nil
+}
+
+// restore logs in to the token on the session's slot again if any
+// user holds a login on it, e.g. because the token has closed all its
+// sessions and so logged out. held reports whether anyone does.
+func (r *loginRegistry) restore(c *libCtx, s *PKCS11Session, slot uint) (held bool, err error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.count[loginKey{s.Ctx, slot}] == 0 {
+		return false, nil
+	}
+	return true, loginToken(c, s, slot)
+}
 
+// release records that a user of the token on the session's slot no
+// longer needs to be logged in. If it was the last such user then the
+// token is logged out.
+func (r *loginRegistry) release(s *PKCS11Session, slot uint) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	k := loginKey{s.Ctx, slot}
+	if r.count[k] == 0 {
+		return nil
+	}
+	r.count[k]--
+	if r.count[k] > 0 {
+		return nil
+	}
+	delete(r.count, k)
+	if err := traceCall("C_Logout", nil, s.Ctx.Logout(s.Handle)); err != nil {
+		if code, ok := err.(pkcs11.Error); ok && code == pkcs11.CKR_USER_NOT_LOGGED_IN {
+			return nil
+		}
+		return err
 	}
 	return nil
 }
 
+// forget discards all login records for a library, e.g. because it
+// has been finalized.
+func (r *loginRegistry) forget(ctx *pkcs11.Ctx) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	for k := range r.count {
+		if k.ctx == ctx {
+			delete(r.count, k)
+		}
+	}
+}
+
+// forgetSlot discards the login record for one token, e.g. because
+// all its sessions have been closed.
+func (r *loginRegistry) forgetSlot(ctx *pkcs11.Ctx, slot uint) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	delete(r.count, loginKey{ctx, slot})
+}
+
 // Releases a sessions specific to the requested slot if present.
 func (p *sessionPool) closeSessions(slot uint) error {
 	p.m.Lock()
@@ -193,6 +519,10 @@ func (p *sessionPool) closeSessions(slot uint) error {
 		return errPoolNotFound
 	}
 
+	if stop, ok := p.stopKeepers[slot]; ok {
+		stop()
+		delete(p.stopKeepers, slot)
+	}
 	rp.Close()
 	delete(p.pool, slot)
 
@@ -0,0 +1,119 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"container/list"
+	"crypto"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// signatureKey identifies a deterministic signature.
+//
+// The key's CKA_ID is included as well as its handle, so that a
+// different key that the token later gives the same handle does not
+// match.
+type signatureKey struct {
+	slot       uint
+	handle     pkcs11.ObjectHandle
+	id         string
+	generation uint64
+	mechanism  uint
+	hash       crypto.Hash
+	digest     string
+}
+
+type signatureEntry struct {
+	key       signatureKey
+	signature []byte
+}
+
+// signatureCache is a bounded LRU cache of deterministic signatures.
+//
+// Only schemes that always produce the same signature for the same key
+// and input may be cached; for anything randomized (ECDSA, DSA, PSS)
+// returning an earlier signature would be wrong, and for ECDSA and DSA
+// dangerous.
+type signatureCache struct {
+	m       sync.Mutex
+	order   *list.List // most recently used at the front
+	entries map[signatureKey]*list.Element
+}
+
+var signatures = signatureCache{}
+
+// get returns a cached signature, or nil. It is always nil if SignatureCacheSize is 0.
+func (c *signatureCache) get(k signatureKey) []byte {
+	c.m.Lock()
+	defer c.m.Unlock()
+	e, ok := c.entries[k]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(e)
+	return append([]byte(nil), e.Value.(*signatureEntry).signature...)
+}
+
+// put records a signature, evicting the least recently used one if the cache is full.
+func (c *signatureCache) put(k signatureKey, signature []byte) {
+	if instance.cfg == nil || instance.cfg.SignatureCacheSize <= 0 {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.entries == nil {
+		c.order = list.New()
+		c.entries = map[signatureKey]*list.Element{}
+	}
+	if e, ok := c.entries[k]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[k] = c.order.PushFront(&signatureEntry{k, append([]byte(nil), signature...)})
+	for c.order.Len() > instance.cfg.SignatureCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*signatureEntry).key)
+	}
+}
+
+// forgetHandle discards the cached signatures made with an object, on any slot, e.g. because it has been destroyed.
+func (c *signatureCache) forgetHandle(handle pkcs11.ObjectHandle) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for k, e := range c.entries {
+		if k.handle == handle {
+			c.order.Remove(e)
+			delete(c.entries, k)
+		}
+	}
+}
+
+// reset discards all cached signatures, e.g. because the library is being closed.
+func (c *signatureCache) reset() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.order = nil
+	c.entries = nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestSignatureCache(t *testing.T) {
+	prev := instance.cfg
+	defer func() { instance.cfg = prev }()
+	instance.cfg = &PKCS11Config{SignatureCacheSize: 2}
+	var c signatureCache
+	k := func(digest string) signatureKey {
+		return signatureKey{slot: 1, handle: 2, hash: crypto.SHA256, digest: digest}
+	}
+	c.put(k("a"), []byte("sig a"))
+	c.put(k("b"), []byte("sig b"))
+	if got := c.get(k("a")); !bytes.Equal(got, []byte("sig a")) {
+		t.Errorf("get(a): got %q", got)
+	}
+	// b is now the least recently used
+	c.put(k("c"), []byte("sig c"))
+	if got := c.get(k("b")); got != nil {
+		t.Errorf("get(b): got %q after eviction", got)
+	}
+	if got := c.get(k("c")); !bytes.Equal(got, []byte("sig c")) {
+		t.Errorf("get(c): got %q", got)
+	}
+	c.get(k("a"))[0] = 'X'
+	if got := c.get(k("a")); !bytes.Equal(got, []byte("sig a")) {
+		t.Errorf("get(a): cached signature modified through returned slice")
+	}
+	c.reset()
+	if got := c.get(k("a")); got != nil {
+		t.Errorf("get(a): got %q after reset", got)
+	}
+	instance.cfg = &PKCS11Config{}
+	c.put(k("a"), []byte("sig a"))
+	if got := c.get(k("a")); got != nil {
+		t.Errorf("get(a): cached with SignatureCacheSize 0")
+	}
+}
+
+func TestSignatureCacheDestroy(t *testing.T) {
+	cfg, err := getConfig("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.SignatureCacheSize = 16
+	if _, err = Configure(cfg); err != nil {
+		t.Fatal("failed to configure service:", err)
+	}
+	defer Close()
+
+	digest := sha256.Sum256([]byte("sign me twice"))
+	key, err := GenerateRSAKeyPair(2048)
+	if err != nil {
+		t.Fatalf("GenerateRSAKeyPair: %v", err)
+	}
+	if _, err = key.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	handle := key.Handle
+	if err = key.Delete(); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	// The token may give the new key the old key's handle
+	key, err = GenerateRSAKeyPair(2048)
+	if err != nil {
+		t.Fatalf("GenerateRSAKeyPair: %v", err)
+	}
+	defer key.Delete()
+	if key.Handle != handle {
+		t.Logf("new key has handle %d, not %d", key.Handle, handle)
+	}
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err = rsa.VerifyPKCS1v15(key.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("signature from the new key does not verify: %v", err)
+	}
+}
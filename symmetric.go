@@ -46,7 +46,8 @@ type SymmetricCipher struct {
 	// True if encryption supported
 	Encrypt bool
 
-	// True if MAC supported
+	// True if MAC supported, in which case keys are created with
+	// CKA_SIGN and CKA_VERIFY set (see also KeyAttributes.MAC)
 	MAC bool
 
 	// ECB mechanism (CKM_..._ECB)
@@ -60,6 +61,15 @@ type SymmetricCipher struct {
 
 	// GCM mechanism (CKM_..._GCM)
 	GCMMech uint
+
+	// CMAC mechanism (CKM_..._CMAC)
+	CMACMech uint
+
+	// CMAC mechanism with caller-specified length (CKM_..._CMAC_GENERAL)
+	CMACGeneralMech uint
+
+	// Key wrapping mechanism (e.g. CKM_AES_KEY_WRAP_PAD)
+	WrapMech uint
 }
 
 // CipherAES describes the AES cipher. Use this with the
@@ -71,13 +81,16 @@ var CipherAES = SymmetricCipher{
 			GenMech: pkcs11.CKM_AES_KEY_GEN,
 		},
 	},
-	BlockSize:   16,
-	Encrypt:     true,
-	MAC:         false,
-	ECBMech:     pkcs11.CKM_AES_ECB,
-	CBCMech:     pkcs11.CKM_AES_CBC,
-	CBCPKCSMech: pkcs11.CKM_AES_CBC_PAD,
-	GCMMech:     pkcs11.CKM_AES_GCM,
+	BlockSize:       16,
+	Encrypt:         true,
+	MAC:             false,
+	ECBMech:         pkcs11.CKM_AES_ECB,
+	CBCMech:         pkcs11.CKM_AES_CBC,
+	CBCPKCSMech:     pkcs11.CKM_AES_CBC_PAD,
+	GCMMech:         pkcs11.CKM_AES_GCM,
+	CMACMech:        pkcs11.CKM_AES_CMAC,
+	CMACGeneralMech: pkcs11.CKM_AES_CMAC_GENERAL,
+	WrapMech:        pkcs11.CKM_AES_KEY_WRAP_PAD,
 }
 
 // CipherDES3 describes the three-key triple-DES cipher. Use this with the
@@ -89,13 +102,15 @@ var CipherDES3 = SymmetricCipher{
 			GenMech: pkcs11.CKM_DES3_KEY_GEN,
 		},
 	},
-	BlockSize:   8,
-	Encrypt:     true,
-	MAC:         false,
-	ECBMech:     pkcs11.CKM_DES3_ECB,
-	CBCMech:     pkcs11.CKM_DES3_CBC,
-	CBCPKCSMech: pkcs11.CKM_DES3_CBC_PAD,
-	GCMMech:     0,
+	BlockSize:       8,
+	Encrypt:         true,
+	MAC:             false,
+	ECBMech:         pkcs11.CKM_DES3_ECB,
+	CBCMech:         pkcs11.CKM_DES3_CBC,
+	CBCPKCSMech:     pkcs11.CKM_DES3_CBC_PAD,
+	GCMMech:         0,
+	CMACMech:        pkcs11.CKM_DES3_CMAC,
+	CMACGeneralMech: pkcs11.CKM_DES3_CMAC_GENERAL,
 }
 
 // CipherGeneric describes the CKK_GENERIC_SECRET key type. Use this with the
@@ -248,6 +263,9 @@ type PKCS11SecretKey struct {
 
 	// Symmetric cipher information
 	Cipher *SymmetricCipher
+
+	// Permitted operations, or nil if not known
+	usage *keyUsage
 }
 
 // Key generation -------------------------------------------------------------
@@ -280,40 +298,64 @@ func GenerateSecretKeyOnSlot(slot uint, id []byte, label []byte, bits int, ciphe
 //
 // Either or both label and/or id can be nil, in which case random values will be generated.
 func GenerateSecretKeyOnSession(session *PKCS11Session, slot uint, id []byte, label []byte, bits int, cipher *SymmetricCipher) (key *PKCS11SecretKey, err error) {
-	// TODO refactor with the other key generation implementations
-	if label == nil {
-		if label, err = generateKeyLabel(); err != nil {
-			return nil, err
-		}
+	return GenerateSecretKeyWithAttributesOnSession(session, slot, &KeyAttributes{
+		ID:     id,
+		Label:  label,
+		Cipher: cipher,
+		Bits:   bits,
+	})
+}
+
+// GenerateSecretKeyWithAttributes creates a secret key described by attrs.
+//
+// attrs.Cipher must be set.
+func GenerateSecretKeyWithAttributes(attrs *KeyAttributes) (*PKCS11SecretKey, error) {
+	return GenerateSecretKeyWithAttributesOnSlot(instance.slot, attrs)
+}
+
+// GenerateSecretKeyWithAttributesOnSlot creates a secret key described by attrs, on a specified slot.
+func GenerateSecretKeyWithAttributesOnSlot(slot uint, attrs *KeyAttributes) (*PKCS11SecretKey, error) {
+	var k *PKCS11SecretKey
+	var err error
+	if err = ensureSessions(instance, slot); err != nil {
+		return nil, err
 	}
-	if id == nil {
-		if id, err = generateKeyLabel(); err != nil {
-			return nil, err
-		}
+	err = withSession(slot, func(session *PKCS11Session) error {
+		k, err = GenerateSecretKeyWithAttributesOnSession(session, slot, attrs)
+		return err
+	})
+	return k, err
+}
+
+// GenerateSecretKeyWithAttributesOnSession creates a secret key described by attrs, on a specified session.
+//
+// If attrs.Trusted is set then session must be logged in as the
+// security officer; the pooled sessions used by the other
+// GenerateSecretKey... functions are logged in as the normal user.
+func GenerateSecretKeyWithAttributesOnSession(session *PKCS11Session, slot uint, attrs *KeyAttributes) (key *PKCS11SecretKey, err error) {
+	if attrs.Cipher == nil {
+		return nil, errNoCipher
+	}
+	if err = attrs.checkLabelCollision(session, pkcs11.CKO_SECRET_KEY); err != nil {
+		return nil, err
+	}
+	// Fix the ID and label now so that all attempts below agree
+	a := *attrs
+	if a.ID, a.Label, err = attrs.identity(); err != nil {
+		return nil, err
 	}
 	var privHandle pkcs11.ObjectHandle
 	// CKK_*_HMAC exists but there is no specific corresponding CKM_*_KEY_GEN
 	// mechanism. Therefore we attempt both CKM_GENERIC_SECRET_KEY_GEN and
 	// vendor-specific mechanisms.
-	for _, genMech := range cipher.GenParams {
-		secretKeyTemplate := []*pkcs11.Attribute{
-			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
-			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, genMech.KeyType),
-			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
-			pkcs11.NewAttribute(pkcs11.CKA_SIGN, cipher.MAC),
-			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, cipher.MAC),
-			pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, cipher.Encrypt),
-			pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, cipher.Encrypt),
-			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
-			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
-			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
-			pkcs11.NewAttribute(pkcs11.CKA_ID, id),
-		}
-		if bits > 0 {
-			secretKeyTemplate = append(secretKeyTemplate, pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, bits/8))
+	for _, genMech := range attrs.Cipher.GenParams {
+		var secretKeyTemplate []*pkcs11.Attribute
+		if secretKeyTemplate, err = a.secretKeyTemplate(genMech.KeyType); err != nil {
+			return
 		}
 		mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(genMech.GenMech, nil)}
 		privHandle, err = session.Ctx.GenerateKey(session.Handle, mech, secretKeyTemplate)
+		traceCall("C_GenerateKey", mech, err, secretKeyTemplate)
 		if err == nil {
 			break
 		}
@@ -322,12 +364,74 @@ func GenerateSecretKeyOnSession(session *PKCS11Session, slot uint, id []byte, la
 			continue
 		}
 		if err != nil {
-			return
+			return nil, storageError(attrs.trustError(err))
 		}
 	}
 	if err != nil {
-		return
+		return nil, storageError(attrs.trustError(err))
 	}
-	key = &PKCS11SecretKey{PKCS11Object{privHandle, slot}, cipher}
+	key = &PKCS11SecretKey{PKCS11Object: newObject(privHandle, slot).withIdentity(a.ID, a.Label), Cipher: attrs.Cipher}
 	return
 }
+
+// GenerateTenantKey creates a fresh AES-256 key for application data encryption, returning the key and its ID.
+//
+// The key is token-resident, sensitive and non-extractable, and may
+// only be used to encrypt and decrypt. It has a random ID, which is
+// returned so that the key can be found again with FindKey, and a
+// random label.
+func GenerateTenantKey() (*PKCS11SecretKey, []byte, error) {
+	return GenerateTenantKeyOnSlot(instance.slot)
+}
+
+// GenerateTenantKeyOnSlot creates a fresh AES-256 key for application data encryption, on a specified slot.
+//
+// See GenerateTenantKey for details.
+func GenerateTenantKeyOnSlot(slot uint) (*PKCS11SecretKey, []byte, error) {
+	id, err := generateKeyLabel()
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := GenerateSecretKeyWithAttributesOnSlot(slot, &KeyAttributes{
+		ID:     id,
+		Cipher: &CipherAES,
+		Bits:   256,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, id, nil
+}
+
+// ExportSecretKey reads a secret key's value (CKA_VALUE) out of the token.
+//
+// This defeats the purpose of keeping the key in the token, and
+// should only be used for a deliberate, audited migration of keys
+// created with CKA_EXTRACTABLE set and CKA_SENSITIVE clear, which is
+// what KeyAttributes.Extractable asks for unless Sensitive is set too.
+// (Keys that are not extractable, or are also sensitive, can at most
+// be moved by wrapping them.) The caller is responsible for
+// protecting, and erasing, the returned bytes.
+//
+// If the token refuses to reveal the value then ErrKeyNotExtractable
+// is returned.
+func ExportSecretKey(key *PKCS11SecretKey) ([]byte, error) {
+	if err := key.checkLive(); err != nil {
+		return nil, err
+	}
+	var attributes []*pkcs11.Attribute
+	err := withSession(key.Slot, func(session *PKCS11Session) error {
+		var err error
+		attributes, err = getAttributes(session, key.Handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+		})
+		return err
+	})
+	if code, ok := err.(pkcs11.Error); ok && code == pkcs11.CKR_ATTRIBUTE_SENSITIVE {
+		return nil, ErrKeyNotExtractable
+	}
+	if err != nil {
+		return nil, key.wrapError("ExportSecretKey", err)
+	}
+	return attributes[0].Value, nil
+}
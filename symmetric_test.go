@@ -136,6 +136,28 @@ func testHardSymmetric(t *testing.T, keytype int, bits int) {
 			needMechanism(t, key2.Slot, pkcs11.CKM_AES_GCM)
 			testAEADMode(t, aead, 127, 129)
 		})
+		t.Run("GCMTokenIV", func(t *testing.T) {
+			needMechanism(t, key2.Slot, pkcs11.CKM_AES_GCM)
+			plaintext, additionalData := []byte("plaintext"), []byte("additional data")
+			iv, ciphertext, err := key2.EncryptGCM(plaintext, additionalData)
+			if err != nil {
+				t.Fatalf("key2.EncryptGCM: %v", err)
+			}
+			if len(iv) != 12 {
+				t.Fatalf("key2.EncryptGCM: IV is %d bytes", len(iv))
+			}
+			aead, err := key2.NewGCM()
+			if err != nil {
+				t.Fatalf("key2.NewGCM: %v", err)
+			}
+			decrypted, err := aead.Open(nil, iv, ciphertext, additionalData)
+			if err != nil {
+				t.Fatalf("aead.Open: %v", err)
+			}
+			if bytes.Compare(plaintext, decrypted) != 0 {
+				t.Errorf("aead.Open: wrong answer")
+			}
+		})
 		// TODO check that hard/soft is consistent!
 	}
 	// TODO CFB
@@ -294,3 +316,128 @@ func BenchmarkCBC(b *testing.B) {
 }
 
 // TODO BenchmarkGCM along the same lines as above
+
+func TestGenerateTenantKey(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	key, id, err := GenerateTenantKey()
+	if err != nil {
+		t.Fatalf("crypto11.GenerateTenantKey: %v", err)
+	}
+	found, err := FindKey(id, nil)
+	if err != nil {
+		t.Fatalf("crypto11.FindKey: %v", err)
+	}
+	if found.Handle != key.Handle {
+		t.Errorf("crypto11.FindKey: found handle %d, want %d", found.Handle, key.Handle)
+	}
+	err = withSession(key.Slot, func(session *PKCS11Session) error {
+		for _, a := range []struct {
+			attributeType uint
+			want          bool
+		}{
+			{pkcs11.CKA_TOKEN, true},
+			{pkcs11.CKA_SENSITIVE, true},
+			{pkcs11.CKA_EXTRACTABLE, false},
+			{pkcs11.CKA_ENCRYPT, true},
+			{pkcs11.CKA_DECRYPT, true},
+			{pkcs11.CKA_SIGN, false},
+			{pkcs11.CKA_WRAP, false},
+		} {
+			if got := getBoolAttribute(session, key.Handle, a.attributeType); got != a.want {
+				t.Errorf("attribute %#x: got %v, want %v", a.attributeType, got, a.want)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("withSession: %v", err)
+	}
+}
+
+func TestAllowedMechanisms(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	allowed := []uint{pkcs11.CKM_AES_CBC, pkcs11.CKM_AES_GCM}
+	key, err := GenerateSecretKeyWithAttributes(&KeyAttributes{Cipher: &CipherAES, Bits: 128, AllowedMechanisms: allowed})
+	if err != nil {
+		t.Fatalf("crypto11.GenerateSecretKeyWithAttributes: %v", err)
+	}
+	got, err := key.AllowedMechanisms()
+	if err != nil {
+		t.Fatalf("AllowedMechanisms: %v", err)
+	}
+	if len(got) != len(allowed) || got[0] != allowed[0] || got[1] != allowed[1] {
+		t.Errorf("AllowedMechanisms: got %#x, want %#x", got, allowed)
+	}
+}
+
+func TestExportSecretKey(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	key, err := GenerateSecretKeyWithAttributes(&KeyAttributes{Cipher: &CipherAES, Bits: 128, Extractable: true})
+	if err != nil {
+		t.Fatalf("crypto11.GenerateSecretKeyWithAttributes: %v", err)
+	}
+	value, err := ExportSecretKey(key)
+	if err != nil {
+		t.Fatalf("ExportSecretKey: %v", err)
+	}
+	if len(value) != 16 {
+		t.Errorf("ExportSecretKey: got %d bytes, want 16", len(value))
+	}
+}
+
+func TestExportSecretKeySensitive(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	key, err := GenerateSecretKeyWithAttributes(&KeyAttributes{Cipher: &CipherAES, Bits: 128, Extractable: true, Sensitive: true})
+	if err != nil {
+		t.Fatalf("crypto11.GenerateSecretKeyWithAttributes: %v", err)
+	}
+	// Extractable, but still sensitive
+	if _, err = ExportSecretKey(key); err != ErrKeyNotExtractable {
+		t.Errorf("ExportSecretKey: got %v, want ErrKeyNotExtractable", err)
+	}
+}
+
+func TestGCMEmptyPlaintext(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	key, err := GenerateSecretKey(128, Ciphers[pkcs11.CKK_AES])
+	if err != nil {
+		t.Fatalf("crypto11.GenerateSecretKey: %v", err)
+	}
+	needMechanism(t, key.Slot, pkcs11.CKM_AES_GCM)
+	aead, err := key.NewGCM()
+	if err != nil {
+		t.Fatalf("key.NewGCM: %v", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	additionalData := []byte("authenticated but not encrypted")
+	var tag []byte
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("aead.Seal: %v", r)
+			}
+		}()
+		tag = aead.Seal(nil, nonce, nil, additionalData)
+	}()
+	if len(tag) != aead.Overhead() {
+		t.Fatalf("aead.Seal: got %d bytes, want %d", len(tag), aead.Overhead())
+	}
+	plaintext, err := aead.Open(nil, nonce, tag, additionalData)
+	if err != nil {
+		t.Fatalf("aead.Open: %v", err)
+	}
+	if len(plaintext) != 0 {
+		t.Errorf("aead.Open: got %d bytes of plaintext", len(plaintext))
+	}
+	if _, err = aead.Open(nil, nonce, tag, []byte("tampered")); err == nil {
+		t.Errorf("aead.Open: accepted tampered additional data")
+	}
+	if _, err = aead.Open(nil, nonce, tag[:4], additionalData); err == nil {
+		t.Errorf("aead.Open: accepted truncated tag")
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/miekg/pkcs11"
+)
+
+// maxChainLength bounds the issuer chain TLSCertificate builds, in case of a loop on the token.
+const maxChainLength = 10
+
+// TLSCertificate returns a tls.Certificate for the key pair with a given CKA_LABEL.
+//
+// The certificate is the X.509 certificate object with the key's
+// CKA_ID, or if the key has no CKA_ID, with the same label. If there
+// is none then ErrCertificateNotFound is returned, and if its public
+// key is not the key pair's then ErrCertificateKeyMismatch is returned.
+//
+// The chain is completed from the other certificates on the token:
+// each issuer is found by subject and must have signed the certificate
+// before it. A self-signed root is left out, since a TLS peer must
+// already have it. PrivateKey is the key pair, which signs on the
+// token, and Leaf is set.
+//
+// The result can be used directly in tls.Config.Certificates.
+func TLSCertificate(label []byte) (tls.Certificate, error) {
+	return TLSCertificateOnSlot(instance.slot, label)
+}
+
+// TLSCertificateOnSlot returns a tls.Certificate for the key pair with a given CKA_LABEL, using a specified slot.
+func TLSCertificateOnSlot(slot uint, label []byte) (tls.Certificate, error) {
+	var cert tls.Certificate
+	var err error
+	if err = ensureSessions(instance, slot); err != nil {
+		return cert, err
+	}
+	err = withSession(slot, func(session *PKCS11Session) error {
+		cert, err = TLSCertificateOnSession(session, slot, label)
+		return err
+	})
+	return cert, err
+}
+
+// TLSCertificateOnSession returns a tls.Certificate for the key pair with a given CKA_LABEL, using a specified session.
+func TLSCertificateOnSession(session *PKCS11Session, slot uint, label []byte) (tls.Certificate, error) {
+	var cert tls.Certificate
+	privHandle, err := findKey(session, nil, label, pkcs11.CKO_PRIVATE_KEY, ^uint(0))
+	if err != nil {
+		return cert, err
+	}
+	k, err := findKeyPairFromPrivateHandle(session, slot, privHandle)
+	if err != nil {
+		return cert, err
+	}
+	signer, ok := k.(crypto.Signer)
+	if !ok {
+		return cert, ErrUnsupportedKeyType
+	}
+	attributes, err := getAttributes(session, privHandle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+	})
+	if err != nil {
+		return cert, err
+	}
+	var leaf *x509.Certificate
+	if id := attributes[0].Value; len(id) > 0 {
+		leaf, err = FindCertificateOnSession(session, id, nil)
+	} else {
+		leaf, err = FindCertificateOnSession(session, nil, label)
+	}
+	if err != nil {
+		return cert, err
+	}
+	match, err := MatchCertificate(signer, leaf)
+	if err != nil {
+		return cert, err
+	}
+	if !match {
+		return cert, ErrCertificateKeyMismatch
+	}
+	cert.Certificate = [][]byte{leaf.Raw}
+	for c := leaf; len(cert.Certificate) < maxChainLength; {
+		issuer, err := findIssuer(session, c)
+		if err != nil {
+			return cert, err
+		}
+		if issuer == nil || isSelfSigned(issuer) {
+			break
+		}
+		cert.Certificate = append(cert.Certificate, issuer.Raw)
+		c = issuer
+	}
+	cert.PrivateKey = signer
+	cert.Leaf = leaf
+	return cert, nil
+}
+
+// findIssuer finds the certificate on the token that issued cert, or nil if there is none.
+//
+// cert itself is never returned, even if it is self-signed.
+func findIssuer(session *PKCS11Session, cert *x509.Certificate) (*x509.Certificate, error) {
+	if isSelfSigned(cert) {
+		return nil, nil
+	}
+	handles, err := findObjects(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+		pkcs11.NewAttribute(pkcs11.CKA_CERTIFICATE_TYPE, pkcs11.CKC_X_509),
+		pkcs11.NewAttribute(pkcs11.CKA_SUBJECT, cert.RawIssuer),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, handle := range handles {
+		attributes, err := getAttributes(session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		candidate, err := x509.ParseCertificate(attributes[0].Value)
+		if err != nil {
+			// Not usable; there may be another with the same subject
+			continue
+		}
+		if cert.CheckSignatureFrom(candidate) == nil {
+			return candidate, nil
+		}
+	}
+	return nil, nil
+}
+
+// isSelfSigned reports whether cert is signed by its own key.
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawSubject, cert.RawIssuer) && cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/elliptic"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestTLSCertificate(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	rootKey, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPair: %v", err)
+	}
+	intermediateKey, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPair: %v", err)
+	}
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPair: %v", err)
+	}
+	root := issueCertificate(t, 1, "crypto11 test root", true, rootKey, nil, rootKey)
+	intermediate := issueCertificate(t, 2, "crypto11 test intermediate", true, intermediateKey, root, rootKey)
+	leaf := issueCertificate(t, 3, "crypto11 test leaf", false, key, intermediate, intermediateKey)
+	for _, c := range []*x509.Certificate{root, intermediate} {
+		if _, err = ImportCertificate(c); err != nil {
+			t.Fatalf("ImportCertificate: %v", err)
+		}
+	}
+	id, label, err := key.Identify()
+	if err != nil {
+		t.Fatalf("key.Identify: %v", err)
+	}
+	if _, err = ImportCertificateOnSlot(key.Slot, id, nil, leaf); err != nil {
+		t.Fatalf("ImportCertificateOnSlot: %v", err)
+	}
+	cert, err := TLSCertificate(label)
+	if err != nil {
+		t.Fatalf("TLSCertificate: %v", err)
+	}
+	if len(cert.Certificate) != 2 || !bytes.Equal(cert.Certificate[0], leaf.Raw) || !bytes.Equal(cert.Certificate[1], intermediate.Raw) {
+		t.Errorf("TLSCertificate: chain of %d certificates, want leaf and intermediate", len(cert.Certificate))
+	}
+	if cert.Leaf == nil || !bytes.Equal(cert.Leaf.Raw, leaf.Raw) {
+		t.Errorf("TLSCertificate: wrong Leaf")
+	}
+	if match, err := MatchCertificate(cert.PrivateKey.(crypto.Signer), leaf); err != nil || !match {
+		t.Errorf("TLSCertificate: PrivateKey does not match the certificate (%v)", err)
+	}
+	// A key with no certificate
+	_, label, err = intermediateKey.Identify()
+	if err != nil {
+		t.Fatalf("intermediateKey.Identify: %v", err)
+	}
+	if _, err = TLSCertificate(label); err != ErrCertificateNotFound {
+		t.Errorf("TLSCertificate without a certificate: got %v, want ErrCertificateNotFound", err)
+	}
+}
+
+// issueCertificate makes a certificate for key, signed by issuerKey, or self-signed if parent is nil.
+func issueCertificate(t *testing.T, serial int64, name string, ca bool, key crypto.Signer, parent *x509.Certificate, issuerKey crypto.Signer) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+	}
+	if ca {
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent = template
+	}
+	der, err := CreateCertificate(template, parent, key.Public(), issuerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	return cert
+}
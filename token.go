@@ -0,0 +1,398 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// DiagnosticInfo describes the PKCS#11 library and the configured token.
+type DiagnosticInfo struct {
+	// The library's CK_INFO
+	Library pkcs11.Info
+
+	// The configured slot and its token's CK_TOKEN_INFO
+	Slot  uint
+	Token pkcs11.TokenInfo
+}
+
+// String formats the diagnostic information on a single line, suitable for pasting into a support request.
+func (d *DiagnosticInfo) String() string {
+	return fmt.Sprintf("cryptoki %d.%d; library %q %q %d.%d; slot %d manufacturer %q model %q serial %q hardware %d.%d firmware %d.%d",
+		d.Library.CryptokiVersion.Major, d.Library.CryptokiVersion.Minor,
+		d.Library.ManufacturerID, d.Library.LibraryDescription,
+		d.Library.LibraryVersion.Major, d.Library.LibraryVersion.Minor,
+		d.Slot, d.Token.ManufacturerID, d.Token.Model, d.Token.SerialNumber,
+		d.Token.HardwareVersion.Major, d.Token.HardwareVersion.Minor,
+		d.Token.FirmwareVersion.Major, d.Token.FirmwareVersion.Minor)
+}
+
+// Diagnostics returns information about the library and the configured token.
+//
+// It is read from C_GetInfo and C_GetTokenInfo each time it is called.
+func Diagnostics() (*DiagnosticInfo, error) {
+	if instance.ctx == nil {
+		return nil, ErrNotConfigured
+	}
+	info, err := instance.ctx.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	tokenInfo, err := instance.ctx.GetTokenInfo(instance.slot)
+	if err != nil {
+		return nil, err
+	}
+	return &DiagnosticInfo{
+		Library: info,
+		Slot:    instance.slot,
+		Token:   tokenInfo,
+	}, nil
+}
+
+// supportsUniqueID reports whether a library implements PKCS#11 v3.0 or later, and therefore CKA_UNIQUE_ID.
+func supportsUniqueID(ctx *pkcs11.Ctx) (bool, error) {
+	info, err := ctx.GetInfo()
+	if err != nil {
+		return false, err
+	}
+	return info.CryptokiVersion.Major >= 3, nil
+}
+
+// ListSlots lists the slots that have a token present, in order of slot ID.
+//
+// The Slot field of each entry is the slot ID to use as SlotNumber in
+// the configuration. If path is the library already configured then
+// that is used; otherwise the library at path is loaded for the
+// duration of the call.
+func ListSlots(path string) ([]TokenCandidate, error) {
+	ctx, done, err := openLibrary(path)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+	list := make([]TokenCandidate, 0, len(slots))
+	for _, slot := range slots {
+		tokenInfo, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, TokenCandidate{slot, tokenInfo})
+	}
+	return list, nil
+}
+
+// openLibrary returns a context for the library at path, and a function to call when finished with it.
+//
+// If path is the library already configured then its context is
+// returned and left alone afterwards. Otherwise the library is loaded
+// and initialized, and finalized and unloaded by the returned function.
+func openLibrary(path string) (*pkcs11.Ctx, func(), error) {
+	if instance.ctx != nil && instance.cfg.Path == path {
+		return instance.ctx, func() {}, nil
+	}
+	ctx := pkcs11.New(path)
+	if ctx == nil {
+		return nil, nil, ErrCannotOpenPKCS11
+	}
+	if err := traceCall("C_Initialize", nil, ctx.Initialize()); err != nil {
+		ctx.Destroy()
+		return nil, nil, err
+	}
+	return ctx, func() {
+		ctx.Finalize()
+		ctx.Destroy()
+	}, nil
+}
+
+// TokenCapacity describes the storage and session capacity of a token.
+//
+// Each field is nil if the token does not report that information
+// (CK_UNAVAILABLE_INFORMATION). Memory sizes are in bytes. A maximum
+// session count of 0 means the token imposes no limit
+// (CK_EFFECTIVELY_INFINITE).
+type TokenCapacity struct {
+	FreePublicMemory   *uint
+	TotalPublicMemory  *uint
+	FreePrivateMemory  *uint
+	TotalPrivateMemory *uint
+	SessionCount       *uint
+	MaxSessionCount    *uint
+	RwSessionCount     *uint
+	MaxRwSessionCount  *uint
+}
+
+// Map CK_UNAVAILABLE_INFORMATION to nil
+func available(n uint) *uint {
+	if n == ckUnavailableInformation {
+		return nil
+	}
+	return &n
+}
+
+// Capacity returns the current capacity counters of the configured token.
+func Capacity() (*TokenCapacity, error) {
+	return CapacityOnSlot(instance.slot)
+}
+
+// CapacityOnSlot returns the current capacity counters of the token in a specified slot.
+//
+// The token is queried afresh on each call, since the counters change
+// as objects and sessions are created and destroyed.
+func CapacityOnSlot(slot uint) (*TokenCapacity, error) {
+	if instance.ctx == nil {
+		return nil, ErrNotConfigured
+	}
+	tokenInfo, err := instance.ctx.GetTokenInfo(slot)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenCapacity{
+		FreePublicMemory:   available(tokenInfo.FreePublicMemory),
+		TotalPublicMemory:  available(tokenInfo.TotalPublicMemory),
+		FreePrivateMemory:  available(tokenInfo.FreePrivateMemory),
+		TotalPrivateMemory: available(tokenInfo.TotalPrivateMemory),
+		SessionCount:       available(tokenInfo.SessionCount),
+		MaxSessionCount:    available(tokenInfo.MaxSessionCount),
+		RwSessionCount:     available(tokenInfo.RwSessionCount),
+		MaxRwSessionCount:  available(tokenInfo.MaxRwSessionCount),
+	}, nil
+}
+
+// TokenPINStatus describes the state of a token's user PIN, from its CK_TOKEN_INFO flags.
+//
+// PKCS#11 does not report how many tries are left, so RemainingTries
+// is only set when the flags imply it: 1 if FinalTry is set, and 0 if
+// Locked is set.
+type TokenPINStatus struct {
+	// A wrong PIN has been entered since the last successful login (CKF_USER_PIN_COUNT_LOW)
+	CountLow bool
+
+	// The next wrong PIN will lock the token (CKF_USER_PIN_FINAL_TRY)
+	FinalTry bool
+
+	// The PIN is locked (CKF_USER_PIN_LOCKED)
+	Locked bool
+
+	// The PIN must be changed before use (CKF_USER_PIN_TO_BE_CHANGED)
+	ToBeChanged bool
+
+	// Number of tries left before the PIN is locked, if known
+	RemainingTries *int
+}
+
+func pinStatusFromFlags(flags uint) *TokenPINStatus {
+	status := &TokenPINStatus{
+		CountLow:    flags&pkcs11.CKF_USER_PIN_COUNT_LOW != 0,
+		FinalTry:    flags&pkcs11.CKF_USER_PIN_FINAL_TRY != 0,
+		Locked:      flags&pkcs11.CKF_USER_PIN_LOCKED != 0,
+		ToBeChanged: flags&pkcs11.CKF_USER_PIN_TO_BE_CHANGED != 0,
+	}
+	var tries int
+	switch {
+	case status.Locked:
+		tries = 0
+		status.RemainingTries = &tries
+	case status.FinalTry:
+		tries = 1
+		status.RemainingTries = &tries
+	}
+	return status
+}
+
+// PINStatus returns the state of the configured token's user PIN.
+func PINStatus() (*TokenPINStatus, error) {
+	return PINStatusOnSlot(instance.slot)
+}
+
+// PINStatusOnSlot returns the state of the user PIN of the token in a specified slot.
+//
+// The token is queried afresh on each call.
+func PINStatusOnSlot(slot uint) (*TokenPINStatus, error) {
+	if instance.ctx == nil {
+		return nil, ErrNotConfigured
+	}
+	tokenInfo, err := instance.ctx.GetTokenInfo(slot)
+	if err != nil {
+		return nil, err
+	}
+	return pinStatusFromFlags(tokenInfo.Flags), nil
+}
+
+// supportedMechanisms caches each slot's mechanism list, for hasMechanism.
+type supportedMechanisms struct {
+	m     sync.Mutex
+	slots map[uint]map[uint]bool
+
+	// Mechanisms the token rejected with CKR_MECHANISM_INVALID when
+	// they were tried, whatever its mechanism list says
+	rejected map[uint]map[uint]bool
+}
+
+var mechanisms = supportedMechanisms{
+	slots:    map[uint]map[uint]bool{},
+	rejected: map[uint]map[uint]bool{},
+}
+
+// hasMechanism reports whether the token in a slot supports a mechanism.
+//
+// The mechanism list is read once per slot and cached until Close.
+func hasMechanism(slot uint, mechanism uint) (bool, error) {
+	mechanisms.m.Lock()
+	defer mechanisms.m.Unlock()
+	if mechanisms.rejected[slot][mechanism] {
+		return false, nil
+	}
+	supported, ok := mechanisms.slots[slot]
+	if !ok {
+		if instance.ctx == nil {
+			return false, ErrNotConfigured
+		}
+		mechs, err := instance.ctx.GetMechanismList(slot)
+		if err != nil {
+			return false, err
+		}
+		supported = map[uint]bool{}
+		for _, mech := range mechs {
+			supported[mech.Mechanism] = true
+		}
+		mechanisms.slots[slot] = supported
+	}
+	return supported[mechanism], nil
+}
+
+// rejectMechanism records that the token in a slot rejected a mechanism.
+//
+// hasMechanism and mechanismRejected then report it as unsupported
+// until Close.
+func rejectMechanism(slot uint, mechanism uint) {
+	mechanisms.m.Lock()
+	defer mechanisms.m.Unlock()
+	if mechanisms.rejected[slot] == nil {
+		mechanisms.rejected[slot] = map[uint]bool{}
+	}
+	mechanisms.rejected[slot][mechanism] = true
+}
+
+// mechanismRejected reports whether rejectMechanism has been called for a mechanism.
+func mechanismRejected(slot uint, mechanism uint) bool {
+	mechanisms.m.Lock()
+	defer mechanisms.m.Unlock()
+	return mechanisms.rejected[slot][mechanism]
+}
+
+// isMechanismInvalid reports whether err is CKR_MECHANISM_INVALID.
+func isMechanismInvalid(err error) bool {
+	code, ok := err.(pkcs11.Error)
+	return ok && code == pkcs11.CKR_MECHANISM_INVALID
+}
+
+// reset discards the cached mechanism lists.
+func (s *supportedMechanisms) reset() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.slots = map[uint]map[uint]bool{}
+	s.rejected = map[uint]map[uint]bool{}
+}
+
+// MechanismInfo describes a mechanism supported by a token.
+//
+// The units of MinKeySize and MaxKeySize depend on the mechanism;
+// for RSA and EC mechanisms they are in bits, for most secret key
+// mechanisms they are in bytes.
+type MechanismInfo struct {
+	// Mechanism is the CKM_... constant for the mechanism.
+	Mechanism uint
+
+	MinKeySize uint
+	MaxKeySize uint
+
+	// Hardware is true if the mechanism is performed by the device
+	// (CKF_HW).
+	Hardware bool
+
+	// The remaining fields record which functions the mechanism may
+	// be used with.
+	Encrypt         bool
+	Decrypt         bool
+	Digest          bool
+	Sign            bool
+	SignRecover     bool
+	Verify          bool
+	VerifyRecover   bool
+	Generate        bool
+	GenerateKeyPair bool
+	Wrap            bool
+	Unwrap          bool
+	Derive          bool
+}
+
+// Mechanisms returns the mechanisms supported by the configured token.
+func Mechanisms() ([]MechanismInfo, error) {
+	return MechanismsOnSlot(instance.slot)
+}
+
+// MechanismsOnSlot returns the mechanisms supported by the token in a specified slot.
+func MechanismsOnSlot(slot uint) ([]MechanismInfo, error) {
+	if instance.ctx == nil {
+		return nil, ErrNotConfigured
+	}
+	mechs, err := instance.ctx.GetMechanismList(slot)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]MechanismInfo, 0, len(mechs))
+	for _, mech := range mechs {
+		mechInfo, err := instance.ctx.GetMechanismInfo(slot, []*pkcs11.Mechanism{mech})
+		if err != nil {
+			return nil, err
+		}
+		flags := mechInfo.Flags
+		infos = append(infos, MechanismInfo{
+			Mechanism:       mech.Mechanism,
+			MinKeySize:      mechInfo.MinKeySize,
+			MaxKeySize:      mechInfo.MaxKeySize,
+			Hardware:        flags&pkcs11.CKF_HW != 0,
+			Encrypt:         flags&pkcs11.CKF_ENCRYPT != 0,
+			Decrypt:         flags&pkcs11.CKF_DECRYPT != 0,
+			Digest:          flags&pkcs11.CKF_DIGEST != 0,
+			Sign:            flags&pkcs11.CKF_SIGN != 0,
+			SignRecover:     flags&pkcs11.CKF_SIGN_RECOVER != 0,
+			Verify:          flags&pkcs11.CKF_VERIFY != 0,
+			VerifyRecover:   flags&pkcs11.CKF_VERIFY_RECOVER != 0,
+			Generate:        flags&pkcs11.CKF_GENERATE != 0,
+			GenerateKeyPair: flags&pkcs11.CKF_GENERATE_KEY_PAIR != 0,
+			Wrap:            flags&pkcs11.CKF_WRAP != 0,
+			Unwrap:          flags&pkcs11.CKF_UNWRAP != 0,
+			Derive:          flags&pkcs11.CKF_DERIVE != 0,
+		})
+	}
+	return infos, nil
+}
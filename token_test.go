@@ -0,0 +1,137 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+func TestCapacity(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	capacity, err := Capacity()
+	if err != nil {
+		t.Fatalf("crypto11.Capacity: %v", err)
+	}
+	// Configure holds at least one session open
+	if capacity.SessionCount != nil && *capacity.SessionCount == 0 {
+		t.Errorf("crypto11.Capacity: no sessions reported")
+	}
+	if capacity.FreePublicMemory != nil && capacity.TotalPublicMemory != nil && *capacity.FreePublicMemory > *capacity.TotalPublicMemory {
+		t.Errorf("crypto11.Capacity: free public memory exceeds total")
+	}
+}
+
+func TestMechanisms(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	mechs, err := Mechanisms()
+	if err != nil {
+		t.Fatalf("crypto11.Mechanisms: %v", err)
+	}
+	for _, mech := range mechs {
+		if mech.Mechanism != pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN {
+			continue
+		}
+		if !mech.GenerateKeyPair {
+			t.Errorf("CKM_RSA_PKCS_KEY_PAIR_GEN cannot generate key pairs")
+		}
+		if mech.MinKeySize > mech.MaxKeySize {
+			t.Errorf("CKM_RSA_PKCS_KEY_PAIR_GEN: min key size %d exceeds max %d", mech.MinKeySize, mech.MaxKeySize)
+		}
+		return
+	}
+	t.Errorf("CKM_RSA_PKCS_KEY_PAIR_GEN not listed")
+}
+
+func TestDiagnostics(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	d, err := Diagnostics()
+	if err != nil {
+		t.Fatalf("crypto11.Diagnostics: %v", err)
+	}
+	if d.Library.CryptokiVersion.Major < 2 {
+		t.Errorf("crypto11.Diagnostics: implausible cryptoki version %d.%d", d.Library.CryptokiVersion.Major, d.Library.CryptokiVersion.Minor)
+	}
+	if s := d.String(); !strings.Contains(s, d.Library.ManufacturerID) || !strings.Contains(s, d.Token.SerialNumber) {
+		t.Errorf("DiagnosticInfo.String: %q lacks version or serial number", s)
+	}
+}
+
+func TestListSlots(t *testing.T) {
+	cfg, err := getConfig("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slots, err := ListSlots(cfg.Path)
+	if err != nil {
+		t.Fatalf("crypto11.ListSlots: %v", err)
+	}
+	if len(slots) == 0 {
+		t.Fatal("crypto11.ListSlots: no slots")
+	}
+	// Configure by the slot ID of the first entry
+	cfg.TokenSerial, cfg.TokenLabel = "", ""
+	cfg.SlotNumber = &slots[0].Slot
+	if _, err = Configure(cfg); err != nil {
+		t.Fatalf("crypto11.Configure with SlotNumber: %v", err)
+	}
+	if instance.slot != slots[0].Slot || instance.token.SerialNumber != slots[0].TokenInfo.SerialNumber {
+		t.Errorf("crypto11.Configure with SlotNumber: got slot %d, want %d", instance.slot, slots[0].Slot)
+	}
+	Close()
+	// A slot with no token
+	missing := slots[len(slots)-1].Slot + 1000
+	cfg.SlotNumber = &missing
+	if _, err = Configure(cfg); err == nil {
+		t.Errorf("crypto11.Configure with empty slot: succeeded")
+	}
+	Close()
+}
+
+func TestPINStatus(t *testing.T) {
+	status := pinStatusFromFlags(pkcs11.CKF_USER_PIN_COUNT_LOW)
+	if !status.CountLow || status.FinalTry || status.Locked || status.RemainingTries != nil {
+		t.Errorf("pinStatusFromFlags(COUNT_LOW): got %+v", status)
+	}
+	status = pinStatusFromFlags(pkcs11.CKF_USER_PIN_COUNT_LOW | pkcs11.CKF_USER_PIN_FINAL_TRY)
+	if !status.FinalTry || status.RemainingTries == nil || *status.RemainingTries != 1 {
+		t.Errorf("pinStatusFromFlags(FINAL_TRY): got %+v", status)
+	}
+	status = pinStatusFromFlags(pkcs11.CKF_USER_PIN_LOCKED)
+	if !status.Locked || status.RemainingTries == nil || *status.RemainingTries != 0 {
+		t.Errorf("pinStatusFromFlags(LOCKED): got %+v", status)
+	}
+	if err := checkPINFinalTry(pkcs11.CKF_USER_PIN_FINAL_TRY, &PKCS11Config{}); err != ErrPINFinalTry {
+		t.Errorf("checkPINFinalTry: got %v, want ErrPINFinalTry", err)
+	}
+	if err := checkPINFinalTry(pkcs11.CKF_USER_PIN_FINAL_TRY, &PKCS11Config{AllowPINFinalTry: true}); err != nil {
+		t.Errorf("checkPINFinalTry with AllowPINFinalTry: %v", err)
+	}
+	if err := checkPINFinalTry(pkcs11.CKF_USER_PIN_COUNT_LOW, &PKCS11Config{}); err != nil {
+		t.Errorf("checkPINFinalTry with COUNT_LOW: %v", err)
+	}
+}
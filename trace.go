@@ -0,0 +1,146 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/miekg/pkcs11"
+)
+
+// TraceEntry records a single PKCS#11 call.
+//
+// Only the function name, mechanism types and object classes are
+// recorded. Key material, mechanism parameters, data and PINs are
+// never recorded, so a trace is safe to ship back for diagnosis.
+type TraceEntry struct {
+	// Time the call returned
+	Time time.Time
+
+	// PKCS#11 function name, e.g. "C_SignInit"
+	Function string
+
+	// Mechanism types (CKM_...) passed to the call, if any
+	Mechanisms []uint
+
+	// Object classes (CKO_...) named in the call's templates, if any
+	Classes []uint
+
+	// Error returned by the call, or nil
+	Err error
+}
+
+// String formats a trace entry on a single line.
+func (e TraceEntry) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s", e.Time.UTC().Format(time.RFC3339Nano), e.Function)
+	for _, mech := range e.Mechanisms {
+		fmt.Fprintf(&b, " mech=%#x", mech)
+	}
+	for _, class := range e.Classes {
+		fmt.Fprintf(&b, " class=%#x", class)
+	}
+	if e.Err != nil {
+		fmt.Fprintf(&b, " err=%v", e.Err)
+	}
+	return b.String()
+}
+
+// tracer is a ring buffer of the most recent PKCS#11 calls.
+type tracer struct {
+	m       sync.Mutex
+	entries []TraceEntry // nil if tracing is disabled
+	next    int          // index of the next entry to write
+	full    bool         // true once the buffer has wrapped
+}
+
+var traces tracer
+
+// EnableTrace starts recording the last n PKCS#11 calls.
+//
+// Any calls already recorded are discarded. If n is 0 then tracing is
+// disabled. Tracing can also be enabled with the TraceSize field of
+// PKCS11Config.
+func EnableTrace(n int) {
+	traces.m.Lock()
+	defer traces.m.Unlock()
+	traces.entries = nil
+	if n > 0 {
+		traces.entries = make([]TraceEntry, n)
+	}
+	traces.next = 0
+	traces.full = false
+}
+
+// DisableTrace stops recording PKCS#11 calls and discards any calls already recorded.
+func DisableTrace() {
+	EnableTrace(0)
+}
+
+// Dump returns the recorded PKCS#11 calls, oldest first.
+//
+// If tracing is disabled then nil is returned.
+func Dump() []TraceEntry {
+	traces.m.Lock()
+	defer traces.m.Unlock()
+	var entries []TraceEntry
+	if traces.full {
+		entries = append(entries, traces.entries[traces.next:]...)
+	}
+	return append(entries, traces.entries[:traces.next]...)
+}
+
+// traceCall records a PKCS#11 call, if tracing is enabled, and returns err.
+func traceCall(function string, mech []*pkcs11.Mechanism, err error, templates ...[]*pkcs11.Attribute) error {
+	traces.m.Lock()
+	defer traces.m.Unlock()
+	if traces.entries == nil {
+		return err
+	}
+	e := TraceEntry{
+		Time:     time.Now(),
+		Function: function,
+		Err:      err,
+	}
+	for _, m := range mech {
+		e.Mechanisms = append(e.Mechanisms, m.Mechanism)
+	}
+	for _, template := range templates {
+		for _, a := range template {
+			// A template being read may have no value yet
+			if a.Type == pkcs11.CKA_CLASS && len(a.Value) == int(unsafe.Sizeof(uint(0))) {
+				e.Classes = append(e.Classes, bytesToUlong(a.Value))
+			}
+		}
+	}
+	traces.entries[traces.next] = e
+	traces.next++
+	if traces.next == len(traces.entries) {
+		traces.next = 0
+		traces.full = true
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+func TestTrace(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	EnableTrace(4)
+	defer DisableTrace()
+	key, err := GenerateSecretKey(128, &CipherAES)
+	if err != nil {
+		t.Fatalf("GenerateSecretKey: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		block := make([]byte, key.BlockSize())
+		key.Encrypt(block, block)
+	}
+	entries := Dump()
+	if len(entries) != 4 {
+		t.Fatalf("Dump: got %d entries, want 4", len(entries))
+	}
+	// The generation has been pushed out; the last call was a C_Encrypt
+	// preceded by its C_EncryptInit.
+	if entries[2].Function != "C_EncryptInit" || entries[3].Function != "C_Encrypt" {
+		t.Errorf("Dump: unexpected calls %v", entries)
+	}
+	if len(entries[2].Mechanisms) != 1 || entries[2].Mechanisms[0] != pkcs11.CKM_AES_ECB {
+		t.Errorf("Dump: C_EncryptInit had mechanisms %v", entries[2].Mechanisms)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Time.Before(entries[i-1].Time) {
+			t.Errorf("Dump: entries out of order")
+		}
+	}
+	if s := entries[2].String(); !strings.Contains(s, "C_EncryptInit") {
+		t.Errorf("TraceEntry.String: %q", s)
+	}
+	DisableTrace()
+	if entries = Dump(); entries != nil {
+		t.Errorf("Dump after DisableTrace: got %d entries", len(entries))
+	}
+}
+
+func TestTraceGetAttributeValue(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	key, err := GenerateSecretKey(128, &CipherAES)
+	if err != nil {
+		t.Fatalf("GenerateSecretKey: %v", err)
+	}
+	EnableTrace(4)
+	defer DisableTrace()
+	if _, _, err = key.Identify(); err != nil {
+		t.Fatalf("Identify: %v", err)
+	}
+	entries := Dump()
+	if len(entries) == 0 || entries[len(entries)-1].Function != "C_GetAttributeValue" {
+		t.Errorf("Dump: unexpected calls %v", entries)
+	}
+	// A template that has not been read yet has no class value
+	traceCall("C_FindObjectsInit", nil, nil, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, nil)})
+	entries = Dump()
+	if e := entries[len(entries)-1]; e.Function != "C_FindObjectsInit" || len(e.Classes) != 0 {
+		t.Errorf("Dump: got %v for a template without a class value", e)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Stages of ValidateConfig, as reported in a ValidationError.
+const (
+	// Loading and initializing the PKCS#11 library
+	StageLibrary = "library"
+
+	// Finding the configured token
+	StageToken = "token"
+
+	// Logging in with the configured PIN
+	StageLogin = "login"
+)
+
+// ValidationError is returned by ValidateConfig when a check fails.
+type ValidationError struct {
+	// The stage that failed: StageLibrary, StageToken or StageLogin
+	Stage string
+
+	// Underlying error
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("crypto11: %s check failed: %v", e.Stage, e.Err)
+}
+
+var errPINNotChecked = errors.New("token is already logged in with a different PIN, which cannot be checked without logging it out")
+
+// ValidateConfig checks that a configuration would work, without configuring anything.
+//
+// The library is loaded, the token is found and, if the token needs a
+// login and config has a PIN, the PIN is checked by logging in on a
+// temporary session and out again. Then everything is torn down. If a
+// check fails then a *ValidationError naming the stage is returned.
+//
+// If config names the library already configured then its context is
+// used and left as it was. Since login state is shared by all sessions
+// with a token, a token that is already logged in can only be checked
+// against the PIN it was logged in with.
+func ValidateConfig(config *PKCS11Config) error {
+	ctx, done, err := openLibrary(config.Path)
+	if err != nil {
+		return &ValidationError{StageLibrary, err}
+	}
+	defer done()
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return &ValidationError{StageToken, err}
+	}
+	slot, token, err := findToken(ctx, slots, config)
+	if err != nil {
+		return &ValidationError{StageToken, err}
+	}
+	if !loginRequired(token.Flags, config) {
+		return nil
+	}
+	if err = checkPINFinalTry(token.Flags, config); err != nil {
+		return &ValidationError{StageLogin, err}
+	}
+	if err = checkLogin(ctx, slot, config.Pin); err != nil {
+		return &ValidationError{StageLogin, err}
+	}
+	return nil
+}
+
+// checkLogin logs in to a token on a temporary session and out again
+func checkLogin(ctx *pkcs11.Ctx, slot uint, pin string) error {
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	traceCall("C_OpenSession", nil, err)
+	if err != nil {
+		return err
+	}
+	defer ctx.CloseSession(session)
+	err = traceCall("C_Login", nil, ctx.Login(session, pkcs11.CKU_USER, pin))
+	if code, ok := err.(pkcs11.Error); ok && code == pkcs11.CKR_USER_ALREADY_LOGGED_IN {
+		if ctx == instance.ctx && slot == instance.slot && pin == instance.cfg.Pin {
+			return nil
+		}
+		return errPINNotChecked
+	}
+	if err != nil {
+		return pinError(err)
+	}
+	return traceCall("C_Logout", nil, ctx.Logout(session))
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	cfg, err := getConfig("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ValidateConfig(cfg); err != nil {
+		t.Errorf("ValidateConfig: %v", err)
+	}
+	if instance.ctx != nil || pool.Get(instance.slot) != nil {
+		t.Errorf("ValidateConfig: left the library configured")
+	}
+	stage := func(cfg PKCS11Config) string {
+		err := ValidateConfig(&cfg)
+		if verr, ok := err.(*ValidationError); ok {
+			return verr.Stage
+		}
+		t.Errorf("ValidateConfig: got %v, want a *ValidationError", err)
+		return ""
+	}
+	bad := *cfg
+	bad.Path = "/nonexistent/libpkcs11.so"
+	if s := stage(bad); s != StageLibrary {
+		t.Errorf("ValidateConfig with bad path: stage %q", s)
+	}
+	bad = *cfg
+	bad.TokenSerial, bad.TokenLabel = "no such serial", "no such label"
+	if s := stage(bad); s != StageToken {
+		t.Errorf("ValidateConfig with bad token: stage %q", s)
+	}
+	bad = *cfg
+	bad.Pin = cfg.Pin + "wrong"
+	if s := stage(bad); s != StageLogin {
+		t.Errorf("ValidateConfig with bad PIN: stage %q", s)
+	}
+	// Alongside a configured library
+	if _, err = Configure(cfg); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	defer Close()
+	if err = ValidateConfig(cfg); err != nil {
+		t.Errorf("ValidateConfig while configured: %v", err)
+	}
+	if _, err = FindKeyPair(nil, []byte("no such key")); err != ErrKeyNotFound {
+		t.Errorf("FindKeyPair after ValidateConfig: got %v, want ErrKeyNotFound", err)
+	}
+}
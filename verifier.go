@@ -0,0 +1,205 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"errors"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ErrVerifierFinished is returned when a Verifier is used after it has finished.
+var ErrVerifierFinished = errors.New("crypto11: verifier already finished")
+
+// Verifier checks a signature over data that is written to it in pieces.
+//
+// The data is passed to the token with C_VerifyUpdate as it is
+// written, and the signature is checked with C_VerifyFinal, so however
+// large the data it is never held in memory. The token verifies with
+// the key's public key object, as for VerifyWithPublicKey.
+//
+// A Verifier holds a session, and the key's concurrency limit if it
+// has one, from when it is created until it finishes: when Verify or
+// Close is called, or when Write fails. Callers must therefore always
+// call Verify or Close. A Verifier must not be used concurrently.
+type Verifier struct {
+	priv *PKCS11PrivateKey
+
+	// Session holding the verification operation, or nil once finished
+	session *PKCS11Session
+
+	// Returns the session to the pool, or discards it if the
+	// operation is still active on it
+	finish func(discard bool)
+
+	// Converts a signature to the form the token expects, if necessary
+	convert func(signature []byte) ([]byte, error)
+}
+
+// newVerifier starts a verification operation with the key's public key object.
+func (priv *PKCS11PrivateKey) newVerifier(keyType uint, mech []*pkcs11.Mechanism, convert func([]byte) ([]byte, error)) (*Verifier, error) {
+	release, err := priv.acquireOp()
+	if err != nil {
+		return nil, err
+	}
+	sessionPool, session, err := getSession(priv.Slot)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	err = withLogin(sessionPool.lib, session, priv.Slot, func(session *PKCS11Session) error {
+		pubHandle, err := priv.findPublicKeyObject(session, keyType)
+		if err != nil {
+			return err
+		}
+		return traceCall("C_VerifyInit", mech, session.Ctx.VerifyInit(session.Handle, mech, pubHandle))
+	})
+	if err != nil {
+		sessionPool.Put(session)
+		release()
+		return nil, priv.wrapError("NewVerifier", err)
+	}
+	return &Verifier{
+		priv:    priv,
+		session: session,
+		finish: func(discard bool) {
+			if discard {
+				// There is no way to abandon an operation except
+				// closing its session
+				session.Close()
+				sessionPool.Put(nil)
+			} else {
+				sessionPool.Put(session)
+			}
+			release()
+		},
+		convert: convert,
+	}, nil
+}
+
+// Write passes data to the token.
+//
+// If it fails then the token has abandoned the verification, and the
+// Verifier is finished.
+func (v *Verifier) Write(p []byte) (int, error) {
+	if v.session == nil {
+		return 0, ErrVerifierFinished
+	}
+	if err := traceCall("C_VerifyUpdate", nil, v.session.Ctx.VerifyUpdate(v.session.Handle, p)); err != nil {
+		v.session = nil
+		v.finish(false)
+		return 0, v.priv.wrapError("Write", err)
+	}
+	return len(p), nil
+}
+
+// Verify checks signature against the data written so far, and finishes the Verifier.
+//
+// The signature is in the same form as Sign produces. If it is wrong
+// then an *ObjectError wrapping the PKCS#11 error (normally
+// CKR_SIGNATURE_INVALID) is returned.
+func (v *Verifier) Verify(signature []byte) error {
+	if v.session == nil {
+		return ErrVerifierFinished
+	}
+	session := v.session
+	v.session = nil
+	if v.convert != nil {
+		var err error
+		if signature, err = v.convert(signature); err != nil {
+			v.finish(true)
+			return err
+		}
+	}
+	err := traceCall("C_VerifyFinal", nil, session.Ctx.VerifyFinal(session.Handle, signature))
+	v.finish(false)
+	return v.priv.wrapError("Verify", err)
+}
+
+// Close finishes the Verifier without checking a signature.
+//
+// It does nothing if the Verifier has already finished.
+func (v *Verifier) Close() error {
+	if v.session != nil {
+		v.session = nil
+		v.finish(true)
+	}
+	return nil
+}
+
+// NewVerifier starts verifying a signature over streamed data using the token's public key object.
+//
+// opts selects the mechanism as for SignMessage, which must be one
+// that hashes and verifies in one step (e.g. CKM_SHA256_RSA_PKCS or
+// CKM_SHA256_RSA_PKCS_PSS); otherwise ErrUnsupportedRSAOptions is
+// returned, as it is for rsa.PSSSaltLengthAuto (see
+// VerifyWithPublicKey). See Verifier for details. The public key
+// object is found by the private key's CKA_ID; if there is none,
+// ErrNoPublicKey is returned.
+func (priv *PKCS11PrivateKeyRSA) NewVerifier(opts crypto.SignerOpts) (*Verifier, error) {
+	opts, err := defaultSignerOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkVerifySaltLength(opts); err != nil {
+		return nil, err
+	}
+	mech, err := combinedMechanism(opts, priv.keyBits())
+	if err != nil {
+		return nil, err
+	}
+	if mech == nil {
+		return nil, ErrUnsupportedRSAOptions
+	}
+	return priv.newVerifier(pkcs11.CKK_RSA, mech, nil)
+}
+
+// NewVerifier starts verifying a DER-encoded signature over streamed data using the token's public key object.
+//
+// The combined mechanism for opts.HashFunc() (e.g. CKM_ECDSA_SHA256)
+// is used; if there is none, ErrUnsupportedHash is returned. See
+// Verifier for details. The public key object is found by the private
+// key's CKA_ID; if there is none, ErrNoPublicKey is returned.
+func (signer *PKCS11PrivateKeyECDSA) NewVerifier(opts crypto.SignerOpts) (*Verifier, error) {
+	pub, ok := signer.PubKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, ErrUnsupportedKeyType
+	}
+	opts, err := defaultSignerOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := ecdsaHashMechanisms[opts.HashFunc()]
+	if !ok {
+		return nil, ErrUnsupportedHash
+	}
+	n := (pub.Curve.Params().BitSize + 7) / 8
+	return signer.newVerifier(pkcs11.CKK_ECDSA, []*pkcs11.Mechanism{pkcs11.NewMechanism(m, nil)}, func(signature []byte) ([]byte, error) {
+		var sig dsaSignature
+		if err := sig.unmarshalDER(signature); err != nil {
+			return nil, err
+		}
+		return sig.marshalBytes(n)
+	})
+}
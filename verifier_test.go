@@ -0,0 +1,103 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	_ "crypto/sha256"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+type streamVerifierKey interface {
+	crypto.Signer
+	SignMessage(message []byte, opts crypto.SignerOpts) ([]byte, error)
+	NewVerifier(opts crypto.SignerOpts) (*Verifier, error)
+}
+
+func TestVerifier(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	rsaKey, err := GenerateRSAKeyPair(2048)
+	if err != nil {
+		t.Fatalf("GenerateRSAKeyPair: %v", err)
+	}
+	ecdsaKey, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPair: %v", err)
+	}
+	t.Run("RSA", func(t *testing.T) {
+		needMechanism(t, rsaKey.Slot, pkcs11.CKM_SHA256_RSA_PKCS)
+		testVerifier(t, rsaKey)
+	})
+	t.Run("ECDSA", func(t *testing.T) {
+		needMechanism(t, ecdsaKey.Slot, pkcs11.CKM_ECDSA_SHA256)
+		testVerifier(t, ecdsaKey)
+	})
+}
+
+func testVerifier(t *testing.T, key streamVerifierKey) {
+	message := make([]byte, 1<<20)
+	for i := range message {
+		message[i] = byte(i)
+	}
+	signature, err := key.SignMessage(message, crypto.SHA256)
+	if err != nil {
+		t.Fatalf("SignMessage: %v", err)
+	}
+	verify := func(signature []byte) error {
+		v, err := key.NewVerifier(crypto.SHA256)
+		if err != nil {
+			t.Fatalf("NewVerifier: %v", err)
+		}
+		defer v.Close()
+		for chunk := message; len(chunk) > 0; chunk = chunk[4096:] {
+			if _, err = v.Write(chunk[:4096]); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+		err = v.Verify(signature)
+		if _, werr := v.Write(message); werr != ErrVerifierFinished {
+			t.Errorf("Write after Verify: got %v, want ErrVerifierFinished", werr)
+		}
+		return err
+	}
+	if err = verify(signature); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	bad := append([]byte(nil), signature...)
+	bad[len(bad)-1] ^= 1
+	if err = verify(bad); err == nil {
+		t.Errorf("Verify accepted a bad signature")
+	}
+	// An abandoned Verifier gives its session back
+	for i := 0; i < 4; i++ {
+		v, err := key.NewVerifier(crypto.SHA256)
+		if err != nil {
+			t.Fatalf("NewVerifier: %v", err)
+		}
+		v.Write(message[:16])
+		v.Close()
+	}
+}
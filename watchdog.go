@@ -0,0 +1,98 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"time"
+)
+
+// Run a signing function with a session, abandoning it after SignTimeout
+//
+// If SignTimeout is not set this is the same as withKeySession.
+// Otherwise f runs on its own goroutine. A PKCS#11 call cannot be
+// interrupted: the pkcs11 package exposes neither C_CancelFunction,
+// which PKCS#11 v2 tokens do not implement anyway, nor the v3.0
+// C_SessionCancel. (If it grows the latter, it belongs here, guarded
+// by the cryptoki version from C_GetInfo.) So on timeout the
+// session is taken out of the pool, and closed if the call ever
+// returns; until then the goroutine and the session remain, and the
+// object's concurrency limit (if any) stays held. A fresh session
+// replaces the abandoned one in the pool, so a token that hangs often
+// may run out of sessions; in StrictSessions mode the abandoned
+// session still counts against MaxSessions until it is closed.
+//
+// f must not modify anything the caller can see, since it may still
+// be running after the caller has returned.
+func withSignSession(object *PKCS11Object, f func(session *PKCS11Session) ([]byte, error)) ([]byte, error) {
+	timeout := slotLib(object.Slot).cfg.SignTimeout
+	if timeout <= 0 {
+		var signature []byte
+		err := withKeySession(object, func(session *PKCS11Session) error {
+			var err error
+			signature, err = f(session)
+			return err
+		})
+		return signature, err
+	}
+	release, err := object.acquireOp()
+	if err != nil {
+		return nil, err
+	}
+	sessionPool, session, err := getSession(object.Slot)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	type result struct {
+		signature []byte
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var r result
+		r.err = withLogin(sessionPool.lib, session, object.Slot, func(session *PKCS11Session) error {
+			var err error
+			r.signature, err = f(session)
+			return err
+		})
+		done <- r
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		sessionPool.Put(session)
+		release()
+		return r.signature, r.err
+	case <-timer.C:
+		abandoned := sessionPool.abandon()
+		go func() {
+			<-done
+			if sessionPool.lib.ctx == session.Ctx {
+				session.Close()
+			}
+			abandoned()
+			release()
+		}()
+		return nil, ErrOperationTimeout
+	}
+}
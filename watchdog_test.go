@@ -0,0 +1,104 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"testing"
+	"time"
+)
+
+func TestSignTimeout(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	prevSignTimeout := instance.cfg.SignTimeout
+	defer func() { instance.cfg.SignTimeout = prevSignTimeout }()
+	instance.cfg.SignTimeout = 100 * time.Millisecond
+
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPair: %v", err)
+	}
+	if _, err = key.Sign(nil, make([]byte, 32), crypto.SHA256); err != nil {
+		t.Errorf("Sign within SignTimeout: %v", err)
+	}
+	// A signature that hangs
+	release := make(chan struct{})
+	_, err = withSignSession(&key.PKCS11Object, func(session *PKCS11Session) ([]byte, error) {
+		<-release
+		return nil, nil
+	})
+	close(release)
+	if err != ErrOperationTimeout {
+		t.Errorf("withSignSession: got %v, want ErrOperationTimeout", err)
+	}
+	// The pool still works
+	if _, err = key.Sign(nil, make([]byte, 32), crypto.SHA256); err != nil {
+		t.Errorf("Sign after timeout: %v", err)
+	}
+}
+
+func TestSignTimeoutStrictSessions(t *testing.T) {
+	cfg, err := getConfig("config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.MaxSessions = 1
+	cfg.StrictSessions = true
+	cfg.SignTimeout = 100 * time.Millisecond
+	if _, err = Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	key, err := GenerateECDSAKeyPair(elliptic.P256())
+	if err != nil {
+		t.Fatalf("GenerateECDSAKeyPair: %v", err)
+	}
+	release := make(chan struct{})
+	if _, err = withSignSession(&key.PKCS11Object, func(session *PKCS11Session) ([]byte, error) {
+		<-release
+		return nil, nil
+	}); err != ErrOperationTimeout {
+		t.Errorf("withSignSession: got %v, want ErrOperationTimeout", err)
+	}
+	// The abandoned session is still the only one allowed
+	random := func(s *PKCS11Session) error {
+		_, err := s.Ctx.GenerateRandom(s.Handle, 16)
+		return err
+	}
+	if err = withSession(instance.slot, random); err != ErrPoolExhausted {
+		t.Errorf("withSession while abandoned session busy: got %v, want ErrPoolExhausted", err)
+	}
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err = withSession(instance.slot, random); err != ErrPoolExhausted || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Errorf("withSession after abandoned session closed: %v", err)
+	}
+}
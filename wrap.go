@@ -0,0 +1,230 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"github.com/miekg/pkcs11"
+)
+
+// RSAWrapOptions controls key wrapping with an RSA key.
+type RSAWrapOptions struct {
+	// Size of the temporary AES key used by CKM_RSA_AES_KEY_WRAP.
+	// If 0, 256 is used.
+	AESKeyBits int
+
+	// Hash function for OAEP and MGF1. If 0, SHA-1 is used, since it
+	// is the only choice many tokens support.
+	Hash crypto.Hash
+
+	// OAEP label, normally empty.
+	Label []byte
+}
+
+// WrapKey wraps (encrypts) another key under this one, using the
+// cipher's wrapping mechanism (e.g. CKM_AES_KEY_WRAP_PAD).
+//
+// The wrapping key must have CKA_WRAP set and the key being wrapped
+// must have CKA_EXTRACTABLE set; see KeyAttributes.
+//
+// If the key being wrapped has CKA_WRAP_WITH_TRUSTED set and the
+// wrapping key does not have CKA_TRUSTED set, ErrWrapNotTrusted is
+// returned without asking the token to wrap.
+func (key *PKCS11SecretKey) WrapKey(target *PKCS11Object) ([]byte, error) {
+	if key.Cipher.WrapMech == 0 {
+		return nil, fmt.Errorf("key wrapping not implemented for key type %#x", key.Cipher.GenParams[0].KeyType)
+	}
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(key.Cipher.WrapMech, nil)}
+	var wrapped []byte
+	err := withKeySession(&key.PKCS11Object, func(session *PKCS11Session) error {
+		needTrusted := getBoolAttribute(session, target.Handle, pkcs11.CKA_WRAP_WITH_TRUSTED)
+		if needTrusted && !getBoolAttribute(session, key.Handle, pkcs11.CKA_TRUSTED) {
+			return ErrWrapNotTrusted
+		}
+		var err error
+		wrapped, err = session.Ctx.WrapKey(session.Handle, mech, key.Handle, target.Handle)
+		traceCall("C_WrapKey", mech, err)
+		return wrapTrustError(err, needTrusted)
+	})
+	return wrapped, key.wrapError("WrapKey", err)
+}
+
+// wrapTrustError reports a token's refusal to wrap a CKA_WRAP_WITH_TRUSTED key as ErrWrapNotTrusted.
+func wrapTrustError(err error, needTrusted bool) error {
+	if e, ok := err.(pkcs11.Error); ok && needTrusted {
+		// The token enforces the policy too; report it the same way
+		if e == pkcs11.CKR_WRAPPING_KEY_HANDLE_INVALID || e == pkcs11.CKR_KEY_NOT_WRAPPABLE {
+			return ErrWrapNotTrusted
+		}
+	}
+	return err
+}
+
+// WrapKey wraps (encrypts) another key under the RSA public key.
+//
+// CKM_RSA_AES_KEY_WRAP is used if the token supports it: a random AES
+// key is wrapped with RSA-OAEP, and the target key is wrapped with the
+// AES key using CKM_AES_KEY_WRAP_PAD. This works for target keys of
+// any size, including private keys. If the token does not support
+// the mechanism, the target is wrapped directly with CKM_RSA_PKCS_OAEP,
+// which only works for keys smaller than the RSA modulus.
+//
+// The wrapping is done by the token's public key object for the pair,
+// found by CKA_ID, which must have CKA_WRAP set (see KeyAttributes.Wrap);
+// ErrNoPublicKey is returned if there is none. The key being wrapped
+// must have CKA_EXTRACTABLE set.
+//
+// If the key being wrapped has CKA_WRAP_WITH_TRUSTED set and the
+// public key does not have CKA_TRUSTED set, ErrWrapNotTrusted is
+// returned without asking the token to wrap.
+//
+// If opts is nil then the default options are used.
+func (priv *PKCS11PrivateKeyRSA) WrapKey(target *PKCS11Object, opts *RSAWrapOptions) ([]byte, error) {
+	var wrapped []byte
+	err := withKeySession(&priv.PKCS11Object, func(session *PKCS11Session) error {
+		pubHandle, err := priv.findPublicKeyObject(session, pkcs11.CKK_RSA)
+		if err != nil {
+			return err
+		}
+		needTrusted := getBoolAttribute(session, target.Handle, pkcs11.CKA_WRAP_WITH_TRUSTED)
+		if needTrusted && !getBoolAttribute(session, pubHandle, pkcs11.CKA_TRUSTED) {
+			return ErrWrapNotTrusted
+		}
+		if wrapped, err = rsaWrap(session, pkcs11.CKM_RSA_AES_KEY_WRAP, pubHandle, target.Handle, opts); err == nil {
+			return nil
+		}
+		if e, ok := err.(pkcs11.Error); ok && e == pkcs11.CKR_MECHANISM_INVALID {
+			wrapped, err = rsaWrap(session, pkcs11.CKM_RSA_PKCS_OAEP, pubHandle, target.Handle, opts)
+		}
+		return wrapTrustError(err, needTrusted)
+	})
+	return wrapped, priv.wrapError("WrapKey", err)
+}
+
+// UnwrapKey unwraps (decrypts) a secret key that was wrapped under the RSA public key.
+//
+// The mechanism is chosen to match WrapKey: a blob the same size as
+// the modulus was wrapped with CKM_RSA_PKCS_OAEP, anything longer with
+// CKM_RSA_AES_KEY_WRAP. The private key must have CKA_UNWRAP set, e.g.
+// by generating it with KeyAttributes.Wrap; if it is known not to,
+// ErrUnwrapNotPermitted is returned without contacting the token.
+//
+// The new key is created according to template, which must specify
+// the cipher. template.Bits is ignored, since the size is determined
+// by the wrapped key.
+//
+// If opts is nil then the default options are used.
+func (priv *PKCS11PrivateKeyRSA) UnwrapKey(wrapped []byte, opts *RSAWrapOptions, template *KeyAttributes) (*PKCS11SecretKey, error) {
+	if err := priv.usage.checkUnwrap(); err != nil {
+		return nil, err
+	}
+	pub, ok := priv.PubKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, ErrUnsupportedKeyType
+	}
+	if template.Cipher == nil {
+		return nil, errNoCipher
+	}
+	attrs := *template
+	attrs.Bits = 0
+	attributes, err := attrs.secretKeyTemplate(template.Cipher.GenParams[0].KeyType)
+	if err != nil {
+		return nil, err
+	}
+	mechanism := uint(pkcs11.CKM_RSA_AES_KEY_WRAP)
+	if len(wrapped) == (pub.N.BitLen()+7)/8 {
+		mechanism = pkcs11.CKM_RSA_PKCS_OAEP
+	}
+	var handle pkcs11.ObjectHandle
+	err = withKeySession(&priv.PKCS11Object, func(session *PKCS11Session) error {
+		mech, keep, err := rsaWrapMechanism(mechanism, opts)
+		if err != nil {
+			return err
+		}
+		handle, err = session.Ctx.UnwrapKey(session.Handle, mech, priv.Handle, wrapped, attributes)
+		runtime.KeepAlive(keep)
+		return storageError(template.trustError(traceCall("C_UnwrapKey", mech, err, attributes)))
+	})
+	if err != nil {
+		return nil, priv.wrapError("UnwrapKey", err)
+	}
+	return &PKCS11SecretKey{PKCS11Object: newObject(handle, priv.Slot), Cipher: template.Cipher}, nil
+}
+
+// rsaWrap wraps a key using CKM_RSA_AES_KEY_WRAP or CKM_RSA_PKCS_OAEP.
+func rsaWrap(session *PKCS11Session, mechanism uint, wrappingKey pkcs11.ObjectHandle, target pkcs11.ObjectHandle, opts *RSAWrapOptions) ([]byte, error) {
+	mech, keep, err := rsaWrapMechanism(mechanism, opts)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := session.Ctx.WrapKey(session.Handle, mech, wrappingKey, target)
+	runtime.KeepAlive(keep)
+	return wrapped, traceCall("C_WrapKey", mech, err)
+}
+
+// rsaWrapMechanism builds the mechanism for CKM_RSA_AES_KEY_WRAP or CKM_RSA_PKCS_OAEP.
+//
+// The parameters may point into the returned buffers, which must be
+// kept alive until the mechanism has been used.
+func rsaWrapMechanism(mechanism uint, opts *RSAWrapOptions) ([]*pkcs11.Mechanism, [][]byte, error) {
+	if opts == nil {
+		opts = &RSAWrapOptions{}
+	}
+	hashFunction := opts.Hash
+	if hashFunction == 0 {
+		hashFunction = crypto.SHA1
+	}
+	aesKeyBits := opts.AESKeyBits
+	if aesKeyBits == 0 {
+		aesKeyBits = 256
+	}
+	oaepParams, err := oaepParameters(hashFunction, opts.Label)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mechanism == pkcs11.CKM_RSA_PKCS_OAEP {
+		return []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, oaepParams)}, [][]byte{opts.Label}, nil
+	}
+	// CK_RSA_AES_KEY_WRAP_PARAMS
+	parameters := concat(ulongToBytes(uint(aesKeyBits)),
+		ulongToBytes(uint(uintptr(unsafe.Pointer(&oaepParams[0])))))
+	return []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, parameters)}, [][]byte{opts.Label, oaepParams}, nil
+}
+
+// getBoolAttribute reads a boolean attribute of an object.
+//
+// false is returned if the attribute cannot be read, e.g. because the
+// token does not support it.
+func getBoolAttribute(session *PKCS11Session, handle pkcs11.ObjectHandle, attributeType uint) bool {
+	attributes, err := getAttributes(session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(attributeType, nil),
+	})
+	if err != nil || len(attributes) == 0 {
+		return false
+	}
+	return bytesToBool(attributes[0].Value)
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Thales e-Security, Inc
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package crypto11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+func TestWrapKey(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	needMechanism(t, instance.slot, pkcs11.CKM_AES_KEY_WRAP_PAD)
+	generate := func(attrs *KeyAttributes) *PKCS11SecretKey {
+		attrs.Cipher = &CipherAES
+		attrs.Bits = 128
+		key, err := GenerateSecretKeyWithAttributes(attrs)
+		if err != nil {
+			t.Fatalf("GenerateSecretKeyWithAttributes: %v", err)
+		}
+		return key
+	}
+	wrappingKey := generate(&KeyAttributes{Wrap: true})
+	t.Run("Plain", func(t *testing.T) {
+		target := generate(&KeyAttributes{Extractable: true})
+		wrapped, err := wrappingKey.WrapKey(&target.PKCS11Object)
+		if err != nil {
+			t.Fatalf("WrapKey: %v", err)
+		}
+		if len(wrapped) <= 16 {
+			t.Errorf("WrapKey: wrapped key too short (%d bytes)", len(wrapped))
+		}
+	})
+	t.Run("WrapWithTrusted", func(t *testing.T) {
+		target := generate(&KeyAttributes{Extractable: true, WrapWithTrusted: true})
+		if _, err := wrappingKey.WrapKey(&target.PKCS11Object); err != ErrWrapNotTrusted {
+			t.Errorf("WrapKey with untrusted key: got %v, want ErrWrapNotTrusted", err)
+		}
+	})
+	t.Run("TrustedNeedsSO", func(t *testing.T) {
+		_, err := GenerateSecretKeyWithAttributes(&KeyAttributes{Cipher: &CipherAES, Bits: 128, Wrap: true, Trusted: true})
+		if err != ErrTrustedNeedsSO {
+			t.Errorf("GenerateSecretKeyWithAttributes with Trusted: got %v, want ErrTrustedNeedsSO", err)
+		}
+	})
+	t.Run("ImportTrustedNeedsSO", func(t *testing.T) {
+		softKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("ecdsa.GenerateKey: %v", err)
+		}
+		_, err = ImportECDSAKeyPairWithAttributes(softKey, &KeyAttributes{Trusted: true})
+		if err != ErrTrustedNeedsSO {
+			t.Errorf("ImportECDSAKeyPairWithAttributes with Trusted: got %v, want ErrTrustedNeedsSO", err)
+		}
+	})
+}
+
+func TestRSAWrapKey(t *testing.T) {
+	ConfigureFromFile("config")
+	defer Close()
+	needMechanism(t, instance.slot, pkcs11.CKM_RSA_PKCS_OAEP)
+	priv, err := GenerateRSAKeyPairWithAttributes(2048, &KeyAttributes{Wrap: true})
+	if err != nil {
+		t.Fatalf("GenerateRSAKeyPairWithAttributes: %v", err)
+	}
+	defer priv.Delete()
+	target, err := GenerateSecretKeyWithAttributes(&KeyAttributes{Cipher: &CipherAES, Bits: 128, Extractable: true})
+	if err != nil {
+		t.Fatalf("GenerateSecretKeyWithAttributes: %v", err)
+	}
+	for _, opts := range []*RSAWrapOptions{nil, {Hash: crypto.SHA1, AESKeyBits: 128}} {
+		wrapped, err := priv.WrapKey(&target.PKCS11Object, opts)
+		if err != nil {
+			t.Fatalf("WrapKey: %v", err)
+		}
+		unwrapped, err := priv.UnwrapKey(wrapped, opts, &KeyAttributes{Cipher: &CipherAES})
+		if err != nil {
+			t.Fatalf("UnwrapKey: %v", err)
+		}
+		plaintext := make([]byte, 16)
+		c1 := make([]byte, 16)
+		c2 := make([]byte, 16)
+		target.Encrypt(c1, plaintext)
+		unwrapped.Encrypt(c2, plaintext)
+		if !bytes.Equal(c1, c2) {
+			t.Errorf("unwrapped key does not match the original")
+		}
+	}
+	trusted, err := GenerateSecretKeyWithAttributes(&KeyAttributes{Cipher: &CipherAES, Bits: 128, Extractable: true, WrapWithTrusted: true})
+	if err != nil {
+		t.Fatalf("GenerateSecretKeyWithAttributes: %v", err)
+	}
+	if _, err = priv.WrapKey(&trusted.PKCS11Object, nil); err != ErrWrapNotTrusted {
+		t.Errorf("WrapKey with untrusted public key: got %v, want ErrWrapNotTrusted", err)
+	}
+	// The token's own policy on the key pair applies
+	noWrap, err := GenerateRSAKeyPair(2048)
+	if err != nil {
+		t.Fatalf("GenerateRSAKeyPair: %v", err)
+	}
+	defer noWrap.Delete()
+	if _, err = noWrap.WrapKey(&target.PKCS11Object, nil); err == nil {
+		t.Errorf("WrapKey with a key pair without CKA_WRAP: no error")
+	}
+}